@@ -5,44 +5,81 @@ import (
 	"fmt"
 	"io"
 	"log"
-
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
 	"github.com/OpenSlides/openslides-icc-service/internal/run"
 )
 
 func main() {
-	ctx, cancel := interruptContext()
-	defer cancel()
-
 	icclog.SetInfoLogger(log.Default())
 	if os.Getenv("OPENSLIDES_DEVELOPMENT") != "" {
 		icclog.SetDebugLogger(log.New(os.Stderr, "DEBUG ", log.LstdFlags))
 	}
-	if err := run.Run(ctx, os.Environ(), secret); err != nil {
+
+	timeouts, err := run.ShutdownTimeouts(os.Environ())
+	if err != nil {
 		icclog.Info("Error: %v", err)
+		os.Exit(1)
 	}
-}
 
-// interruptContext works like signal.NotifyContext
-//
-// In only listens on os.Interrupt. If the signal is received two times,
-// os.Exit(1) is called.
-func interruptContext() (context.Context, context.CancelFunc) {
 	ctx, cancel := context.WithCancel(context.Background())
-	go func() {
-		sigint := make(chan os.Signal, 1)
-		signal.Notify(sigint, os.Interrupt)
-		<-sigint
+	defer cancel()
+
+	// Without a signal, the connections are drained like after SIGTERM.
+	shutdownTimeout := timeouts[syscall.SIGTERM]
+	var shutdownMu sync.Mutex
+	ctx = run.WithShutdownTimeout(ctx, func() time.Duration {
+		shutdownMu.Lock()
+		defer shutdownMu.Unlock()
+		return shutdownTimeout
+	})
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	// The signals are handled until Run returns, also after ctx is done. So a
+	// second signal can stop a slow shutdown.
+	signalCtx, stopSignals := context.WithCancel(context.Background())
+	defer stopSignals()
+
+	go shutdownOnSignal(signalCtx, signals, timeouts, func(timeout time.Duration) {
+		shutdownMu.Lock()
+		shutdownTimeout = timeout
+		shutdownMu.Unlock()
 		cancel()
+	}, func() {
+		os.Exit(1)
+	})
 
-		// If the signal was send for the second time, make a hard cut.
-		<-sigint
+	if err := run.Run(ctx, os.Environ(), secret); err != nil {
+		icclog.Info("Error: %v", err)
 		os.Exit(1)
-	}()
-	return ctx, cancel
+	}
+}
+
+// shutdownOnSignal calls stop with the timeout of the first received signal.
+// If a second signal is received, exit is called. It returns, when the context
+// is done.
+func shutdownOnSignal(ctx context.Context, signals <-chan os.Signal, timeouts map[os.Signal]time.Duration, stop func(timeout time.Duration), exit func()) {
+	select {
+	case <-ctx.Done():
+		return
+	case sig := <-signals:
+		icclog.Info("Received %s, shutdown with timeout %s", sig, timeouts[sig])
+		stop(timeouts[sig])
+	}
+
+	// If the signal was send for the second time, make a hard cut.
+	select {
+	case <-ctx.Done():
+	case <-signals:
+		exit()
+	}
 }
 
 func secret(name string) (string, error) {
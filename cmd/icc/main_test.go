@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShutdownOnSignal(t *testing.T) {
+	timeouts := map[os.Signal]time.Duration{
+		syscall.SIGINT:  time.Second,
+		syscall.SIGTERM: time.Minute,
+	}
+
+	for _, tt := range []struct {
+		name   string
+		signal os.Signal
+		expect time.Duration
+	}{
+		{"SIGINT", syscall.SIGINT, time.Second},
+		{"SIGTERM", syscall.SIGTERM, time.Minute},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			signals := make(chan os.Signal, 1)
+			stopped := make(chan time.Duration, 1)
+			exited := make(chan struct{})
+
+			go shutdownOnSignal(context.Background(), signals, timeouts, func(timeout time.Duration) {
+				stopped <- timeout
+			}, func() {
+				close(exited)
+			})
+
+			signals <- tt.signal
+
+			select {
+			case got := <-stopped:
+				if got != tt.expect {
+					t.Errorf("got timeout %s, expected %s", got, tt.expect)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("stop was not called after the signal")
+			}
+
+			signals <- tt.signal
+
+			select {
+			case <-exited:
+			case <-time.After(time.Second):
+				t.Errorf("exit was not called after the second signal")
+			}
+		})
+	}
+
+	t.Run("context done after first signal", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		signals := make(chan os.Signal, 1)
+		returned := make(chan struct{})
+
+		go func() {
+			shutdownOnSignal(ctx, signals, timeouts, func(time.Duration) {}, func() {
+				t.Errorf("exit was called without a second signal")
+			})
+			close(returned)
+		}()
+
+		signals <- syscall.SIGTERM
+		cancel()
+
+		select {
+		case <-returned:
+		case <-time.After(time.Second):
+			t.Errorf("shutdownOnSignal did not return after the context was done")
+		}
+	})
+}
@@ -5,10 +5,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
 	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
 	"github.com/ostcar/topic"
 )
 
@@ -16,19 +19,76 @@ const (
 	applauseInterval = time.Second
 	countTime        = 5 * time.Second
 	pruneTime        = 10 * time.Minute
+
+	// defaultPruneInterval is the time between two runs of PruneOldData.
+	defaultPruneInterval = 5 * time.Minute
+
+	// maxCountWindow is the duration, applause is kept in the backend. It is
+	// the longest window that can be counted with Count().
+	maxCountWindow = time.Minute
+
+	// meetingCacheTime is the duration, a meeting is remembered as existing.
+	meetingCacheTime = time.Minute
+
+	// notifyName is the name of the notify message that contains the applause
+	// level.
+	notifyName = "applause_level"
 )
 
+// ErrDropped is returned by Send with WithBestEffort, when the applause could
+// not be saved in the backend.
+var ErrDropped = errors.New("applause dropped")
+
 // Backend stores the applause messages.
 type Backend interface {
 	// ApplausePublish adds the applause from a user to a meeting.
 	//
 	// The function can be called many times. The implementation of the
 	// interface has to make sure, that the applause is only counted once.
+	//
+	// The time is a unix time in seconds or, with WithMilliseconds(), in
+	// milliseconds. The backend does not need to know the resolution.
 	ApplausePublish(meetingID, userID int, time int64) error
 
 	// ApplauseSince returns the number of applause for each meeting since
 	// `time`
 	ApplauseSince(time int64) (map[int]int, error)
+
+	// ApplauseCleanOld removes the applause that is older then `olderThen`.
+	ApplauseCleanOld(olderThen int64) error
+}
+
+// CounterBackend keeps counters of the applause of each meeting.
+type CounterBackend interface {
+	// ApplauseCounters returns the number of users with applause since the
+	// given time for each meeting. It can contain applause of one counter
+	// window before since.
+	ApplauseCounters(since int64) (map[int]int, error)
+}
+
+// ContextBackend is a Backend that can stop ApplausePublish, when the context
+// is done.
+type ContextBackend interface {
+	ApplausePublishContext(ctx context.Context, meetingID, userID int, time int64) error
+}
+
+// ActiveBackend is a Backend that can list the meetings with applause.
+type ActiveBackend interface {
+	// ActiveApplauseMeetings returns the ids of the meetings with applause
+	// since `since`, ordered by id.
+	ActiveApplauseMeetings(since int64) ([]int, error)
+}
+
+// UserBackend is a Backend that can list the users with applause.
+type UserBackend interface {
+	// ApplauseUsers returns the ids of the users with applause in the meeting
+	// since `since`.
+	ApplauseUsers(meetingID int, since int64) ([]int, error)
+}
+
+// Notifier publishes messages from the service to the notify connections.
+type Notifier interface {
+	PublishSystem(meetingID int, name string, message interface{}) error
 }
 
 // Applause holds the state of the service.
@@ -36,17 +96,138 @@ type Applause struct {
 	backend   Backend
 	topic     *topic.Topic
 	datastore datastore.Getter
+	notifier  Notifier
+
+	meetingsMu sync.Mutex
+	meetings   map[int]time.Time
+
+	maxMeetings int
+	activeMu    sync.Mutex
+	active      map[int]bool
+
+	milliseconds bool
+	bestEffort   bool
+	counter      CounterBackend
+	users        UserBackend
+
+	leaderboard       LeaderboardBackend
+	leaderboardWindow time.Duration
+
+	cooldown *cooldown
+
+	// current holds the last message of each meeting with applause. It is
+	// updated together with the topic, so a new connection gets a snapshot
+	// that fits to the topic id.
+	currentMu sync.Mutex
+	current   map[int]MSG
+
+	// decayFactor is the part of the decayed level that is kept from one
+	// interval to the next. 0 means, that there is no decayed level.
+	decayFactor float64
+
+	pruneInterval time.Duration
+
+	// newTicker returns a channel that gets a value after each interval and a
+	// function to stop it. It can be replaced in tests.
+	newTicker func(interval time.Duration) (<-chan time.Time, func())
+}
+
+// Option is an optional argument for applause.New().
+type Option func(*Applause)
+
+// WithNotify lets the applause service publish each change of the applause
+// level as notify message to the meeting.
+func WithNotify(n Notifier) Option {
+	return func(a *Applause) {
+		a.notifier = n
+	}
+}
+
+// WithMaxMeetings limits the number of meetings that can have applause at the
+// same time. Applause for other meetings is refused until the applause in one
+// of the active meetings stopped.
+func WithMaxMeetings(max int) Option {
+	return func(a *Applause) {
+		a.maxMeetings = max
+	}
+}
+
+// WithMilliseconds saves the time of each applause as unix time in
+// milliseconds instead of seconds. So the applause level is counted precisely
+// for the last countTime and not since the start of a second.
+//
+// Applause that was saved with the other resolution is not counted correctly.
+func WithMilliseconds() Option {
+	return func(a *Applause) {
+		a.milliseconds = true
+	}
+}
+
+// WithCounter reads the applause level from the counters of the backend
+// instead of counting the applause of the last seconds. This is faster for
+// meetings with a lot of applause.
+//
+// The counters are read for the same time as the counted applause. Depending
+// on the width of the counters, the level can contain some applause before.
+// Count is not affected.
+func WithCounter(counter CounterBackend) Option {
+	return func(a *Applause) {
+		a.counter = counter
+	}
+}
+
+// WithPresentLevel adds the field PresentLevel to each message from Receive. It
+// only counts the applause of the users, that are present in the meeting.
+//
+// The present level is always counted for the last seconds, also with
+// WithCounter.
+func WithPresentLevel(users UserBackend) Option {
+	return func(a *Applause) {
+		a.users = users
+	}
+}
+
+// WithBestEffort drops applause, that can not be saved in the backend, for
+// example when redis is not available. The error is only logged and Send
+// returns ErrDropped.
+func WithBestEffort() Option {
+	return func(a *Applause) {
+		a.bestEffort = true
+	}
+}
+
+// WithPruneInterval sets the time between two runs of PruneOldData. It does not
+// change, how old the removed data is. The default is five minutes.
+func WithPruneInterval(interval time.Duration) Option {
+	return func(a *Applause) {
+		if interval > 0 {
+			a.pruneInterval = interval
+		}
+	}
 }
 
 // New returns an initialized state of the notify service.
 //
 // The New function is not blocking. The context is used to stop a goroutine
 // that is started by this function.
-func New(b Backend, db datastore.Getter, closed <-chan struct{}) *Applause {
+func New(b Backend, db datastore.Getter, closed <-chan struct{}, options ...Option) *Applause {
 	notify := Applause{
 		backend:   b,
 		topic:     topic.New(topic.WithClosed(closed)),
 		datastore: db,
+		meetings:  make(map[int]time.Time),
+		active:    make(map[int]bool),
+		current:   make(map[int]MSG),
+
+		pruneInterval: defaultPruneInterval,
+		newTicker: func(interval time.Duration) (<-chan time.Time, func()) {
+			ticker := time.NewTicker(interval)
+			return ticker.C, ticker.Stop
+		},
+	}
+
+	for _, o := range options {
+		o(&notify)
 	}
 
 	// Make sure the topic is not empty.
@@ -56,9 +237,16 @@ func New(b Backend, db datastore.Getter, closed <-chan struct{}) *Applause {
 }
 
 // MSG contians the current applause level and number of present users.
+//
+// DecayedLevel is only set with WithDecay. A missing value means 0.
+//
+// PresentLevel is only set with WithPresentLevel. It is the part of the level
+// from users, that are present in the meeting.
 type MSG struct {
-	Level        int `json:"level"`
-	PresentUsers int `json:"present_users"`
+	Level        int     `json:"level"`
+	PresentUsers int     `json:"present_users"`
+	DecayedLevel float64 `json:"decayed_level,omitempty"`
+	PresentLevel *int    `json:"present_level,omitempty"`
 }
 
 // Send registers, that a user applaused in a meeting.
@@ -67,6 +255,14 @@ func (a *Applause) Send(ctx context.Context, meetingID, userID int) error {
 		return iccerror.NewMessageError(iccerror.ErrNotAllowed, "Anonymous is not allowed to applause. Please be quiet.")
 	}
 
+	if err := a.meetingExists(ctx, meetingID); err != nil {
+		return fmt.Errorf("checking meeting: %w", err)
+	}
+
+	if !a.canTrack(meetingID) {
+		return iccerror.NewMessageError(iccerror.ErrUnavailable, "Too many meetings have applause at the moment. Please try again later.")
+	}
+
 	fetcher := datastore.NewRequest(a.datastore)
 
 	applauseEnabled, err := fetcher.Meeting_ApplauseEnable(meetingID).Value(ctx)
@@ -95,12 +291,76 @@ func (a *Applause) Send(ctx context.Context, meetingID, userID int) error {
 		return iccerror.NewMessageError(iccerror.ErrNotAllowed, "You are not part of meeting %d. Please be quiet.", meetingID)
 	}
 
-	if err := a.backend.ApplausePublish(meetingID, userID, time.Now().Unix()); err != nil {
+	if err := a.cooldown.allow(meetingID, userID); err != nil {
+		return err
+	}
+
+	if err := a.applausePublish(ctx, meetingID, userID, a.score(time.Now())); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("publish applause in backend: %w", ctx.Err())
+		}
+
+		if a.bestEffort {
+			icclog.Info("Dropping applause of user %d in meeting %d: %v", userID, meetingID, err)
+			return ErrDropped
+		}
 		return fmt.Errorf("publish applause in backend: %w", err)
 	}
+
+	if err := a.leaderboardAdd(meetingID, userID); err != nil {
+		return err
+	}
 	return nil
 }
 
+// applausePublish saves the applause in the backend. If the backend supports
+// it, the call returns when the context is done.
+func (a *Applause) applausePublish(ctx context.Context, meetingID, userID int, time int64) error {
+	if backend, ok := a.backend.(ContextBackend); ok {
+		return backend.ApplausePublishContext(ctx, meetingID, userID, time)
+	}
+	return a.backend.ApplausePublish(meetingID, userID, time)
+}
+
+// meetingExists returns an ErrNotFound error, if the meeting does not exist.
+//
+// Existing meetings are cached for a short time.
+func (a *Applause) meetingExists(ctx context.Context, meetingID int) error {
+	a.meetingsMu.Lock()
+	lastSeen, ok := a.meetings[meetingID]
+	a.meetingsMu.Unlock()
+
+	if ok && time.Since(lastSeen) < meetingCacheTime {
+		return nil
+	}
+
+	if _, err := datastore.NewRequest(a.datastore).Meeting_ID(meetingID).Value(ctx); err != nil {
+		var errDoesNotExist datastore.DoesNotExistError
+		if errors.As(err, &errDoesNotExist) {
+			return iccerror.NewMessageError(iccerror.ErrNotFound, "meeting %d does not exist", meetingID)
+		}
+		return fmt.Errorf("fetching meeting id: %w", err)
+	}
+
+	a.meetingsMu.Lock()
+	a.meetings[meetingID] = time.Now()
+	a.meetingsMu.Unlock()
+	return nil
+}
+
+// canTrack returns false, if the meeting does not have applause and the max
+// number of meetings with applause is reached.
+func (a *Applause) canTrack(meetingID int) bool {
+	if a.maxMeetings <= 0 {
+		return true
+	}
+
+	a.activeMu.Lock()
+	defer a.activeMu.Unlock()
+
+	return a.active[meetingID] || len(a.active) < a.maxMeetings
+}
+
 // CanReceive returns an error, if the user can not receive applause.
 func (a *Applause) CanReceive(ctx context.Context, meetingID, userID int) error {
 	fetcher := datastore.NewRequest(a.datastore)
@@ -136,13 +396,22 @@ func (a *Applause) CanReceive(ctx context.Context, meetingID, userID int) error
 }
 
 // Receive returns the applause for a given meeting.
+//
+// The first call with tid 0 returns the current applause of the meeting
+// without blocking. Each following call blocks until the applause changes.
 func (a *Applause) Receive(ctx context.Context, tid uint64, meetingID int) (newTID uint64, msg MSG, err error) {
 	if tid == 0 {
+		a.currentMu.Lock()
+		tid = a.topic.LastID()
+		msg := a.current[meetingID]
+		a.currentMu.Unlock()
+
 		present, err := a.presentUser(ctx, meetingID)
 		if err != nil {
 			return 0, MSG{}, fmt.Errorf("fetching present user: %w", err)
 		}
-		return a.topic.LastID(), MSG{0, present}, nil
+		msg.PresentUsers = present
+		return tid, msg, nil
 	}
 
 	for {
@@ -167,6 +436,60 @@ func (a *Applause) Receive(ctx context.Context, tid uint64, meetingID int) (newT
 	}
 }
 
+// Count returns the applause of a meeting since the given time.
+func (a *Applause) Count(ctx context.Context, meetingID int, since time.Time) (MSG, error) {
+	applause, err := a.backend.ApplauseSince(a.score(since))
+	if err != nil {
+		return MSG{}, fmt.Errorf("fetching applause: %w", err)
+	}
+
+	msg, err := a.toMSG(ctx, meetingID, applause[meetingID])
+	if err != nil {
+		return MSG{}, fmt.Errorf("converting level to MSG: %w", err)
+	}
+	return msg, nil
+}
+
+// Total returns the applause of all meetings since the given time and the
+// number of meetings with applause.
+func (a *Applause) Total(since time.Time) (level, meetings int, err error) {
+	applause, err := a.backend.ApplauseSince(a.score(since))
+	if err != nil {
+		return 0, 0, fmt.Errorf("fetching applause: %w", err)
+	}
+
+	for _, count := range applause {
+		level += count
+	}
+	return level, len(applause), nil
+}
+
+// ActiveMeetings returns the ids of the meetings with applause since the given
+// time, ordered by id.
+func (a *Applause) ActiveMeetings(since time.Time) ([]int, error) {
+	if backend, ok := a.backend.(ActiveBackend); ok {
+		meetingIDs, err := backend.ActiveApplauseMeetings(a.score(since))
+		if err != nil {
+			return nil, fmt.Errorf("fetching active meetings: %w", err)
+		}
+		return meetingIDs, nil
+	}
+
+	applause, err := a.backend.ApplauseSince(a.score(since))
+	if err != nil {
+		return nil, fmt.Errorf("fetching applause: %w", err)
+	}
+
+	meetingIDs := make([]int, 0, len(applause))
+	for meetingID, count := range applause {
+		if count > 0 {
+			meetingIDs = append(meetingIDs, meetingID)
+		}
+	}
+	sort.Ints(meetingIDs)
+	return meetingIDs, nil
+}
+
 // LastID returns the newest id from the topic.
 func (a *Applause) LastID() uint64 {
 	return a.topic.LastID()
@@ -180,14 +503,15 @@ func (a *Applause) Loop(ctx context.Context, errHandler func(error)) {
 	}
 
 	lastApplause := make(map[int]int)
+	lastDecayed := make(map[int]float64)
+	lastPresent := make(map[int]int)
 
 	for {
 		if err := contextSleep(ctx, applauseInterval); err != nil {
 			return
 		}
 
-		d := time.Now().Add(-countTime)
-		applause, err := a.backend.ApplauseSince(d.Unix())
+		applause, err := a.level()
 		if err != nil {
 			errHandler(fmt.Errorf("fetching applause: %w", err))
 			continue
@@ -202,20 +526,63 @@ func (a *Applause) Loop(ctx context.Context, errHandler func(error)) {
 
 		message := make(map[int]MSG)
 		for meetingID, level := range applause {
-			if lastApplause[meetingID] == level {
+			var decayed float64
+			if a.decayFactor > 0 {
+				decayed = decayLevel(lastDecayed[meetingID], level, a.decayFactor)
+			}
+
+			var present int
+			if a.users != nil && level > 0 {
+				present, err = a.presentLevel(ctx, meetingID)
+				if err != nil {
+					errHandler(fmt.Errorf("counting present applause: %w", err))
+					continue
+				}
+			}
+
+			if lastApplause[meetingID] == level && lastDecayed[meetingID] == decayed && lastPresent[meetingID] == present {
 				continue
 			}
 			lastApplause[meetingID] = level
+			lastDecayed[meetingID] = decayed
+			lastPresent[meetingID] = present
 
 			msg, err := a.toMSG(ctx, meetingID, level)
 			if err != nil {
 				errHandler(fmt.Errorf("converting level to MSG: %w", err))
 				continue
 			}
+			msg.DecayedLevel = decayed
+			if a.users != nil {
+				msg.PresentLevel = &present
+			}
 
 			message[meetingID] = msg
+
+			if a.notifier != nil {
+				if err := a.notifier.PublishSystem(meetingID, notifyName, msg); err != nil {
+					errHandler(fmt.Errorf("publish applause level to notify: %w", err))
+				}
+			}
+		}
+
+		// Forget meetings without applause. Otherwise lastApplause would
+		// contain each meeting that ever had applause.
+		active := make(map[int]bool, len(lastApplause))
+		for meetingID, level := range lastApplause {
+			if level == 0 && lastDecayed[meetingID] == 0 {
+				delete(lastApplause, meetingID)
+				delete(lastDecayed, meetingID)
+				delete(lastPresent, meetingID)
+				continue
+			}
+			active[meetingID] = true
 		}
 
+		a.activeMu.Lock()
+		a.active = active
+		a.activeMu.Unlock()
+
 		if len(message) == 0 {
 			continue
 		}
@@ -225,8 +592,34 @@ func (a *Applause) Loop(ctx context.Context, errHandler func(error)) {
 			errHandler(fmt.Errorf("encoding message: %w", err))
 			continue
 		}
-		a.topic.Publish(string(b))
+		a.publish(message, string(b))
+	}
+}
+
+// publish updates the current applause and publishes the encoded message to
+// the topic.
+func (a *Applause) publish(message map[int]MSG, encoded string) {
+	a.currentMu.Lock()
+	defer a.currentMu.Unlock()
+
+	for meetingID, msg := range message {
+		if msg.Level == 0 && msg.DecayedLevel == 0 {
+			delete(a.current, meetingID)
+			continue
+		}
+		a.current[meetingID] = msg
 	}
+
+	a.topic.Publish(encoded)
+}
+
+// level returns the applause level of each meeting with applause.
+func (a *Applause) level() (map[int]int, error) {
+	if a.counter != nil {
+		return a.counter.ApplauseCounters(a.score(time.Now().Add(-countTime)))
+	}
+
+	return a.backend.ApplauseSince(a.score(time.Now().Add(-countTime)))
 }
 
 // toMSG converts a int (applause level) to a MSG object.
@@ -237,37 +630,104 @@ func (a *Applause) toMSG(ctx context.Context, meetingID, level int) (MSG, error)
 	}
 
 	return MSG{
-		level,
-		presentUser,
+		Level:        level,
+		PresentUsers: presentUser,
 	}, nil
 }
 
-// PruneOldData removes applause data.
-func (a *Applause) PruneOldData(ctx context.Context) {
-	tick := time.NewTicker(5 * time.Minute)
-	defer tick.Stop()
+// PruneOldData removes applause data. It runs every prune interval, see
+// WithPruneInterval.
+func (a *Applause) PruneOldData(ctx context.Context, errHandler func(error)) {
+	if errHandler == nil {
+		errHandler = func(error) {}
+	}
+
+	tick, stop := a.newTicker(a.pruneInterval)
+	defer stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-tick.C:
+		case <-tick:
 			a.topic.Prune(time.Now().Add(-pruneTime))
+			a.pruneMeetings()
+
+			if err := a.backend.ApplauseCleanOld(a.score(time.Now().Add(-maxCountWindow))); err != nil {
+				errHandler(fmt.Errorf("removing old applause: %w", err))
+			}
+		}
+	}
+}
+
+// score returns the time as it is saved in the backend.
+func (a *Applause) score(t time.Time) int64 {
+	if a.milliseconds {
+		return t.UnixMilli()
+	}
+	return t.Unix()
+}
+
+// pruneMeetings removes meetings from the cache that were not seen for
+// meetingCacheTime.
+func (a *Applause) pruneMeetings() {
+	a.meetingsMu.Lock()
+	defer a.meetingsMu.Unlock()
+
+	for meetingID, lastSeen := range a.meetings {
+		if time.Since(lastSeen) >= meetingCacheTime {
+			delete(a.meetings, meetingID)
 		}
 	}
 }
 
 // presentUser returns the number of users in this meeting.
 func (a *Applause) presentUser(ctx context.Context, meetingID int) (int, error) {
+	ids, err := a.presentUserIDs(ctx, meetingID)
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+// presentUserIDs returns the ids of the users in this meeting.
+func (a *Applause) presentUserIDs(ctx context.Context, meetingID int) ([]int, error) {
 	fetch := datastore.NewRequest(a.datastore)
 	ids, err := fetch.Meeting_PresentUserIDs(meetingID).Value(ctx)
 	if err != nil {
 		var errDoesNotExist datastore.DoesNotExistError
 		if !errors.As(err, &errDoesNotExist) {
-			return 0, fmt.Errorf("get present users for meeting %d: %w", meetingID, err)
+			return nil, fmt.Errorf("get present users for meeting %d: %w", meetingID, err)
 		}
 	}
-	return len(ids), nil
+	return ids, nil
+}
+
+// presentLevel returns the applause of the last seconds from the users, that
+// are present in the meeting.
+func (a *Applause) presentLevel(ctx context.Context, meetingID int) (int, error) {
+	userIDs, err := a.users.ApplauseUsers(meetingID, a.score(time.Now().Add(-countTime)))
+	if err != nil {
+		return 0, fmt.Errorf("fetching applause users: %w", err)
+	}
+
+	presentIDs, err := a.presentUserIDs(ctx, meetingID)
+	if err != nil {
+		return 0, err
+	}
+
+	present := make(map[int]bool, len(presentIDs))
+	for _, id := range presentIDs {
+		present[id] = true
+	}
+
+	var level int
+	for _, id := range userIDs {
+		if present[id] {
+			level++
+		}
+	}
+	return level, nil
 }
 
 // contextSleep is like time.Sleep but also takes a context.
@@ -0,0 +1,509 @@
+package applause_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/dsmock"
+	"github.com/OpenSlides/openslides-icc-service/internal/applause"
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+	"github.com/OpenSlides/openslides-icc-service/internal/icctest"
+	"github.com/OpenSlides/openslides-icc-service/internal/notify"
+)
+
+type notifyBackendStub struct{}
+
+func (notifyBackendStub) NotifyPublish([]byte) error {
+	return nil
+}
+
+func (notifyBackendStub) NotifyReceive(ctx context.Context) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (notifyBackendStub) NotifyPublishEphemeral([]byte) error {
+	return nil
+}
+
+func (notifyBackendStub) NotifyReceiveEphemeral(ctx context.Context) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (notifyBackendStub) NotifyRetain(int, string, []byte, time.Duration) error {
+	return nil
+}
+
+func (notifyBackendStub) NotifyUnretain(int, string) error {
+	return nil
+}
+
+func (notifyBackendStub) NotifyRetained(int) ([][]byte, error) {
+	return nil, nil
+}
+
+func TestLoopWithNotify(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.Stub(dsmock.YAMLData(`
+	meeting/1:
+		present_user_ids: [1,2]
+	`))
+
+	backend := new(backendStub)
+	n := notify.New(ctx, notifyBackendStub{})
+	a := applause.New(backend, ds, ctx.Done(), applause.WithNotify(n))
+	go a.Loop(ctx, func(err error) { t.Errorf("Loop error: %v", err) })
+
+	_, next := n.Receive(ctx, 1, 5)
+
+	for _, level := range []int{1, 2} {
+		backend.setApplause(1, level)
+
+		nextCtx, nextCancel := context.WithTimeout(ctx, 3*time.Second)
+		message, err := next(nextCtx)
+		nextCancel()
+		if err != nil {
+			t.Fatalf("receiving notify message: %v", err)
+		}
+
+		if message.Name != "applause_level" {
+			t.Errorf("got notify message with name %s, expected applause_level", message.Name)
+		}
+
+		if message.SenderUserID != 0 {
+			t.Errorf("got notify message from user %d, expected 0", message.SenderUserID)
+		}
+
+		expect := fmt.Sprintf(`{"level":%d,"present_users":2}`, level)
+		if string(message.Message) != expect {
+			t.Errorf("got message %s, expected %s", message.Message, expect)
+		}
+	}
+}
+
+func TestSendMeetingExists(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.Stub(dsmock.YAMLData(`
+	meeting/1:
+		applause_enable: true
+		user_ids: [5]
+	`))
+
+	backend := icctest.NewRecordingBackend()
+	a := applause.New(backend, ds, ctx.Done())
+
+	t.Run("known meeting", func(t *testing.T) {
+		if err := a.Send(ctx, 1, 5); err != nil {
+			t.Errorf("Send returned unexpected error: %v", err)
+		}
+
+		ops := backend.Operations()
+		if len(ops) != 1 || ops[0].Method != "ApplausePublish" || ops[0].Args[0] != 1 || ops[0].Args[1] != 5 {
+			t.Errorf("got operations %v, expected one ApplausePublish for meeting 1 and user 5", ops)
+		}
+	})
+
+	t.Run("unknown meeting", func(t *testing.T) {
+		err := a.Send(ctx, 404, 5)
+
+		if !errors.Is(err, iccerror.ErrNotFound) {
+			t.Errorf("Send returned error `%v`, expected `%v`", err, iccerror.ErrNotFound)
+		}
+
+		if ops := backend.Operations(); len(ops) != 1 {
+			t.Errorf("got %d operations, expected no new operation", len(ops))
+		}
+	})
+}
+
+func TestSendMaxMeetings(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.Stub(dsmock.YAMLData(`
+	meeting/1:
+		applause_enable: true
+		user_ids: [5]
+	meeting/2:
+		applause_enable: true
+		user_ids: [5]
+	`))
+
+	backend := new(backendStub)
+	a := applause.New(backend, ds, ctx.Done(), applause.WithMaxMeetings(1))
+	go a.Loop(ctx, func(err error) { t.Errorf("Loop error: %v", err) })
+
+	// waitForSend calls Send until it returns the expected error.
+	waitForSend := func(meetingID int, expect error) {
+		t.Helper()
+
+		var err error
+		for i := 0; i < 30; i++ {
+			err = a.Send(ctx, meetingID, 5)
+			if errors.Is(err, expect) || (expect == nil && err == nil) {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("Send for meeting %d returned `%v`, expected `%v`", meetingID, err, expect)
+	}
+
+	backend.setApplause(1, 3)
+	waitForSend(2, iccerror.ErrUnavailable)
+
+	if err := a.Send(ctx, 1, 5); err != nil {
+		t.Errorf("Send for active meeting returned: %v", err)
+	}
+
+	backend.setApplause(1, 0)
+	waitForSend(2, nil)
+}
+
+func TestMilliseconds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.Stub(dsmock.YAMLData(`
+	meeting/1:
+		applause_enable: true
+		user_ids: [5]
+	`))
+
+	now := time.Now()
+	backend := &timedBackendStub{applause: map[int][]int64{
+		1: {
+			now.Add(-1500 * time.Millisecond).UnixMilli(),
+			now.Add(-800 * time.Millisecond).UnixMilli(),
+			now.Add(-200 * time.Millisecond).UnixMilli(),
+		},
+	}}
+	a := applause.New(backend, ds, ctx.Done(), applause.WithMilliseconds())
+
+	t.Run("Count sub second", func(t *testing.T) {
+		msg, err := a.Count(ctx, 1, now.Add(-500*time.Millisecond))
+		if err != nil {
+			t.Fatalf("Count: %v", err)
+		}
+
+		if msg.Level != 1 {
+			t.Errorf("got level %d since 500ms, expected 1", msg.Level)
+		}
+
+		msg, err = a.Count(ctx, 1, now.Add(-time.Second))
+		if err != nil {
+			t.Fatalf("Count: %v", err)
+		}
+
+		if msg.Level != 2 {
+			t.Errorf("got level %d since 1s, expected 2", msg.Level)
+		}
+	})
+
+	t.Run("Send saves milliseconds", func(t *testing.T) {
+		before := time.Now().UnixMilli()
+		if err := a.Send(ctx, 1, 5); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		after := time.Now().UnixMilli()
+
+		times := backend.applause[1]
+		if got := times[len(times)-1]; got < before || got > after {
+			t.Errorf("Send saved time %d, expected a unix time in milliseconds between %d and %d", got, before, after)
+		}
+	})
+}
+
+func TestBestEffort(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.Stub(dsmock.YAMLData(`
+	meeting/1:
+		applause_enable: true
+		user_ids: [5]
+	`))
+
+	backend := &backendStub{publishErr: errors.New("redis is not available")}
+	auther := icctest.AutherStub{UserID: 5}
+
+	for _, tt := range []struct {
+		name    string
+		options []applause.Option
+		status  int
+	}{
+		{"strict", nil, 500},
+		{"best effort", []applause.Option{applause.WithBestEffort()}, 202},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a := applause.New(backend, ds, ctx.Done(), tt.options...)
+			mux := http.NewServeMux()
+			applause.HandleSend(mux, a, &auther)
+
+			resp := httptest.NewRecorder()
+			mux.ServeHTTP(resp, httptest.NewRequest("POST", "/system/icc/applause/send?meeting_id=1", nil))
+
+			if resp.Result().StatusCode != tt.status {
+				t.Errorf("handler returned status %s, expected %d: %s", resp.Result().Status, tt.status, resp.Body.String())
+			}
+		})
+	}
+
+	t.Run("best effort keeps other errors", func(t *testing.T) {
+		a := applause.New(backend, ds, ctx.Done(), applause.WithBestEffort())
+
+		if err := a.Send(ctx, 404, 5); !errors.Is(err, iccerror.ErrNotFound) {
+			t.Errorf("Send returned error `%v`, expected `%v`", err, iccerror.ErrNotFound)
+		}
+	})
+}
+
+func TestLoopWithCounter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.Stub(dsmock.YAMLData(`
+	meeting/1/present_user_ids: [1,2]
+	`))
+
+	backend := new(backendStub)
+	backend.setApplause(1, 1)
+
+	counter := &counterStub{at: time.Now().Unix(), counters: map[int]int{1: 7}}
+
+	a := applause.New(backend, ds, ctx.Done(), applause.WithCounter(counter))
+	go a.Loop(ctx, func(err error) { t.Errorf("Loop error: %v", err) })
+
+	tid, _, err := a.Receive(ctx, 0, 1)
+	if err != nil {
+		t.Fatalf("first receive: %v", err)
+	}
+
+	receiveCtx, receiveCancel := context.WithTimeout(ctx, 3*time.Second)
+	defer receiveCancel()
+
+	tid, msg, err := a.Receive(receiveCtx, tid, 1)
+	if err != nil {
+		t.Fatalf("receiving applause: %v", err)
+	}
+
+	if msg.Level != 7 {
+		t.Errorf("got level %d, expected 7 from the counter", msg.Level)
+	}
+
+	// The applause is older then the count time.
+	counter.setTime(time.Now().Add(-6 * time.Second).Unix())
+
+	_, msg, err = a.Receive(receiveCtx, tid, 1)
+	if err != nil {
+		t.Fatalf("receiving applause after count time: %v", err)
+	}
+
+	if msg.Level != 0 {
+		t.Errorf("got level %d after the count time, expected 0", msg.Level)
+	}
+}
+
+func TestLoopWithPresentLevel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The users 3 and 4 applaud, but are not present.
+	ds := dsmock.Stub(dsmock.YAMLData(`
+	meeting/1/present_user_ids: [1,2,5]
+	`))
+
+	backend := new(backendStub)
+	backend.setApplause(1, 4)
+
+	a := applause.New(backend, ds, ctx.Done(), applause.WithPresentLevel(usersStub{1: {1, 2, 3, 4}}))
+	go a.Loop(ctx, func(err error) { t.Errorf("Loop error: %v", err) })
+
+	tid, _, err := a.Receive(ctx, 0, 1)
+	if err != nil {
+		t.Fatalf("first receive: %v", err)
+	}
+
+	receiveCtx, receiveCancel := context.WithTimeout(ctx, 3*time.Second)
+	defer receiveCancel()
+
+	_, msg, err := a.Receive(receiveCtx, tid, 1)
+	if err != nil {
+		t.Fatalf("receiving applause: %v", err)
+	}
+
+	if msg.Level != 4 {
+		t.Errorf("got level %d, expected 4", msg.Level)
+	}
+
+	if msg.PresentLevel == nil || *msg.PresentLevel != 2 {
+		t.Errorf("got present level %v, expected 2 from the present users 1 and 2", msg.PresentLevel)
+	}
+}
+
+func TestSendCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.Stub(dsmock.YAMLData(`
+	meeting/1:
+		applause_enable: true
+		user_ids: [5]
+	`))
+
+	backend := &stallingBackend{called: make(chan struct{})}
+	a := applause.New(backend, ds, ctx.Done(), applause.WithBestEffort())
+
+	sendCtx, sendCancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- a.Send(sendCtx, 1, 5)
+	}()
+
+	<-backend.called
+	sendCancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Send returned `%v`, expected context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Send did not return after the context was canceled")
+	}
+}
+
+func TestLeaderboard(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.Stub(dsmock.YAMLData(`
+	meeting/1:
+		applause_enable: true
+		user_ids: [5]
+	`))
+
+	leaderboard := &leaderboardStub{counts: map[int]map[int]int{
+		2: {1: 3, 2: 7, 3: 3, 4: 1, 5: 0},
+	}}
+	a := applause.New(new(backendStub), ds, ctx.Done(), applause.WithLeaderboard(leaderboard, time.Hour))
+
+	t.Run("top users", func(t *testing.T) {
+		got, err := a.Leaderboard(2, 3)
+		if err != nil {
+			t.Fatalf("Leaderboard: %v", err)
+		}
+
+		// Users with the same count are ordered by id.
+		expect := []applause.LeaderboardEntry{{UserID: 2, Count: 7}, {UserID: 1, Count: 3}, {UserID: 3, Count: 3}}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("got %v, expected %v", got, expect)
+		}
+	})
+
+	t.Run("less users then limit", func(t *testing.T) {
+		got, err := a.Leaderboard(2, 10)
+		if err != nil {
+			t.Fatalf("Leaderboard: %v", err)
+		}
+
+		// User 5 has no applause.
+		if len(got) != 4 {
+			t.Errorf("got %d users, expected 4", len(got))
+		}
+	})
+
+	t.Run("send is counted", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			if err := a.Send(ctx, 1, 5); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+		}
+
+		got, err := a.Leaderboard(1, 10)
+		if err != nil {
+			t.Fatalf("Leaderboard: %v", err)
+		}
+
+		expect := []applause.LeaderboardEntry{{UserID: 5, Count: 2}}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("got %v, expected %v", got, expect)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		a := applause.New(new(backendStub), ds, ctx.Done())
+
+		if _, err := a.Leaderboard(1, 10); !errors.Is(err, iccerror.ErrNotFound) {
+			t.Errorf("got error `%v`, expected ErrNotFound", err)
+		}
+	})
+}
+
+func TestCooldown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.Stub(dsmock.YAMLData(`
+	meeting/1:
+		applause_enable: true
+		user_ids: [5, 6]
+	`))
+
+	send := func(a *applause.Applause, userID int) *httptest.ResponseRecorder {
+		auther := icctest.AutherStub{UserID: userID}
+		mux := http.NewServeMux()
+		applause.HandleSend(mux, a, &auther)
+
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, httptest.NewRequest("POST", "/system/icc/applause/send?meeting_id=1", nil))
+		return resp
+	}
+
+	t.Run("with cooldown", func(t *testing.T) {
+		a := applause.New(new(backendStub), ds, ctx.Done(), applause.WithCooldown(3*time.Second))
+
+		resp := send(a, 5)
+		if resp.Result().StatusCode != 200 {
+			t.Fatalf("first applause returned status %s: %s", resp.Result().Status, resp.Body.String())
+		}
+
+		if got := resp.Body.String(); got != `{"cooldown_ms":3000}`+"\n" {
+			t.Errorf("got body `%s`, expected the cooldown", got)
+		}
+
+		resp = send(a, 5)
+		if resp.Result().StatusCode != 429 {
+			t.Errorf("second applause returned status %s, expected 429: %s", resp.Result().Status, resp.Body.String())
+		}
+
+		if resp := send(a, 6); resp.Result().StatusCode != 200 {
+			t.Errorf("applause of other user returned status %s: %s", resp.Result().Status, resp.Body.String())
+		}
+	})
+
+	t.Run("without cooldown", func(t *testing.T) {
+		a := applause.New(new(backendStub), ds, ctx.Done())
+
+		for i := 0; i < 2; i++ {
+			resp := send(a, 5)
+			if resp.Result().StatusCode != 200 {
+				t.Fatalf("applause returned status %s: %s", resp.Result().Status, resp.Body.String())
+			}
+
+			if got := resp.Body.String(); got != "" {
+				t.Errorf("got body `%s`, expected no body", got)
+			}
+		}
+	})
+}
@@ -0,0 +1,92 @@
+package applause
+
+import (
+	"sync"
+	"time"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+)
+
+// cooldownCleanup is the minimum time between two removals of old entries.
+const cooldownCleanup = time.Minute
+
+// WithCooldown sets the minimum time between two applause of the same user in
+// the same meeting. Applause during the cooldown is rejected with
+// ErrTooManyRequests.
+//
+// The cooldown is returned by HandleSend, so clients can disable the applause
+// button for this time. The last applause of each user is only saved in this
+// process.
+func WithCooldown(d time.Duration) Option {
+	return func(a *Applause) {
+		if d > 0 {
+			a.cooldown = newCooldown(d, time.Now)
+		}
+	}
+}
+
+// Cooldown returns the time of WithCooldown. It is 0 without the option.
+func (a *Applause) Cooldown() time.Duration {
+	if a.cooldown == nil {
+		return 0
+	}
+	return a.cooldown.duration
+}
+
+type cooldownKey struct {
+	meetingID int
+	userID    int
+}
+
+// cooldown holds the time of the last applause of each user.
+type cooldown struct {
+	duration time.Duration
+	now      func() time.Time
+
+	mu          sync.Mutex
+	last        map[cooldownKey]time.Time
+	lastCleanup time.Time
+}
+
+func newCooldown(d time.Duration, now func() time.Time) *cooldown {
+	return &cooldown{
+		duration:    d,
+		now:         now,
+		last:        make(map[cooldownKey]time.Time),
+		lastCleanup: now(),
+	}
+}
+
+// allow saves the applause of the user. It returns an ErrTooManyRequests
+// error, if the last applause of the user was less then the cooldown ago.
+func (c *cooldown) allow(meetingID, userID int) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if now.Sub(c.lastCleanup) >= cooldownCleanup {
+		for key, last := range c.last {
+			if now.Sub(last) >= c.duration {
+				delete(c.last, key)
+			}
+		}
+		c.lastCleanup = now
+	}
+
+	key := cooldownKey{meetingID: meetingID, userID: userID}
+	if last, ok := c.last[key]; ok && now.Sub(last) < c.duration {
+		return iccerror.NewMessageError(iccerror.ErrTooManyRequests, "Please wait %s before the next applause.", (c.duration - now.Sub(last)).Round(time.Millisecond))
+	}
+
+	c.last[key] = now
+	return nil
+}
+
+// cooldowner is a Sender with a cooldown between two applause.
+type cooldowner interface {
+	Cooldown() time.Duration
+}
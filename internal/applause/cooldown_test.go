@@ -0,0 +1,41 @@
+package applause
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+)
+
+func TestCooldownExpires(t *testing.T) {
+	now := time.Unix(1_000, 0)
+	c := newCooldown(3*time.Second, func() time.Time { return now })
+
+	if err := c.allow(1, 5); err != nil {
+		t.Fatalf("first applause: %v", err)
+	}
+
+	now = now.Add(2 * time.Second)
+	if err := c.allow(1, 5); !errors.Is(err, iccerror.ErrTooManyRequests) {
+		t.Errorf("applause during cooldown returned `%v`, expected `%v`", err, iccerror.ErrTooManyRequests)
+	}
+
+	if err := c.allow(2, 5); err != nil {
+		t.Errorf("applause in other meeting: %v", err)
+	}
+
+	now = now.Add(time.Second)
+	if err := c.allow(1, 5); err != nil {
+		t.Errorf("applause after cooldown: %v", err)
+	}
+
+	now = now.Add(cooldownCleanup)
+	if err := c.allow(3, 5); err != nil {
+		t.Fatalf("applause after cleanup: %v", err)
+	}
+
+	if len(c.last) != 1 {
+		t.Errorf("cooldown has %d entries after cleanup, expected 1", len(c.last))
+	}
+}
@@ -0,0 +1,39 @@
+package applause
+
+import (
+	"math"
+	"time"
+)
+
+// WithDecay adds a decayed level to each applause message. It follows the raw
+// level exponentially with the time constant tau. So short breaks in the
+// applause do not let the level jump to 0 and the clients do not have to
+// smooth the level themselves.
+func WithDecay(tau time.Duration) Option {
+	return func(a *Applause) {
+		a.decayFactor = decayFactor(applauseInterval, tau)
+	}
+}
+
+// decayFactor returns the part of the old decayed level that is kept after
+// the interval.
+func decayFactor(interval, tau time.Duration) float64 {
+	if tau <= 0 {
+		return 0
+	}
+	return math.Exp(-interval.Seconds() / tau.Seconds())
+}
+
+// decayLevel returns the next decayed level from the last decayed level and
+// the current raw level.
+//
+// The value is rounded to two decimals. With a factor of 0.5 or more, the
+// rounding alone would stop the value one step before the raw level. So the
+// raw level is returned, when the value is closer to it then the rounding.
+func decayLevel(last float64, level int, factor float64) float64 {
+	decayed := float64(level) + (last-float64(level))*factor
+	if math.Abs(decayed-float64(level)) < 0.01 {
+		return float64(level)
+	}
+	return math.Round(decayed*100) / 100
+}
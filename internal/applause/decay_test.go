@@ -0,0 +1,62 @@
+package applause
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecayLevel(t *testing.T) {
+	factor := decayFactor(time.Second, time.Second)
+
+	for _, tt := range []struct {
+		name   string
+		levels []int
+		expect []float64
+	}{
+		{"constant", []int{10, 10, 10}, []float64{6.32, 8.65, 9.5}},
+		{"stop", []int{10, 10, 0, 0}, []float64{6.32, 8.65, 3.18, 1.17}},
+		{"short break", []int{4, 0, 4}, []float64{2.53, 0.93, 2.87}},
+		{"no applause", []int{0, 0}, []float64{0, 0}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var decayed float64
+			for i, level := range tt.levels {
+				decayed = decayLevel(decayed, level, factor)
+				if decayed != tt.expect[i] {
+					t.Errorf("step %d: got %v, expected %v", i, decayed, tt.expect[i])
+				}
+			}
+		})
+	}
+
+	t.Run("reaches zero", func(t *testing.T) {
+		decayed := 100.0
+		for i := 0; i < 20; i++ {
+			decayed = decayLevel(decayed, 0, factor)
+		}
+
+		if decayed != 0 {
+			t.Errorf("got %v after 20 steps without applause, expected 0", decayed)
+		}
+	})
+
+	t.Run("reaches level with long tau", func(t *testing.T) {
+		// With tau over 1.44s, the factor is 0.5 or more.
+		slowFactor := decayFactor(time.Second, 3*time.Second)
+
+		for _, level := range []int{0, 10} {
+			decayed := 5.0
+			for i := 0; i < 100; i++ {
+				decayed = decayLevel(decayed, level, slowFactor)
+			}
+
+			if decayed != float64(level) {
+				t.Errorf("got %v after 100 steps with level %d, expected %d", decayed, level, level)
+			}
+		}
+	})
+
+	if got := decayFactor(time.Second, 0); got != 0 {
+		t.Errorf("decayFactor without tau is %v, expected 0", got)
+	}
+}
@@ -3,12 +3,17 @@ package applause
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
 	"github.com/OpenSlides/openslides-icc-service/internal/icchttp"
+	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
 )
 
 // Sender saves the applause.
@@ -17,6 +22,11 @@ type Sender interface {
 }
 
 // HandleSend registers the icc/applause route.
+//
+// If the applause is dropped, the status 202 is returned.
+//
+// If the applause service has a cooldown, the response body contains the
+// cooldown in milliseconds like `{"cooldown_ms":3000}`.
 func HandleSend(mux *http.ServeMux, applause Sender, auth icchttp.Authenticater) {
 	url := icchttp.Path + "/applause/send"
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -36,15 +46,35 @@ func HandleSend(mux *http.ServeMux, applause Sender, auth icchttp.Authenticater)
 			return
 		}
 
+		status := 200
 		if err := applause.Send(r.Context(), meetingID, uid); err != nil {
-			icchttp.Error(w, fmt.Errorf("saving applause: %w", err))
+			if !errors.Is(err, ErrDropped) {
+				icchttp.Error(w, fmt.Errorf("saving applause: %w", err))
+				return
+			}
+			status = 202
+		}
+
+		c, ok := applause.(cooldowner)
+		if !ok || c.Cooldown() == 0 {
+			w.WriteHeader(status)
+			return
+		}
+
+		response := struct {
+			Cooldown int64 `json:"cooldown_ms"`
+		}{c.Cooldown().Milliseconds()}
+
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			icchttp.ErrorNoStatus(w, fmt.Errorf("encoding cooldown: %w", err))
 			return
 		}
 	})
 
 	mux.Handle(
 		url,
-		icchttp.AuthMiddleware(handler, auth),
+		icchttp.MethodMiddleware(icchttp.AuthMiddleware(handler, auth), http.MethodPost),
 	)
 }
 
@@ -55,11 +85,19 @@ type Receive interface {
 }
 
 // HandleReceive registers the icc/applause route.
+//
+// If the client sends the header `Accept: text/plain`, each message is only
+// the applause level as number in one line.
 func HandleReceive(mux *http.ServeMux, applause Receive, auth icchttp.Authenticater) {
 	url := icchttp.Path + "/applause"
 	handler := http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
+			plain := acceptsPlainText(r)
+
 			w.Header().Set("Content-Type", "application/json")
+			if plain {
+				w.Header().Set("Content-Type", plainTextType)
+			}
 			w.Header().Set("Cache-Control", "no-store, max-age=0")
 
 			meetingStr := r.URL.Query().Get("meeting_id")
@@ -69,23 +107,32 @@ func HandleReceive(mux *http.ServeMux, applause Receive, auth icchttp.Authentica
 				return
 			}
 
-			if err := applause.CanReceive(r.Context(), meetingID, auth.FromContext(r.Context())); err != nil {
+			uid := auth.FromContext(r.Context())
+			if err := applause.CanReceive(r.Context(), meetingID, uid); err != nil {
 				icchttp.Error(w, err)
 				return
 			}
 
-			encoder := json.NewEncoder(w)
+			icchttp.DescribeConnection(r.Context(), uid, meetingID, "")
+			icclog.Debug("Applause: connect meeting=%d user=%d", meetingID, uid)
+			defer icclog.Debug("Applause: disconnect meeting=%d user=%d", meetingID, uid)
+
 			var tid uint64
 			for {
 				var message MSG
 				tid, message, err = applause.Receive(r.Context(), tid, meetingID)
 				if err != nil {
+					icclog.Debug("Applause: error meeting=%d user=%d: %v", meetingID, uid, err)
 					icchttp.ErrorNoStatus(w, fmt.Errorf("receive applause data: %w", err))
 					return
 				}
 
-				if err := encoder.Encode(message); err != nil {
-					icchttp.ErrorNoStatus(w, fmt.Errorf("writing message: %w", err))
+				if err := writeMSG(w, message, plain); err != nil {
+					// The message could be written partly. The client could
+					// not parse another message after it, so the connection is
+					// closed.
+					icclog.Debug("Applause: error meeting=%d user=%d: writing message: %v", meetingID, uid, err)
+					icchttp.CloseConnection(r.Context())
 					return
 				}
 				w.(http.Flusher).Flush()
@@ -94,6 +141,289 @@ func HandleReceive(mux *http.ServeMux, applause Receive, auth icchttp.Authentica
 
 	mux.Handle(
 		url,
-		icchttp.AuthMiddleware(handler, auth),
+		icchttp.MethodMiddleware(icchttp.AuthMiddleware(handler, auth), http.MethodGet),
+	)
+}
+
+// Counter counts the applause of a meeting.
+type Counter interface {
+	Count(ctx context.Context, meetingID int, since time.Time) (MSG, error)
+	CanReceive(ctx context.Context, meetingID, userID int) error
+}
+
+// HandleCount registers the icc/applause/count route.
+//
+// It returns the applause of a meeting since a unix time, given with the query
+// argument `since`, or in the last `window_seconds` seconds. The default is the
+// same window that is used for the applause level.
+//
+// Like HandleReceive, it returns only the number with `Accept: text/plain`.
+func HandleCount(mux *http.ServeMux, applause Counter, auth icchttp.Authenticater) {
+	url := icchttp.Path + "/applause/count"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		plain := acceptsPlainText(r)
+
+		w.Header().Set("Content-Type", "application/json")
+		if plain {
+			w.Header().Set("Content-Type", plainTextType)
+		}
+		w.Header().Set("Cache-Control", "no-store, max-age=0")
+
+		query := r.URL.Query()
+
+		meetingID, err := strconv.Atoi(query.Get("meeting_id"))
+		if err != nil {
+			icchttp.Error(w, iccerror.NewMessageError(iccerror.ErrInvalid, "Query meeting has to be an int."))
+			return
+		}
+
+		since, err := parseSince(query.Get("since"), query.Get("window_seconds"))
+		if err != nil {
+			icchttp.Error(w, err)
+			return
+		}
+
+		if err := applause.CanReceive(r.Context(), meetingID, auth.FromContext(r.Context())); err != nil {
+			icchttp.Error(w, err)
+			return
+		}
+
+		msg, err := applause.Count(r.Context(), meetingID, since)
+		if err != nil {
+			icchttp.Error(w, fmt.Errorf("counting applause: %w", err))
+			return
+		}
+
+		if err := writeMSG(w, msg, plain); err != nil {
+			icchttp.ErrorNoStatus(w, fmt.Errorf("writing message: %w", err))
+			return
+		}
+	})
+
+	mux.Handle(
+		url,
+		icchttp.MethodMiddleware(icchttp.AuthMiddleware(handler, auth), http.MethodGet),
+	)
+}
+
+// Totaler sums the applause of all meetings.
+type Totaler interface {
+	Total(since time.Time) (level, meetings int, err error)
+}
+
+// HandleTotal registers the icc/applause/total route. It only accepts GET
+// requests with the admin token.
+//
+// It returns the sum of the applause of all meetings and the number of
+// meetings with applause. The time is given like for HandleCount.
+func HandleTotal(mux *http.ServeMux, applause Totaler, adminToken string) {
+	url := icchttp.Path + "/applause/total"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		plain := acceptsPlainText(r)
+
+		w.Header().Set("Content-Type", "application/json")
+		if plain {
+			w.Header().Set("Content-Type", plainTextType)
+		}
+		w.Header().Set("Cache-Control", "no-store, max-age=0")
+
+		query := r.URL.Query()
+		since, err := parseSince(query.Get("since"), query.Get("window_seconds"))
+		if err != nil {
+			icchttp.Error(w, err)
+			return
+		}
+
+		level, meetings, err := applause.Total(since)
+		if err != nil {
+			icchttp.Error(w, fmt.Errorf("summing applause: %w", err))
+			return
+		}
+
+		if plain {
+			fmt.Fprintf(w, "%d\n", level)
+			return
+		}
+
+		response := struct {
+			Level    int `json:"level"`
+			Meetings int `json:"meetings"`
+		}{level, meetings}
+
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			icchttp.Error(w, fmt.Errorf("encoding total: %w", err))
+			return
+		}
+	})
+
+	mux.Handle(
+		url,
+		icchttp.MethodMiddleware(icchttp.AdminMiddleware(handler, adminToken), http.MethodGet),
+	)
+}
+
+// ActiveLister lists the meetings with applause.
+type ActiveLister interface {
+	ActiveMeetings(since time.Time) ([]int, error)
+}
+
+// HandleActive registers the icc/applause/active route. It only accepts GET
+// requests with the admin token.
+//
+// It returns the ids of the meetings with applause. The time is given like for
+// HandleCount.
+func HandleActive(mux *http.ServeMux, applause ActiveLister, adminToken string) {
+	url := icchttp.Path + "/applause/active"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store, max-age=0")
+
+		query := r.URL.Query()
+		since, err := parseSince(query.Get("since"), query.Get("window_seconds"))
+		if err != nil {
+			icchttp.Error(w, err)
+			return
+		}
+
+		meetingIDs, err := applause.ActiveMeetings(since)
+		if err != nil {
+			icchttp.Error(w, fmt.Errorf("listing active meetings: %w", err))
+			return
+		}
+
+		response := struct {
+			MeetingIDs []int `json:"meeting_ids"`
+		}{meetingIDs}
+
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			icchttp.Error(w, fmt.Errorf("encoding active meetings: %w", err))
+			return
+		}
+	})
+
+	mux.Handle(
+		url,
+		icchttp.MethodMiddleware(icchttp.AdminMiddleware(handler, adminToken), http.MethodGet),
 	)
 }
+
+// LeaderboardLister returns the users with the most applause.
+type LeaderboardLister interface {
+	Leaderboard(meetingID, n int) ([]LeaderboardEntry, error)
+}
+
+// maxLeaderboardLimit is the maximum number of users the leaderboard route
+// returns.
+const maxLeaderboardLimit = 100
+
+// HandleLeaderboard registers the icc/applause/leaderboard route. It only
+// accepts GET requests with the admin token.
+//
+// It returns the users of the meeting with the most applause. The query
+// meeting_id is required. The query limit sets the number of users, the
+// default is 10.
+func HandleLeaderboard(mux *http.ServeMux, applause LeaderboardLister, adminToken string) {
+	url := icchttp.Path + "/applause/leaderboard"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store, max-age=0")
+
+		query := r.URL.Query()
+		meetingID, err := strconv.Atoi(query.Get("meeting_id"))
+		if err != nil {
+			icchttp.Error(w, iccerror.NewMessageError(iccerror.ErrInvalid, "Query meeting_id has to be an int."))
+			return
+		}
+
+		limit := 10
+		if limitStr := query.Get("limit"); limitStr != "" {
+			limit, err = strconv.Atoi(limitStr)
+			if err != nil || limit <= 0 || limit > maxLeaderboardLimit {
+				icchttp.Error(w, iccerror.NewMessageError(iccerror.ErrInvalid, "Query limit has to be between 1 and %d.", maxLeaderboardLimit))
+				return
+			}
+		}
+
+		users, err := applause.Leaderboard(meetingID, limit)
+		if err != nil {
+			icchttp.Error(w, fmt.Errorf("getting leaderboard: %w", err))
+			return
+		}
+
+		response := struct {
+			Users []LeaderboardEntry `json:"users"`
+		}{users}
+
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			icchttp.Error(w, fmt.Errorf("encoding leaderboard: %w", err))
+			return
+		}
+	})
+
+	mux.Handle(
+		url,
+		icchttp.MethodMiddleware(icchttp.AdminMiddleware(handler, adminToken), http.MethodGet),
+	)
+}
+
+// plainTextType is the content type of responses with `Accept: text/plain`.
+const plainTextType = "text/plain; charset=utf-8"
+
+// acceptsPlainText returns true, if the client prefers text/plain over json.
+//
+// The first media type of the Accept header that is text/plain or json
+// decides. Quality values are ignored.
+func acceptsPlainText(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			switch strings.TrimSpace(strings.SplitN(mediaType, ";", 2)[0]) {
+			case "text/plain":
+				return true
+			case "application/json", "application/*", "*/*":
+				return false
+			}
+		}
+	}
+	return false
+}
+
+// writeMSG writes the message as json or, if plain is true, only the applause
+// level. Each message ends with a newline.
+func writeMSG(w io.Writer, msg MSG, plain bool) error {
+	if plain {
+		_, err := fmt.Fprintf(w, "%d\n", msg.Level)
+		return err
+	}
+	return json.NewEncoder(w).Encode(msg)
+}
+
+// parseSince returns the time from the query arguments since and
+// window_seconds. Only one of them can be used.
+func parseSince(sinceStr, windowStr string) (time.Time, error) {
+	if sinceStr != "" && windowStr != "" {
+		return time.Time{}, iccerror.NewMessageError(iccerror.ErrInvalid, "Only one of the queries since and window_seconds can be used.")
+	}
+
+	if sinceStr != "" {
+		since, err := strconv.ParseInt(sinceStr, 10, 64)
+		if err != nil {
+			return time.Time{}, iccerror.NewMessageError(iccerror.ErrInvalid, "Query since has to be an int.")
+		}
+		return time.Unix(since, 0), nil
+	}
+
+	window := countTime
+	if windowStr != "" {
+		seconds, err := strconv.Atoi(windowStr)
+		if err != nil {
+			return time.Time{}, iccerror.NewMessageError(iccerror.ErrInvalid, "Query window_seconds has to be an int.")
+		}
+
+		window = time.Duration(seconds) * time.Second
+		if window <= 0 || window > maxCountWindow {
+			return time.Time{}, iccerror.NewMessageError(iccerror.ErrInvalid, "Query window_seconds has to be between 1 and %d.", int(maxCountWindow.Seconds()))
+		}
+	}
+
+	return time.Now().Add(-window), nil
+}
@@ -1,12 +1,17 @@
 package applause_test
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/dsmock"
 	"github.com/OpenSlides/openslides-icc-service/internal/applause"
 	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
 	"github.com/OpenSlides/openslides-icc-service/internal/icctest"
@@ -22,7 +27,7 @@ func TestHandleSend(t *testing.T) {
 		applause.HandleSend(mux, &applauser, &auther)
 		resp := httptest.NewRecorder()
 
-		mux.ServeHTTP(resp, httptest.NewRequest("GET", url, nil))
+		mux.ServeHTTP(resp, httptest.NewRequest("POST", url, nil))
 
 		if resp.Result().StatusCode != 401 {
 			t.Fatalf("handler returned status %s: %s", resp.Result().Status, resp.Body.String())
@@ -46,7 +51,7 @@ func TestHandleSend(t *testing.T) {
 		applause.HandleSend(mux, &applauser, &auther)
 		resp := httptest.NewRecorder()
 
-		mux.ServeHTTP(resp, httptest.NewRequest("GET", url, nil))
+		mux.ServeHTTP(resp, httptest.NewRequest("POST", url, nil))
 
 		if resp.Result().StatusCode != 200 {
 			t.Fatalf("handler returned status %s: %s", resp.Result().Status, resp.Body.String())
@@ -73,7 +78,7 @@ func TestHandleSend(t *testing.T) {
 		applause.HandleSend(mux, &applauser, &auther)
 		resp := httptest.NewRecorder()
 
-		mux.ServeHTTP(resp, httptest.NewRequest("GET", url, nil))
+		mux.ServeHTTP(resp, httptest.NewRequest("POST", url, nil))
 
 		if resp.Result().StatusCode != 500 {
 			t.Fatalf("handler returned status %s: %s", resp.Result().Status, resp.Body.String())
@@ -84,3 +89,412 @@ func TestHandleSend(t *testing.T) {
 		}
 	})
 }
+
+func TestHandleCount(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.Stub(dsmock.YAMLData(`
+	meeting/1/present_user_ids: [1,2,3]
+	`))
+
+	now := time.Now().Unix()
+	backend := &timedBackendStub{applause: map[int][]int64{
+		1: {now - 2, now - 8, now - 30},
+		2: {now},
+	}}
+
+	app := applause.New(backend, ds, ctx.Done())
+	auther := icctest.AutherStub{UserID: 1}
+	mux := http.NewServeMux()
+	applause.HandleCount(mux, countApplauser{app}, &auther)
+
+	for _, tt := range []struct {
+		name   string
+		query  string
+		status int
+		level  int
+	}{
+		{"default window", "meeting_id=1", 200, 1},
+		{"small window", "meeting_id=1&window_seconds=5", 200, 1},
+		{"bigger window", "meeting_id=1&window_seconds=10", 200, 2},
+		{"window for all", "meeting_id=1&window_seconds=60", 200, 3},
+		{"since", fmt.Sprintf("meeting_id=1&since=%d", now-10), 200, 2},
+		{"window too big", "meeting_id=1&window_seconds=61", 400, 0},
+		{"window zero", "meeting_id=1&window_seconds=0", 400, 0},
+		{"window and since", fmt.Sprintf("meeting_id=1&window_seconds=5&since=%d", now), 400, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			mux.ServeHTTP(resp, httptest.NewRequest("GET", "/system/icc/applause/count?"+tt.query, nil))
+
+			if resp.Result().StatusCode != tt.status {
+				t.Fatalf("handler returned status %s: %s", resp.Result().Status, resp.Body.String())
+			}
+
+			if tt.status != 200 {
+				return
+			}
+
+			var got applause.MSG
+			if err := json.Unmarshal(resp.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+
+			if expect := (applause.MSG{Level: tt.level, PresentUsers: 3}); got != expect {
+				t.Errorf("got %v, expected %v", got, expect)
+			}
+		})
+	}
+}
+
+// countApplauser uses the Count method of an applause service but skips the
+// permission check.
+type countApplauser struct {
+	*applause.Applause
+}
+
+func (countApplauser) CanReceive(ctx context.Context, meetingID, userID int) error {
+	return nil
+}
+
+func TestHandleWrongMethod(t *testing.T) {
+	auther := icctest.AutherStub{UserID: 1}
+	mux := http.NewServeMux()
+	applause.HandleSend(mux, &applauserStrub{}, &auther)
+	applause.HandleReceive(mux, &wsApplauserStub{}, &auther)
+	applause.HandleCount(mux, countApplauser{}, &auther)
+
+	for _, tt := range []struct {
+		method string
+		url    string
+		allow  string
+	}{
+		{"GET", "/system/icc/applause/send?meeting_id=1", "POST"},
+		{"POST", "/system/icc/applause?meeting_id=1", "GET"},
+		{"POST", "/system/icc/applause/count?meeting_id=1", "GET"},
+	} {
+		t.Run(tt.method+" "+tt.url, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			mux.ServeHTTP(resp, httptest.NewRequest(tt.method, tt.url, nil))
+
+			if resp.Result().StatusCode != 405 {
+				t.Errorf("handler returned status %s, expected 405", resp.Result().Status)
+			}
+
+			if got := resp.Header().Get("Allow"); got != tt.allow {
+				t.Errorf("Allow header is `%s`, expected `%s`", got, tt.allow)
+			}
+		})
+	}
+}
+
+func TestHandleAccept(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.Stub(dsmock.YAMLData(`
+	meeting/1/present_user_ids: [1,2,3]
+	`))
+
+	now := time.Now().Unix()
+	backend := &timedBackendStub{applause: map[int][]int64{
+		1: {now - 1, now - 2},
+	}}
+
+	app := applause.New(backend, ds, ctx.Done())
+	auther := icctest.AutherStub{UserID: 1}
+	mux := http.NewServeMux()
+	applause.HandleCount(mux, countApplauser{app}, &auther)
+
+	jsonBody := `{"level":2,"present_users":3}` + "\n"
+
+	for _, tt := range []struct {
+		name        string
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"no accept", "", "application/json", jsonBody},
+		{"json", "application/json", "application/json", jsonBody},
+		{"plain", "text/plain", "text/plain; charset=utf-8", "2\n"},
+		{"plain first", "text/plain;q=0.9, application/json", "text/plain; charset=utf-8", "2\n"},
+		{"json first", "application/json, text/plain", "application/json", jsonBody},
+		{"any", "*/*", "application/json", jsonBody},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/system/icc/applause/count?meeting_id=1", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+
+			resp := httptest.NewRecorder()
+			mux.ServeHTTP(resp, req)
+
+			if got := resp.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("got content type `%s`, expected `%s`", got, tt.contentType)
+			}
+
+			if got := resp.Body.String(); got != tt.body {
+				t.Errorf("got body `%s`, expected `%s`", got, tt.body)
+			}
+		})
+	}
+
+	t.Run("receive plain", func(t *testing.T) {
+		receiveMux := http.NewServeMux()
+		applause.HandleReceive(receiveMux, &wsApplauserStub{sent: make(chan int)}, &auther)
+
+		reqCtx, reqCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer reqCancel()
+
+		req := httptest.NewRequest("GET", "/system/icc/applause?meeting_id=1", nil).WithContext(reqCtx)
+		req.Header.Set("Accept", "text/plain")
+
+		resp := httptest.NewRecorder()
+		receiveMux.ServeHTTP(resp, req)
+
+		if got := resp.Body.String(); got != "0\n" {
+			t.Errorf("got body `%s`, expected `0\\n`", got)
+		}
+	})
+}
+
+func TestHandleReceiveSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.Stub(dsmock.YAMLData(`
+	meeting/1/present_user_ids: [1,2]
+	`))
+
+	backend := new(backendStub)
+	backend.setApplause(1, 3)
+
+	app := applause.New(backend, ds, ctx.Done())
+	go app.Loop(ctx, func(err error) { t.Errorf("Loop error: %v", err) })
+
+	// Wait until the loop has seen the applause.
+	tid, _, err := app.Receive(ctx, 0, 1)
+	if err != nil {
+		t.Fatalf("first receive: %v", err)
+	}
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, 3*time.Second)
+	_, _, err = app.Receive(waitCtx, tid, 1)
+	waitCancel()
+	if err != nil {
+		t.Fatalf("waiting for applause: %v", err)
+	}
+
+	auther := icctest.AutherStub{UserID: 1}
+	mux := http.NewServeMux()
+	applause.HandleReceive(mux, countApplauser{app}, &auther)
+
+	reqCtx, reqCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer reqCancel()
+
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, httptest.NewRequest("GET", "/system/icc/applause?meeting_id=1", nil).WithContext(reqCtx))
+
+	expect := `{"level":3,"present_users":2}` + "\n"
+	if got := resp.Body.String(); got != expect {
+		t.Errorf("got body `%s`, expected `%s`", got, expect)
+	}
+}
+
+// brokenWriter is a ResponseWriter, that writes only half of each write and
+// returns an error.
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (w *brokenWriter) Write(p []byte) (int, error) {
+	w.writes++
+	n, _ := w.ResponseRecorder.Write(p[:len(p)/2])
+	return n, errors.New("connection reset by peer")
+}
+
+func TestHandleReceiveWriteError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.Stub(dsmock.YAMLData(`
+	meeting/1/present_user_ids: [1,2]
+	`))
+
+	app := applause.New(new(backendStub), ds, ctx.Done())
+	auther := icctest.AutherStub{UserID: 1}
+	mux := http.NewServeMux()
+	applause.HandleReceive(mux, countApplauser{app}, &auther)
+
+	w := &brokenWriter{ResponseRecorder: httptest.NewRecorder()}
+
+	done := make(chan struct{})
+	go func() {
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/system/icc/applause?meeting_id=1", nil).WithContext(ctx))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("handler did not return after the write error")
+	}
+
+	if w.writes != 1 {
+		t.Errorf("handler wrote %d times, expected only the failed message", w.writes)
+	}
+}
+
+func TestHandleTotal(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now().Unix()
+	backend := &timedBackendStub{applause: map[int][]int64{
+		1: {now - 1, now - 2},
+		2: {now - 1, now - 3, now - 4},
+		3: {now - 1},
+		4: {now - 30},
+	}}
+
+	app := applause.New(backend, dsmock.Stub(nil), ctx.Done())
+	mux := http.NewServeMux()
+	applause.HandleTotal(mux, app, "secret")
+
+	request := func(url, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		return resp
+	}
+
+	for _, tt := range []struct {
+		name   string
+		url    string
+		expect string
+	}{
+		{"default window", "/system/icc/applause/total", `{"level":6,"meetings":3}`},
+		{"window", "/system/icc/applause/total?window_seconds=60", `{"level":7,"meetings":4}`},
+		{"since", fmt.Sprintf("/system/icc/applause/total?since=%d", now-2), `{"level":4,"meetings":3}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := request(tt.url, "secret")
+			if resp.Result().StatusCode != 200 {
+				t.Fatalf("request returned status %s: %s", resp.Result().Status, resp.Body.String())
+			}
+
+			if got := resp.Body.String(); got != tt.expect+"\n" {
+				t.Errorf("got `%s`, expected `%s`", got, tt.expect)
+			}
+		})
+	}
+
+	t.Run("without admin token", func(t *testing.T) {
+		if resp := request("/system/icc/applause/total", ""); resp.Result().StatusCode != 401 {
+			t.Errorf("request returned status %s, expected 401", resp.Result().Status)
+		}
+	})
+}
+
+func TestHandleActive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now().Unix()
+	backend := &timedBackendStub{applause: map[int][]int64{
+		1: {now - 1},
+		2: {now - 30},
+		3: {now - 2, now - 40},
+		4: {now - 100},
+	}}
+
+	app := applause.New(backend, dsmock.Stub(nil), ctx.Done())
+	mux := http.NewServeMux()
+	applause.HandleActive(mux, app, "secret")
+
+	for _, tt := range []struct {
+		name   string
+		url    string
+		token  string
+		status int
+		expect string
+	}{
+		{"default window", "/system/icc/applause/active", "secret", 200, `{"meeting_ids":[1,3]}`},
+		{"window", "/system/icc/applause/active?window_seconds=60", "secret", 200, `{"meeting_ids":[1,2,3]}`},
+		{"no active meeting", fmt.Sprintf("/system/icc/applause/active?since=%d", now+10), "secret", 200, `{"meeting_ids":[]}`},
+		{"without admin token", "/system/icc/applause/active", "", 401, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp := httptest.NewRecorder()
+			mux.ServeHTTP(resp, req)
+
+			if resp.Result().StatusCode != tt.status {
+				t.Fatalf("request returned status %s, expected %d: %s", resp.Result().Status, tt.status, resp.Body.String())
+			}
+
+			if tt.expect != "" && resp.Body.String() != tt.expect+"\n" {
+				t.Errorf("got `%s`, expected `%s`", resp.Body.String(), tt.expect)
+			}
+		})
+	}
+}
+
+func TestHandleLeaderboard(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	leaderboard := &leaderboardStub{counts: map[int]map[int]int{
+		1: {1: 3, 2: 7, 3: 5},
+	}}
+	app := applause.New(new(backendStub), dsmock.Stub(nil), ctx.Done(), applause.WithLeaderboard(leaderboard, time.Hour))
+	mux := http.NewServeMux()
+	applause.HandleLeaderboard(mux, app, "secret")
+
+	disabledMux := http.NewServeMux()
+	applause.HandleLeaderboard(disabledMux, applause.New(new(backendStub), dsmock.Stub(nil), ctx.Done()), "secret")
+
+	for _, tt := range []struct {
+		name   string
+		mux    *http.ServeMux
+		url    string
+		token  string
+		status int
+		expect string
+	}{
+		{"default limit", mux, "/system/icc/applause/leaderboard?meeting_id=1", "secret", 200, `{"users":[{"user_id":2,"count":7},{"user_id":3,"count":5},{"user_id":1,"count":3}]}`},
+		{"limit", mux, "/system/icc/applause/leaderboard?meeting_id=1&limit=1", "secret", 200, `{"users":[{"user_id":2,"count":7}]}`},
+		{"no applause", mux, "/system/icc/applause/leaderboard?meeting_id=2", "secret", 200, `{"users":[]}`},
+		{"without meeting", mux, "/system/icc/applause/leaderboard", "secret", 400, ""},
+		{"invalid limit", mux, "/system/icc/applause/leaderboard?meeting_id=1&limit=1000", "secret", 400, ""},
+		{"disabled", disabledMux, "/system/icc/applause/leaderboard?meeting_id=1", "secret", 404, ""},
+		{"without admin token", mux, "/system/icc/applause/leaderboard?meeting_id=1", "", 401, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp := httptest.NewRecorder()
+			tt.mux.ServeHTTP(resp, req)
+
+			if resp.Result().StatusCode != tt.status {
+				t.Fatalf("request returned status %s, expected %d: %s", resp.Result().Status, tt.status, resp.Body.String())
+			}
+
+			if tt.expect != "" && resp.Body.String() != tt.expect+"\n" {
+				t.Errorf("got `%s`, expected `%s`", resp.Body.String(), tt.expect)
+			}
+		})
+	}
+}
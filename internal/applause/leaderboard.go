@@ -0,0 +1,91 @@
+package applause
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+)
+
+// LeaderboardBackend counts the applause of each user.
+type LeaderboardBackend interface {
+	// ApplauseLeaderboardAdd counts one applause of the user in the meeting
+	// at the unix time in seconds. It can be removed after ttl.
+	ApplauseLeaderboardAdd(meetingID, userID int, at int64, ttl time.Duration) error
+
+	// ApplauseLeaderboard returns the number of applause of each user in the
+	// meeting since the unix time in seconds.
+	ApplauseLeaderboard(meetingID int, since int64) (map[int]int, error)
+}
+
+// WithLeaderboard counts how often each user applauses. Leaderboard returns
+// the users with the most applause in the last window.
+//
+// Without this option, no applause is saved with the user.
+func WithLeaderboard(backend LeaderboardBackend, window time.Duration) Option {
+	return func(a *Applause) {
+		if window > 0 {
+			a.leaderboard = backend
+			a.leaderboardWindow = window
+		}
+	}
+}
+
+// LeaderboardEntry is the number of applause of one user.
+type LeaderboardEntry struct {
+	UserID int `json:"user_id"`
+	Count  int `json:"count"`
+}
+
+// Leaderboard returns up to n users of the meeting with the most applause in
+// the window of WithLeaderboard. Users with the same number of applause are
+// ordered by id.
+//
+// Returns ErrNotFound without WithLeaderboard.
+func (a *Applause) Leaderboard(meetingID, n int) ([]LeaderboardEntry, error) {
+	if a.leaderboard == nil {
+		return nil, iccerror.NewMessageError(iccerror.ErrNotFound, "The applause leaderboard is disabled.")
+	}
+
+	counts, err := a.leaderboard.ApplauseLeaderboard(meetingID, time.Now().Add(-a.leaderboardWindow).Unix())
+	if err != nil {
+		return nil, fmt.Errorf("fetching leaderboard: %w", err)
+	}
+
+	return topUsers(counts, n), nil
+}
+
+// leaderboardAdd counts the applause of the user, if the leaderboard is used.
+func (a *Applause) leaderboardAdd(meetingID, userID int) error {
+	if a.leaderboard == nil {
+		return nil
+	}
+
+	if err := a.leaderboard.ApplauseLeaderboardAdd(meetingID, userID, time.Now().Unix(), a.leaderboardWindow); err != nil {
+		return fmt.Errorf("counting applause for leaderboard: %w", err)
+	}
+	return nil
+}
+
+// topUsers returns the n users with the highest count.
+func topUsers(counts map[int]int, n int) []LeaderboardEntry {
+	entries := make([]LeaderboardEntry, 0, len(counts))
+	for userID, count := range counts {
+		if count > 0 {
+			entries = append(entries, LeaderboardEntry{UserID: userID, Count: count})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].UserID < entries[j].UserID
+	})
+
+	if n >= 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
@@ -1,6 +1,12 @@
 package applause_test
 
-import "context"
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/applause"
+)
 
 type applauserStrub struct {
 	expectedErr     error
@@ -15,3 +21,166 @@ func (s *applauserStrub) Send(ctx context.Context, meetingID, uid int) error {
 	s.calledMeetingID = meetingID
 	return s.expectedErr
 }
+
+type backendStub struct {
+	mu       sync.Mutex
+	applause map[int]int
+
+	// publishErr is returned by ApplausePublish.
+	publishErr error
+}
+
+func (b *backendStub) ApplausePublish(meetingID, userID int, time int64) error {
+	return b.publishErr
+}
+
+func (b *backendStub) ApplauseSince(time int64) (map[int]int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out := make(map[int]int, len(b.applause))
+	for k, v := range b.applause {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (b *backendStub) ApplauseCleanOld(olderThen int64) error {
+	return nil
+}
+
+func (b *backendStub) setApplause(meetingID, level int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.applause == nil {
+		b.applause = make(map[int]int)
+	}
+	b.applause[meetingID] = level
+}
+
+// timedBackendStub saves the time of each applause and counts the applause
+// since the given time.
+type timedBackendStub struct {
+	applause map[int][]int64
+}
+
+func (b *timedBackendStub) ApplausePublish(meetingID, userID int, time int64) error {
+	b.applause[meetingID] = append(b.applause[meetingID], time)
+	return nil
+}
+
+func (b *timedBackendStub) ApplauseSince(time int64) (map[int]int, error) {
+	out := make(map[int]int)
+	for meetingID, times := range b.applause {
+		for _, t := range times {
+			if t >= time {
+				out[meetingID]++
+			}
+		}
+	}
+	return out, nil
+}
+
+func (b *timedBackendStub) ApplauseCleanOld(olderThen int64) error {
+	return nil
+}
+
+// usersStub returns the same users with applause for each meeting.
+type usersStub map[int][]int
+
+func (u usersStub) ApplauseUsers(meetingID int, since int64) ([]int, error) {
+	return u[meetingID], nil
+}
+
+// leaderboardStub counts the applause of each user of each meeting. The time
+// is ignored.
+type leaderboardStub struct {
+	counts map[int]map[int]int
+}
+
+func (l *leaderboardStub) ApplauseLeaderboardAdd(meetingID, userID int, at int64, ttl time.Duration) error {
+	if l.counts[meetingID] == nil {
+		l.counts[meetingID] = make(map[int]int)
+	}
+	l.counts[meetingID][userID]++
+	return nil
+}
+
+func (l *leaderboardStub) ApplauseLeaderboard(meetingID int, since int64) (map[int]int, error) {
+	out := make(map[int]int, len(l.counts[meetingID]))
+	for k, v := range l.counts[meetingID] {
+		out[k] = v
+	}
+	return out, nil
+}
+
+type wsApplauserStub struct {
+	sent chan int
+}
+
+func (s *wsApplauserStub) Send(ctx context.Context, meetingID, uid int) error {
+	s.sent <- uid
+	return nil
+}
+
+func (s *wsApplauserStub) CanReceive(ctx context.Context, meetingID, userID int) error {
+	return nil
+}
+
+func (s *wsApplauserStub) Receive(ctx context.Context, tid uint64, meetingID int) (uint64, applause.MSG, error) {
+	if tid == 0 {
+		return 1, applause.MSG{Level: 0, PresentUsers: 2}, nil
+	}
+
+	select {
+	case <-s.sent:
+		return tid + 1, applause.MSG{Level: 1, PresentUsers: 2}, nil
+	case <-ctx.Done():
+		return 0, applause.MSG{}, ctx.Err()
+	}
+}
+
+// counterStub returns the counters of one applause time.
+type counterStub struct {
+	mu       sync.Mutex
+	at       int64
+	counters map[int]int
+}
+
+func (c *counterStub) ApplauseCounters(since int64) (map[int]int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make(map[int]int, len(c.counters))
+	if c.at < since {
+		return out, nil
+	}
+
+	for k, v := range c.counters {
+		out[k] = v
+	}
+	return out, nil
+}
+
+// setTime sets the time of the applause in the counters.
+func (c *counterStub) setTime(at int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.at = at
+}
+
+// stallingBackend is a backend where ApplausePublishContext blocks until the
+// context is done.
+// The channel called is closed on the first call.
+type stallingBackend struct {
+	backendStub
+	called chan struct{}
+}
+
+func (b *stallingBackend) ApplausePublishContext(ctx context.Context, meetingID, userID int, time int64) error {
+	close(b.called)
+	<-ctx.Done()
+	return ctx.Err()
+}
@@ -0,0 +1,54 @@
+package applause
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type pruneBackendStub struct {
+	Backend
+	cleaned chan int64
+}
+
+func (b pruneBackendStub) ApplauseCleanOld(olderThen int64) error {
+	b.cleaned <- olderThen
+	return nil
+}
+
+func TestPruneInterval(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := pruneBackendStub{cleaned: make(chan int64, 10)}
+	a := New(backend, nil, ctx.Done(), WithPruneInterval(time.Hour))
+
+	ticks := make(chan time.Time)
+	intervals := make(chan time.Duration, 1)
+	a.newTicker = func(interval time.Duration) (<-chan time.Time, func()) {
+		intervals <- interval
+		return ticks, func() {}
+	}
+
+	go a.PruneOldData(ctx, nil)
+
+	if got := <-intervals; got != time.Hour {
+		t.Errorf("prune loop uses interval %s, expected 1h0m0s", got)
+	}
+
+	select {
+	case <-backend.cleaned:
+		t.Fatalf("prune ran before the first tick")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	for i := 0; i < 2; i++ {
+		ticks <- time.Now()
+
+		select {
+		case <-backend.cleaned:
+		case <-time.After(time.Second):
+			t.Fatalf("prune did not run after tick %d", i+1)
+		}
+	}
+}
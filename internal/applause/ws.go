@@ -0,0 +1,163 @@
+package applause
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+	"github.com/OpenSlides/openslides-icc-service/internal/icchttp"
+	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
+	"golang.org/x/net/websocket"
+)
+
+// wsApplauseMessage is the message, a client has to send via the websocket to
+// applause.
+const wsApplauseMessage = "applause"
+
+// SendReceiver can send and receive applause.
+type SendReceiver interface {
+	Sender
+	Receive
+}
+
+// HandleWS registers the icc/applause/ws route.
+//
+// It is a websocket connection. The server sends the applause messages like
+// the icc/applause route. The client sends the text message `applause` to
+// applause.
+//
+// A browser sends the cookies of the user also with a websocket from another
+// site. So requests with the header Origin are only accepted from the same
+// host or from one of the origins, like `https://example.com`. The origin `*`
+// accepts all.
+func HandleWS(mux *http.ServeMux, applause SendReceiver, auth icchttp.Authenticater, origins []string) {
+	path := icchttp.Path + "/applause/ws"
+	handler := http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if !allowedOrigin(r, origins) {
+				icchttp.Error(w, iccerror.NewMessageError(iccerror.ErrNotAllowed, "The origin is not allowed."))
+				return
+			}
+
+			meetingStr := r.URL.Query().Get("meeting_id")
+			meetingID, err := strconv.Atoi(meetingStr)
+			if err != nil {
+				icchttp.Error(w, iccerror.NewMessageError(iccerror.ErrInvalid, "Query meeting has to be an int."))
+				return
+			}
+
+			uid := auth.FromContext(r.Context())
+			if err := applause.CanReceive(r.Context(), meetingID, uid); err != nil {
+				icchttp.Error(w, err)
+				return
+			}
+
+			icchttp.DescribeConnection(r.Context(), uid, meetingID, "")
+
+			wsServer := websocket.Server{
+				Handler: func(ws *websocket.Conn) {
+					handleWSConn(r.Context(), ws, applause, meetingID, uid)
+				},
+			}
+			wsServer.ServeHTTP(w, r)
+		})
+
+	mux.Handle(
+		path,
+		icchttp.MethodMiddleware(icchttp.AuthMiddleware(handler, auth), http.MethodGet),
+	)
+}
+
+// allowedOrigin returns true, if the request has no header Origin, the origin
+// has the host of the request or it is one of the origins. Clients without a
+// browser do not send the header.
+func allowedOrigin(r *http.Request, origins []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleWSConn sends the applause messages to the websocket and reads the
+// applause from the client.
+//
+// It returns, when the client closes the connection or the server shuts down.
+func handleWSConn(ctx context.Context, ws *websocket.Conn, applause SendReceiver, meetingID, uid int) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	icclog.Debug("Websocket: connect meeting=%d user=%d", meetingID, uid)
+	defer icclog.Debug("Websocket: disconnect meeting=%d user=%d", meetingID, uid)
+
+	go func() {
+		// Cancel the context, when the client closes the connection.
+		defer cancel()
+
+		for {
+			var message string
+			if err := websocket.Message.Receive(ws, &message); err != nil {
+				return
+			}
+
+			if message != wsApplauseMessage {
+				sendWSError(ws, iccerror.NewMessageError(iccerror.ErrInvalid, "Unknown message. Only `%s` can be sent.", wsApplauseMessage))
+				continue
+			}
+
+			if uid == 0 {
+				sendWSError(ws, iccerror.NewMessageError(iccerror.ErrNotAllowed, "Anonymous user can not send applause."))
+				continue
+			}
+
+			if err := applause.Send(ctx, meetingID, uid); err != nil && !errors.Is(err, ErrDropped) {
+				sendWSError(ws, fmt.Errorf("saving applause: %w", err))
+			}
+		}
+	}()
+
+	var tid uint64
+	for {
+		var message MSG
+		var err error
+		tid, message, err = applause.Receive(ctx, tid, meetingID)
+		if err != nil {
+			icclog.Debug("Websocket: error meeting=%d user=%d: %v", meetingID, uid, err)
+			sendWSError(ws, fmt.Errorf("receive applause data: %w", err))
+			return
+		}
+
+		if err := websocket.JSON.Send(ws, message); err != nil {
+			icclog.Debug("Websocket: error meeting=%d user=%d: writing message: %v", meetingID, uid, err)
+			return
+		}
+	}
+}
+
+// sendWSError sends an error as json-message via the websocket.
+func sendWSError(ws *websocket.Conn, err error) {
+	var buf strings.Builder
+	icchttp.ErrorNoStatus(&buf, err)
+	if buf.Len() == 0 {
+		return
+	}
+
+	if err := websocket.Message.Send(ws, buf.String()); err != nil {
+		icclog.Debug("Websocket: writing error: %v", err)
+	}
+}
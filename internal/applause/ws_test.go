@@ -0,0 +1,138 @@
+package applause_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/applause"
+	"github.com/OpenSlides/openslides-icc-service/internal/icctest"
+	"golang.org/x/net/websocket"
+)
+
+func TestHandleWS(t *testing.T) {
+	applauser := wsApplauserStub{sent: make(chan int, 1)}
+	auther := icctest.AutherStub{UserID: 1}
+	mux := http.NewServeMux()
+	applause.HandleWS(mux, &applauser, &auther, nil)
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/system/icc/applause/ws?meeting_id=1"
+	ws, err := websocket.Dial(url, "", srv.URL)
+	if err != nil {
+		t.Fatalf("websocket handshake: %v", err)
+	}
+	defer ws.Close()
+
+	var msg applause.MSG
+	if err := websocket.JSON.Receive(ws, &msg); err != nil {
+		t.Fatalf("receiving first message: %v", err)
+	}
+
+	if msg.Level != 0 || msg.PresentUsers != 2 {
+		t.Errorf("got first message %v, expected level 0 and 2 present users", msg)
+	}
+
+	if err := websocket.Message.Send(ws, "applause"); err != nil {
+		t.Fatalf("sending applause: %v", err)
+	}
+
+	if err := websocket.JSON.Receive(ws, &msg); err != nil {
+		t.Fatalf("receiving applause update: %v", err)
+	}
+
+	if msg.Level != 1 {
+		t.Errorf("got level %d, expected 1", msg.Level)
+	}
+
+	if err := websocket.Message.Send(ws, `"unknown`); err != nil {
+		t.Fatalf("sending unknown message: %v", err)
+	}
+
+	var errMsg string
+	if err := websocket.Message.Receive(ws, &errMsg); err != nil {
+		t.Fatalf("receiving error: %v", err)
+	}
+
+	var decoded struct {
+		Error string `json:"error"`
+		Msg   string `json:"msg"`
+	}
+	if err := json.Unmarshal([]byte(errMsg), &decoded); err != nil {
+		t.Fatalf("decoding error `%s`: %v", errMsg, err)
+	}
+
+	if decoded.Error != "invalid" || strings.Contains(decoded.Msg, "unknown") {
+		t.Errorf("got error `%s`, expected an invalid error without the client message", errMsg)
+	}
+}
+
+func TestHandleWSAuth(t *testing.T) {
+	applauser := wsApplauserStub{sent: make(chan int, 1)}
+	auther := icctest.AutherStub{AuthErr: true}
+	mux := http.NewServeMux()
+	applause.HandleWS(mux, &applauser, &auther, nil)
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/system/icc/applause/ws?meeting_id=1"
+	if _, err := websocket.Dial(url, "", srv.URL); err == nil {
+		t.Errorf("websocket handshake succeeded, expected the auth to fail")
+	}
+}
+
+func TestHandleWSOrigin(t *testing.T) {
+	applauser := wsApplauserStub{sent: make(chan int, 1)}
+	auther := icctest.AutherStub{UserID: 1}
+	mux := http.NewServeMux()
+	applause.HandleWS(mux, &applauser, &auther, []string{"https://openslides.example"})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/system/icc/applause/ws?meeting_id=1"
+
+	for _, tt := range []struct {
+		origin string
+		expect bool
+	}{
+		{srv.URL, true},
+		{"https://openslides.example", true},
+		{"https://evil.example", false},
+	} {
+		t.Run(tt.origin, func(t *testing.T) {
+			ws, err := websocket.Dial(url, "", tt.origin)
+			if err == nil {
+				ws.Close()
+			}
+
+			if got := err == nil; got != tt.expect {
+				t.Errorf("websocket handshake succeeded: %t, expected %t (%v)", got, tt.expect, err)
+			}
+		})
+	}
+
+	t.Run("error body", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/system/icc/applause/ws?meeting_id=1", nil)
+		req.Header.Set("Origin", `https://evil.example/"`)
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+
+		var decoded struct {
+			Error string `json:"error"`
+			Msg   string `json:"msg"`
+		}
+		if err := json.Unmarshal(resp.Body.Bytes(), &decoded); err != nil {
+			t.Fatalf("decoding body `%s`: %v", resp.Body.String(), err)
+		}
+
+		if decoded.Error != "not-allowed" || strings.Contains(decoded.Msg, "evil") {
+			t.Errorf("got body `%s`, expected a not-allowed error without the origin", resp.Body.String())
+		}
+	})
+}
@@ -1,6 +1,10 @@
 package iccerror
 
-import "fmt"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
 
 const (
 	// ErrInternal should not happen.
@@ -12,6 +16,21 @@ const (
 	// ErrNotAllowed happens on a vote request, when the request user is
 	// anonymous or is not allowed for the request.
 	ErrNotAllowed
+
+	// ErrNotFound happens, when a requested object does not exist.
+	ErrNotFound
+
+	// ErrUnavailable happens, when the service can not handle the request at
+	// the moment.
+	ErrUnavailable
+
+	// ErrTooManyRequests happens, when a client sends more requests then
+	// allowed.
+	ErrTooManyRequests
+
+	// ErrTooSlow happens, when a client receives the messages slower then they
+	// are published.
+	ErrTooSlow
 )
 
 // TypeError is an error that can happend in this API.
@@ -26,6 +45,18 @@ func (err TypeError) Type() string {
 	case ErrNotAllowed:
 		return "not-allowed"
 
+	case ErrNotFound:
+		return "not-found"
+
+	case ErrUnavailable:
+		return "unavailable"
+
+	case ErrTooManyRequests:
+		return "too-many-requests"
+
+	case ErrTooSlow:
+		return "too-slow"
+
 	default:
 		return "internal"
 	}
@@ -40,6 +71,18 @@ func (err TypeError) Error() string {
 	case ErrNotAllowed:
 		msg = "You are not allowed to do this."
 
+	case ErrNotFound:
+		msg = "The requested object does not exist."
+
+	case ErrUnavailable:
+		msg = "The service is not available at the moment."
+
+	case ErrTooManyRequests:
+		msg = "Too many requests. Please slow down."
+
+	case ErrTooSlow:
+		msg = "The client receives the messages too slowly."
+
 	default:
 		msg = "Ups, something went wrong!"
 
@@ -63,10 +106,53 @@ func NewMessageError(t TypeError, format string, a ...interface{}) error {
 	}
 }
 
+// Error returns the error as json. The message is encoded, since it can
+// contain quotes or other input from the client.
 func (err MessageError) Error() string {
-	return fmt.Sprintf(`{"error":"%s","msg":"%s"}`, err.t.Type(), err.msg)
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if jsonErr := encoder.Encode(struct {
+		Error string `json:"error"`
+		Msg   string `json:"msg"`
+	}{err.t.Type(), err.msg}); jsonErr != nil {
+		return err.t.Error()
+	}
+	return string(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
 }
 
 func (err MessageError) Unwrap() error {
 	return err.t
 }
+
+// ValidationError is an ErrInvalid that lists all problems of a list of items,
+// so the client can fix them at once.
+type ValidationError struct {
+	Problems []Problem
+}
+
+// Problem is one invalid item of a ValidationError.
+type Problem struct {
+	Index int    `json:"index"`
+	Msg   string `json:"msg"`
+}
+
+func (err ValidationError) Error() string {
+	bs, jsonErr := json.Marshal(struct {
+		Error  string    `json:"error"`
+		Msg    string    `json:"msg"`
+		Errors []Problem `json:"errors"`
+	}{
+		ErrInvalid.Type(),
+		fmt.Sprintf("%d of the items are invalid", len(err.Problems)),
+		err.Problems,
+	})
+	if jsonErr != nil {
+		return ErrInvalid.Error()
+	}
+	return string(bs)
+}
+
+func (err ValidationError) Unwrap() error {
+	return ErrInvalid
+}
@@ -0,0 +1,74 @@
+package icchttp
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+)
+
+// LimitAuth is an Authenticater that allows only a limited number of
+// Authenticate calls at the same time. So many connections, that arrive at
+// once, do not overwhelm the auth service.
+//
+// Has to be created with icchttp.NewLimitAuth().
+type LimitAuth struct {
+	auth Authenticater
+	sem  chan struct{}
+	wait time.Duration
+}
+
+// NewLimitAuth initializes a LimitAuth with at most `limit` concurrent calls to
+// auth.Authenticate.
+//
+// A call over the limit waits up to `wait` for a free slot. If there is none,
+// it fails with ErrUnavailable. A wait of 0 fails directly.
+func NewLimitAuth(auth Authenticater, limit int, wait time.Duration) *LimitAuth {
+	return &LimitAuth{
+		auth: auth,
+		sem:  make(chan struct{}, limit),
+		wait: wait,
+	}
+}
+
+// Authenticate calls Authenticate on the wrapped Authenticater, if there is a
+// free slot.
+func (a *LimitAuth) Authenticate(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	if err := a.acquire(r.Context()); err != nil {
+		return nil, err
+	}
+	defer func() { <-a.sem }()
+
+	return a.auth.Authenticate(w, r)
+}
+
+// FromContext calls FromContext on the wrapped Authenticater.
+func (a *LimitAuth) FromContext(ctx context.Context) int {
+	return a.auth.FromContext(ctx)
+}
+
+func (a *LimitAuth) acquire(ctx context.Context) error {
+	select {
+	case a.sem <- struct{}{}:
+		return nil
+	default:
+	}
+
+	errBusy := iccerror.NewMessageError(iccerror.ErrUnavailable, "Too many requests are authenticated at the moment. Please try again.")
+	if a.wait <= 0 {
+		return errBusy
+	}
+
+	timer := time.NewTimer(a.wait)
+	defer timer.Stop()
+
+	select {
+	case a.sem <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
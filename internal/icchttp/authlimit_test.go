@@ -0,0 +1,105 @@
+package icchttp_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+	"github.com/OpenSlides/openslides-icc-service/internal/icchttp"
+)
+
+// blockingAuth blocks each Authenticate call until release is closed.
+type blockingAuth struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (a blockingAuth) Authenticate(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	a.started <- struct{}{}
+	<-a.release
+	return r.Context(), nil
+}
+
+func (a blockingAuth) FromContext(context.Context) int {
+	return 1
+}
+
+func TestLimitAuth(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		wait time.Duration
+	}{
+		{"fail fast", 0},
+		{"queue timeout", 20 * time.Millisecond},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := blockingAuth{started: make(chan struct{}, 10), release: make(chan struct{})}
+			limited := icchttp.NewLimitAuth(inner, 2, tt.wait)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					limited.Authenticate(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+				}()
+				<-inner.started
+			}
+
+			_, err := limited.Authenticate(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			if !errors.Is(err, iccerror.ErrUnavailable) {
+				t.Errorf("call over the limit returned `%v`, expected `%v`", err, iccerror.ErrUnavailable)
+			}
+
+			close(inner.release)
+			wg.Wait()
+
+			if _, err := limited.Authenticate(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)); err != nil {
+				t.Errorf("call after release returned: %v", err)
+			}
+		})
+	}
+
+	t.Run("queued call gets a slot", func(t *testing.T) {
+		inner := blockingAuth{started: make(chan struct{}, 10), release: make(chan struct{})}
+		limited := icchttp.NewLimitAuth(inner, 1, time.Second)
+
+		go limited.Authenticate(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		<-inner.started
+
+		queued := make(chan error, 1)
+		go func() {
+			_, err := limited.Authenticate(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			queued <- err
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+		close(inner.release)
+
+		if err := <-queued; err != nil {
+			t.Errorf("queued call returned: %v", err)
+		}
+	})
+
+	t.Run("status 503", func(t *testing.T) {
+		inner := blockingAuth{started: make(chan struct{}, 10), release: make(chan struct{})}
+		defer close(inner.release)
+		limited := icchttp.NewLimitAuth(inner, 1, 0)
+
+		go limited.Authenticate(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		<-inner.started
+
+		resp := httptest.NewRecorder()
+		icchttp.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), limited).
+			ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+
+		if resp.Code != 503 {
+			t.Errorf("got status %d, expected 503", resp.Code)
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package icchttp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
+)
+
+type contextKey int
+
+const clientIPKey contextKey = iota
+
+// ParseTrustedProxies parses a comma separated list of CIDRs or ip addresses.
+func ParseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip address `%s`", part)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr `%s`: %w", part, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// ClientIP returns the ip of the client that sent the request.
+//
+// If the direct peer is a trusted proxy, the headers X-Forwarded-For and
+// X-Real-IP are used to find the real client. The X-Forwarded-For header is
+// read from right to left. The first address that is not a trusted proxy is
+// the client.
+func ClientIP(r *http.Request, trusted []*net.IPNet) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+
+	if !isTrusted(peer, trusted) {
+		return peer
+	}
+
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+
+			if i == 0 || !isTrusted(hop, trusted) {
+				return hop
+			}
+		}
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+
+	return peer
+}
+
+func isTrusted(addr string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIPMiddleware saves the ip of the client in the request context and
+// logs the request on debug level.
+//
+// Use ClientIPFromContext to get the ip.
+func ClientIPMiddleware(next http.Handler, trusted []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := ClientIP(r, trusted)
+		icclog.Debug("HTTP: %s %s from %s", r.Method, r.URL.Path, ip)
+
+		r = r.WithContext(context.WithValue(r.Context(), clientIPKey, ip))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ClientIPFromContext returns the ip of the client that was saved by
+// ClientIPMiddleware. Returns an empty string, if there is no ip in the
+// context.
+func ClientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey).(string)
+	return ip
+}
@@ -0,0 +1,99 @@
+package icchttp_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/icchttp"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := icchttp.ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatalf("parsing trusted proxies: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name       string
+		remoteAddr string
+		header     map[string]string
+		expect     string
+	}{
+		{
+			"untrusted peer without header",
+			"1.2.3.4:1234",
+			nil,
+			"1.2.3.4",
+		},
+		{
+			"untrusted peer with header",
+			"1.2.3.4:1234",
+			map[string]string{"X-Forwarded-For": "5.6.7.8"},
+			"1.2.3.4",
+		},
+		{
+			"trusted peer with forwarded for",
+			"10.1.2.3:1234",
+			map[string]string{"X-Forwarded-For": "5.6.7.8"},
+			"5.6.7.8",
+		},
+		{
+			"trusted peer with many proxies",
+			"10.1.2.3:1234",
+			map[string]string{"X-Forwarded-For": "6.6.6.6, 5.6.7.8, 192.168.1.1"},
+			"5.6.7.8",
+		},
+		{
+			"trusted peer with real ip",
+			"192.168.1.1:1234",
+			map[string]string{"X-Real-IP": "5.6.7.8"},
+			"5.6.7.8",
+		},
+		{
+			"trusted peer without header",
+			"10.1.2.3:1234",
+			nil,
+			"10.1.2.3",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+
+			if got := icchttp.ClientIP(r, trusted); got != tt.expect {
+				t.Errorf("ClientIP() returned %s, expected %s", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestClientIPMiddleware(t *testing.T) {
+	trusted, err := icchttp.ParseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("parsing trusted proxies: %v", err)
+	}
+
+	var got string
+	handler := icchttp.ClientIPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = icchttp.ClientIPFromContext(r.Context())
+	}), trusted)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Forwarded-For", "5.6.7.8")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if got != "5.6.7.8" {
+		t.Errorf("ClientIPFromContext() returned %s, expected 5.6.7.8", got)
+	}
+}
+
+func TestParseTrustedProxiesInvalid(t *testing.T) {
+	if _, err := icchttp.ParseTrustedProxies("10.0.0.0/8,not-an-ip"); err == nil {
+		t.Errorf("ParseTrustedProxies() did not return an error")
+	}
+}
@@ -0,0 +1,29 @@
+package icchttp
+
+import (
+	"context"
+	"net"
+)
+
+type connContextKey struct{}
+
+// ConnContext adds the network connection to the context of its requests. It
+// has to be used as ConnContext of the http.Server, so CloseConnection can
+// close the connection of a request.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// CloseConnection closes the network connection of a request. This also stops
+// a write to a client that does not read.
+//
+// Returns false, if the server does not use ConnContext.
+func CloseConnection(ctx context.Context) bool {
+	c, ok := ctx.Value(connContextKey{}).(net.Conn)
+	if !ok {
+		return false
+	}
+
+	c.Close()
+	return true
+}
@@ -0,0 +1,60 @@
+package icchttp
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ConnectionCounter counts the active connections of a http handler.
+//
+// The zero value is ready to use.
+type ConnectionCounter struct {
+	active int64
+}
+
+// Middleware counts the requests that are currently handled by next.
+func (c *ConnectionCounter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&c.active, 1)
+		defer atomic.AddInt64(&c.active, -1)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Active returns the number of active connections.
+func (c *ConnectionCounter) Active() int {
+	return int(atomic.LoadInt64(&c.active))
+}
+
+// Drain calls shutdown and reports the number of active connections every
+// interval until shutdown returns.
+//
+// The report function is called at least two times. At the beginning and
+// when shutdown returned.
+//
+// Returns the time it took to drain the connections.
+func (c *ConnectionCounter) Drain(shutdown func() error, interval time.Duration, report func(active int)) (time.Duration, error) {
+	start := time.Now()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- shutdown()
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	report(c.Active())
+	for {
+		select {
+		case err := <-done:
+			report(c.Active())
+			return time.Since(start), err
+
+		case <-ticker.C:
+			report(c.Active())
+		}
+	}
+}
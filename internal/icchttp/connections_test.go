@@ -0,0 +1,64 @@
+package icchttp_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/icchttp"
+)
+
+func TestConnectionCounterDrain(t *testing.T) {
+	counter := new(icchttp.ConnectionCounter)
+
+	release := make(chan struct{})
+	handler := counter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}()
+	}
+
+	for counter.Active() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var reports []int
+	shutdown := func() error {
+		time.Sleep(5 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		return nil
+	}
+
+	duration, err := counter.Drain(shutdown, time.Millisecond, func(active int) {
+		reports = append(reports, active)
+	})
+	if err != nil {
+		t.Fatalf("Drain returned unexpected error: %v", err)
+	}
+
+	if duration < 5*time.Millisecond {
+		t.Errorf("Drain returned duration %s, expected at least 5ms", duration)
+	}
+
+	if len(reports) < 2 {
+		t.Fatalf("Drain reported %d times, expected at least 2", len(reports))
+	}
+
+	if reports[0] != 2 {
+		t.Errorf("first report was %d, expected 2", reports[0])
+	}
+
+	if last := reports[len(reports)-1]; last != 0 {
+		t.Errorf("last report was %d, expected 0", last)
+	}
+}
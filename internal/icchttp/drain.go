@@ -0,0 +1,83 @@
+package icchttp
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
+)
+
+// Drainer holds the drain state of the service.
+//
+// When the service is draining, it does not accept new streaming connections.
+// Existing connections are not affected.
+//
+// The zero value is ready to use.
+type Drainer struct {
+	draining int32
+}
+
+// Drain sets the service in drain mode. There is no way back.
+func (d *Drainer) Drain() {
+	atomic.StoreInt32(&d.draining, 1)
+}
+
+// Draining returns true, if the service is in drain mode.
+func (d *Drainer) Draining() bool {
+	return atomic.LoadInt32(&d.draining) == 1
+}
+
+// Middleware refuses new requests to the given paths, when the service is in
+// drain mode. All other requests are passed to next.
+func (d *Drainer) Middleware(next http.Handler, paths ...string) http.Handler {
+	refused := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		refused[p] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d.Draining() && refused[r.URL.Path] {
+			Error(w, iccerror.NewMessageError(iccerror.ErrUnavailable, "The service is draining. Please connect to another instance."))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandleDrain registers the drain route. It only accepts POST requests with
+// the admin token.
+func HandleDrain(mux *http.ServeMux, d *Drainer, adminToken string) {
+	url := Path + "/drain"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		d.Drain()
+		icclog.Info("Drain mode activated")
+		fmt.Fprintln(w, `{"draining": true}`)
+	})
+
+	mux.Handle(
+		url,
+		MethodMiddleware(AdminMiddleware(handler, adminToken), http.MethodPost),
+	)
+}
+
+// HandleReady returns 200 if the service accepts new connections and 503 if
+// it is in drain mode.
+func HandleReady(mux *http.ServeMux, d *Drainer) {
+	mux.HandleFunc(
+		Path+"/ready",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if d.Draining() {
+				w.WriteHeader(503)
+				fmt.Fprintln(w, `{"ready": false}`)
+				return
+			}
+			fmt.Fprintln(w, `{"ready": true}`)
+		},
+	)
+}
@@ -0,0 +1,109 @@
+package icchttp_test
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/icchttp"
+)
+
+func TestDrain(t *testing.T) {
+	drainer := new(icchttp.Drainer)
+	messages := make(chan string)
+
+	mux := http.NewServeMux()
+	icchttp.HandleReady(mux, drainer)
+	icchttp.HandleDrain(mux, drainer, "secret")
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case m := <-messages:
+				fmt.Fprintln(w, m)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+
+	srv := httptest.NewServer(drainer.Middleware(mux, "/stream"))
+	defer srv.Close()
+
+	stream, err := http.Get(srv.URL + "/stream")
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	defer stream.Body.Close()
+	streamReader := bufio.NewReader(stream.Body)
+
+	t.Run("drain without token", func(t *testing.T) {
+		resp, err := http.Post(srv.URL+"/system/icc/drain", "", nil)
+		if err != nil {
+			t.Fatalf("sending drain request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != 401 {
+			t.Errorf("drain returned status %s, expected 401", resp.Status)
+		}
+
+		if drainer.Draining() {
+			t.Errorf("service is draining after request without token")
+		}
+	})
+
+	t.Run("drain", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", srv.URL+"/system/icc/drain", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("sending drain request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			t.Fatalf("drain returned status %s", resp.Status)
+		}
+	})
+
+	t.Run("not ready", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/system/icc/ready")
+		if err != nil {
+			t.Fatalf("sending ready request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != 503 {
+			t.Errorf("ready returned status %s, expected 503", resp.Status)
+		}
+	})
+
+	t.Run("new stream is refused", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/stream")
+		if err != nil {
+			t.Fatalf("open stream: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != 503 {
+			t.Errorf("stream returned status %s, expected 503", resp.Status)
+		}
+	})
+
+	t.Run("existing stream keeps running", func(t *testing.T) {
+		messages <- "hello"
+
+		line, err := streamReader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading from stream: %v", err)
+		}
+
+		if line != "hello\n" {
+			t.Errorf("got %q, expected hello", line)
+		}
+	})
+}
@@ -5,10 +5,13 @@ package icchttp
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
 	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
@@ -49,7 +52,9 @@ func ErrorNoStatus(w io.Writer, err error) {
 // Error sends an error message to the client as json-message.
 //
 // If the error does not have a Type() string message, it is handled as 500er.
-// In other case, it is handled as 400er.
+// Errors of type not-found are handled as 404er, errors of type
+// too-many-requests as 429er and errors of type unavailable as 503er. In other
+// case, it is handled as 400er.
 func Error(w http.ResponseWriter, err error) {
 	if isConnectionClose(err) {
 		return
@@ -61,7 +66,15 @@ func Error(w http.ResponseWriter, err error) {
 	}
 	status := 500
 	if errors.As(err, &errTyped) {
-		if errTyped.Type() != iccerror.ErrInternal.Error() {
+		switch errTyped.Type() {
+		case iccerror.ErrInternal.Type():
+		case iccerror.ErrNotFound.Type():
+			status = 404
+		case iccerror.ErrTooManyRequests.Type():
+			status = 429
+		case iccerror.ErrUnavailable.Type():
+			status = 503
+		default:
 			status = 400
 		}
 	}
@@ -88,10 +101,18 @@ func isConnectionClose(err error) bool {
 }
 
 // AuthMiddleware checks the user id of the request.
+//
+// If the Authenticater returns an error of type unavailable, the request gets
+// the status 503. Other errors are handled as 401.
 func AuthMiddleware(next http.Handler, auth Authenticater) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx, err := auth.Authenticate(w, r)
 		if err != nil {
+			if errors.Is(err, iccerror.ErrUnavailable) {
+				Error(w, err)
+				return
+			}
+
 			w.WriteHeader(401)
 			ErrorNoStatus(w, iccerror.NewMessageError(iccerror.ErrNotAllowed, "Anonymous user can not receive icc messages."))
 			return
@@ -101,6 +122,95 @@ func AuthMiddleware(next http.Handler, auth Authenticater) http.Handler {
 	})
 }
 
+// MethodMiddleware only allows requests with one of the given http methods.
+// Other requests get the status 405 with an Allow header.
+func MethodMiddleware(next http.Handler, methods ...string) http.Handler {
+	allow := strings.Join(methods, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range methods {
+			if r.Method == m {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		w.Header().Set("Allow", allow)
+		w.WriteHeader(405)
+		ErrorNoStatus(w, iccerror.NewMessageError(iccerror.ErrInvalid, "Method %s is not allowed. Use %s.", r.Method, allow))
+	})
+}
+
+// AdminMiddleware only allows requests with the header `Authorization: Bearer
+// TOKEN`.
+//
+// If token is empty, all requests are refused.
+func AdminMiddleware(next http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			w.WriteHeader(403)
+			ErrorNoStatus(w, iccerror.NewMessageError(iccerror.ErrNotAllowed, "Admin routes are disabled."))
+			return
+		}
+
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.WriteHeader(401)
+			ErrorNoStatus(w, iccerror.NewMessageError(iccerror.ErrNotAllowed, "Invalid admin token."))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// APIKeyHeader is the header with the api key for APIKeyMiddleware.
+const APIKeyHeader = "X-ICC-API-Key"
+
+// APIKeyMiddleware only allows requests to the given paths, that have one of
+// the keys in the header X-ICC-API-Key. All other requests are passed to next.
+//
+// The check is additional to the user authentication. If keys is empty, all
+// requests are allowed.
+func APIKeyMiddleware(next http.Handler, keys []string, paths ...string) http.Handler {
+	if len(keys) == 0 {
+		return next
+	}
+
+	checked := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		checked[p] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checked[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		got := []byte(r.Header.Get(APIKeyHeader))
+		for _, key := range keys {
+			if subtle.ConstantTimeCompare(got, []byte(key)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		w.WriteHeader(401)
+		ErrorNoStatus(w, iccerror.NewMessageError(iccerror.ErrNotAllowed, "Invalid api key."))
+	})
+}
+
+// ParseAPIKeys parses a comma separated list of api keys.
+func ParseAPIKeys(raw string) []string {
+	var keys []string
+	for _, key := range strings.Split(raw, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
 // HandleHealth returns 200 (if the service is running).
 func HandleHealth(mux *http.ServeMux) {
 	mux.HandleFunc(
@@ -111,3 +221,46 @@ func HandleHealth(mux *http.ServeMux) {
 		},
 	)
 }
+
+// HandleRoot registers the root path.
+//
+// The behavior `info` returns a json object that names the service and lists
+// the given endpoints. The behavior `redirect` redirects to the health route.
+// The behavior `none` returns 404.
+func HandleRoot(mux *http.ServeMux, behavior string, endpoints []string) error {
+	var handler http.HandlerFunc
+	switch behavior {
+	case "info":
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(struct {
+				Service   string   `json:"service"`
+				Endpoints []string `json:"endpoints"`
+			}{
+				"icc",
+				endpoints,
+			})
+		}
+
+	case "redirect":
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, Path+"/health", http.StatusFound)
+		}
+
+	case "none":
+		return nil
+
+	default:
+		return fmt.Errorf("unknown root behavior `%s`", behavior)
+	}
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// The pattern `/` matches all paths without an other handler.
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		handler(w, r)
+	})
+	return nil
+}
@@ -0,0 +1,147 @@
+package icchttp_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/icchttp"
+)
+
+func TestHandleRoot(t *testing.T) {
+	t.Run("info", func(t *testing.T) {
+		mux := http.NewServeMux()
+		if err := icchttp.HandleRoot(mux, "info", []string{"/system/icc/health"}); err != nil {
+			t.Fatalf("HandleRoot: %v", err)
+		}
+		resp := httptest.NewRecorder()
+
+		mux.ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+
+		if resp.Result().StatusCode != 200 {
+			t.Fatalf("handler returned status %s", resp.Result().Status)
+		}
+
+		expect := `{"service":"icc","endpoints":["/system/icc/health"]}` + "\n"
+		if resp.Body.String() != expect {
+			t.Errorf("handler returned %q, expected %q", resp.Body.String(), expect)
+		}
+	})
+
+	t.Run("info on unknown path", func(t *testing.T) {
+		mux := http.NewServeMux()
+		if err := icchttp.HandleRoot(mux, "info", nil); err != nil {
+			t.Fatalf("HandleRoot: %v", err)
+		}
+		resp := httptest.NewRecorder()
+
+		mux.ServeHTTP(resp, httptest.NewRequest("GET", "/unknown", nil))
+
+		if resp.Result().StatusCode != 404 {
+			t.Errorf("handler returned status %s, expected 404", resp.Result().Status)
+		}
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		mux := http.NewServeMux()
+		if err := icchttp.HandleRoot(mux, "redirect", nil); err != nil {
+			t.Fatalf("HandleRoot: %v", err)
+		}
+		resp := httptest.NewRecorder()
+
+		mux.ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+
+		if resp.Result().StatusCode != 302 {
+			t.Fatalf("handler returned status %s, expected 302", resp.Result().Status)
+		}
+
+		if got := resp.Header().Get("Location"); !strings.HasSuffix(got, "/system/icc/health") {
+			t.Errorf("handler redirected to %s", got)
+		}
+	})
+
+	t.Run("unknown behavior", func(t *testing.T) {
+		if err := icchttp.HandleRoot(http.NewServeMux(), "foo", nil); err == nil {
+			t.Errorf("HandleRoot did not return an error")
+		}
+	})
+}
+
+func TestMethodMiddleware(t *testing.T) {
+	var called bool
+	handler := icchttp.MethodMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}), http.MethodGet, http.MethodHead)
+
+	t.Run("allowed", func(t *testing.T) {
+		called = false
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest("HEAD", "/", nil))
+
+		if !called {
+			t.Errorf("next handler was not called")
+		}
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		called = false
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest("DELETE", "/", nil))
+
+		if called {
+			t.Errorf("next handler was called")
+		}
+
+		if resp.Result().StatusCode != 405 {
+			t.Errorf("handler returned status %s, expected 405", resp.Result().Status)
+		}
+
+		if got := resp.Header().Get("Allow"); got != "GET, HEAD" {
+			t.Errorf("Allow header is `%s`, expected `GET, HEAD`", got)
+		}
+	})
+}
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	var called bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	keys := icchttp.ParseAPIKeys("first, second")
+	handler := icchttp.APIKeyMiddleware(next, keys, "/send")
+
+	for _, tt := range []struct {
+		name    string
+		handler http.Handler
+		path    string
+		key     string
+		status  int
+	}{
+		{"valid key", handler, "/send", "second", 200},
+		{"invalid key", handler, "/send", "third", 401},
+		{"without key", handler, "/send", "", 401},
+		{"other path", handler, "/receive", "", 200},
+		{"disabled", icchttp.APIKeyMiddleware(next, icchttp.ParseAPIKeys(""), "/send"), "/send", "", 200},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			called = false
+			req := httptest.NewRequest("POST", tt.path, nil)
+			if tt.key != "" {
+				req.Header.Set(icchttp.APIKeyHeader, tt.key)
+			}
+			resp := httptest.NewRecorder()
+
+			tt.handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.status {
+				t.Errorf("got status %d, expected %d", resp.Code, tt.status)
+			}
+
+			if called != (tt.status == 200) {
+				t.Errorf("next handler called: %t, expected %t", called, tt.status == 200)
+			}
+		})
+	}
+}
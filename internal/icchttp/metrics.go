@@ -0,0 +1,117 @@
+package icchttp
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// metricsMeetingNone is the meeting label of connections without a
+	// meeting.
+	metricsMeetingNone = "none"
+
+	// metricsMeetingOther is the meeting label of connections to meetings
+	// over the limit of HandleMetrics.
+	metricsMeetingOther = "other"
+)
+
+// HandleMetrics registers the metrics route. It only accepts GET requests with
+// the admin token.
+//
+// The response uses the prometheus text format. The gauge
+// icc_active_connections counts the active streaming connections of the
+// registry with the labels path and meeting.
+//
+// To limit the number of label values, only the maxMeetings meetings with the
+// most connections get their own meeting label. The connections of all other
+// meetings have the label `meeting="other"`. Connections without a meeting
+// have the label `meeting="none"`.
+func HandleMetrics(mux *http.ServeMux, reg *Registry, adminToken string, maxMeetings int) {
+	url := Path + "/metrics"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		fmt.Fprintln(w, "# HELP icc_active_connections Number of active streaming connections.")
+		fmt.Fprintln(w, "# TYPE icc_active_connections gauge")
+		for _, g := range connectionGauges(reg.Connections(), maxMeetings) {
+			fmt.Fprintf(w, "icc_active_connections{path=%s,meeting=%s} %d\n", metricsLabel(g.path), metricsLabel(g.meeting), g.value)
+		}
+	})
+
+	mux.Handle(
+		url,
+		MethodMiddleware(AdminMiddleware(handler, adminToken), http.MethodGet),
+	)
+}
+
+type connectionGauge struct {
+	path    string
+	meeting string
+	value   int
+}
+
+// connectionGauges counts the connections by path and meeting. The result is
+// ordered by path and meeting.
+func connectionGauges(connections []Connection, maxMeetings int) []connectionGauge {
+	perMeeting := make(map[int]int)
+	for _, conn := range connections {
+		if conn.MeetingID != 0 {
+			perMeeting[conn.MeetingID]++
+		}
+	}
+
+	meetingIDs := make([]int, 0, len(perMeeting))
+	for meetingID := range perMeeting {
+		meetingIDs = append(meetingIDs, meetingID)
+	}
+	sort.Slice(meetingIDs, func(i, j int) bool {
+		if perMeeting[meetingIDs[i]] != perMeeting[meetingIDs[j]] {
+			return perMeeting[meetingIDs[i]] > perMeeting[meetingIDs[j]]
+		}
+		return meetingIDs[i] < meetingIDs[j]
+	})
+
+	labeled := make(map[int]bool)
+	for i, meetingID := range meetingIDs {
+		if i >= maxMeetings {
+			break
+		}
+		labeled[meetingID] = true
+	}
+
+	type key struct {
+		path    string
+		meeting string
+	}
+	counts := make(map[key]int)
+	for _, conn := range connections {
+		meeting := metricsMeetingNone
+		if conn.MeetingID != 0 {
+			meeting = metricsMeetingOther
+			if labeled[conn.MeetingID] {
+				meeting = strconv.Itoa(conn.MeetingID)
+			}
+		}
+		counts[key{conn.Path, meeting}]++
+	}
+
+	gauges := make([]connectionGauge, 0, len(counts))
+	for k, v := range counts {
+		gauges = append(gauges, connectionGauge{path: k.path, meeting: k.meeting, value: v})
+	}
+	sort.Slice(gauges, func(i, j int) bool {
+		if gauges[i].path != gauges[j].path {
+			return gauges[i].path < gauges[j].path
+		}
+		return gauges[i].meeting < gauges[j].meeting
+	})
+	return gauges
+}
+
+// metricsLabel returns the quoted label value for the prometheus text format.
+func metricsLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
@@ -0,0 +1,128 @@
+package icchttp_test
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/icchttp"
+)
+
+func TestHandleMetrics(t *testing.T) {
+	registry := new(icchttp.Registry)
+
+	mux := http.NewServeMux()
+	icchttp.HandleMetrics(mux, registry, "secret", 2)
+	stream := func(w http.ResponseWriter, r *http.Request) {
+		meetingID, _ := strconv.Atoi(r.URL.Query().Get("meeting_id"))
+		icchttp.DescribeConnection(r.Context(), 5, meetingID, "")
+		io.WriteString(w, "connected\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}
+	mux.HandleFunc("/stream", stream)
+	mux.HandleFunc("/other", stream)
+
+	// The streams are closed by t.Cleanup, which runs after this function. So
+	// the server has to be closed by t.Cleanup, too.
+	srv := httptest.NewServer(registry.Middleware(mux, "/stream", "/other"))
+	t.Cleanup(srv.Close)
+
+	connect := func(t *testing.T, path string) *http.Response {
+		t.Helper()
+
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("open stream: %v", err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+
+		if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+			t.Fatalf("reading from stream: %v", err)
+		}
+		return resp
+	}
+
+	metrics := func(t *testing.T) string {
+		t.Helper()
+
+		req, _ := http.NewRequest("GET", srv.URL+"/system/icc/metrics", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("sending request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			t.Fatalf("metrics returned status %s", resp.Status)
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("reading metrics: %v", err)
+		}
+		return string(body)
+	}
+
+	connect(t, "/stream?meeting_id=1")
+	connect(t, "/stream?meeting_id=1")
+	connect(t, "/other?meeting_id=1")
+	meeting2 := connect(t, "/stream?meeting_id=2")
+	connect(t, "/stream?meeting_id=3")
+	connect(t, "/stream")
+
+	t.Run("labeled gauges", func(t *testing.T) {
+		// Meeting 1 has the most connections. Meeting 2 and 3 have the same
+		// number, so the lower id gets the second label.
+		expect := `# HELP icc_active_connections Number of active streaming connections.
+# TYPE icc_active_connections gauge
+icc_active_connections{path="/other",meeting="1"} 1
+icc_active_connections{path="/stream",meeting="1"} 2
+icc_active_connections{path="/stream",meeting="2"} 1
+icc_active_connections{path="/stream",meeting="none"} 1
+icc_active_connections{path="/stream",meeting="other"} 1
+`
+
+		if got := metrics(t); got != expect {
+			t.Errorf("got metrics\n%s\nexpected\n%s", got, expect)
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		meeting2.Body.Close()
+
+		// Meeting 3 gets the label of meeting 2.
+		expect := `# HELP icc_active_connections Number of active streaming connections.
+# TYPE icc_active_connections gauge
+icc_active_connections{path="/other",meeting="1"} 1
+icc_active_connections{path="/stream",meeting="1"} 2
+icc_active_connections{path="/stream",meeting="3"} 1
+icc_active_connections{path="/stream",meeting="none"} 1
+`
+
+		var got string
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+			if got = metrics(t); got == expect {
+				return
+			}
+		}
+		t.Errorf("got metrics\n%s\nexpected\n%s", got, expect)
+	})
+
+	t.Run("without token", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/system/icc/metrics")
+		if err != nil {
+			t.Fatalf("sending request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != 401 {
+			t.Errorf("metrics returned status %s, expected 401", resp.Status)
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package icchttp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
+)
+
+// Registry holds the active streaming connections, so they can be listed and
+// closed by an admin.
+//
+// The zero value is ready to use.
+type Registry struct {
+	mu          sync.Mutex
+	lastID      uint64
+	connections map[string]*registeredConnection
+}
+
+// Connection describes an active streaming connection.
+type Connection struct {
+	ID        string        `json:"id"`
+	Path      string        `json:"path"`
+	UserID    int           `json:"user_id"`
+	MeetingID int           `json:"meeting_id,omitempty"`
+	ChannelID string        `json:"channel_id,omitempty"`
+	Age       time.Duration `json:"-"`
+}
+
+type registeredConnection struct {
+	registry *Registry
+	info     Connection
+	started  time.Time
+	cancel   context.CancelFunc
+}
+
+type registryContextKey struct{}
+
+// Middleware registers each request to one of the given paths for the time it
+// is handled by next. All other requests are passed to next without
+// registration.
+func (reg *Registry) Middleware(next http.Handler, paths ...string) http.Handler {
+	registered := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		registered[p] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !registered[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		conn := reg.add(r.URL.Path, cancel)
+		defer reg.remove(conn.info.ID)
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, registryContextKey{}, conn)))
+	})
+}
+
+// DescribeConnection sets the user, the meeting and the channel of a
+// registered connection. It does nothing, if the connection of the context is
+// not registered.
+func DescribeConnection(ctx context.Context, uid, meetingID int, channelID string) {
+	conn, ok := ctx.Value(registryContextKey{}).(*registeredConnection)
+	if !ok {
+		return
+	}
+
+	conn.registry.mu.Lock()
+	defer conn.registry.mu.Unlock()
+
+	conn.info.UserID = uid
+	conn.info.MeetingID = meetingID
+	conn.info.ChannelID = channelID
+}
+
+// ConnectionID returns the id of the registered connection of the context. It
+// returns an empty string, if the connection is not registered.
+func ConnectionID(ctx context.Context) string {
+	conn, ok := ctx.Value(registryContextKey{}).(*registeredConnection)
+	if !ok {
+		return ""
+	}
+	return conn.info.ID
+}
+
+// Connections returns all active connections ordered by their id.
+func (reg *Registry) Connections() []Connection {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	connections := make([]Connection, 0, len(reg.connections))
+	for _, conn := range reg.connections {
+		info := conn.info
+		info.Age = time.Since(conn.started)
+		connections = append(connections, info)
+	}
+
+	sort.Slice(connections, func(i, j int) bool {
+		a, _ := strconv.ParseUint(connections[i].ID, 10, 64)
+		b, _ := strconv.ParseUint(connections[j].ID, 10, 64)
+		return a < b
+	})
+	return connections
+}
+
+// Close closes the connection with the given id. Returns false, if there is no
+// connection with the id.
+func (reg *Registry) Close(id string) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	conn, ok := reg.connections[id]
+	if !ok {
+		return false
+	}
+
+	conn.cancel()
+	return true
+}
+
+func (reg *Registry) add(path string, cancel context.CancelFunc) *registeredConnection {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if reg.connections == nil {
+		reg.connections = make(map[string]*registeredConnection)
+	}
+
+	reg.lastID++
+	conn := registeredConnection{
+		registry: reg,
+		info:     Connection{ID: strconv.FormatUint(reg.lastID, 10), Path: path},
+		started:  time.Now(),
+		cancel:   cancel,
+	}
+	reg.connections[conn.info.ID] = &conn
+	return &conn
+}
+
+func (reg *Registry) remove(id string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	delete(reg.connections, id)
+}
+
+// HandleConnections registers the connections routes. They only accept
+// requests with the admin token.
+//
+// GET /system/icc/connections lists the active connections. DELETE
+// /system/icc/connections/ID closes one of them.
+func HandleConnections(mux *http.ServeMux, reg *Registry, adminToken string) {
+	url := Path + "/connections"
+
+	list := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		type connectionAge struct {
+			Connection
+			AgeSeconds int64 `json:"age_seconds"`
+		}
+
+		connections := reg.Connections()
+		response := struct {
+			Connections []connectionAge `json:"connections"`
+		}{make([]connectionAge, len(connections))}
+
+		for i, conn := range connections {
+			response.Connections[i] = connectionAge{conn, int64(conn.Age / time.Second)}
+		}
+
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			Error(w, fmt.Errorf("encoding connections: %w", err))
+			return
+		}
+	})
+
+	closeConn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id := strings.TrimPrefix(r.URL.Path, url+"/")
+		if !reg.Close(id) {
+			Error(w, iccerror.NewMessageError(iccerror.ErrNotFound, "There is no connection with id `%s`.", id))
+			return
+		}
+
+		icclog.Info("Connection %s closed by admin", id)
+		fmt.Fprintln(w, `{"closed": true}`)
+	})
+
+	mux.Handle(
+		url,
+		MethodMiddleware(AdminMiddleware(list, adminToken), http.MethodGet),
+	)
+	mux.Handle(
+		url+"/",
+		MethodMiddleware(AdminMiddleware(closeConn, adminToken), http.MethodDelete),
+	)
+}
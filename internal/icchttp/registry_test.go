@@ -0,0 +1,132 @@
+package icchttp_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/icchttp"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := new(icchttp.Registry)
+
+	mux := http.NewServeMux()
+	icchttp.HandleConnections(mux, registry, "secret")
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		icchttp.DescribeConnection(r.Context(), 5, 0, "host:5:1")
+		fmt.Fprintln(w, "connected")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+
+	srv := httptest.NewServer(registry.Middleware(mux, "/stream"))
+	defer srv.Close()
+
+	stream, err := http.Get(srv.URL + "/stream")
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	defer stream.Body.Close()
+	streamReader := bufio.NewReader(stream.Body)
+
+	if _, err := streamReader.ReadString('\n'); err != nil {
+		t.Fatalf("reading from stream: %v", err)
+	}
+
+	adminRequest := func(t *testing.T, method, path string) *http.Response {
+		t.Helper()
+
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("sending request: %v", err)
+		}
+		return resp
+	}
+
+	t.Run("list without token", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/system/icc/connections")
+		if err != nil {
+			t.Fatalf("sending request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != 401 {
+			t.Errorf("list returned status %s, expected 401", resp.Status)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		resp := adminRequest(t, "GET", "/system/icc/connections")
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			t.Fatalf("list returned status %s", resp.Status)
+		}
+
+		var got struct {
+			Connections []struct {
+				ID        string `json:"id"`
+				Path      string `json:"path"`
+				UserID    int    `json:"user_id"`
+				ChannelID string `json:"channel_id"`
+			} `json:"connections"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+
+		if len(got.Connections) != 1 {
+			t.Fatalf("got %d connections, expected 1", len(got.Connections))
+		}
+
+		conn := got.Connections[0]
+		if conn.ID != "1" || conn.Path != "/stream" || conn.UserID != 5 || conn.ChannelID != "host:5:1" {
+			t.Errorf("got connection %v, expected id 1 on /stream from user 5 with channel host:5:1", conn)
+		}
+	})
+
+	t.Run("close unknown", func(t *testing.T) {
+		resp := adminRequest(t, "DELETE", "/system/icc/connections/404")
+		resp.Body.Close()
+
+		if resp.StatusCode != 404 {
+			t.Errorf("close returned status %s, expected 404", resp.Status)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		resp := adminRequest(t, "DELETE", "/system/icc/connections/1")
+		resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			t.Fatalf("close returned status %s", resp.Status)
+		}
+
+		closed := make(chan error, 1)
+		go func() {
+			_, err := streamReader.ReadString('\n')
+			closed <- err
+		}()
+
+		select {
+		case err := <-closed:
+			if err != io.EOF {
+				t.Errorf("reading from closed stream returned %v, expected EOF", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("stream was not closed")
+		}
+
+		if got := registry.Connections(); len(got) != 0 {
+			t.Errorf("got connections %v after close, expected none", got)
+		}
+	})
+}
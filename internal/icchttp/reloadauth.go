@@ -0,0 +1,225 @@
+package icchttp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
+)
+
+// ReloadAuth is an Authenticater that can be replaced while the service is
+// running.
+//
+// Requests that were authenticated before a reload keep their context. So open
+// connections are not closed.
+//
+// Each Authenticater gets its own context from the build function. It is
+// canceled, after the Authenticater was replaced and the last request, that
+// it authenticated, is done. So its background goroutines can stop.
+//
+// Has to be created with icchttp.NewReloadAuth().
+type ReloadAuth struct {
+	ctx   context.Context
+	build func(ctx context.Context) (Authenticater, error)
+
+	mu   sync.RWMutex
+	auth *authGeneration
+}
+
+// NewReloadAuth initializes a ReloadAuth. The build function is called
+// directly and on each reload. The contexts for the build function are
+// derived from ctx.
+func NewReloadAuth(ctx context.Context, build func(ctx context.Context) (Authenticater, error)) (*ReloadAuth, error) {
+	a := &ReloadAuth{ctx: ctx, build: build}
+
+	auth, err := a.buildGeneration()
+	if err != nil {
+		return nil, fmt.Errorf("building auth: %w", err)
+	}
+
+	a.auth = auth
+	return a, nil
+}
+
+// StartReloadAuth is like NewReloadAuth, but does not fail, if the build
+// function returns an error.
+//
+// Until the build function succeeds, all authenticated requests are refused
+// with ErrUnavailable. The build function is retried every `retry` in the
+// background until it succeeds or the context is done.
+func StartReloadAuth(ctx context.Context, build func(ctx context.Context) (Authenticater, error), retry time.Duration, errHandler func(error)) *ReloadAuth {
+	a, err := NewReloadAuth(ctx, build)
+	if err == nil {
+		return a
+	}
+
+	errHandler(fmt.Errorf("starting without auth: %w", err))
+	a = &ReloadAuth{ctx: ctx, build: build, auth: &authGeneration{auth: unavailableAuth{}, cancel: func() {}}}
+	go a.retry(ctx, retry, errHandler)
+	return a
+}
+
+// retry calls Reload until it succeeds.
+func (a *ReloadAuth) retry(ctx context.Context, interval time.Duration, errHandler func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, ok := a.current().auth.(unavailableAuth); !ok {
+			// Auth was reloaded in another way.
+			return
+		}
+
+		if err := a.Reload(); err != nil {
+			errHandler(fmt.Errorf("retry building auth: %w", err))
+			continue
+		}
+
+		icclog.Info("Auth is available")
+		return
+	}
+}
+
+// Reload builds a new Authenticater and uses it for all following requests.
+//
+// If the build function fails, the old Authenticater is kept.
+func (a *ReloadAuth) Reload() error {
+	auth, err := a.buildGeneration()
+	if err != nil {
+		return fmt.Errorf("building auth: %w", err)
+	}
+
+	a.mu.Lock()
+	old := a.auth
+	a.auth = auth
+	a.mu.Unlock()
+
+	old.retire()
+	return nil
+}
+
+// buildGeneration calls the build function with a new context.
+func (a *ReloadAuth) buildGeneration() (*authGeneration, error) {
+	ctx, cancel := context.WithCancel(a.ctx)
+	auth, err := a.build(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &authGeneration{auth: auth, cancel: cancel}, nil
+}
+
+func (a *ReloadAuth) current() *authGeneration {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.auth
+}
+
+// Authenticate calls Authenticate on the current Authenticater.
+func (a *ReloadAuth) Authenticate(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	// The generation is entered with the lock, so it is not retired before.
+	a.mu.RLock()
+	auth := a.auth
+	auth.enter()
+	a.mu.RUnlock()
+
+	ctx, err := auth.auth.Authenticate(w, r)
+	if err != nil {
+		auth.leave()
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		auth.leave()
+	}()
+	return ctx, nil
+}
+
+// FromContext calls FromContext on the current Authenticater.
+func (a *ReloadAuth) FromContext(ctx context.Context) int {
+	return a.current().auth.FromContext(ctx)
+}
+
+// authGeneration is an Authenticater of ReloadAuth with the number of its
+// requests, that are not done.
+type authGeneration struct {
+	auth   Authenticater
+	cancel func()
+
+	mu      sync.Mutex
+	active  int
+	retired bool
+}
+
+func (g *authGeneration) enter() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active++
+}
+
+func (g *authGeneration) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.active--
+	if g.retired && g.active == 0 {
+		g.cancel()
+	}
+}
+
+// retire marks the generation as replaced. Its context is canceled, when it
+// has no active requests.
+func (g *authGeneration) retire() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.retired = true
+	if g.active == 0 {
+		g.cancel()
+	}
+}
+
+// unavailableAuth is used by ReloadAuth, until the Authenticater could be
+// build.
+type unavailableAuth struct{}
+
+func (unavailableAuth) Authenticate(http.ResponseWriter, *http.Request) (context.Context, error) {
+	return nil, iccerror.NewMessageError(iccerror.ErrUnavailable, "The auth service is not available at the moment.")
+}
+
+func (unavailableAuth) FromContext(context.Context) int {
+	return 0
+}
+
+// HandleReloadAuth registers the route to reload the auth service. It only
+// accepts POST requests with the admin token.
+func HandleReloadAuth(mux *http.ServeMux, a *ReloadAuth, adminToken string) {
+	url := Path + "/auth/reload"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := a.Reload(); err != nil {
+			Error(w, fmt.Errorf("reloading auth: %w", err))
+			return
+		}
+
+		icclog.Info("Auth reloaded")
+		fmt.Fprintln(w, `{"reloaded": true}`)
+	})
+
+	mux.Handle(
+		url,
+		MethodMiddleware(AdminMiddleware(handler, adminToken), http.MethodPost),
+	)
+}
@@ -0,0 +1,196 @@
+package icchttp_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/auth"
+	"github.com/OpenSlides/openslides-icc-service/internal/icchttp"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// signedRequest returns a request with a token and cookie for user 1 signed
+// with the given key.
+func signedRequest(t *testing.T, key string) *http.Request {
+	t.Helper()
+
+	cookie, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sessionId": "session1",
+	}).SignedString([]byte(key))
+	if err != nil {
+		t.Fatalf("signing cookie: %v", err)
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"userId":    1,
+		"sessionId": "session1",
+	}).SignedString([]byte(key))
+	if err != nil {
+		t.Fatalf("signing token: %v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Cookie", "refreshId="+cookie)
+	r.Header.Set("Authentication", "bearer "+token)
+	return r
+}
+
+func TestReloadAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := "old-key"
+	reloadAuth, err := icchttp.NewReloadAuth(ctx, func(authCtx context.Context) (icchttp.Authenticater, error) {
+		return auth.New("", authCtx.Done(), []byte(key), []byte(key))
+	})
+	if err != nil {
+		t.Fatalf("NewReloadAuth: %v", err)
+	}
+
+	oldCtx, err := reloadAuth.Authenticate(httptest.NewRecorder(), signedRequest(t, "old-key"))
+	if err != nil {
+		t.Fatalf("Authenticate with old key before reload: %v", err)
+	}
+
+	key = "new-key"
+	mux := http.NewServeMux()
+	icchttp.HandleReloadAuth(mux, reloadAuth, "admin")
+
+	req := httptest.NewRequest("POST", "/system/icc/auth/reload", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+
+	if resp.Result().StatusCode != 200 {
+		t.Fatalf("reload returned status %s: %s", resp.Result().Status, resp.Body.String())
+	}
+
+	t.Run("new key", func(t *testing.T) {
+		ctx, err := reloadAuth.Authenticate(httptest.NewRecorder(), signedRequest(t, "new-key"))
+		if err != nil {
+			t.Fatalf("Authenticate: %v", err)
+		}
+
+		if uid := reloadAuth.FromContext(ctx); uid != 1 {
+			t.Errorf("FromContext() returned %d, expected 1", uid)
+		}
+	})
+
+	t.Run("old key", func(t *testing.T) {
+		if _, err := reloadAuth.Authenticate(httptest.NewRecorder(), signedRequest(t, "old-key")); err == nil {
+			t.Errorf("Authenticate with old key did not return an error")
+		}
+	})
+
+	t.Run("old connection", func(t *testing.T) {
+		if oldCtx.Err() != nil {
+			t.Errorf("context of old connection was canceled")
+		}
+
+		if uid := reloadAuth.FromContext(oldCtx); uid != 1 {
+			t.Errorf("FromContext() for old connection returned %d, expected 1", uid)
+		}
+	})
+}
+
+func TestReloadAuthRetire(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var buildCtxs []context.Context
+	reloadAuth, err := icchttp.NewReloadAuth(ctx, func(authCtx context.Context) (icchttp.Authenticater, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		buildCtxs = append(buildCtxs, authCtx)
+		return auth.New("", authCtx.Done(), []byte("key"), []byte("key"))
+	})
+	if err != nil {
+		t.Fatalf("NewReloadAuth: %v", err)
+	}
+
+	reqCtx, reqCancel := context.WithCancel(ctx)
+	defer reqCancel()
+
+	connCtx, err := reloadAuth.Authenticate(httptest.NewRecorder(), signedRequest(t, "key").WithContext(reqCtx))
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+
+	if err := reloadAuth.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	mu.Lock()
+	oldCtx, newCtx := buildCtxs[0], buildCtxs[1]
+	mu.Unlock()
+
+	t.Run("open connection", func(t *testing.T) {
+		if oldCtx.Err() != nil {
+			t.Errorf("context of the old auth was canceled with an open connection")
+		}
+
+		if connCtx.Err() != nil {
+			t.Errorf("context of the connection was canceled")
+		}
+	})
+
+	t.Run("closed connection", func(t *testing.T) {
+		reqCancel()
+
+		select {
+		case <-oldCtx.Done():
+		case <-time.After(time.Second):
+			t.Errorf("context of the old auth was not canceled after the last connection")
+		}
+
+		if newCtx.Err() != nil {
+			t.Errorf("context of the new auth was canceled")
+		}
+	})
+}
+
+func TestStartReloadAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	available := false
+	reloadAuth := icchttp.StartReloadAuth(ctx, func(authCtx context.Context) (icchttp.Authenticater, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !available {
+			return nil, errors.New("auth is down")
+		}
+		return auth.New("", authCtx.Done(), []byte("key"), []byte("key"))
+	}, 10*time.Millisecond, func(error) {})
+
+	handler := icchttp.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), reloadAuth)
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, signedRequest(t, "key"))
+	if resp.Code != 503 {
+		t.Fatalf("got status %d while auth is down, expected 503", resp.Code)
+	}
+
+	mu.Lock()
+	available = true
+	mu.Unlock()
+
+	for i := 0; i < 100; i++ {
+		resp = httptest.NewRecorder()
+		handler.ServeHTTP(resp, signedRequest(t, "key"))
+		if resp.Code == 200 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("got status %d after auth is available, expected 200", resp.Code)
+}
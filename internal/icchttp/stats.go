@@ -0,0 +1,114 @@
+package icchttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+)
+
+// StatsBackend returns the size of the data in the backend.
+type StatsBackend interface {
+	// StreamLen returns the number of notify messages in the stream.
+	StreamLen() (int, error)
+
+	// ApplauseSize returns the number of users with applause in a meeting.
+	ApplauseSize(meetingID int) (int, error)
+}
+
+// CursorBackend is a StatsBackend that knows, how far the receiver of the
+// notify stream is behind.
+type CursorBackend interface {
+	// LastID returns the id of the newest message in the stream.
+	LastID() (string, error)
+
+	// Cursor returns the id of the last received message.
+	Cursor() string
+
+	// StreamLag returns the number of messages, that were not received yet.
+	StreamLag() (int, error)
+}
+
+// HandleStats registers the stats route. It only accepts GET requests with the
+// admin token.
+//
+// The response contains the length of the notify stream. With the query
+// argument `meeting_id`, that can be given more then once, it also contains
+// the size of the applause of each meeting.
+//
+// If the backend is a CursorBackend, the response also contains the newest id
+// of the stream, the id of the last received message and the number of
+// messages between them.
+func HandleStats(mux *http.ServeMux, backend StatsBackend, adminToken string) {
+	url := Path + "/stats"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var meetingIDs []int
+		for _, raw := range r.URL.Query()["meeting_id"] {
+			meetingID, err := strconv.Atoi(raw)
+			if err != nil {
+				Error(w, iccerror.NewMessageError(iccerror.ErrInvalid, "Query argument meeting_id has to be a number, not `%s`.", raw))
+				return
+			}
+			meetingIDs = append(meetingIDs, meetingID)
+		}
+
+		streamLen, err := backend.StreamLen()
+		if err != nil {
+			Error(w, fmt.Errorf("getting stream length: %w", err))
+			return
+		}
+
+		response := struct {
+			StreamLength int            `json:"stream_length"`
+			StreamLastID string         `json:"stream_last_id,omitempty"`
+			StreamCursor string         `json:"stream_cursor,omitempty"`
+			StreamLag    *int           `json:"stream_lag,omitempty"`
+			ApplauseSize map[string]int `json:"applause_size,omitempty"`
+		}{StreamLength: streamLen}
+
+		if cursorBackend, ok := backend.(CursorBackend); ok {
+			lastID, err := cursorBackend.LastID()
+			if err != nil {
+				Error(w, fmt.Errorf("getting last stream id: %w", err))
+				return
+			}
+
+			lag, err := cursorBackend.StreamLag()
+			if err != nil {
+				Error(w, fmt.Errorf("getting stream lag: %w", err))
+				return
+			}
+
+			response.StreamLastID = lastID
+			response.StreamCursor = cursorBackend.Cursor()
+			response.StreamLag = &lag
+		}
+
+		if len(meetingIDs) > 0 {
+			response.ApplauseSize = make(map[string]int, len(meetingIDs))
+		}
+
+		for _, meetingID := range meetingIDs {
+			size, err := backend.ApplauseSize(meetingID)
+			if err != nil {
+				Error(w, fmt.Errorf("getting applause size of meeting %d: %w", meetingID, err))
+				return
+			}
+			response.ApplauseSize[strconv.Itoa(meetingID)] = size
+		}
+
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			Error(w, fmt.Errorf("encoding stats: %w", err))
+			return
+		}
+	})
+
+	mux.Handle(
+		url,
+		MethodMiddleware(AdminMiddleware(handler, adminToken), http.MethodGet),
+	)
+}
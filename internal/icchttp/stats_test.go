@@ -0,0 +1,93 @@
+package icchttp_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/icchttp"
+	"github.com/OpenSlides/openslides-icc-service/internal/icctest"
+)
+
+func TestStats(t *testing.T) {
+	backend := icctest.NewRecordingBackend()
+	for _, m := range []string{"first", "second", "third"} {
+		backend.NotifyPublish([]byte(m))
+	}
+	backend.ScriptApplause(map[int]int{5: 2})
+
+	mux := http.NewServeMux()
+	icchttp.HandleStats(mux, backend, "secret")
+
+	for _, tt := range []struct {
+		name   string
+		query  string
+		token  string
+		status int
+		expect string
+	}{
+		{"without token", "", "", 401, ""},
+		{"stream length", "", "secret", 200, `{"stream_length":3}`},
+		{"applause size", "?meeting_id=5&meeting_id=6", "secret", 200, `{"stream_length":3,"applause_size":{"5":2,"6":0}}`},
+		{"invalid meeting", "?meeting_id=five", "secret", 400, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/system/icc/stats"+tt.query, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp := httptest.NewRecorder()
+
+			mux.ServeHTTP(resp, req)
+
+			if resp.Code != tt.status {
+				t.Fatalf("got status %d, expected %d", resp.Code, tt.status)
+			}
+
+			if tt.expect == "" {
+				return
+			}
+
+			if got := strings.TrimSpace(resp.Body.String()); got != tt.expect {
+				t.Errorf("got %s, expected %s", got, tt.expect)
+			}
+		})
+	}
+}
+
+type cursorBackend struct {
+	*icctest.RecordingBackend
+}
+
+func (cursorBackend) LastID() (string, error) {
+	return "5-0", nil
+}
+
+func (cursorBackend) Cursor() string {
+	return "3-0"
+}
+
+func (cursorBackend) StreamLag() (int, error) {
+	return 2, nil
+}
+
+func TestStatsCursor(t *testing.T) {
+	mux := http.NewServeMux()
+	icchttp.HandleStats(mux, cursorBackend{icctest.NewRecordingBackend()}, "secret")
+
+	req := httptest.NewRequest("GET", "/system/icc/stats", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp := httptest.NewRecorder()
+
+	mux.ServeHTTP(resp, req)
+
+	if resp.Code != 200 {
+		t.Fatalf("got status %d, expected 200", resp.Code)
+	}
+
+	expect := `{"stream_length":0,"stream_last_id":"5-0","stream_cursor":"3-0","stream_lag":2}`
+	if got := strings.TrimSpace(resp.Body.String()); got != expect {
+		t.Errorf("got %s, expected %s", got, expect)
+	}
+}
@@ -0,0 +1,287 @@
+package icctest
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operation is a call to a write method of the RecordingBackend.
+type Operation struct {
+	Method string
+	Args   []interface{}
+}
+
+// RecordingBackend implements the backends of the notify and the applause
+// service.
+//
+// It records each call to a write method. The read methods return the data,
+// that was set with ScriptNotify() and ScriptApplause().
+//
+// Has to be created with NewRecordingBackend().
+type RecordingBackend struct {
+	mu         sync.Mutex
+	operations []Operation
+	applause   map[int]int
+	retained   map[int]map[string][]byte
+	inboxes    map[string][]inboxEntry
+	inboxID    int
+	marks      map[string]string
+
+	notifyScript chan []byte
+	ephemeral    chan []byte
+}
+
+// NewRecordingBackend initializes a RecordingBackend.
+func NewRecordingBackend() *RecordingBackend {
+	return &RecordingBackend{
+		applause:     make(map[int]int),
+		retained:     make(map[int]map[string][]byte),
+		inboxes:      make(map[string][]inboxEntry),
+		marks:        make(map[string]string),
+		notifyScript: make(chan []byte, 100),
+		ephemeral:    make(chan []byte, 100),
+	}
+}
+
+// ScriptNotify adds messages that are returned by NotifyReceive().
+func (b *RecordingBackend) ScriptNotify(messages ...[]byte) {
+	for _, m := range messages {
+		b.notifyScript <- m
+	}
+}
+
+// ScriptApplause sets the value that is returned by ApplauseSince() and
+// ApplauseCounters().
+func (b *RecordingBackend) ScriptApplause(applause map[int]int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.applause = applause
+}
+
+// Operations returns all recorded operations in the order they were called.
+func (b *RecordingBackend) Operations() []Operation {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out := make([]Operation, len(b.operations))
+	copy(out, b.operations)
+	return out
+}
+
+func (b *RecordingBackend) record(method string, args ...interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.operations = append(b.operations, Operation{Method: method, Args: args})
+}
+
+// NotifyPublish records the message.
+func (b *RecordingBackend) NotifyPublish(message []byte) error {
+	b.record("NotifyPublish", string(message))
+	return nil
+}
+
+// NotifyReceive returns the messages from ScriptNotify().
+func (b *RecordingBackend) NotifyReceive(ctx context.Context) ([]byte, error) {
+	select {
+	case m := <-b.notifyScript:
+		return m, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// NotifyPublishEphemeral records the message and returns it with the next call
+// of NotifyReceiveEphemeral().
+func (b *RecordingBackend) NotifyPublishEphemeral(message []byte) error {
+	b.record("NotifyPublishEphemeral", string(message))
+	b.ephemeral <- message
+	return nil
+}
+
+// NotifyReceiveEphemeral returns the messages from NotifyPublishEphemeral().
+func (b *RecordingBackend) NotifyReceiveEphemeral(ctx context.Context) ([]byte, error) {
+	select {
+	case m := <-b.ephemeral:
+		return m, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// NotifyRetain records the message and saves it as retained message. The ttl
+// is ignored.
+func (b *RecordingBackend) NotifyRetain(meetingID int, name string, message []byte, ttl time.Duration) error {
+	b.record("NotifyRetain", meetingID, name, string(message), ttl)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.retained[meetingID] == nil {
+		b.retained[meetingID] = make(map[string][]byte)
+	}
+	b.retained[meetingID][name] = message
+	return nil
+}
+
+// NotifyUnretain records the call and removes the retained message.
+func (b *RecordingBackend) NotifyUnretain(meetingID int, name string) error {
+	b.record("NotifyUnretain", meetingID, name)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.retained[meetingID], name)
+	return nil
+}
+
+// NotifyRetained returns the messages from NotifyRetain() for the meeting.
+func (b *RecordingBackend) NotifyRetained(meetingID int) ([][]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var out [][]byte
+	for _, m := range b.retained[meetingID] {
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+type inboxEntry struct {
+	id      int
+	message []byte
+}
+
+// InboxAdd records the message and adds it to the inboxes. Each inbox keeps
+// the newest `size` messages. The ttl is ignored.
+func (b *RecordingBackend) InboxAdd(keys []string, message []byte, size int, ttl time.Duration) error {
+	b.record("InboxAdd", keys, string(message), size, ttl)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, key := range keys {
+		b.inboxID++
+		inbox := append(b.inboxes[key], inboxEntry{id: b.inboxID, message: message})
+		if len(inbox) > size {
+			inbox = inbox[len(inbox)-size:]
+		}
+		b.inboxes[key] = inbox
+	}
+	return nil
+}
+
+// InboxSince returns the messages from InboxAdd() that are newer then lastID.
+//
+// The ids have the form `N-0` where N is increased with each added message.
+func (b *RecordingBackend) InboxSince(key string, lastID string) ([]string, [][]byte, error) {
+	last := 0
+	if lastID != "" {
+		var err error
+		last, err = strconv.Atoi(strings.SplitN(lastID, "-", 2)[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid id %s: %w", lastID, err)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var ids []string
+	var messages [][]byte
+	for _, e := range b.inboxes[key] {
+		if e.id > last {
+			ids = append(ids, fmt.Sprintf("%d-0", e.id))
+			messages = append(messages, e.message)
+		}
+	}
+	return ids, messages, nil
+}
+
+// NotifyPersist records the message.
+func (b *RecordingBackend) NotifyPersist(message []byte, senderUserID int, name string, maxLen int) error {
+	b.record("NotifyPersist", string(message), senderUserID, name, maxLen)
+	return nil
+}
+
+// IdempotencyMark records the key and saves the message id, if the key is
+// new. Otherwise, the first message id is returned. The ttl is ignored.
+func (b *RecordingBackend) IdempotencyMark(key string, messageID string, ttl time.Duration) (string, error) {
+	b.record("IdempotencyMark", key, messageID, ttl)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if firstID, ok := b.marks[key]; ok {
+		return firstID, nil
+	}
+	b.marks[key] = messageID
+	return messageID, nil
+}
+
+// IdempotencyUnmark records and removes the key.
+func (b *RecordingBackend) IdempotencyUnmark(key string) error {
+	b.record("IdempotencyUnmark", key)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.marks, key)
+	return nil
+}
+
+// ApplausePublish records the applause.
+func (b *RecordingBackend) ApplausePublish(meetingID, userID int, time int64) error {
+	b.record("ApplausePublish", meetingID, userID, time)
+	return nil
+}
+
+// ApplauseSince returns the value from ScriptApplause().
+func (b *RecordingBackend) ApplauseSince(time int64) (map[int]int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out := make(map[int]int, len(b.applause))
+	for k, v := range b.applause {
+		out[k] = v
+	}
+	return out, nil
+}
+
+// ApplauseCounters returns the value from ScriptApplause().
+func (b *RecordingBackend) ApplauseCounters(since int64) (map[int]int, error) {
+	return b.ApplauseSince(since)
+}
+
+// StreamLen returns the number of recorded NotifyPublish calls.
+func (b *RecordingBackend) StreamLen() (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var length int
+	for _, op := range b.operations {
+		if op.Method == "NotifyPublish" {
+			length++
+		}
+	}
+	return length, nil
+}
+
+// ApplauseSize returns the value for the meeting from ScriptApplause().
+func (b *RecordingBackend) ApplauseSize(meetingID int) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.applause[meetingID], nil
+}
+
+// ApplauseCleanOld records the call.
+func (b *RecordingBackend) ApplauseCleanOld(olderThen int64) error {
+	b.record("ApplauseCleanOld", olderThen)
+	return nil
+}
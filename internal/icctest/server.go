@@ -0,0 +1,42 @@
+package icctest
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
+	"github.com/OpenSlides/openslides-icc-service/internal/icchttp"
+	"github.com/OpenSlides/openslides-icc-service/internal/run"
+)
+
+// NewServer starts a httptest server with all routes of the service, like
+// run.Run builds them.
+//
+// Published notify messages are delivered back to the receive connections
+// like with redis. The environment is used like in run.Run. The server has to
+// be closed by the caller.
+func NewServer(ctx context.Context, backend *RecordingBackend, ds datastore.Getter, auth icchttp.Authenticater, environment ...string) (*httptest.Server, error) {
+	handler, err := run.Handler(ctx, environment, loopbackBackend{backend}, ds, auth)
+	if err != nil {
+		return nil, fmt.Errorf("building handler: %w", err)
+	}
+
+	return httptest.NewServer(handler), nil
+}
+
+// loopbackBackend is a RecordingBackend that returns each published message
+// with NotifyReceive.
+type loopbackBackend struct {
+	*RecordingBackend
+}
+
+// NotifyPublish records the message and scripts it for NotifyReceive.
+func (b loopbackBackend) NotifyPublish(message []byte) error {
+	if err := b.RecordingBackend.NotifyPublish(message); err != nil {
+		return err
+	}
+
+	b.ScriptNotify(message)
+	return nil
+}
@@ -0,0 +1,178 @@
+package icctest_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/dsmock"
+	"github.com/OpenSlides/openslides-icc-service/internal/icctest"
+)
+
+func TestServerNotify(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv, err := icctest.NewServer(ctx, icctest.NewRecordingBackend(), dsmock.Stub(nil), &icctest.AutherStub{UserID: 1})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer srv.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+"/system/icc/notify", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("receive request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	lines := bufio.NewScanner(resp.Body)
+	if !lines.Scan() {
+		t.Fatalf("receive did not send the channel id: %v", lines.Err())
+	}
+
+	var channel struct {
+		ChannelID string `json:"channel_id"`
+	}
+	if err := json.Unmarshal(lines.Bytes(), &channel); err != nil {
+		t.Fatalf("decoding channel id `%s`: %v", lines.Bytes(), err)
+	}
+
+	message := fmt.Sprintf(`{"channel_id":"%s","name":"greeting","to_users":[1],"message":"hello"}`, channel.ChannelID)
+	publishResp, err := http.Post(srv.URL+"/system/icc/notify/publish", "application/json", strings.NewReader(message))
+	if err != nil {
+		t.Fatalf("publish request: %v", err)
+	}
+	defer publishResp.Body.Close()
+
+	if publishResp.StatusCode != 200 {
+		t.Fatalf("publish returned status %s", publishResp.Status)
+	}
+
+	var published struct {
+		MessageIDs []string `json:"message_ids"`
+	}
+	if err := json.NewDecoder(publishResp.Body).Decode(&published); err != nil {
+		t.Fatalf("decoding publish response: %v", err)
+	}
+
+	if len(published.MessageIDs) != 1 {
+		t.Fatalf("publish returned %d message ids, expected 1", len(published.MessageIDs))
+	}
+
+	if !lines.Scan() {
+		t.Fatalf("receive did not send the message: %v", lines.Err())
+	}
+
+	var received struct {
+		PublishedAt int64 `json:"published_at"`
+	}
+	if err := json.Unmarshal(lines.Bytes(), &received); err != nil || received.PublishedAt == 0 {
+		t.Fatalf("message `%s` has no published_at: %v", lines.Text(), err)
+	}
+
+	expect := fmt.Sprintf(`{"sender_user_id":1,"sender_channel_id":"%s","name":"greeting","message":"hello","message_id":"%s","published_at":%d}`, channel.ChannelID, published.MessageIDs[0], received.PublishedAt)
+	if got := lines.Text(); got != expect {
+		t.Errorf("got `%s`, expected `%s`", got, expect)
+	}
+}
+
+func TestServerApplause(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.Stub(dsmock.YAMLData(`
+	meeting/1:
+		applause_enable: true
+		user_ids: [1]
+		present_user_ids: [1]
+	`))
+
+	backend := icctest.NewRecordingBackend()
+	srv, err := icctest.NewServer(ctx, backend, ds, &icctest.AutherStub{UserID: 1})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/system/icc/applause/send?meeting_id=1", "", nil)
+	if err != nil {
+		t.Fatalf("send request: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Fatalf("send returned status %s", resp.Status)
+	}
+
+	var sent bool
+	for _, op := range backend.Operations() {
+		if op.Method == "ApplausePublish" && op.Args[0] == 1 && op.Args[1] == 1 {
+			sent = true
+		}
+	}
+	if !sent {
+		t.Errorf("applause was not saved in the backend: %v", backend.Operations())
+	}
+
+	backend.ScriptApplause(map[int]int{1: 1})
+
+	resp, err = http.Get(srv.URL + "/system/icc/applause/count?meeting_id=1")
+	if err != nil {
+		t.Fatalf("count request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var got struct {
+		Level    int `json:"level"`
+		Presents int `json:"present_users"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("decoding count: %v", err)
+	}
+
+	if got.Level != 1 || got.Presents != 1 {
+		t.Errorf("got level %d with %d present users, expected 1 and 1", got.Level, got.Presents)
+	}
+}
+
+func TestServerPollDrain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv, err := icctest.NewServer(ctx, icctest.NewRecordingBackend(), dsmock.Stub(nil), &icctest.AutherStub{UserID: 1}, "ICC_ADMIN_TOKEN=secret", "ICC_NOTIFY_INBOX_SIZE=10")
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer srv.Close()
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", srv.URL+"/system/icc/drain", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	drainResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("drain request: %v", err)
+	}
+	drainResp.Body.Close()
+
+	if drainResp.StatusCode != 200 {
+		t.Fatalf("drain returned status %s", drainResp.Status)
+	}
+
+	resp, err := http.Get(srv.URL + "/system/icc/notify/poll?timeout_seconds=1")
+	if err != nil {
+		t.Fatalf("poll request: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 503 {
+		t.Errorf("poll in drain mode returned status %s, expected 503", resp.Status)
+	}
+}
@@ -0,0 +1,168 @@
+package notify
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+)
+
+// slowClientGrace is the time a client, that is too slow, has to receive the
+// error before its connection is closed.
+var slowClientGrace = time.Second
+
+// WithBufferSize limits the number of messages, that are queued for a receive
+// connection. If a client does not read its messages and the queue is full,
+// it gets the error ErrTooSlow and is disconnected.
+//
+// A size of 0 means, that there is no queue. The messages wait until the
+// client reads them.
+func WithBufferSize(size int) Option {
+	return func(n *Notify) {
+		n.bufferSize = size
+	}
+}
+
+// BufferSize returns the number of messages, that are queued for a receive
+// connection.
+func (n *Notify) BufferSize() int {
+	return n.bufferSize
+}
+
+// bufferedReceiver is a Receiver with a queue for each connection.
+type bufferedReceiver interface {
+	BufferSize() int
+}
+
+// bufferNext reads the messages from next in the background and queues up to
+// size of them.
+//
+// When the queue is full, the returned function returns ErrTooSlow and
+// tooSlow is called.
+//
+// The queued messages are counted in memory. When its limit is reached, the
+// connection with the most queued bytes is closed with ErrTooSlow. If this is
+// the connection itself, its oldest queued messages are dropped instead.
+// memory can be nil.
+func bufferNext(ctx context.Context, next NextMessage, size int, memory *memoryBudget, tooSlow func()) NextMessage {
+	type result struct {
+		message OutMessage
+		err     error
+	}
+
+	queue := make(chan result, size)
+
+	// overflow is closed, when the connection is too slow. errTooSlow is set
+	// before.
+	overflow := make(chan struct{})
+	var errTooSlow error
+	var overflowOnce sync.Once
+	setTooSlow := func(err error) {
+		overflowOnce.Do(func() {
+			errTooSlow = err
+			close(overflow)
+			tooSlow()
+		})
+	}
+
+	conn := memory.newConn(func() {
+		setTooSlow(iccerror.NewMessageError(iccerror.ErrTooSlow, "The buffered messages reached the memory limit."))
+	})
+	if conn != nil {
+		go func() {
+			<-ctx.Done()
+			conn.close()
+		}()
+	}
+
+	go func() {
+		for {
+			message, err := next(ctx)
+			if err != nil {
+				select {
+				case queue <- result{err: err}:
+				case <-ctx.Done():
+				}
+				return
+			}
+
+			select {
+			case <-overflow:
+				return
+			default:
+			}
+
+			if conn != nil {
+				conn.add(outMessageSize(message))
+				if !shedQueue(conn, func() (OutMessage, bool) {
+					select {
+					case r := <-queue:
+						return r.message, true
+					default:
+						return OutMessage{}, false
+					}
+				}) {
+					conn.release(outMessageSize(message))
+					memory.shed(1)
+					continue
+				}
+			}
+
+			select {
+			case queue <- result{message: message}:
+			default:
+				setTooSlow(iccerror.NewMessageError(iccerror.ErrTooSlow, "More then %d messages are waiting for the client.", size))
+				return
+			}
+		}
+	}()
+
+	return func(ctx context.Context) (OutMessage, error) {
+		select {
+		case <-overflow:
+			return OutMessage{}, errTooSlow
+		default:
+		}
+
+		select {
+		case r := <-queue:
+			if r.err == nil {
+				conn.release(outMessageSize(r.message))
+			}
+			return r.message, r.err
+		case <-overflow:
+			return OutMessage{}, errTooSlow
+		case <-ctx.Done():
+			return OutMessage{}, ctx.Err()
+		}
+	}
+}
+
+// shedQueue drops the oldest messages from a queue, while the limit is
+// reached and the connection has the most buffered bytes. oldest returns
+// false, if the queue is empty.
+//
+// Returns false, if the queue is empty and the limit is still reached.
+func shedQueue(conn *connMemory, oldest func() (OutMessage, bool)) bool {
+	var dropped int
+	defer func() {
+		if dropped > 0 {
+			conn.budget.shed(dropped)
+		}
+	}()
+
+	for conn.budget.full() {
+		if conn.reclaim() {
+			return true
+		}
+
+		message, ok := oldest()
+		if !ok {
+			return false
+		}
+		conn.release(outMessageSize(message))
+		dropped++
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// WithCanonicalJSON saves the field `message` of published messages in a
+// canonical form. The keys of all objects are sorted and numbers are kept as
+// they were sent.
+//
+// Insignificant whitespace is removed from all messages, also without this
+// option, since the json encoder compacts the field. If an object has the same
+// key more then once, only the last value is kept.
+//
+// With the default utf8 policy, a message with invalid UTF-8 is saved
+// unchanged, since decoding would replace the invalid bytes.
+func WithCanonicalJSON() Option {
+	return func(n *Notify) {
+		n.canonicalJSON = true
+	}
+}
+
+// canonicalize sorts the keys of all objects in the field `message`. It
+// returns the problems of a message, that can not be decoded.
+func (n *Notify) canonicalize(message *Message) []string {
+	if !n.canonicalJSON || isEmptyJSON(message.Message) {
+		return nil
+	}
+
+	if n.invalidUTF8 == utf8Keep && !utf8.Valid(message.Message) {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(message.Message))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return []string{fmt.Sprintf("field `message` is invalid json: %v", err)}
+	}
+
+	// The json encoder sorts the keys of maps.
+	canonical, err := marshalJSON(value)
+	if err != nil {
+		return []string{fmt.Sprintf("field `message` can not be encoded: %v", err)}
+	}
+
+	message.Message = canonical
+	return nil
+}
+
+// marshalJSON encodes the value like json.Marshal, but does not escape the
+// characters `<`, `>` and `&`.
+func marshalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -35,8 +35,9 @@ type cIDGen struct {
 	host    string
 	hostGen sync.Once
 
-	mu    sync.Mutex
-	count uint64
+	mu           sync.Mutex
+	count        uint64
+	messageCount uint64
 }
 
 func (c *cIDGen) generate(uid int) channelID {
@@ -51,6 +52,19 @@ func (c *cIDGen) generate(uid int) channelID {
 	return channelID(cid)
 }
 
+// generateMessageID returns an id for a published message. It is unique for
+// all instances of the service, like the channel ids.
+func (c *cIDGen) generateMessageID() string {
+	c.hostGen.Do(c.buildHostID)
+
+	c.mu.Lock()
+	count := c.messageCount
+	c.messageCount++
+	c.mu.Unlock()
+
+	return fmt.Sprintf("%s-%d", c.host, count)
+}
+
 func (c *cIDGen) buildHostID() {
 	rand.Seed(time.Now().UnixNano())
 
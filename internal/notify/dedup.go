@@ -0,0 +1,50 @@
+package notify
+
+// dedupMaxSenders is the number of sender channels, that a connection
+// remembers the last message of with WithDedup.
+const dedupMaxSenders = 64
+
+// lastMessages holds the last message of the most recent sender channels of a
+// connection. If a message from a new sender channel is added and the limit
+// is reached, the sender channel that was used the longest time ago is
+// forgotten.
+type lastMessages struct {
+	max      int
+	messages map[channelID]string
+
+	// order holds the sender channels. The most recent one is the last.
+	order []channelID
+}
+
+func newLastMessages(max int) *lastMessages {
+	return &lastMessages{
+		max:      max,
+		messages: make(map[channelID]string, max),
+	}
+}
+
+// repeated saves the message as the last message of the sender channel. It
+// returns true, if it is the same as the message before.
+func (l *lastMessages) repeated(sender channelID, message string) bool {
+	last, ok := l.messages[sender]
+	if ok {
+		l.remove(sender)
+	} else if len(l.order) >= l.max {
+		delete(l.messages, l.order[0])
+		l.order = l.order[1:]
+	}
+
+	l.messages[sender] = message
+	l.order = append(l.order, sender)
+	return ok && last == message
+}
+
+// remove removes the sender channel from the order.
+func (l *lastMessages) remove(sender channelID) {
+	for i, cid := range l.order {
+		if cid == sender {
+			l.order = append(l.order[:i], l.order[i+1:]...)
+			return
+		}
+	}
+}
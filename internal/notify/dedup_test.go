@@ -0,0 +1,45 @@
+package notify
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLastMessages(t *testing.T) {
+	last := newLastMessages(2)
+
+	for i, tt := range []struct {
+		sender   channelID
+		message  string
+		repeated bool
+	}{
+		{"a:1:1", "hello", false},
+		{"a:1:1", "hello", true},
+		{"a:1:2", "hello", false},
+		{"a:1:1", "hello", true},
+
+		// a:1:2 is the oldest sender and is forgotten.
+		{"a:1:3", "hello", false},
+		{"a:1:2", "hello", false},
+
+		// a:1:1 was forgotten for a:1:2.
+		{"a:1:1", "hello", false},
+		{"a:1:1", "world", false},
+	} {
+		if got := last.repeated(tt.sender, tt.message); got != tt.repeated {
+			t.Errorf("message %d: repeated(%s, %s) = %t, expected %t", i, tt.sender, tt.message, got, tt.repeated)
+		}
+	}
+}
+
+func TestLastMessagesBounded(t *testing.T) {
+	last := newLastMessages(dedupMaxSenders)
+
+	for i := 0; i < 10*dedupMaxSenders; i++ {
+		last.repeated(channelID(fmt.Sprintf("a:1:%d", i)), "hello")
+	}
+
+	if len(last.messages) != dedupMaxSenders || len(last.order) != dedupMaxSenders {
+		t.Errorf("got %d messages and %d senders, expected %d", len(last.messages), len(last.order), dedupMaxSenders)
+	}
+}
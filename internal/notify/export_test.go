@@ -0,0 +1,11 @@
+package notify
+
+import "time"
+
+// WithPublishClock replaces the system time, that is used for the field
+// published_at.
+func WithPublishClock(now func() time.Time) Option {
+	return func(n *Notify) {
+		n.clock.clock = now
+	}
+}
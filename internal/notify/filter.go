@@ -0,0 +1,137 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+)
+
+// filter decides, if a message is delivered to a connection. A message is
+// delivered, if it matches all fields of the filter.
+//
+// An empty filter matches all messages.
+type filter []fieldMatch
+
+// fieldMatch compares one field of a message with a value.
+type fieldMatch struct {
+	path  []string
+	value string
+}
+
+// parseFilter parses the values of the query argument `filter`.
+//
+// Each value has the form `path=value`. The path are field names separated by
+// dots, like `message.type`. Strings are compared with the value. Other json
+// values are compared with their compact encoding, like `true` or `5`. Numbers
+// are compared as they are written in the message, so big integers do not lose
+// precision.
+func parseFilter(values []string) (filter, error) {
+	var f filter
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, iccerror.NewMessageError(iccerror.ErrInvalid, "filter `%s` has to have the form path=value", v)
+		}
+
+		path := strings.Split(parts[0], ".")
+		for _, field := range path {
+			if field == "" {
+				return nil, iccerror.NewMessageError(iccerror.ErrInvalid, "filter `%s` has an invalid path", v)
+			}
+		}
+
+		f = append(f, fieldMatch{path: path, value: parts[1]})
+	}
+	return f, nil
+}
+
+// parseQueryFilter parses the query arguments `filter` and `sender_user_id` of
+// a request. `sender_user_id=5` is the same as `filter=sender_user_id=5`, but
+// the value has to be a user id.
+func parseQueryFilter(query url.Values) (filter, error) {
+	f, err := parseFilter(query["filter"])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range query["sender_user_id"] {
+		senderID, err := strconv.Atoi(v)
+		if err != nil || senderID < 0 {
+			return nil, iccerror.NewMessageError(iccerror.ErrInvalid, "url query sender_user_id has to be a user id, not `%s`", v)
+		}
+		f = append(f, fieldMatch{path: []string{"sender_user_id"}, value: strconv.Itoa(senderID)})
+	}
+	return f, nil
+}
+
+// inbox returns the inbox messages, that match the filter.
+func (f filter) inbox(messages []InboxMessage) []InboxMessage {
+	if len(f) == 0 {
+		return messages
+	}
+
+	var out []InboxMessage
+	for _, m := range messages {
+		if f.match(m.OutMessage) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// match returns true, if the message matches the filter.
+func (f filter) match(message OutMessage) bool {
+	if len(f) == 0 {
+		return true
+	}
+
+	bs, err := json.Marshal(message)
+	if err != nil {
+		return false
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(bs))
+	decoder.UseNumber()
+
+	var decoded interface{}
+	if err := decoder.Decode(&decoded); err != nil {
+		return false
+	}
+
+	for _, m := range f {
+		if !m.match(decoded) {
+			return false
+		}
+	}
+	return true
+}
+
+// match returns true, if the field of the decoded message has the value.
+func (m fieldMatch) match(decoded interface{}) bool {
+	value := decoded
+	for _, field := range m.path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return false
+		}
+
+		value, ok = object[field]
+		if !ok {
+			return false
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		return s == m.value
+	}
+
+	bs, err := json.Marshal(value)
+	if err != nil {
+		return false
+	}
+	return string(bs) == m.value
+}
@@ -1,27 +1,113 @@
 package notify
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
 	"github.com/OpenSlides/openslides-icc-service/internal/icchttp"
+	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
 )
 
 // Receiver is a type with the function Receive(). It is a blocking function
 // that writes the notify-messages to the writer as soon as they occur.
 type Receiver interface {
-	Receive(meetingID, uid int) (cid string, mp NextMessage)
+	Receive(ctx context.Context, meetingID, uid int) (cid string, mp NextMessage)
+}
+
+// jsonSeqType is the media type of RFC 7464 JSON text sequences.
+const jsonSeqType = "application/json-seq"
+
+// recordWriter writes json records to a stream.
+type recordWriter struct {
+	w       io.Writer
+	jsonSeq bool
+}
+
+// write writes one compact json object terminated by a newline. For a JSON text
+// sequence, the object is prefixed with the record separator.
+func (rw recordWriter) write(record []byte) error {
+	var buf bytes.Buffer
+	if rw.jsonSeq {
+		buf.WriteByte(0x1E)
+	}
+
+	if err := json.Compact(&buf, record); err != nil {
+		return fmt.Errorf("compacting record: %w", err)
+	}
+	buf.WriteByte('\n')
+
+	_, err := rw.w.Write(buf.Bytes())
+	return err
+}
+
+// encode writes the value as one record.
+func (rw recordWriter) encode(v interface{}) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding record: %w", err)
+	}
+	return rw.write(bs)
+}
+
+// error writes an error as one record.
+//
+// The record is the json message of the typed error without the wrapping
+// text, so it can be parsed by the client.
+func (rw recordWriter) error(err error) {
+	var buf bytes.Buffer
+	icchttp.ErrorNoStatus(&buf, err)
+	if buf.Len() == 0 {
+		return
+	}
+
+	record := buf.Bytes()
+	var errTyped interface {
+		error
+		Type() string
+	}
+	if errors.As(err, &errTyped) {
+		record = []byte(errTyped.Error())
+	}
+
+	if err := rw.write(record); err != nil {
+		icclog.Debug("Notify: writing error: %v", err)
+	}
 }
 
 // HandleReceive registers the notify route.
+//
+// The connection is closed, when the session of the user is revoked. The
+// Authenticater cancels the request context in this case.
+//
+// Each message is sent as one compact json object in one line. If the client
+// sends the header `Accept: application/json-seq`, the messages are sent as
+// RFC 7464 JSON text sequence.
+//
+// With the query argument `filter=path=value`, only messages with the value in
+// the field are sent. The argument can be used many times. The query argument
+// `sender_user_id` only sends the messages from this user.
+//
+// If the Receiver has a BufferSize, a client that does not read its messages
+// fast enough gets the error ErrTooSlow and is disconnected.
 func HandleReceive(mux *http.ServeMux, notify Receiver, auth icchttp.Authenticater) {
 	url := icchttp.Path + "/notify"
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		records := recordWriter{w: w, jsonSeq: acceptsJSONSeq(r)}
+
 		w.Header().Set("Content-Type", "application/octet-stream")
+		if records.jsonSeq {
+			w.Header().Set("Content-Type", jsonSeqType)
+		}
 		w.Header().Set("Cache-Control", "no-store, max-age=0")
 
 		uid := auth.FromContext(r.Context())
@@ -42,26 +128,92 @@ func HandleReceive(mux *http.ServeMux, notify Receiver, auth icchttp.Authenticat
 			}
 		}
 
-		cid, next := notify.Receive(meetingID, uid)
+		messageFilter, err := parseQueryFilter(r.URL.Query())
+		if err != nil {
+			icchttp.Error(w, err)
+			return
+		}
+
+		// The receiver releases the state of the connection, when ctx is done.
+		// This has to happen, when the handler returns, also if the client is
+		// still connected.
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		cid, next := notify.Receive(ctx, meetingID, uid)
+		icchttp.DescribeConnection(r.Context(), uid, meetingID, cid)
+
+		if buffered, ok := notify.(bufferedReceiver); ok && buffered.BufferSize() > 0 {
+			var memory *memoryBudget
+			if limited, ok := notify.(memoryLimitedReceiver); ok {
+				memory = limited.bufferMemory()
+			}
+
+			next = bufferNext(ctx, next, buffered.BufferSize(), memory, func() {
+				icclog.Debug("Notify: too slow meeting=%d user=%d channel=%s", meetingID, uid, cid)
+
+				// Give the client some time to receive the error. It can not
+				// get it, if it does not read at all.
+				timer := time.AfterFunc(slowClientGrace, func() {
+					icchttp.CloseConnection(r.Context())
+				})
+				go func() {
+					<-r.Context().Done()
+					timer.Stop()
+				}()
+			})
+		}
+
+		icclog.Debug("Notify: connect meeting=%d user=%d channel=%s", meetingID, uid, cid)
+		defer icclog.Debug("Notify: disconnect meeting=%d user=%d channel=%s", meetingID, uid, cid)
 
-		// Send channel id.
-		if _, err := fmt.Fprintf(w, `{"channel_id": "%s"}`+"\n", cid); err != nil {
-			icchttp.Error(w, fmt.Errorf("sending channel id: %w", err))
+		// Send the handshake with the channel id and the parameters of the
+		// connection.
+		handshake := struct {
+			ChannelID    string   `json:"channel_id"`
+			UserID       int      `json:"user_id"`
+			MeetingID    int      `json:"meeting_id,omitempty"`
+			Filter       []string `json:"filter,omitempty"`
+			SenderUserID []string `json:"sender_user_id,omitempty"`
+			ConnectionID string   `json:"connection_id,omitempty"`
+		}{
+			ChannelID:    cid,
+			UserID:       uid,
+			MeetingID:    meetingID,
+			Filter:       r.URL.Query()["filter"],
+			SenderUserID: r.URL.Query()["sender_user_id"],
+			ConnectionID: icchttp.ConnectionID(r.Context()),
+		}
+		if err := records.encode(handshake); err != nil {
+			icclog.Debug("Notify: error meeting=%d user=%d channel=%s: sending handshake: %v", meetingID, uid, cid, err)
+			icchttp.CloseConnection(r.Context())
 			return
 		}
 		w.(http.Flusher).Flush()
 
-		encoder := json.NewEncoder(w)
-
 		for {
-			message, err := next(r.Context())
+			message, err := next(ctx)
 			if err != nil {
-				icchttp.ErrorNoStatus(w, fmt.Errorf("receiving message: %w", err))
+				if errors.Is(err, errConnectionExpired) {
+					// Tell the client to open a new connection.
+					records.write([]byte(`{"reconnect":true}`))
+					return
+				}
+
+				icclog.Debug("Notify: error meeting=%d user=%d channel=%s: %v", meetingID, uid, cid, err)
+				records.error(fmt.Errorf("receiving message: %w", err))
 				return
 			}
 
-			if err := encoder.Encode(message); err != nil {
-				icchttp.ErrorNoStatus(w, fmt.Errorf("sending message: %w", err))
+			if !messageFilter.match(message) {
+				continue
+			}
+
+			if err := records.encode(message); err != nil {
+				// The record could be written partly. The client could not
+				// parse another record after it, so the connection is closed.
+				icclog.Debug("Notify: error meeting=%d user=%d channel=%s: sending message: %v", meetingID, uid, cid, err)
+				icchttp.CloseConnection(r.Context())
 				return
 			}
 
@@ -71,16 +223,39 @@ func HandleReceive(mux *http.ServeMux, notify Receiver, auth icchttp.Authenticat
 
 	mux.Handle(
 		url,
-		icchttp.AuthMiddleware(handler, auth),
+		icchttp.MethodMiddleware(icchttp.AuthMiddleware(handler, auth), http.MethodGet),
 	)
 }
 
+// acceptsJSONSeq returns true, if the client prefers a JSON text sequence.
+func acceptsJSONSeq(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			if strings.TrimSpace(strings.SplitN(mediaType, ";", 2)[0]) == jsonSeqType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Publisher saves a notify message.
 type Publisher interface {
-	Publish(io.Reader, int) error
+	Publish(context.Context, io.Reader, int) ([]string, error)
+}
+
+// asyncPublisher is a Publisher that can return before the message is saved.
+type asyncPublisher interface {
+	AsyncPublish() bool
 }
 
 // HandlePublish registers the notify/publish route.
+//
+// The response contains the ids of the published messages, like
+// `{"message_ids":["id"]}`. If the Publisher saves messages asynchronously, the
+// status 202 is returned.
+//
+// The headers with the MetaHeaderPrefix are saved as metadata of the messages.
 func HandlePublish(mux *http.ServeMux, notify Publisher, auth icchttp.Authenticater) {
 	url := icchttp.Path + "/notify/publish"
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -93,14 +268,274 @@ func HandlePublish(mux *http.ServeMux, notify Publisher, auth icchttp.Authentica
 			return
 		}
 
-		if err := notify.Publish(r.Body, uid); err != nil {
+		ids, err := notify.Publish(withMeta(r.Context(), metaFromHeader(r.Header)), r.Body, uid)
+		if err != nil {
 			icchttp.Error(w, fmt.Errorf("publish notify message: %w", err))
 			return
 		}
+
+		if async, ok := notify.(asyncPublisher); ok && async.AsyncPublish() {
+			// The message is not saved yet.
+			w.WriteHeader(202)
+		}
+
+		if ids == nil {
+			ids = []string{}
+		}
+
+		response := struct {
+			MessageIDs []string `json:"message_ids"`
+		}{ids}
+
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			icchttp.Error(w, fmt.Errorf("encoding message ids: %w", err))
+			return
+		}
 	})
 
 	mux.Handle(
 		url,
-		icchttp.AuthMiddleware(handler, auth),
+		icchttp.MethodMiddleware(icchttp.AuthMiddleware(handler, auth), http.MethodPost),
 	)
 }
+
+// Inboxer returns the messages a user missed.
+type Inboxer interface {
+	CanReadInbox(ctx context.Context, meetingID, uid int) error
+	Inbox(meetingID, uid int, cursor InboxCursor) ([]InboxMessage, error)
+}
+
+// HandleInbox registers the notify/inbox route.
+//
+// It returns the messages to the user and to the meeting `meeting_id`, that are
+// newer then the query arguments `last_user_id` and `last_meeting_id`. The
+// returned values can be used for the next request. The messages can be
+// filtered like in HandleReceive.
+//
+// For older clients, the query argument `last_id` is used for both inboxes and
+// the id of the newest message is returned as `last_id`.
+func HandleInbox(mux *http.ServeMux, notify Inboxer, auth icchttp.Authenticater) {
+	url := icchttp.Path + "/notify/inbox"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store, max-age=0")
+
+		uid := auth.FromContext(r.Context())
+		if uid == 0 {
+			w.WriteHeader(401)
+			icchttp.ErrorNoStatus(w, iccerror.NewMessageError(iccerror.ErrNotAllowed, "Anonymous user can not read the notify inbox."))
+			return
+		}
+
+		meetingID := 0
+		if meetingStr := r.URL.Query().Get("meeting_id"); meetingStr != "" {
+			var err error
+			meetingID, err = strconv.Atoi(meetingStr)
+			if err != nil {
+				icchttp.Error(w, iccerror.NewMessageError(iccerror.ErrInvalid, "url query meeting_id has to be an int"))
+				return
+			}
+		}
+
+		messageFilter, err := parseQueryFilter(r.URL.Query())
+		if err != nil {
+			icchttp.Error(w, err)
+			return
+		}
+
+		if err := notify.CanReadInbox(r.Context(), meetingID, uid); err != nil {
+			icchttp.Error(w, err)
+			return
+		}
+
+		cursor := parseInboxCursor(r.URL.Query())
+		messages, err := notify.Inbox(meetingID, uid, cursor)
+		if err != nil {
+			icchttp.Error(w, fmt.Errorf("reading inbox: %w", err))
+			return
+		}
+
+		// The cursor also contains the messages, that do not match the
+		// filter, so the client does not fetch them again.
+		writeInbox(w, messageFilter.inbox(messages), cursor.next(messages))
+	})
+
+	mux.Handle(
+		url,
+		icchttp.MethodMiddleware(icchttp.AuthMiddleware(handler, auth), http.MethodGet),
+	)
+}
+
+// parseInboxCursor returns the cursor from the query arguments `last_user_id`
+// and `last_meeting_id`. If both are missing, the query argument `last_id` is
+// used for both inboxes.
+func parseInboxCursor(query url.Values) InboxCursor {
+	if !query.Has("last_user_id") && !query.Has("last_meeting_id") {
+		lastID := query.Get("last_id")
+		return InboxCursor{User: lastID, Meeting: lastID}
+	}
+
+	return InboxCursor{
+		User:    query.Get("last_user_id"),
+		Meeting: query.Get("last_meeting_id"),
+	}
+}
+
+// writeInbox writes the messages and the cursor. The newest id of the cursor
+// is written as `last_id` for older clients.
+func writeInbox(w http.ResponseWriter, messages []InboxMessage, cursor InboxCursor) {
+	if messages == nil {
+		messages = []InboxMessage{}
+	}
+
+	response := struct {
+		Messages      []InboxMessage `json:"messages"`
+		LastID        string         `json:"last_id"`
+		LastUserID    string         `json:"last_user_id"`
+		LastMeetingID string         `json:"last_meeting_id"`
+	}{messages, cursor.newest(), cursor.User, cursor.Meeting}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		icchttp.Error(w, fmt.Errorf("encoding inbox: %w", err))
+		return
+	}
+}
+
+const (
+	// defaultPollTimeout is the time a poll request waits for messages, if
+	// the client does not set `timeout_seconds`.
+	defaultPollTimeout = 30 * time.Second
+
+	// maxPollTimeout is the longest time a poll request can wait.
+	maxPollTimeout = 60 * time.Second
+)
+
+// InboxWaiter returns the messages a user missed or waits for new ones.
+type InboxWaiter interface {
+	CanReadInbox(ctx context.Context, meetingID, uid int) error
+	InboxWait(ctx context.Context, meetingID, uid int, cursor InboxCursor, match func(OutMessage) bool) ([]InboxMessage, InboxCursor, error)
+}
+
+// HandlePoll registers the notify/poll route. It is a long poll alternative to
+// the notify stream for clients that can not receive a stream.
+//
+// It works like the inbox route, but if there are no messages newer then
+// the cursor, that match the filter, the request waits until there is one or
+// until `timeout_seconds` passed. In the second case, the response has no
+// messages. The returned cursor is after all messages, that were read while
+// waiting.
+func HandlePoll(mux *http.ServeMux, notify InboxWaiter, auth icchttp.Authenticater) {
+	url := icchttp.Path + "/notify/poll"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store, max-age=0")
+
+		uid := auth.FromContext(r.Context())
+		if uid == 0 {
+			w.WriteHeader(401)
+			icchttp.ErrorNoStatus(w, iccerror.NewMessageError(iccerror.ErrNotAllowed, "Anonymous user can not poll notify messages."))
+			return
+		}
+
+		query := r.URL.Query()
+
+		meetingID := 0
+		if meetingStr := query.Get("meeting_id"); meetingStr != "" {
+			var err error
+			meetingID, err = strconv.Atoi(meetingStr)
+			if err != nil {
+				icchttp.Error(w, iccerror.NewMessageError(iccerror.ErrInvalid, "url query meeting_id has to be an int"))
+				return
+			}
+		}
+
+		messageFilter, err := parseQueryFilter(query)
+		if err != nil {
+			icchttp.Error(w, err)
+			return
+		}
+
+		timeout := defaultPollTimeout
+		if timeoutStr := query.Get("timeout_seconds"); timeoutStr != "" {
+			seconds, err := strconv.Atoi(timeoutStr)
+			if err != nil || seconds < 0 {
+				icchttp.Error(w, iccerror.NewMessageError(iccerror.ErrInvalid, "url query timeout_seconds has to be a positive int"))
+				return
+			}
+			timeout = time.Duration(seconds) * time.Second
+		}
+
+		if timeout > maxPollTimeout {
+			timeout = maxPollTimeout
+		}
+
+		if err := notify.CanReadInbox(r.Context(), meetingID, uid); err != nil {
+			icchttp.Error(w, err)
+			return
+		}
+
+		icchttp.DescribeConnection(r.Context(), uid, meetingID, "")
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		messages, cursor, err := notify.InboxWait(ctx, meetingID, uid, parseInboxCursor(query), messageFilter.match)
+		if err != nil {
+			icchttp.Error(w, fmt.Errorf("polling inbox: %w", err))
+			return
+		}
+
+		writeInbox(w, messages, cursor)
+	})
+
+	mux.Handle(
+		url,
+		icchttp.MethodMiddleware(icchttp.AuthMiddleware(handler, auth), http.MethodGet),
+	)
+}
+
+// Pauser pauses and resumes the delivery of messages to a connection.
+type Pauser interface {
+	Pause(uid int, cid string) error
+	Resume(uid int, cid string) error
+}
+
+// HandlePause registers the notify/pause and notify/resume routes.
+//
+// Both routes need the query argument `channel_id` of a receive connection of
+// the user.
+func HandlePause(mux *http.ServeMux, notify Pauser, auth icchttp.Authenticater) {
+	handle := func(url string, do func(uid int, cid string) error, result string) {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			uid := auth.FromContext(r.Context())
+			if uid == 0 {
+				w.WriteHeader(401)
+				icchttp.ErrorNoStatus(w, iccerror.NewMessageError(iccerror.ErrNotAllowed, "Anonymous user can not pause notify connections."))
+				return
+			}
+
+			cid := r.URL.Query().Get("channel_id")
+			if cid == "" {
+				icchttp.Error(w, iccerror.NewMessageError(iccerror.ErrInvalid, "url query channel_id is required"))
+				return
+			}
+
+			if err := do(uid, cid); err != nil {
+				icchttp.Error(w, err)
+				return
+			}
+
+			fmt.Fprintln(w, result)
+		})
+
+		mux.Handle(
+			url,
+			icchttp.MethodMiddleware(icchttp.AuthMiddleware(handler, auth), http.MethodPost),
+		)
+	}
+
+	handle(icchttp.Path+"/notify/pause", notify.Pause, `{"paused": true}`)
+	handle(icchttp.Path+"/notify/resume", notify.Resume, `{"paused": false}`)
+}
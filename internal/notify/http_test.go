@@ -2,15 +2,24 @@ package notify_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/dsmock"
 	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+	"github.com/OpenSlides/openslides-icc-service/internal/icchttp"
 	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
 	"github.com/OpenSlides/openslides-icc-service/internal/icctest"
 	"github.com/OpenSlides/openslides-icc-service/internal/notify"
@@ -74,7 +83,7 @@ func TestHandleReceive(t *testing.T) {
 			t.Errorf("receiver was not called")
 		}
 
-		expect := `{"channel_id": "mycid"}` + "\n"
+		expect := `{"channel_id":"mycid","user_id":1}` + "\n"
 		if resp.Body.String() != expect {
 			t.Errorf("resp body is %q, expected %q", resp.Body.String(), expect)
 		}
@@ -114,7 +123,7 @@ func TestHandleReceive(t *testing.T) {
 			t.Errorf("receiver was called witht meetingID %d, expected 5", receiver.callledMeetingID)
 		}
 
-		expect := `{"channel_id": "mycid"}` + "\n"
+		expect := `{"channel_id":"mycid","user_id":1,"meeting_id":5}` + "\n"
 		if resp.Body.String() != expect {
 			t.Errorf("resp body is %q, expected %q", resp.Body.String(), expect)
 		}
@@ -223,6 +232,166 @@ func TestHandleReceive(t *testing.T) {
 	})
 }
 
+func TestHandleReceiveHandshake(t *testing.T) {
+	receiver := receiverStub{
+		cid: "mycid",
+		nm:  newMessageProviderStub().Next,
+	}
+	auther := icctest.AutherStub{UserID: 1}
+	mux := http.NewServeMux()
+	notify.HandleReceive(mux, &receiver, &auther)
+
+	var registry icchttp.Registry
+	handler := registry.Middleware(mux, "/system/icc/notify")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		time.Sleep(time.Millisecond)
+		cancel()
+	}()
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/system/icc/notify?meeting_id=5&filter=name=vote", nil).WithContext(ctx))
+
+	if resp.Result().StatusCode != 200 {
+		t.Fatalf("handler returned status %s: %s", resp.Result().Status, resp.Body.String())
+	}
+
+	firstLine := strings.SplitN(resp.Body.String(), "\n", 2)[0]
+	expect := `{"channel_id":"mycid","user_id":1,"meeting_id":5,"filter":["name=vote"],"connection_id":"1"}`
+	if firstLine != expect {
+		t.Errorf("first record is %s, expected %s", firstLine, expect)
+	}
+}
+
+// failingWriter is a ResponseWriter, where the write with the number failAt
+// writes only half of the data and returns an error. Each write is also sent
+// to the channel written.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	failAt  int
+	writes  int
+	written chan struct{}
+}
+
+func newFailingWriter(failAt int) *failingWriter {
+	return &failingWriter{
+		ResponseRecorder: httptest.NewRecorder(),
+		failAt:           failAt,
+		written:          make(chan struct{}, 10),
+	}
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	defer func() { w.written <- struct{}{} }()
+
+	if w.writes < w.failAt {
+		return w.ResponseRecorder.Write(p)
+	}
+
+	n, _ := w.ResponseRecorder.Write(p[:len(p)/2])
+	return n, errors.New("connection reset by peer")
+}
+
+func TestHandleReceiveWriteError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	receive := func(t *testing.T, n *notify.Notify, w *failingWriter, url string) <-chan struct{} {
+		mux := http.NewServeMux()
+		notify.HandleReceive(mux, n, &icctest.AutherStub{UserID: 1})
+
+		done := make(chan struct{})
+		go func() {
+			// The request context is not canceled after the handler returns.
+			mux.ServeHTTP(w, httptest.NewRequest("GET", url, nil).WithContext(ctx))
+			close(done)
+		}()
+		return done
+	}
+
+	waitUnregistered := func(t *testing.T, n *notify.Notify, cid string) {
+		t.Helper()
+
+		timeout := time.After(time.Second)
+		for {
+			if err := n.Pause(1, cid); errors.Is(err, iccerror.ErrNotFound) {
+				return
+			}
+
+			select {
+			case <-timeout:
+				t.Fatalf("connection %s is still registered after the handler returned", cid)
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+
+	t.Run("fails on message", func(t *testing.T) {
+		n := notify.New(ctx, newBackendStrub(), notify.WithPause(10))
+		w := newFailingWriter(2)
+		done := receive(t, n, w, "/system/icc/notify")
+
+		<-w.written
+		if _, err := n.Publish(ctx, strings.NewReader(`{"channel_id":"server:1:0","name":"test","to_users":[1],"message":"a long enough message"}`), 1); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("handler did not return after the write error")
+		}
+
+		lines := strings.Split(w.Body.String(), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("got %d lines, expected the handshake and a partial message: %q", len(lines), w.Body.String())
+		}
+
+		if strings.Contains(lines[1], "error") {
+			t.Errorf("an error was written after the partial message: %q", lines[1])
+		}
+
+		var handshake struct {
+			ChannelID string `json:"channel_id"`
+		}
+		if err := json.Unmarshal([]byte(lines[0]), &handshake); err != nil {
+			t.Fatalf("decoding handshake: %v", err)
+		}
+
+		waitUnregistered(t, n, handshake.ChannelID)
+	})
+
+	t.Run("fails on handshake", func(t *testing.T) {
+		n := notify.New(ctx, newBackendStrub(), notify.WithPause(10))
+		w := newFailingWriter(1)
+
+		// The long filter makes the handshake long enough, that its first
+		// half contains the channel id.
+		done := receive(t, n, w, "/system/icc/notify?filter=name="+strings.Repeat("x", 100))
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("handler did not return after the write error")
+		}
+
+		if w.writes != 1 {
+			t.Errorf("handler wrote %d times, expected only the failed handshake", w.writes)
+		}
+
+		partial := strings.TrimPrefix(w.Body.String(), `{"channel_id":"`)
+		cid := strings.SplitN(partial, `"`, 2)[0]
+		if err := n.Pause(1, cid); errors.Is(err, iccerror.ErrNotAllowed) {
+			t.Fatalf("could not read channel id from partial handshake %q", w.Body.String())
+		}
+		waitUnregistered(t, n, cid)
+	})
+}
+
 func TestHandleSend(t *testing.T) {
 	url := "/system/icc/notify/publish"
 
@@ -233,7 +402,7 @@ func TestHandleSend(t *testing.T) {
 		notify.HandlePublish(mux, &sender, &auther)
 		resp := httptest.NewRecorder()
 
-		mux.ServeHTTP(resp, httptest.NewRequest("GET", url, nil))
+		mux.ServeHTTP(resp, httptest.NewRequest("POST", url, nil))
 
 		if resp.Result().StatusCode != 401 {
 			t.Fatalf("handler returned status %s: %s", resp.Result().Status, resp.Body.String())
@@ -257,7 +426,7 @@ func TestHandleSend(t *testing.T) {
 		notify.HandlePublish(mux, &sender, &auther)
 		resp := httptest.NewRecorder()
 
-		mux.ServeHTTP(resp, httptest.NewRequest("GET", url, nil))
+		mux.ServeHTTP(resp, httptest.NewRequest("POST", url, nil))
 
 		if resp.Result().StatusCode != 200 {
 			t.Fatalf("handler returned status %s: %s", resp.Result().Status, resp.Body.String())
@@ -284,7 +453,7 @@ func TestHandleSend(t *testing.T) {
 		notify.HandlePublish(mux, &sender, &auther)
 		resp := httptest.NewRecorder()
 
-		mux.ServeHTTP(resp, httptest.NewRequest("GET", url, nil))
+		mux.ServeHTTP(resp, httptest.NewRequest("POST", url, nil))
 
 		if resp.Result().StatusCode != 500 {
 			t.Fatalf("handler returned status %s: %s", resp.Result().Status, resp.Body.String())
@@ -295,3 +464,1043 @@ func TestHandleSend(t *testing.T) {
 		}
 	})
 }
+
+func TestHandleReceiveMaxConnectionAge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := notify.New(ctx, newBackendStrub(), notify.WithMaxConnectionAge(20*time.Millisecond))
+	auther := icctest.AutherStub{UserID: 1}
+	mux := http.NewServeMux()
+	notify.HandleReceive(mux, n, &auther)
+	resp := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		mux.ServeHTTP(resp, httptest.NewRequest("GET", "/system/icc/notify", nil).WithContext(ctx))
+		close(done)
+	}()
+
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C:
+		t.Fatalf("connection was not closed after the max connection age")
+	}
+
+	if !strings.HasSuffix(resp.Body.String(), `{"reconnect":true}`+"\n") {
+		t.Errorf("resp body is %q, expected reconnect marker", resp.Body.String())
+	}
+}
+
+func TestHandlePublishRateLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := notify.New(ctx, newBackendStrub(), notify.WithMaxPublishRate(0.001))
+	auther := icctest.AutherStub{UserID: 1}
+	mux := http.NewServeMux()
+	notify.HandlePublish(mux, n, &auther)
+
+	message := `{"channel_id":"server:1:2","name":"message-name","to_users":[2],"message":"hans"}`
+
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, httptest.NewRequest("POST", "/system/icc/notify/publish", strings.NewReader(message)))
+	if resp.Result().StatusCode != 200 {
+		t.Fatalf("first request returned status %s: %s", resp.Result().Status, resp.Body.String())
+	}
+
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, httptest.NewRequest("POST", "/system/icc/notify/publish", strings.NewReader(message)))
+	if resp.Result().StatusCode != 429 {
+		t.Errorf("second request returned status %s, expected 429", resp.Result().Status)
+	}
+
+	t.Run("list", func(t *testing.T) {
+		// A rate of 2 allows two messages at once.
+		n := notify.New(ctx, newBackendStrub(), notify.WithMaxPublishRate(2))
+		mux := http.NewServeMux()
+		notify.HandlePublish(mux, n, &auther)
+
+		publish := func(count int) int {
+			list := "[" + strings.TrimSuffix(strings.Repeat(message+",", count), ",") + "]"
+			resp := httptest.NewRecorder()
+			mux.ServeHTTP(resp, httptest.NewRequest("POST", "/system/icc/notify/publish", strings.NewReader(list)))
+			return resp.Result().StatusCode
+		}
+
+		if status := publish(3); status != 429 {
+			t.Errorf("list of three messages returned status %d, expected 429", status)
+		}
+
+		// The rejected list did not take a token.
+		if status := publish(2); status != 200 {
+			t.Errorf("list of two messages returned status %d, expected 200", status)
+		}
+
+		if status := publish(1); status != 429 {
+			t.Errorf("list after the limit returned status %d, expected 429", status)
+		}
+	})
+}
+
+func TestHandlePublishMaxListItems(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := notify.New(ctx, newBackendStrub(), notify.WithMaxListItems(2))
+	auther := icctest.AutherStub{UserID: 1}
+	mux := http.NewServeMux()
+	notify.HandlePublish(mux, n, &auther)
+
+	message := `{"channel_id":"server:1:2","name":"message-name","to_users":[2],"message":"hans"}`
+
+	for _, tt := range []struct {
+		count  int
+		status int
+	}{
+		{2, 200},
+		{3, 400},
+	} {
+		list := "[" + strings.TrimSuffix(strings.Repeat(message+",", tt.count), ",") + "]"
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, httptest.NewRequest("POST", "/system/icc/notify/publish", strings.NewReader(list)))
+
+		if got := resp.Result().StatusCode; got != tt.status {
+			t.Errorf("list of %d messages returned status %d, expected %d: %s", tt.count, got, tt.status, resp.Body.String())
+		}
+	}
+}
+
+func TestHandlePublishMeetingRateLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := notify.New(ctx, newBackendStrub(), notify.WithMaxMeetingPublishRate(0.001))
+	auther := icctest.AutherStub{UserID: 1}
+	mux := http.NewServeMux()
+	notify.HandlePublish(mux, n, &auther)
+
+	publish := func(message string) int {
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, httptest.NewRequest("POST", "/system/icc/notify/publish", strings.NewReader(message)))
+		return resp.Result().StatusCode
+	}
+
+	toMeeting1 := `{"channel_id":"server:1:2","name":"message-name","to_meeting":1,"message":"hans"}`
+	toMeeting2 := `{"channel_id":"server:1:2","name":"message-name","to_meeting":2,"message":"hans"}`
+	toMeeting3 := `{"channel_id":"server:1:2","name":"message-name","to_meeting":3,"message":"hans"}`
+	toUser := `{"channel_id":"server:1:2","name":"message-name","to_users":[2],"message":"hans"}`
+
+	if status := publish(toMeeting1); status != 200 {
+		t.Fatalf("first message to meeting 1 returned status %d", status)
+	}
+
+	if status := publish(toMeeting1); status != 429 {
+		t.Errorf("second message to meeting 1 returned status %d, expected 429", status)
+	}
+
+	if status := publish(toMeeting2); status != 200 {
+		t.Errorf("message to meeting 2 returned status %d, expected 200", status)
+	}
+
+	if status := publish(toUser); status != 200 {
+		t.Errorf("message without meeting returned status %d, expected 200", status)
+	}
+
+	if status := publish("[" + toMeeting2 + "]"); status != 429 {
+		t.Errorf("list with a message to meeting 2 returned status %d, expected 429", status)
+	}
+
+	// The rejected list does not take the token of meeting 3.
+	if status := publish("[" + toMeeting3 + "," + toMeeting1 + "]"); status != 429 {
+		t.Errorf("list with a message to meeting 1 returned status %d, expected 429", status)
+	}
+
+	if status := publish(toMeeting3); status != 200 {
+		t.Errorf("message to meeting 3 after a rejected list returned status %d, expected 200", status)
+	}
+}
+
+func TestHandlePublishMeta(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := notify.New(ctx, newBackendStrub())
+	auther := icctest.AutherStub{UserID: 1}
+	mux := http.NewServeMux()
+	notify.HandlePublish(mux, n, &auther)
+
+	_, next := n.Receive(ctx, 1, 2)
+
+	t.Run("with headers", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/system/icc/notify/publish", strings.NewReader(
+			`{"channel_id":"server:1:2","name":"message-name","to_users":[2],"message":"hans","meta":{"source":"body"}}`,
+		))
+		req.Header.Set("X-ICC-Meta-Source", "motion-service")
+		req.Header.Set("X-ICC-Meta-Correlation-ID", "42")
+		req.Header.Set("X-Other", "ignored")
+
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		if resp.Result().StatusCode != 200 {
+			t.Fatalf("publish returned status %s: %s", resp.Result().Status, resp.Body.String())
+		}
+
+		message, err := next(ctx)
+		if err != nil {
+			t.Fatalf("receiving message: %v", err)
+		}
+
+		expect := map[string]string{"source": "motion-service", "correlation-id": "42"}
+		if !reflect.DeepEqual(message.Meta, expect) {
+			t.Errorf("got meta %v, expected %v", message.Meta, expect)
+		}
+	})
+
+	t.Run("without headers", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/system/icc/notify/publish", strings.NewReader(
+			`{"channel_id":"server:1:2","name":"message-name","to_users":[2],"message":"hans","meta":{"source":"body"}}`,
+		))
+
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		if resp.Result().StatusCode != 200 {
+			t.Fatalf("publish returned status %s: %s", resp.Result().Status, resp.Body.String())
+		}
+
+		message, err := next(ctx)
+		if err != nil {
+			t.Fatalf("receiving message: %v", err)
+		}
+
+		if message.Meta != nil {
+			t.Errorf("got meta %v, expected none", message.Meta)
+		}
+
+		bs, err := json.Marshal(message)
+		if err != nil {
+			t.Fatalf("encoding message: %v", err)
+		}
+
+		if strings.Contains(string(bs), "meta") {
+			t.Errorf("encoded message `%s` contains meta", bs)
+		}
+	})
+}
+
+func TestHandleReceiveLogout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := notify.New(ctx, newBackendStrub())
+
+	receive := func(auther icchttp.Authenticater) <-chan struct{} {
+		mux := http.NewServeMux()
+		notify.HandleReceive(mux, n, auther)
+
+		done := make(chan struct{})
+		go func() {
+			mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/system/icc/notify", nil).WithContext(ctx))
+			close(done)
+		}()
+		return done
+	}
+
+	loggedOut := &logoutAutherStub{icctest.AutherStub{UserID: 1}, make(chan struct{})}
+	other := &logoutAutherStub{icctest.AutherStub{UserID: 2}, make(chan struct{})}
+
+	loggedOutDone := receive(loggedOut)
+	otherDone := receive(other)
+
+	close(loggedOut.logout)
+
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+
+	select {
+	case <-loggedOutDone:
+	case <-timer.C:
+		t.Fatalf("connection was not closed after logout")
+	}
+
+	select {
+	case <-otherDone:
+		t.Errorf("connection of other user was closed")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestHandleWrongMethod(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := notify.New(ctx, newBackendStrub())
+	auther := icctest.AutherStub{UserID: 1}
+	mux := http.NewServeMux()
+	notify.HandleReceive(mux, n, &auther)
+	notify.HandlePublish(mux, n, &auther)
+
+	for _, tt := range []struct {
+		method string
+		url    string
+		allow  string
+	}{
+		{"POST", "/system/icc/notify", "GET"},
+		{"GET", "/system/icc/notify/publish", "POST"},
+	} {
+		t.Run(tt.method+" "+tt.url, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			mux.ServeHTTP(resp, httptest.NewRequest(tt.method, tt.url, nil))
+
+			if resp.Result().StatusCode != 405 {
+				t.Errorf("handler returned status %s, expected 405", resp.Result().Status)
+			}
+
+			if got := resp.Header().Get("Allow"); got != tt.allow {
+				t.Errorf("Allow header is `%s`, expected `%s`", got, tt.allow)
+			}
+		})
+	}
+}
+
+func TestHandleReceiveConnectionLog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	n := notify.New(ctx, newBackendStrub())
+	auther := icctest.AutherStub{UserID: 3}
+	mux := http.NewServeMux()
+	notify.HandleReceive(mux, n, &auther)
+
+	done := make(chan struct{})
+	go func() {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/system/icc/notify?meeting_id=7", nil).WithContext(ctx))
+		close(done)
+	}()
+
+	cancel()
+	<-done
+
+	logs := debugLog.String()
+	if !strings.Contains(logs, "connect meeting=7 user=3") {
+		t.Errorf("log does not contain connect line with meeting and user:\n%s", logs)
+	}
+
+	if !strings.Contains(logs, "disconnect meeting=7 user=3") {
+		t.Errorf("log does not contain disconnect line with meeting and user:\n%s", logs)
+	}
+}
+
+func TestHandlePublishAsync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := newBlockingBackend()
+	n := notify.New(ctx, backend, notify.WithPublishWorkers(2), notify.WithAsyncPublish())
+	auther := icctest.AutherStub{UserID: 1}
+	mux := http.NewServeMux()
+	notify.HandlePublish(mux, n, &auther)
+
+	message := `{"channel_id":"server:1:2","name":"message-name","to_users":[2],"message":"hans"}`
+
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, httptest.NewRequest("POST", "/system/icc/notify/publish", strings.NewReader(message)))
+
+	if resp.Result().StatusCode != 202 {
+		t.Fatalf("handler returned status %s, expected 202: %s", resp.Result().Status, resp.Body.String())
+	}
+
+	select {
+	case <-backend.saved:
+		t.Fatalf("message was saved before the backend was released")
+	default:
+	}
+
+	close(backend.release)
+
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+
+	select {
+	case got := <-backend.saved:
+		if !strings.Contains(string(got), `"name":"message-name"`) {
+			t.Errorf("saved message %s, expected the published message", got)
+		}
+	case <-timer.C:
+		t.Fatalf("message was not saved after the backend was released")
+	}
+
+	t.Run("invalid message", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, httptest.NewRequest("POST", "/system/icc/notify/publish", strings.NewReader(`{"channel_id":"server:1:2"}`)))
+
+		if resp.Result().StatusCode != 400 {
+			t.Errorf("handler returned status %s, expected 400", resp.Result().Status)
+		}
+	})
+}
+
+func TestHandleReceiveFraming(t *testing.T) {
+	// next returns one message with a multiline json value and then an error.
+	var called int
+	next := func(ctx context.Context) (notify.OutMessage, error) {
+		called++
+		if called == 1 {
+			return notify.OutMessage{Name: "myname", Message: []byte("{\n  \"key\": \"value\"\n}")}, nil
+		}
+		return notify.OutMessage{}, iccerror.ErrInvalid
+	}
+
+	for _, tt := range []struct {
+		name        string
+		accept      string
+		contentType string
+		split       func(body string) []string
+	}{
+		{
+			"ndjson",
+			"",
+			"application/octet-stream",
+			func(body string) []string {
+				if !strings.HasSuffix(body, "\n") {
+					t.Errorf("body does not end with a newline: %q", body)
+				}
+				return strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+			},
+		},
+		{
+			"json-seq",
+			"application/json-seq",
+			"application/json-seq",
+			func(body string) []string {
+				if !strings.HasPrefix(body, "\x1e") {
+					t.Errorf("body does not start with a record separator: %q", body)
+				}
+
+				var records []string
+				for _, record := range strings.Split(body, "\x1e")[1:] {
+					if !strings.HasSuffix(record, "\n") {
+						t.Errorf("record does not end with a newline: %q", record)
+					}
+					records = append(records, strings.TrimSuffix(record, "\n"))
+				}
+				return records
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			called = 0
+			receiver := receiverStub{cid: "mycid", nm: next}
+			auther := icctest.AutherStub{UserID: 1}
+			mux := http.NewServeMux()
+			notify.HandleReceive(mux, &receiver, &auther)
+
+			req := httptest.NewRequest("GET", "/system/icc/notify", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			resp := httptest.NewRecorder()
+			mux.ServeHTTP(resp, req)
+
+			if got := resp.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("got content type %s, expected %s", got, tt.contentType)
+			}
+
+			records := tt.split(resp.Body.String())
+			if len(records) != 3 {
+				t.Fatalf("got %d records, expected 3: %q", len(records), resp.Body.String())
+			}
+
+			for i, expect := range []string{
+				`{"channel_id":"mycid","user_id":1}`,
+				`{"sender_user_id":0,"sender_channel_id":"","name":"myname","message":{"key":"value"}}`,
+				iccerror.ErrInvalid.Error(),
+			} {
+				if !json.Valid([]byte(records[i])) {
+					t.Errorf("record %d is not valid json: %q", i, records[i])
+				}
+
+				if records[i] != expect {
+					t.Errorf("record %d is %s, expected %s", i, records[i], expect)
+				}
+			}
+		})
+	}
+}
+
+// gatedWriter is a ResponseWriter that blocks each write until the gate is
+// closed.
+type gatedWriter struct {
+	*httptest.ResponseRecorder
+	gate chan struct{}
+}
+
+func (w gatedWriter) Write(p []byte) (int, error) {
+	<-w.gate
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestHandleReceiveTooSlow(t *testing.T) {
+	var mu sync.Mutex
+	var sent int
+	next := func(ctx context.Context) (notify.OutMessage, error) {
+		mu.Lock()
+		sent++
+		mu.Unlock()
+		return notify.OutMessage{Name: "message"}, nil
+	}
+
+	receiver := bufferedReceiverStub{receiverStub: receiverStub{cid: "mycid", nm: next}, size: 2}
+	auther := icctest.AutherStub{UserID: 1}
+	mux := http.NewServeMux()
+	notify.HandleReceive(mux, &receiver, &auther)
+
+	w := gatedWriter{httptest.NewRecorder(), make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/system/icc/notify", nil))
+		close(done)
+	}()
+
+	// Open the gate after the queue is full.
+	for {
+		mu.Lock()
+		full := sent > 2
+		mu.Unlock()
+		if full {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(w.gate)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("connection was not closed")
+	}
+
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if got := lines[len(lines)-1]; !strings.Contains(got, `"error":"too-slow"`) {
+		t.Errorf("got last record %s, expected a too-slow error", got)
+	}
+}
+
+func TestHandleReceiveNotReading(t *testing.T) {
+	payload := []byte(`"` + strings.Repeat("x", 64<<10) + `"`)
+
+	next := func(ctx context.Context) (notify.OutMessage, error) {
+		select {
+		case <-ctx.Done():
+			return notify.OutMessage{}, ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+		return notify.OutMessage{Name: "big", Message: payload}, nil
+	}
+
+	receiver := bufferedReceiverStub{receiverStub: receiverStub{cid: "mycid", nm: next}, size: 10}
+	auther := icctest.AutherStub{UserID: 1}
+	mux := http.NewServeMux()
+	notify.HandleReceive(mux, &receiver, &auther)
+
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Config.ConnContext = icchttp.ConnContext
+	srv.Start()
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	// Send the request but do not read the response, until the service
+	// should have closed the connection.
+	fmt.Fprintf(conn, "GET /system/icc/notify HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	time.Sleep(2 * time.Second)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, conn); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("connection was not closed")
+	}
+}
+
+func TestHandleReceiveFilter(t *testing.T) {
+	messages := []notify.OutMessage{
+		{SenderUserID: 1, Name: "myname", Message: []byte(`{"type":"reaction","value":5}`)},
+		{SenderUserID: 2, Name: "myname", Message: []byte(`{"type":"chat","value":5}`)},
+		{SenderUserID: 1, Name: "other", Message: []byte(`{"type":"reaction","value":6}`)},
+		{SenderUserID: 3, Name: "big", Message: []byte(`{"type":"user","value":9007199254740993}`)},
+	}
+
+	for _, tt := range []struct {
+		name   string
+		query  string
+		status int
+		expect []string
+	}{
+		{
+			"no filter",
+			"",
+			200,
+			[]string{"myname", "myname", "other", "big"},
+		},
+		{
+			"string field",
+			"?filter=message.type%3Dreaction",
+			200,
+			[]string{"myname", "other"},
+		},
+		{
+			"number field",
+			"?filter=message.value%3D5",
+			200,
+			[]string{"myname", "myname"},
+		},
+		{
+			"large number",
+			"?filter=message.value%3D9007199254740993",
+			200,
+			[]string{"big"},
+		},
+		{
+			"large number without precision loss",
+			"?filter=message.value%3D9007199254740992",
+			200,
+			nil,
+		},
+		{
+			"many filters",
+			"?filter=message.type%3Dreaction&filter=name%3Dother",
+			200,
+			[]string{"other"},
+		},
+		{
+			"unknown field",
+			"?filter=message.unknown%3Dreaction",
+			200,
+			nil,
+		},
+		{
+			"sender",
+			"?sender_user_id=1",
+			200,
+			[]string{"myname", "other"},
+		},
+		{
+			"sender with filter",
+			"?sender_user_id=1&filter=message.type%3Dreaction&filter=name%3Dmyname",
+			200,
+			[]string{"myname"},
+		},
+		{
+			"unknown sender",
+			"?sender_user_id=4",
+			200,
+			nil,
+		},
+		{
+			"invalid sender",
+			"?sender_user_id=one",
+			400,
+			nil,
+		},
+		{
+			"no value",
+			"?filter=message.type",
+			400,
+			nil,
+		},
+		{
+			"empty path",
+			"?filter=message..type%3Dreaction",
+			400,
+			nil,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var called int
+			next := func(ctx context.Context) (notify.OutMessage, error) {
+				if called == len(messages) {
+					return notify.OutMessage{}, iccerror.ErrInvalid
+				}
+				called++
+				return messages[called-1], nil
+			}
+
+			receiver := receiverStub{cid: "mycid", nm: next}
+			auther := icctest.AutherStub{UserID: 1}
+			mux := http.NewServeMux()
+			notify.HandleReceive(mux, &receiver, &auther)
+
+			req := httptest.NewRequest("GET", "/system/icc/notify"+tt.query, nil)
+			resp := httptest.NewRecorder()
+			mux.ServeHTTP(resp, req)
+
+			if resp.Code != tt.status {
+				t.Fatalf("got status %d, expected %d: %s", resp.Code, tt.status, resp.Body.String())
+			}
+
+			if tt.status != 200 {
+				return
+			}
+
+			lines := strings.Split(strings.TrimSuffix(resp.Body.String(), "\n"), "\n")
+			// The first line is the channel id and the last line the error.
+			lines = lines[1 : len(lines)-1]
+
+			var got []string
+			for _, line := range lines {
+				var message struct {
+					Name string `json:"name"`
+				}
+				if err := json.Unmarshal([]byte(line), &message); err != nil {
+					t.Fatalf("decoding message `%s`: %v", line, err)
+				}
+				got = append(got, message.Name)
+			}
+
+			if !reflect.DeepEqual(got, tt.expect) {
+				t.Errorf("got messages %v, expected %v", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestHandleInbox(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := icctest.NewRecordingBackend()
+	n := notify.New(ctx, backend, notify.WithInbox(backend, nil, 10, time.Hour))
+	auther := icctest.AutherStub{UserID: 2}
+	mux := http.NewServeMux()
+	notify.HandleInbox(mux, n, &auther)
+
+	ids, err := n.Publish(ctx, strings.NewReader(`{"channel_id":"server:1:2","name":"missed","to_users":[2],"message":"hans"}`), 1)
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, httptest.NewRequest("GET", "/system/icc/notify/inbox", nil))
+	if resp.Result().StatusCode != 200 {
+		t.Fatalf("request returned status %s: %s", resp.Result().Status, resp.Body.String())
+	}
+
+	expect := fmt.Sprintf(`{"messages":[{"id":"1-0","sender_user_id":1,"sender_channel_id":"server:1:2","name":"missed","message":"hans","message_id":"%s","published_at":%d}],"last_id":"1-0","last_user_id":"1-0","last_meeting_id":""}`, ids[0], publishedAt(t, resp.Body.String())) + "\n"
+	if got := resp.Body.String(); got != expect {
+		t.Errorf("got `%s`, expected `%s`", got, expect)
+	}
+
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, httptest.NewRequest("GET", "/system/icc/notify/inbox?last_id=1-0", nil))
+
+	expect = `{"messages":[],"last_id":"1-0","last_user_id":"1-0","last_meeting_id":"1-0"}` + "\n"
+	if got := resp.Body.String(); got != expect {
+		t.Errorf("got `%s` after last id, expected `%s`", got, expect)
+	}
+
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, httptest.NewRequest("GET", "/system/icc/notify/inbox?last_user_id=1-0", nil))
+
+	expect = `{"messages":[],"last_id":"1-0","last_user_id":"1-0","last_meeting_id":""}` + "\n"
+	if got := resp.Body.String(); got != expect {
+		t.Errorf("got `%s` after last user id, expected `%s`", got, expect)
+	}
+
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, httptest.NewRequest("GET", "/system/icc/notify/inbox?meeting_id=five", nil))
+	if resp.Result().StatusCode != 400 {
+		t.Errorf("invalid meeting id returned status %s, expected 400", resp.Result().Status)
+	}
+}
+
+func TestHandleInboxMeetingMember(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.Stub(dsmock.YAMLData(`
+	meeting/1/user_ids: [2]
+	meeting/2/user_ids: [3]
+	`))
+
+	backend := icctest.NewRecordingBackend()
+	n := notify.New(ctx, backend, notify.WithInbox(backend, ds, 10, time.Hour))
+	auther := icctest.AutherStub{UserID: 2}
+	mux := http.NewServeMux()
+	notify.HandleInbox(mux, n, &auther)
+	notify.HandlePoll(mux, n, &auther)
+
+	for _, meetingID := range []int{1, 2} {
+		message := fmt.Sprintf(`{"channel_id":"server:1:2","name":"meeting-%d","to_meeting":%d,"message":"hans"}`, meetingID, meetingID)
+		if _, err := n.Publish(ctx, strings.NewReader(message), 1); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	t.Run("member", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, httptest.NewRequest("GET", "/system/icc/notify/inbox?meeting_id=1", nil))
+		if resp.Result().StatusCode != 200 {
+			t.Fatalf("request returned status %s: %s", resp.Result().Status, resp.Body.String())
+		}
+
+		if !strings.Contains(resp.Body.String(), `"name":"meeting-1"`) {
+			t.Errorf("got `%s`, expected the message to meeting 1", resp.Body.String())
+		}
+	})
+
+	for _, path := range []string{"inbox", "poll"} {
+		t.Run("not member "+path, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			mux.ServeHTTP(resp, httptest.NewRequest("GET", "/system/icc/notify/"+path+"?meeting_id=2&timeout_seconds=0", nil))
+			if resp.Result().StatusCode != 400 {
+				t.Errorf("request returned status %s, expected 400", resp.Result().Status)
+			}
+
+			body := resp.Body.String()
+			if strings.Contains(body, "meeting-2") || !strings.Contains(body, `"error":"not-allowed"`) {
+				t.Errorf("got `%s`, expected a not-allowed error without the message", body)
+			}
+		})
+	}
+}
+
+func TestHandleInboxSender(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := icctest.NewRecordingBackend()
+	n := notify.New(ctx, backend, notify.WithInbox(backend, nil, 10, time.Hour))
+	auther := icctest.AutherStub{UserID: 2}
+	mux := http.NewServeMux()
+	notify.HandleInbox(mux, n, &auther)
+
+	for _, sender := range []int{1, 3, 1} {
+		message := fmt.Sprintf(`{"channel_id":"server:%d:1","name":"from-%d","to_users":[2],"message":"hans"}`, sender, sender)
+		if _, err := n.Publish(ctx, strings.NewReader(message), sender); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, httptest.NewRequest("GET", "/system/icc/notify/inbox?sender_user_id=3", nil))
+	if resp.Result().StatusCode != 200 {
+		t.Fatalf("request returned status %s: %s", resp.Result().Status, resp.Body.String())
+	}
+
+	// The last id is from the last message, also if it is from another sender.
+	body := resp.Body.String()
+	if strings.Contains(body, `"name":"from-1"`) || !strings.Contains(body, `"id":"2-0"`) || !strings.Contains(body, `"last_id":"3-0","last_user_id":"3-0","last_meeting_id":""`) {
+		t.Errorf("got `%s`, expected only message 2-0 and the last id 3-0", body)
+	}
+
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, httptest.NewRequest("GET", "/system/icc/notify/inbox?sender_user_id=-1", nil))
+	if resp.Result().StatusCode != 400 {
+		t.Errorf("invalid sender returned status %s, expected 400", resp.Result().Status)
+	}
+}
+
+func TestHandlePoll(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := icctest.NewRecordingBackend()
+	n := notify.New(ctx, backend, notify.WithInbox(backend, nil, 10, time.Hour))
+	auther := icctest.AutherStub{UserID: 2}
+	mux := http.NewServeMux()
+	notify.HandlePoll(mux, n, &auther)
+
+	publish := func(t *testing.T, name string) string {
+		t.Helper()
+
+		ids, err := n.Publish(ctx, strings.NewReader(`{"channel_id":"server:1:2","name":"`+name+`","to_users":[2],"message":"hans"}`), 1)
+		if err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+
+		// Deliver the saved message back to the topic like redis does.
+		ops := backend.Operations()
+		for i := len(ops) - 1; i >= 0; i-- {
+			if ops[i].Method == "NotifyPublish" {
+				backend.ScriptNotify([]byte(ops[i].Args[0].(string)))
+				break
+			}
+		}
+		return ids[0]
+	}
+
+	poll := func(url string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, httptest.NewRequest("GET", url, nil).WithContext(ctx))
+		return resp
+	}
+
+	t.Run("immediate batch", func(t *testing.T) {
+		id := publish(t, "missed")
+
+		resp := poll("/system/icc/notify/poll")
+		if resp.Result().StatusCode != 200 {
+			t.Fatalf("request returned status %s: %s", resp.Result().Status, resp.Body.String())
+		}
+
+		expect := fmt.Sprintf(`{"messages":[{"id":"1-0","sender_user_id":1,"sender_channel_id":"server:1:2","name":"missed","message":"hans","message_id":"%s","published_at":%d}],"last_id":"1-0","last_user_id":"1-0","last_meeting_id":""}`, id, publishedAt(t, resp.Body.String())) + "\n"
+		if got := resp.Body.String(); got != expect {
+			t.Errorf("got `%s`, expected `%s`", got, expect)
+		}
+	})
+
+	t.Run("timeout empty", func(t *testing.T) {
+		start := time.Now()
+		resp := poll("/system/icc/notify/poll?last_id=1-0&timeout_seconds=1")
+
+		if d := time.Since(start); d < time.Second {
+			t.Errorf("request returned after %s, expected to wait one second", d)
+		}
+
+		expect := `{"messages":[],"last_id":"1-0","last_user_id":"1-0","last_meeting_id":"1-0"}` + "\n"
+		if got := resp.Body.String(); got != expect {
+			t.Errorf("got `%s`, expected `%s`", got, expect)
+		}
+	})
+
+	t.Run("wait for message", func(t *testing.T) {
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			done <- poll("/system/icc/notify/poll?last_id=1-0&timeout_seconds=5")
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+		publish(t, "new")
+
+		select {
+		case resp := <-done:
+			if !strings.Contains(resp.Body.String(), `"name":"new"`) || !strings.Contains(resp.Body.String(), `"last_id":"2-0"`) {
+				t.Errorf("got `%s`, expected the new message", resp.Body.String())
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("poll did not return after a new message")
+		}
+	})
+
+	t.Run("wait for matching message", func(t *testing.T) {
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			done <- poll("/system/icc/notify/poll?last_id=2-0&filter=name=wanted&timeout_seconds=5")
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+		publish(t, "other")
+		time.Sleep(10 * time.Millisecond)
+		publish(t, "wanted")
+
+		select {
+		case resp := <-done:
+			body := resp.Body.String()
+			if strings.Contains(body, `"name":"other"`) || !strings.Contains(body, `"name":"wanted"`) || !strings.Contains(body, `"last_user_id":"4-0"`) {
+				t.Errorf("got `%s`, expected only the wanted message", body)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("poll did not return after a matching message")
+		}
+	})
+
+	t.Run("filter timeout moves cursor", func(t *testing.T) {
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			done <- poll("/system/icc/notify/poll?last_id=4-0&filter=name=wanted&timeout_seconds=1")
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+		publish(t, "other")
+
+		select {
+		case resp := <-done:
+			expect := `{"messages":[],"last_id":"5-0","last_user_id":"5-0","last_meeting_id":"4-0"}` + "\n"
+			if got := resp.Body.String(); got != expect {
+				t.Errorf("got `%s`, expected `%s`", got, expect)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("poll did not return after the timeout")
+		}
+	})
+
+	t.Run("inbox disabled", func(t *testing.T) {
+		disabledMux := http.NewServeMux()
+		notify.HandlePoll(disabledMux, notify.New(ctx, newBackendStrub()), &auther)
+
+		resp := httptest.NewRecorder()
+		disabledMux.ServeHTTP(resp, httptest.NewRequest("GET", "/system/icc/notify/poll", nil))
+		if resp.Result().StatusCode != 400 {
+			t.Errorf("request returned status %s, expected 400", resp.Result().Status)
+		}
+	})
+}
+
+func TestHandlePause(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := notify.New(ctx, newBackendStrub(), notify.WithPause(10))
+	auther := icctest.AutherStub{UserID: 2}
+	mux := http.NewServeMux()
+	notify.HandlePause(mux, n, &auther)
+
+	cid, _ := n.Receive(ctx, 0, 2)
+
+	for _, tt := range []struct {
+		name   string
+		url    string
+		status int
+		expect string
+	}{
+		{"pause", "/system/icc/notify/pause?channel_id=" + cid, 200, `{"paused": true}` + "\n"},
+		{"resume", "/system/icc/notify/resume?channel_id=" + cid, 200, `{"paused": false}` + "\n"},
+		{"without channel", "/system/icc/notify/pause", 400, ""},
+		{"unknown channel", "/system/icc/notify/pause?channel_id=server:2:404", 404, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			mux.ServeHTTP(resp, httptest.NewRequest("POST", tt.url, nil))
+
+			if resp.Result().StatusCode != tt.status {
+				t.Fatalf("got status %s, expected %d: %s", resp.Result().Status, tt.status, resp.Body.String())
+			}
+
+			if tt.expect != "" && resp.Body.String() != tt.expect {
+				t.Errorf("got `%s`, expected `%s`", resp.Body.String(), tt.expect)
+			}
+		})
+	}
+}
+
+func TestHandlePublishList(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := notify.New(ctx, newBackendStrub())
+	auther := icctest.AutherStub{UserID: 1}
+	mux := http.NewServeMux()
+	notify.HandlePublish(mux, n, &auther)
+
+	messages := `[
+		{"channel_id":"server:1:2","name":"valid","to_users":[2],"message":"hans"},
+		{"channel_id":"server:1:2","to_users":[2],"message":"hans"},
+		{"channel_id":"server:3:2","name":"other-user","to_users":[2],"message":"hans"}
+	]`
+
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, httptest.NewRequest("POST", "/system/icc/notify/publish", strings.NewReader(messages)))
+	if resp.Result().StatusCode != 400 {
+		t.Fatalf("request returned status %s, expected 400", resp.Result().Status)
+	}
+
+	expect := `"errors":[{"index":1,"msg":"notify message does not have required field ` + "`name`" + `"},{"index":2,"msg":"invalid channel id ` + "`server:3:2`" + `"}]`
+	if !strings.Contains(resp.Body.String(), expect) {
+		t.Errorf("got body `%s`, expected it to contain `%s`", resp.Body.String(), expect)
+	}
+}
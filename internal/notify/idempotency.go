@@ -0,0 +1,81 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// IdempotencyBackend remembers the idempotency keys of published messages.
+type IdempotencyBackend interface {
+	// IdempotencyMark saves the message id for the key, if the key is not
+	// saved yet. Otherwise, the saved message id is returned. The key is
+	// removed after ttl.
+	IdempotencyMark(key string, messageID string, ttl time.Duration) (firstID string, err error)
+
+	// IdempotencyUnmark removes the key.
+	IdempotencyUnmark(key string) error
+}
+
+// WithIdempotency lets a client publish a message with the field
+// `idempotency_key`. If the same user publishes another message with the same
+// key in the given window, it is not saved. Publish returns the id of the
+// first message instead.
+//
+// So a client can retry a publish request, when it does not know, if the
+// first request was successful.
+//
+// With WithAsyncPublish, the key is kept, even if the message could not be
+// saved.
+//
+// The window is the lifetime of the keys in the backend. It has to be greater
+// then 0. Otherwise the option is ignored.
+func WithIdempotency(backend IdempotencyBackend, window time.Duration) Option {
+	return func(n *Notify) {
+		if window <= 0 {
+			return
+		}
+		n.idempotency = backend
+		n.idempotencyWindow = window
+	}
+}
+
+// publishOnce saves the message, if its idempotency key was not used yet.
+// Returns the id of the saved message or of the first message with the key.
+func (n *Notify) publishOnce(ctx context.Context, uid int, message Message) (string, error) {
+	message.ID = n.generateMessageID()
+	message.PublishedAt = n.clock.now()
+
+	var key string
+	if n.idempotency != nil && message.IdempotencyKey != "" {
+		key = fmt.Sprintf("%d:%s", uid, message.IdempotencyKey)
+
+		firstID, err := n.idempotency.IdempotencyMark(key, message.ID, n.idempotencyWindow)
+		if err != nil {
+			return "", fmt.Errorf("marking idempotency key: %w", err)
+		}
+
+		if firstID != message.ID {
+			return firstID, nil
+		}
+	}
+
+	// The key is only needed to find duplicates.
+	message.IdempotencyKey = ""
+
+	bs, err := marshalJSON(message)
+	if err != nil {
+		return "", fmt.Errorf("can not marshal notify message: %v", err)
+	}
+
+	if err := n.save(ctx, bs, message); err != nil {
+		if key != "" {
+			if unmarkErr := n.idempotency.IdempotencyUnmark(key); unmarkErr != nil {
+				return "", fmt.Errorf("%w (removing idempotency key: %v)", err, unmarkErr)
+			}
+		}
+		return "", err
+	}
+
+	return message.ID, nil
+}
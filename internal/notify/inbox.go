@@ -0,0 +1,249 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+)
+
+// InboxBackend stores the messages of the inboxes.
+type InboxBackend interface {
+	// InboxAdd adds a message to the inboxes with the given keys. Each inbox
+	// keeps only the newest `size` messages. It is removed, if there was no
+	// new message for the duration ttl.
+	InboxAdd(keys []string, message []byte, size int, ttl time.Duration) error
+
+	// InboxSince returns all messages of the inbox with the given key that
+	// are newer then lastID. If lastID is empty, all messages are returned.
+	//
+	// The ids are stream ids in the form `milliseconds-sequence` and are
+	// ordered like the messages.
+	InboxSince(key string, lastID string) (ids []string, messages [][]byte, err error)
+}
+
+// WithInbox saves each message to a user or a meeting in an inbox. A client
+// can fetch the messages it missed while it was not connected.
+//
+// Each inbox keeps the newest `size` messages and is removed after ttl without
+// new messages. The datastore is used to check, that a user belongs to a
+// meeting before the meeting inbox is read.
+func WithInbox(inbox InboxBackend, ds datastore.Getter, size int, ttl time.Duration) Option {
+	return func(n *Notify) {
+		n.inbox = inbox
+		n.datastore = ds
+		n.inboxSize = size
+		n.inboxTTL = ttl
+	}
+}
+
+// The kinds of inboxes.
+const (
+	inboxUser    = "user"
+	inboxMeeting = "meeting"
+)
+
+// InboxMessage is a message from an inbox.
+type InboxMessage struct {
+	ID string `json:"id"`
+	OutMessage
+
+	// inbox is the kind of inbox, the message is from.
+	inbox string
+}
+
+// InboxCursor is the id of the last read message in the inbox of the user and
+// in the inbox of the meeting. The inboxes are different streams, so their ids
+// are not compared with each other.
+type InboxCursor struct {
+	User    string
+	Meeting string
+}
+
+// next returns the cursor after the messages.
+func (c InboxCursor) next(messages []InboxMessage) InboxCursor {
+	for _, m := range messages {
+		switch m.inbox {
+		case inboxUser:
+			c.User = m.ID
+		case inboxMeeting:
+			c.Meeting = m.ID
+		}
+	}
+	return c
+}
+
+// newest returns the newer id of the two inboxes.
+func (c InboxCursor) newest() string {
+	if c.User == "" || (c.Meeting != "" && streamIDLess(c.User, c.Meeting)) {
+		return c.Meeting
+	}
+	return c.User
+}
+
+// CanReadInbox checks, that the user can read the inbox of the meeting.
+//
+// A user can only read the inbox of a meeting, that he belongs to. With a
+// meetingID of 0, only the inbox of the user is read, which is always allowed.
+func (n *Notify) CanReadInbox(ctx context.Context, meetingID, uid int) error {
+	if meetingID == 0 {
+		return nil
+	}
+
+	if n.datastore == nil {
+		return iccerror.NewMessageError(iccerror.ErrNotAllowed, "You are not part of meeting %d.", meetingID)
+	}
+
+	meetingUserIDs, err := datastore.NewRequest(n.datastore).Meeting_UserIDs(meetingID).Value(ctx)
+	if err != nil {
+		return fmt.Errorf("fetching meeting users: %w", err)
+	}
+
+	for _, u := range meetingUserIDs {
+		if u == uid {
+			return nil
+		}
+	}
+
+	return iccerror.NewMessageError(iccerror.ErrNotAllowed, "You are not part of meeting %d.", meetingID)
+}
+
+// Inbox returns the messages for the user and the meeting, that are newer then
+// the cursor.
+//
+// With a meetingID of 0, only the messages to the user are returned. If the
+// inbox is not enabled, no messages are returned.
+func (n *Notify) Inbox(meetingID, uid int, cursor InboxCursor) ([]InboxMessage, error) {
+	if n.inbox == nil {
+		return nil, nil
+	}
+
+	for _, lastID := range []string{cursor.User, cursor.Meeting} {
+		if lastID == "" {
+			continue
+		}
+
+		if _, _, ok := splitStreamID(lastID); !ok {
+			return nil, iccerror.NewMessageError(iccerror.ErrInvalid, "invalid last id `%s`", lastID)
+		}
+	}
+
+	type inbox struct {
+		kind   string
+		key    string
+		lastID string
+	}
+
+	var inboxes []inbox
+	if uid != 0 {
+		inboxes = append(inboxes, inbox{inboxUser, userInboxKey(uid), cursor.User})
+	}
+	if meetingID != 0 {
+		inboxes = append(inboxes, inbox{inboxMeeting, meetingInboxKey(meetingID), cursor.Meeting})
+	}
+
+	var out []InboxMessage
+	for _, inbox := range inboxes {
+		key := inbox.key
+		ids, messages, err := n.inbox.InboxSince(key, inbox.lastID)
+		if err != nil {
+			return nil, fmt.Errorf("reading inbox %s: %w", key, err)
+		}
+
+		for i, m := range messages {
+			var message Message
+			if err := json.Unmarshal(m, &message); err != nil {
+				return nil, fmt.Errorf("decoding message %s from inbox %s: %w", ids[i], key, err)
+			}
+
+			out = append(out, InboxMessage{
+				ID:    ids[i],
+				inbox: inbox.kind,
+				OutMessage: OutMessage{
+					message.ChannelID.uid(),
+					message.ChannelID.String(),
+					message.Name,
+					message.Message,
+					message.ID,
+					message.PublishedAt,
+					message.Meta,
+				},
+			})
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return streamIDLess(out[i].ID, out[j].ID)
+	})
+
+	return out, nil
+}
+
+// addToInbox saves the encoded message in the inboxes of its users and its
+// meeting. Ephemeral messages are not saved.
+func (n *Notify) addToInbox(bs []byte, message Message) error {
+	if n.inbox == nil || message.Ephemeral {
+		return nil
+	}
+
+	var keys []string
+	for _, uid := range message.ToUsers {
+		keys = append(keys, userInboxKey(uid))
+	}
+	if message.ToMeeting != 0 {
+		keys = append(keys, meetingInboxKey(message.ToMeeting))
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if err := n.inbox.InboxAdd(keys, bs, n.inboxSize, n.inboxTTL); err != nil {
+		return fmt.Errorf("adding message to inboxes %v: %w", keys, err)
+	}
+	return nil
+}
+
+func userInboxKey(uid int) string {
+	return fmt.Sprintf("user:%d", uid)
+}
+
+func meetingInboxKey(meetingID int) string {
+	return fmt.Sprintf("meeting:%d", meetingID)
+}
+
+// streamIDLess returns true, if the stream id a is older then b.
+//
+// Stream ids have the form `milliseconds-sequence`.
+func streamIDLess(a, b string) bool {
+	aMS, aSeq, _ := splitStreamID(a)
+	bMS, bSeq, _ := splitStreamID(b)
+	if aMS != bMS {
+		return aMS < bMS
+	}
+	return aSeq < bSeq
+}
+
+// splitStreamID returns the milliseconds and the sequence of a stream id. The
+// sequence is optional. ok is false, if the id is invalid.
+func splitStreamID(id string) (ms, seq uint64, ok bool) {
+	parts := strings.SplitN(id, "-", 2)
+	ms, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	if len(parts) == 2 {
+		seq, err = strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+	}
+	return ms, seq, true
+}
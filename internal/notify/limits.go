@@ -0,0 +1,80 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// WithMaxMessageBytes limits the size of the field `message` of published
+// messages. Bigger messages are rejected with ErrInvalid.
+func WithMaxMessageBytes(size int) Option {
+	return func(n *Notify) {
+		n.maxMessageBytes = size
+	}
+}
+
+// WithMaxMessageDepth limits the nesting of objects and lists in the field
+// `message` of published messages. Deeper messages are rejected with
+// ErrInvalid.
+//
+// A message like `{"a":[1]}` has a depth of 2. Strings and numbers have a
+// depth of 0.
+func WithMaxMessageDepth(depth int) Option {
+	return func(n *Notify) {
+		n.maxMessageDepth = depth
+	}
+}
+
+// WithMaxListItems limits the number of messages in a published list.
+// Longer lists are rejected with ErrInvalid.
+func WithMaxListItems(max int) Option {
+	return func(n *Notify) {
+		n.maxListItems = max
+	}
+}
+
+// validateLimits returns the problems of a message, that is too big or too
+// deep.
+func (n *Notify) validateLimits(message Message) []string {
+	var problems []string
+	if n.maxMessageBytes > 0 && len(message.Message) > n.maxMessageBytes {
+		problems = append(problems, fmt.Sprintf("field `message` has %d bytes, only %d are allowed", len(message.Message), n.maxMessageBytes))
+	}
+
+	if n.maxMessageDepth > 0 && jsonDepth(message.Message) > n.maxMessageDepth {
+		problems = append(problems, fmt.Sprintf("field `message` is nested deeper then %d levels", n.maxMessageDepth))
+	}
+	return problems
+}
+
+// jsonDepth returns the maximum nesting of objects and lists in valid json.
+func jsonDepth(data json.RawMessage) int {
+	var depth, max int
+	var inString, escaped bool
+	for _, b := range data {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case b == '\\':
+				escaped = true
+			case b == '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch b {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+			if depth > max {
+				max = depth
+			}
+		case '}', ']':
+			depth--
+		}
+	}
+	return max
+}
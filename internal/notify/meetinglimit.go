@@ -0,0 +1,130 @@
+package notify
+
+import (
+	"sync"
+	"time"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+	"github.com/OpenSlides/openslides-icc-service/internal/ratelimit"
+)
+
+// meetingLimitCleanup is the minimum time between two removals of unused
+// buckets.
+const meetingLimitCleanup = time.Minute
+
+// WithMaxMeetingPublishRate limits the number of published messages per second
+// for each meeting. Messages to a meeting over the limit are rejected with
+// ErrTooManyRequests. Other meetings are not affected.
+//
+// Messages without to_meeting are not limited by this option.
+func WithMaxMeetingPublishRate(rps float64) Option {
+	return func(n *Notify) {
+		n.meetingLimit = newMeetingLimit(rps, time.Now)
+	}
+}
+
+// meetingLimit holds a token bucket for each meeting.
+type meetingLimit struct {
+	rps   float64
+	burst int
+
+	// idle is the time after that an unused bucket is full again. Such a
+	// bucket can be removed.
+	idle time.Duration
+	now  func() time.Time
+
+	mu          sync.Mutex
+	buckets     map[int]*meetingBucket
+	lastCleanup time.Time
+}
+
+type meetingBucket struct {
+	bucket   *ratelimit.Bucket
+	lastUsed time.Time
+}
+
+func newMeetingLimit(rps float64, now func() time.Time) *meetingLimit {
+	burst := int(rps)
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &meetingLimit{
+		rps:         rps,
+		burst:       burst,
+		idle:        time.Duration(float64(burst) / rps * float64(time.Second)),
+		now:         now,
+		buckets:     make(map[int]*meetingBucket),
+		lastCleanup: now(),
+	}
+}
+
+// allow takes a token from the bucket of each meeting. If one bucket is empty,
+// no token is taken and the id of this meeting is returned with false.
+func (l *meetingLimit) allow(meetingIDs ...int) (int, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastCleanup) >= meetingLimitCleanup {
+		l.cleanup(now)
+	}
+
+	taken := make([]*meetingBucket, 0, len(meetingIDs))
+	for _, meetingID := range meetingIDs {
+		b, ok := l.buckets[meetingID]
+		if !ok {
+			b = &meetingBucket{bucket: ratelimit.New(l.rps, l.burst)}
+			l.buckets[meetingID] = b
+		}
+		b.lastUsed = now
+
+		if !b.bucket.Allow() {
+			for _, t := range taken {
+				t.bucket.Refund()
+			}
+			return meetingID, false
+		}
+		taken = append(taken, b)
+	}
+	return 0, true
+}
+
+// cleanup removes the buckets, that are full again. A new bucket for the same
+// meeting would behave the same.
+//
+// Has to be called with the lock.
+func (l *meetingLimit) cleanup(now time.Time) {
+	for meetingID, b := range l.buckets {
+		if now.Sub(b.lastUsed) >= l.idle {
+			delete(l.buckets, meetingID)
+		}
+	}
+	l.lastCleanup = now
+}
+
+// allowMeetings checks the limit of each meeting the messages are sent to.
+// Each meeting is counted once, also if more then one message is sent to it.
+//
+// The tokens are only taken, if all meetings are under the limit. So it has to
+// be called after all other checks of the messages.
+func (n *Notify) allowMeetings(messages ...Message) error {
+	if n.meetingLimit == nil {
+		return nil
+	}
+
+	seen := make(map[int]bool, len(messages))
+	meetingIDs := make([]int, 0, len(messages))
+	for _, message := range messages {
+		if message.ToMeeting == 0 || seen[message.ToMeeting] {
+			continue
+		}
+		seen[message.ToMeeting] = true
+		meetingIDs = append(meetingIDs, message.ToMeeting)
+	}
+
+	if meetingID, ok := n.meetingLimit.allow(meetingIDs...); !ok {
+		return iccerror.NewMessageError(iccerror.ErrTooManyRequests, "Too many messages to meeting %d.", meetingID)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package notify
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMeetingLimitCleanup(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newMeetingLimit(10, func() time.Time { return now })
+
+	l.allow(1)
+	now = now.Add(59500 * time.Millisecond)
+	l.allow(2)
+
+	if len(l.buckets) != 2 {
+		t.Fatalf("got %d buckets, expected 2", len(l.buckets))
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	l.allow(3)
+
+	if _, ok := l.buckets[1]; ok {
+		t.Errorf("unused bucket of meeting 1 was not removed")
+	}
+
+	if _, ok := l.buckets[2]; !ok {
+		t.Errorf("bucket of meeting 2 was removed")
+	}
+}
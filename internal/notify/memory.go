@@ -0,0 +1,276 @@
+package notify
+
+import (
+	"sync"
+	"time"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
+)
+
+// memoryLogInterval is the minimum time between two log messages about
+// dropped messages.
+const memoryLogInterval = 10 * time.Second
+
+// WithMaxBufferedBytes limits the bytes of all messages, that are buffered in
+// the process for receive connections. This are the messages waiting for a
+// connection, the messages of paused connections and the queues of
+// WithBufferSize.
+//
+// When the limit is reached, the connection with the most buffered bytes is
+// closed with ErrTooSlow. So one slow client does not make the other
+// connections lose messages. If the connection, that gets a new message, has
+// the most buffered bytes itself, its oldest messages are dropped instead.
+// Closed connections and dropped messages are logged.
+//
+// A size of 0 means, that there is no limit.
+func WithMaxBufferedBytes(size int) Option {
+	return func(n *Notify) {
+		if size > 0 {
+			n.memory = &memoryBudget{max: int64(size), now: time.Now}
+		}
+	}
+}
+
+// BufferedBytes returns the bytes of all messages, that are buffered for
+// receive connections. It returns 0 without WithMaxBufferedBytes, since the
+// bytes are not counted.
+func (n *Notify) BufferedBytes() int64 {
+	if n.memory == nil {
+		return 0
+	}
+	return n.memory.current()
+}
+
+// bufferMemory returns the memory budget for the queues of bufferNext. It is
+// nil, if the memory is not limited.
+func (n *Notify) bufferMemory() *memoryBudget {
+	return n.memory
+}
+
+// memoryLimitedReceiver is a Receiver with a limit for buffered messages.
+type memoryLimitedReceiver interface {
+	bufferMemory() *memoryBudget
+}
+
+// memoryBudget counts the bytes of buffered messages of all connections.
+//
+// The methods can be called on a nil pointer. In this case, nothing is counted.
+type memoryBudget struct {
+	max int64
+	now func() time.Time
+
+	// mu also protects the fields of all connMemory of the budget.
+	mu      sync.Mutex
+	used    int64
+	conns   map[*connMemory]struct{}
+	dropped int
+	lastLog time.Time
+}
+
+// newConn returns the counter for the buffered messages of one connection.
+//
+// evict is called, when the connection is removed from the budget, because
+// the limit is reached and it has the most buffered bytes. The connection
+// should be closed with ErrTooSlow.
+func (m *memoryBudget) newConn(evict func()) *connMemory {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conns == nil {
+		m.conns = make(map[*connMemory]struct{})
+	}
+
+	c := &connMemory{budget: m, evict: evict}
+	m.conns[c] = struct{}{}
+	return c
+}
+
+// full returns true, if more bytes are counted then the limit.
+func (m *memoryBudget) full() bool {
+	if m == nil {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.used > m.max
+}
+
+func (m *memoryBudget) current() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.used
+}
+
+// shed is called after count messages were dropped. It logs the dropped
+// messages, but not more then once per memoryLogInterval.
+func (m *memoryBudget) shed(count int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.dropped += count
+	now := m.now()
+	if now.Sub(m.lastLog) < memoryLogInterval {
+		return
+	}
+
+	icclog.Info("Buffered messages reached the limit of %d bytes. Dropped %d messages", m.max, m.dropped)
+	m.dropped = 0
+	m.lastLog = now
+}
+
+// connMemory counts the buffered messages of one connection. After close, the
+// bytes are released and later calls do nothing.
+type connMemory struct {
+	budget *memoryBudget
+	evict  func()
+
+	// The fields are protected by the lock of the budget.
+	used   int
+	closed bool
+}
+
+func (c *connMemory) add(size int) {
+	if c == nil {
+		return
+	}
+
+	c.budget.mu.Lock()
+	defer c.budget.mu.Unlock()
+
+	if !c.closed {
+		c.used += size
+		c.budget.used += int64(size)
+	}
+}
+
+func (c *connMemory) release(size int) {
+	if c == nil {
+		return
+	}
+
+	c.budget.mu.Lock()
+	defer c.budget.mu.Unlock()
+
+	if !c.closed {
+		c.used -= size
+		c.budget.used -= int64(size)
+	}
+}
+
+// close releases all bytes of the connection.
+func (c *connMemory) close() {
+	c.budget.mu.Lock()
+	defer c.budget.mu.Unlock()
+
+	c.closeLocked()
+}
+
+// closeLocked is like close, but has to be called with the lock of the budget.
+func (c *connMemory) closeLocked() {
+	c.budget.used -= int64(c.used)
+	c.used = 0
+	c.closed = true
+	delete(c.budget.conns, c)
+}
+
+// reclaim evicts the other connections with the most buffered bytes, while
+// the limit is reached. So a slow client, that holds most of the memory, does
+// not make other connections drop their messages.
+//
+// Returns false, if the limit is still reached, because c itself has the most
+// buffered bytes. In this case, c has to drop some of its messages.
+func (c *connMemory) reclaim() bool {
+	type eviction struct {
+		conn *connMemory
+		used int
+	}
+
+	m := c.budget
+	var evicted []eviction
+	defer func() {
+		for _, e := range evicted {
+			icclog.Info("Buffered messages reached the limit of %d bytes. Closing a connection with %d bytes", m.max, e.used)
+			e.conn.evict()
+		}
+	}()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for m.used > m.max {
+		var largest *connMemory
+		for conn := range m.conns {
+			if largest == nil || conn.used > largest.used {
+				largest = conn
+			}
+		}
+
+		if largest == nil || largest == c || largest.used <= c.used {
+			return false
+		}
+
+		evicted = append(evicted, eviction{largest, largest.used})
+		largest.closeLocked()
+	}
+	return true
+}
+
+// checkEvicted returns ErrTooSlow, if the connection was removed from the
+// memory budget, since it had the most buffered bytes.
+func (mp *messageProvider) checkEvicted() error {
+	select {
+	case <-mp.evicted:
+		return iccerror.NewMessageError(iccerror.ErrTooSlow, "The buffered messages reached the memory limit.")
+	default:
+		return nil
+	}
+}
+
+// messageSize is the number of bytes, that are counted for a buffered
+// message.
+func messageSize(m Message) int {
+	size := len(m.ID) + len(m.ChannelID) + len(m.Name) + len(m.Message)
+	for k, v := range m.Meta {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+// outMessageSize is the number of bytes, that are counted for a queued
+// message.
+func outMessageSize(m OutMessage) int {
+	size := len(m.MessageID) + len(m.SenderChannelID) + len(m.Name) + len(m.Message)
+	for k, v := range m.Meta {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+// shedBuffer drops the oldest messages of the connection, while the limit is
+// reached and the connection has the most buffered bytes.
+func (mp *messageProvider) shedBuffer() {
+	if mp.memory == nil {
+		return
+	}
+
+	var dropped int
+	for len(mp.messageBuf) > 0 && mp.memory.budget.full() {
+		if mp.memory.reclaim() {
+			break
+		}
+
+		mp.memory.release(messageSize(mp.messageBuf[0]))
+		mp.messageBuf = mp.messageBuf[1:]
+		dropped++
+	}
+
+	if dropped > 0 {
+		mp.memory.budget.shed(dropped)
+	}
+}
@@ -0,0 +1,145 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+)
+
+func TestBufferNextMemory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	memory := &memoryBudget{max: 3500, now: time.Now}
+
+	payload := []byte(`"` + strings.Repeat("x", 1000) + `"`)
+	var sent int
+	next := func(ctx context.Context) (OutMessage, error) {
+		if sent == 6 {
+			<-ctx.Done()
+			return OutMessage{}, ctx.Err()
+		}
+		sent++
+		return OutMessage{Name: string(rune('0' + sent)), Message: payload}, nil
+	}
+
+	receiveCtx, cancelReceive := context.WithCancel(ctx)
+	buffered := bufferNext(receiveCtx, next, 10, memory, func() {
+		t.Errorf("tooSlow was called")
+	})
+
+	// Wait until the six messages are queued.
+	time.Sleep(20 * time.Millisecond)
+
+	if used := memory.current(); used > 3500 || used == 0 {
+		t.Errorf("%d bytes are counted, expected at most 3500", used)
+	}
+
+	message, err := buffered(receiveCtx)
+	if err != nil {
+		t.Fatalf("receiving message: %v", err)
+	}
+
+	if message.Name != "4" {
+		t.Errorf("got message %s, expected the oldest message 1 to 3 to be dropped", message.Name)
+	}
+
+	cancelReceive()
+
+	// The counted bytes are released in the background.
+	time.Sleep(10 * time.Millisecond)
+
+	if used := memory.current(); used != 0 {
+		t.Errorf("%d bytes are counted after the connection is closed, expected 0", used)
+	}
+}
+
+func TestBufferNextMemorySlowConnection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	memory := &memoryBudget{max: 3500, now: time.Now}
+	payload := []byte(`"` + strings.Repeat("x", 1000) + `"`)
+
+	feed := func() (chan OutMessage, NextMessage) {
+		messages := make(chan OutMessage, 10)
+		return messages, func(ctx context.Context) (OutMessage, error) {
+			select {
+			case m := <-messages:
+				return m, nil
+			case <-ctx.Done():
+				return OutMessage{}, ctx.Err()
+			}
+		}
+	}
+
+	stalledFeed, stalledNext := feed()
+	stalledTooSlow := make(chan struct{})
+	stalled := bufferNext(ctx, stalledNext, 100, memory, func() { close(stalledTooSlow) })
+
+	healthyFeed, healthyNext := feed()
+	healthy := bufferNext(ctx, healthyNext, 100, memory, func() {
+		t.Errorf("tooSlow of the healthy connection was called")
+	})
+
+	for i := 0; i < 10; i++ {
+		message := OutMessage{Name: fmt.Sprintf("m-%d", i), Message: payload}
+		stalledFeed <- message
+
+		// Let the stalled connection queue the message first.
+		time.Sleep(5 * time.Millisecond)
+		healthyFeed <- message
+
+		nextCtx, nextCancel := context.WithTimeout(ctx, time.Second)
+		got, err := healthy(nextCtx)
+		nextCancel()
+		if err != nil {
+			t.Fatalf("healthy connection: %v", err)
+		}
+
+		if got.Name != message.Name {
+			t.Fatalf("healthy connection got %s, expected %s", got.Name, message.Name)
+		}
+	}
+
+	select {
+	case <-stalledTooSlow:
+	case <-time.After(time.Second):
+		t.Fatalf("stalled connection was not closed")
+	}
+
+	if _, err := stalled(ctx); !errors.Is(err, iccerror.ErrTooSlow) {
+		t.Errorf("stalled connection returned `%v`, expected `%v`", err, iccerror.ErrTooSlow)
+	}
+
+	if used := memory.current(); used > 3500 {
+		t.Errorf("%d bytes are counted, expected at most 3500", used)
+	}
+}
+
+func TestMemoryBudgetLog(t *testing.T) {
+	now := time.Unix(1000, 0)
+	memory := &memoryBudget{max: 10, now: func() time.Time { return now }}
+
+	memory.shed(2)
+	if memory.dropped != 0 {
+		t.Fatalf("first drop was not logged")
+	}
+
+	now = now.Add(time.Second)
+	memory.shed(3)
+	if memory.dropped != 3 {
+		t.Errorf("got %d dropped messages, expected 3 waiting for the next log", memory.dropped)
+	}
+
+	now = now.Add(memoryLogInterval)
+	memory.shed(1)
+	if memory.dropped != 0 {
+		t.Errorf("got %d dropped messages after the interval, expected them to be logged", memory.dropped)
+	}
+}
@@ -0,0 +1,117 @@
+package notify
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// WithULIDMessageIDs uses ULIDs (https://github.com/ulid/spec) as message ids
+// instead of the instance id with a counter. ULIDs can be sorted as strings.
+//
+// The ids of one instance are strictly increasing in the order the messages
+// are published, also within the same millisecond. The ids of different
+// instances are ordered by their time in milliseconds.
+func WithULIDMessageIDs() Option {
+	return func(n *Notify) {
+		n.ulid = &ulidGen{now: time.Now}
+	}
+}
+
+// generateMessageID returns the id for a published message.
+func (n *Notify) generateMessageID() string {
+	if n.ulid != nil {
+		return n.ulid.generate()
+	}
+	return n.cIDGen.generateMessageID()
+}
+
+// crockford is the base32 alphabet of ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidGen generates monotonic ULIDs.
+type ulidGen struct {
+	now func() time.Time
+
+	mu     sync.Mutex
+	lastMS uint64
+
+	// entropy contains the 80 random bits of the last id. The first 16 bits
+	// are in hi.
+	hi uint16
+	lo uint64
+}
+
+// generate returns a new ULID. If the time did not increase since the last
+// id, the random part of the last id is increased by one.
+func (g *ulidGen) generate() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := uint64(g.now().UnixMilli())
+	if ms > g.lastMS {
+		var b [10]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			// Without randomness, the ids are still increasing.
+			b = [10]byte{}
+		}
+		g.lastMS = ms
+		g.hi = binary.BigEndian.Uint16(b[:2])
+		g.lo = binary.BigEndian.Uint64(b[2:])
+	} else {
+		g.lo++
+		if g.lo == 0 {
+			g.hi++
+			if g.hi == 0 {
+				// The random part overflowed. Use the next millisecond.
+				g.lastMS++
+			}
+		}
+	}
+
+	return encodeULID(g.lastMS, g.hi, g.lo)
+}
+
+// encodeULID encodes the 48 bit time and the 80 bit entropy as 26 characters
+// of crockford base32.
+func encodeULID(ms uint64, hi uint16, lo uint64) string {
+	// The 128 bits of the id as two numbers.
+	high := ms<<16 | uint64(hi)
+	low := lo
+
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[low&31]
+		low = low>>5 | high<<59
+		high >>= 5
+	}
+	return string(out[:])
+}
+
+// publishClock returns the publish time of messages. The zero value uses the
+// system time.
+type publishClock struct {
+	// clock replaces the system time, if it is set.
+	clock func() time.Time
+
+	mu   sync.Mutex
+	last int64
+}
+
+// now returns the current time in unix milliseconds. The returned values of
+// one instance never decrease, also if the system time is set back.
+func (c *publishClock) now() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	systemTime := time.Now
+	if c.clock != nil {
+		systemTime = c.clock
+	}
+
+	if ms := systemTime().UnixMilli(); ms > c.last {
+		c.last = ms
+	}
+	return c.last
+}
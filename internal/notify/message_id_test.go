@@ -0,0 +1,53 @@
+package notify
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestULID(t *testing.T) {
+	t.Run("encoding", func(t *testing.T) {
+		// The time part from the example of the ULID spec.
+		got := encodeULID(1469918176385, 0, 0)
+		expect := "01ARYZ6S41" + strings.Repeat("0", 16)
+
+		if got != expect {
+			t.Errorf("got %s, expected %s", got, expect)
+		}
+	})
+
+	t.Run("monotonic in the same millisecond", func(t *testing.T) {
+		now := time.UnixMilli(1469918176385)
+		g := ulidGen{now: func() time.Time { return now }}
+
+		last := g.generate()
+		for i := 0; i < 100; i++ {
+			if i == 50 {
+				now = now.Add(time.Millisecond)
+			}
+
+			id := g.generate()
+			if len(id) != 26 {
+				t.Fatalf("id %s has length %d, expected 26", id, len(id))
+			}
+
+			if id <= last {
+				t.Fatalf("id %s is not greater then the last id %s", id, last)
+			}
+			last = id
+		}
+	})
+
+	t.Run("overflow of the random part", func(t *testing.T) {
+		now := time.UnixMilli(1000)
+		g := ulidGen{now: func() time.Time { return now }}
+		first := g.generate()
+
+		g.hi = 1<<16 - 1
+		g.lo = 1<<64 - 1
+		if id := g.generate(); id <= first || g.lastMS != 1001 {
+			t.Errorf("got id %s with time %d after overflow, expected the next millisecond", id, g.lastMS)
+		}
+	})
+}
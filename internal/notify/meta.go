@@ -0,0 +1,48 @@
+package notify
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// MetaHeaderPrefix is the prefix of the http headers, that are saved as
+// metadata of a published message. The header `X-ICC-Meta-Source: x` is saved
+// as `{"source":"x"}`.
+const MetaHeaderPrefix = "X-ICC-Meta-"
+
+type metaContextKey struct{}
+
+// metaFromHeader returns the metadata from the headers with the
+// MetaHeaderPrefix. Returns nil, if there are none.
+func metaFromHeader(header http.Header) map[string]string {
+	prefix := http.CanonicalHeaderKey(MetaHeaderPrefix)
+
+	var meta map[string]string
+	for name, values := range header {
+		if !strings.HasPrefix(name, prefix) || len(name) == len(prefix) {
+			continue
+		}
+
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[strings.ToLower(name[len(prefix):])] = strings.Join(values, ",")
+	}
+	return meta
+}
+
+// withMeta adds the metadata to the context, so Publish adds it to the
+// messages.
+func withMeta(ctx context.Context, meta map[string]string) context.Context {
+	if meta == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, metaContextKey{}, meta)
+}
+
+// metaFromContext returns the metadata from withMeta.
+func metaFromContext(ctx context.Context) map[string]string {
+	meta, _ := ctx.Value(metaContextKey{}).(map[string]string)
+	return meta
+}
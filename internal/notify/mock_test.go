@@ -1,12 +1,43 @@
 package notify_test
 
 import (
+	"bytes"
 	"context"
 	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
 
+	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
+	"github.com/OpenSlides/openslides-icc-service/internal/icctest"
 	"github.com/OpenSlides/openslides-icc-service/internal/notify"
 )
 
+// logoutAutherStub is like icctest.AutherStub but cancels the context of all
+// authenticated requests, when the logout channel is closed. This is the same
+// behavior as auth.Auth on a logout event.
+type logoutAutherStub struct {
+	icctest.AutherStub
+	logout chan struct{}
+}
+
+func (a *logoutAutherStub) Authenticate(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	ctx, cancel := context.WithCancel(r.Context())
+	go func() {
+		defer cancel()
+
+		select {
+		case <-a.logout:
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, nil
+}
+
 type messageProviderStub struct {
 	nm  chan notify.OutMessage
 	err chan error
@@ -46,38 +77,54 @@ type receiverStub struct {
 	callledMeetingID int
 }
 
-func (r *receiverStub) Receive(meetingID, uid int) (cid string, nm notify.NextMessage) {
+func (r *receiverStub) Receive(ctx context.Context, meetingID, uid int) (cid string, nm notify.NextMessage) {
 	r.called = true
 	r.callledMeetingID = meetingID
 
 	return r.cid, r.nm
 }
 
+type bufferedReceiverStub struct {
+	receiverStub
+	size int
+}
+
+func (r *bufferedReceiverStub) BufferSize() int {
+	return r.size
+}
+
 type publisherStub struct {
 	expectedErr  error
 	called       bool
 	calledUserID int
 }
 
-func (s *publisherStub) Publish(r io.Reader, uid int) error {
+func (s *publisherStub) Publish(ctx context.Context, r io.Reader, uid int) ([]string, error) {
 	s.called = true
 	s.calledUserID = uid
-	return s.expectedErr
+	if s.expectedErr != nil {
+		return nil, s.expectedErr
+	}
+	return []string{"message-id"}, nil
 }
 
 type backendStub struct {
 	messages         chan []byte
 	receivedMessages [][]byte
+	ephemeral        chan []byte
+	retained         map[int]map[string][]byte
 }
 
 func newBackendStrub() *backendStub {
 	b := backendStub{}
 	b.messages = make(chan []byte, 10)
+	b.ephemeral = make(chan []byte, 10)
 	return &b
 }
 
 func (b *backendStub) reset() {
 	b.receivedMessages = b.receivedMessages[0:0]
+	b.retained = nil
 	for {
 		select {
 		case <-b.messages:
@@ -102,3 +149,143 @@ func (b *backendStub) NotifyReceive(ctx context.Context) (message []byte, err er
 		return nil, ctx.Err()
 	}
 }
+
+func (b *backendStub) NotifyPublishEphemeral(bs []byte) error {
+	b.ephemeral <- bs
+	return nil
+}
+
+func (b *backendStub) NotifyReceiveEphemeral(ctx context.Context) ([]byte, error) {
+	select {
+	case m := <-b.ephemeral:
+		return m, nil
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (b *backendStub) NotifyRetain(meetingID int, name string, message []byte, ttl time.Duration) error {
+	if b.retained == nil {
+		b.retained = make(map[int]map[string][]byte)
+	}
+	if b.retained[meetingID] == nil {
+		b.retained[meetingID] = make(map[string][]byte)
+	}
+	b.retained[meetingID][name] = message
+	return nil
+}
+
+func (b *backendStub) NotifyUnretain(meetingID int, name string) error {
+	delete(b.retained[meetingID], name)
+	return nil
+}
+
+func (b *backendStub) NotifyRetained(meetingID int) ([][]byte, error) {
+	var out [][]byte
+	for _, m := range b.retained[meetingID] {
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// nopBackend is a backend that drops all messages.
+type nopBackend struct{}
+
+func (nopBackend) NotifyPublish([]byte) error {
+	return nil
+}
+
+func (nopBackend) NotifyReceive(ctx context.Context) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (nopBackend) NotifyPublishEphemeral([]byte) error {
+	return nil
+}
+
+func (nopBackend) NotifyReceiveEphemeral(ctx context.Context) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (nopBackend) NotifyRetain(int, string, []byte, time.Duration) error {
+	return nil
+}
+
+func (nopBackend) NotifyUnretain(int, string) error {
+	return nil
+}
+
+func (nopBackend) NotifyRetained(int) ([][]byte, error) {
+	return nil, nil
+}
+
+// blockingBackend is a backend that blocks NotifyPublish until release is
+// closed.
+type blockingBackend struct {
+	nopBackend
+	release chan struct{}
+	saved   chan []byte
+}
+
+func newBlockingBackend() *blockingBackend {
+	return &blockingBackend{
+		release: make(chan struct{}),
+		saved:   make(chan []byte, 10),
+	}
+}
+
+func (b *blockingBackend) NotifyPublish(bs []byte) error {
+	<-b.release
+	b.saved <- bs
+	return nil
+}
+
+// debugLog contains the debug output of all tests.
+//
+// The debug logger is set in init(), because it can not be changed while
+// goroutines of other tests are logging.
+var debugLog syncBuffer
+
+func init() {
+	icclog.SetDebugLogger(log.New(&debugLog, "", 0))
+}
+
+// syncBuffer is a bytes.Buffer that can be used from many goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+var publishedAtRE = regexp.MustCompile(`"published_at":(\d+)`)
+
+// publishedAt returns the first value of the field published_at in data. It
+// fails the test, if there is none.
+func publishedAt(t testing.TB, data string) int64 {
+	t.Helper()
+
+	match := publishedAtRE.FindStringSubmatch(data)
+	if match == nil {
+		t.Fatalf("no published_at in %s", data)
+	}
+
+	v, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		t.Fatalf("invalid published_at in %s: %v", data, err)
+	}
+	return v
+}
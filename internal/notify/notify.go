@@ -1,18 +1,29 @@
 package notify
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
 	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
 	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
+	"github.com/OpenSlides/openslides-icc-service/internal/ratelimit"
 	"github.com/ostcar/topic"
 )
 
+// systemChannelID is the reserved channel id for messages that are created by
+// the service itself. No user can publish with it, since it belongs to the
+// anonymous user.
+const systemChannelID channelID = "system:0:0"
+
 // Backend stores the notify messages.
 type Backend interface {
 	// NotifyPublish saves a valid notify message.
@@ -27,34 +38,197 @@ type Backend interface {
 	// It is expected, that only one goroutine is calling this function. The
 	// Backend keeps track what the last send message was.
 	NotifyReceive(ctx context.Context) (message []byte, err error)
+
+	// NotifyPublishEphemeral sends an ephemeral message to all instances
+	// without saving it. So it is never received by a later NotifyReceive.
+	NotifyPublishEphemeral([]byte) error
+
+	// NotifyReceiveEphemeral is a blocking function that receives the
+	// ephemeral messages, that are published while it is listening.
+	//
+	// It is expected, that only one goroutine is calling this function.
+	NotifyReceiveEphemeral(ctx context.Context) (message []byte, err error)
+
+	// NotifyRetain saves a message as the last value for the name in the
+	// meeting. An older message with the same name is overwritten. The
+	// retained messages of a meeting are removed after ttl without a new
+	// retained message.
+	NotifyRetain(meetingID int, name string, message []byte, ttl time.Duration) error
+
+	// NotifyUnretain removes the retained message for the name in the
+	// meeting.
+	NotifyUnretain(meetingID int, name string) error
+
+	// NotifyRetained returns the retained messages of a meeting.
+	NotifyRetained(meetingID int) ([][]byte, error)
 }
 
+// defaultRetainTTL is the time, the retained messages of a meeting are kept
+// without WithRetainTTL.
+const defaultRetainTTL = 24 * time.Hour
+
+// errConnectionExpired is returned by the NextMessage function, when the
+// connection is older then the max connection age.
+var errConnectionExpired = errors.New("connection expired")
+
 // Notify holds the state of the service.
 type Notify struct {
 	backend Backend
 	cIDGen  cIDGen
+	ulid    *ulidGen
+	clock   publishClock
 	topic   *topic.Topic
+
+	maxConnectionAge time.Duration
+	dedup            bool
+	retainTTL        time.Duration
+	publishLimit     *ratelimit.Bucket
+	meetingLimit     *meetingLimit
+
+	publishWorkers   int
+	publishQueueSize int
+	pooledBufferSize int
+	publishAsync     bool
+	pool             *publishPool
+
+	inbox     InboxBackend
+	inboxSize int
+	inboxTTL  time.Duration
+
+	datastore    datastore.Getter
+	publishPerms map[string]string
+
+	idempotency       IdempotencyBackend
+	idempotencyWindow time.Duration
+
+	schemas Schemas
+
+	maxMessageBytes   int
+	maxMessageDepth   int
+	maxListItems      int
+	allowEmptyMessage bool
+	invalidUTF8       utf8Policy
+	canonicalJSON     bool
+
+	bufferSize int
+	memory     *memoryBudget
+
+	persist       PersistBackend
+	persistMaxLen int
+
+	pauseBuffer int
+	pausesMu    sync.Mutex
+	pauses      map[string]*pauseState
+}
+
+// Option is an optional argument for notify.New().
+type Option func(*Notify)
+
+// WithMaxConnectionAge sets the duration, a receive connection is open. After
+// this duration, the server tells the client to reconnect.
+//
+// A duration of 0 means, that connections are open without limit.
+func WithMaxConnectionAge(d time.Duration) Option {
+	return func(n *Notify) {
+		n.maxConnectionAge = d
+	}
+}
+
+// WithRetainTTL sets the time, the retained messages of a meeting are kept
+// after the last retained message to the meeting. The default is one day.
+func WithRetainTTL(d time.Duration) Option {
+	return func(n *Notify) {
+		n.retainTTL = d
+	}
+}
+
+// WithAllowEmptyMessage accepts published messages without the field
+// `message` or with the value null. Without this option, they are rejected
+// with ErrInvalid.
+func WithAllowEmptyMessage() Option {
+	return func(n *Notify) {
+		n.allowEmptyMessage = true
+	}
+}
+
+// WithDedup lets each connection drop a message, if it is the same as the last
+// message from the same sender channel.
+//
+// Each connection only remembers the last message of the 64 sender channels,
+// it received a message from most recently.
+func WithDedup() Option {
+	return func(n *Notify) {
+		n.dedup = true
+	}
+}
+
+// WithMaxPublishRate limits the number of published messages per second for
+// all users together. Messages over the limit are rejected with
+// ErrTooManyRequests.
+func WithMaxPublishRate(rps float64) Option {
+	return func(n *Notify) {
+		burst := int(rps)
+		if burst < 1 {
+			burst = 1
+		}
+		n.publishLimit = ratelimit.New(rps, burst)
+	}
+}
+
+// WithPublishWorkers saves published messages with a fixed number of workers
+// instead of the request goroutine. So a slow backend does not block more then
+// `workers` goroutines.
+func WithPublishWorkers(workers int) Option {
+	return func(n *Notify) {
+		n.publishWorkers = workers
+	}
+}
+
+// WithAsyncPublish lets Publish return, before the message is saved in the
+// backend. Errors from the backend are only logged.
+//
+// If WithPublishWorkers is not used, one worker saves the messages.
+func WithAsyncPublish() Option {
+	return func(n *Notify) {
+		n.publishAsync = true
+	}
 }
 
 // New returns an initialized state of the notify service.
 //
 // The New function is not blocking. The context is used to stop a goroutine
 // that is started by this function.
-func New(ctx context.Context, b Backend) *Notify {
+func New(ctx context.Context, b Backend, options ...Option) *Notify {
 	notify := Notify{
-		backend: b,
-		topic:   topic.New(topic.WithClosed(ctx.Done())),
+		backend:          b,
+		topic:            topic.New(topic.WithClosed(ctx.Done())),
+		retainTTL:        defaultRetainTTL,
+		publishQueueSize: defaultPublishQueueSize,
+		pooledBufferSize: defaultPooledBufferSize,
+	}
+
+	for _, o := range options {
+		o(&notify)
+	}
+
+	if notify.publishAsync && notify.publishWorkers < 1 {
+		notify.publishWorkers = 1
 	}
 
-	go notify.listen(ctx)
+	if notify.publishWorkers > 0 {
+		notify.pool = newPublishPool(&notify, notify.publishWorkers, notify.publishQueueSize, notify.publishAsync, ctx.Done())
+	}
+
+	go notify.listen(ctx, b.NotifyReceive)
+	go notify.listen(ctx, b.NotifyReceiveEphemeral)
 	return &notify
 }
 
 // listen waits for Notify messages from the backend and saves them into the
 // topic.
-func (n *Notify) listen(ctx context.Context) {
+func (n *Notify) listen(ctx context.Context, receive func(context.Context) ([]byte, error)) {
 	for {
-		m, err := n.backend.NotifyReceive(ctx)
+		m, err := receive(ctx)
 		if err != nil {
 			if errors.Is(err, context.Canceled) {
 				return
@@ -75,34 +249,238 @@ type NextMessage func(context.Context) (OutMessage, error)
 
 // Receive returns an individuel channel id and a channel to receive messages
 // from.
-func (n *Notify) Receive(meetingID, uid int) (cid string, nm NextMessage) {
-	channelID := n.cIDGen.generate(uid)
+//
+// The state of the connection, like its pause state and its memory, is
+// released, when ctx is done.
+func (n *Notify) Receive(ctx context.Context, meetingID, uid int) (cid string, nm NextMessage) {
+	id := n.cIDGen.generate(uid)
 
 	mp := messageProvider{
 		tid:       n.topic.LastID(),
 		uid:       uid,
 		meetingID: meetingID,
-		channelID: channelID,
+		channelID: id,
 		topic:     n.topic,
 	}
 
-	return channelID.String(), mp.Next
+	if meetingID != 0 {
+		mp.retained = func() ([][]byte, error) {
+			return n.backend.NotifyRetained(meetingID)
+		}
+	}
+
+	if n.maxConnectionAge > 0 {
+		mp.expires = time.Now().Add(n.maxConnectionAge)
+	}
+
+	if n.dedup {
+		mp.lastMessage = newLastMessages(dedupMaxSenders)
+	}
+
+	var release []func()
+	if n.pauses != nil {
+		var unregister func()
+		mp.pause, unregister = n.registerPause(id.String())
+		mp.pauseBuffer = n.pauseBuffer
+		release = append(release, unregister)
+	}
+
+	if n.memory != nil {
+		evicted := make(chan struct{})
+		var once sync.Once
+		mp.evicted = evicted
+		mp.memory = n.memory.newConn(func() { once.Do(func() { close(evicted) }) })
+		release = append(release, mp.memory.close)
+	}
+
+	if len(release) > 0 {
+		go func() {
+			<-ctx.Done()
+			for _, f := range release {
+				f()
+			}
+		}()
+	}
+
+	return id.String(), mp.Next
+}
+
+// defaultPooledBufferSize is the maximum size of a buffer that is put back into
+// the bufferPool without WithPooledBufferSize.
+const defaultPooledBufferSize = 64 << 10
+
+// WithPooledBufferSize sets the maximum size of a buffer, that is put back
+// into the bufferPool after a publish request. Bigger buffers are left for the
+// garbage collector. A size of 0 reads each request into a new buffer. A
+// negative size is ignored.
+func WithPooledBufferSize(size int) Option {
+	return func(n *Notify) {
+		if size >= 0 {
+			n.pooledBufferSize = size
+		}
+	}
+}
+
+// bufferPool holds buffers to read the body of publish requests.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
 }
 
 // Publish reads and saves the notify event from the given reader.
-func (n *Notify) Publish(r io.Reader, uid int) error {
-	var message Message
-	if err := json.NewDecoder(r).Decode(&message); err != nil {
-		return iccerror.NewMessageError(iccerror.ErrInvalid, "invalid json: %v", err)
+//
+// The reader can also contain a json list of messages. In this case, either
+// all messages are saved or, if some are invalid, none. The returned
+// iccerror.ValidationError lists the problems of all invalid messages. Each
+// message of a list counts for the publish rate. For the publish rate of each
+// meeting, a list counts as one message.
+//
+// With WithPublishPermissions, the user needs the permission for each message.
+//
+// Returns the ids of the saved messages. The receivers get each message with
+// its id.
+func (n *Notify) Publish(ctx context.Context, r io.Reader, uid int) ([]string, error) {
+	if n.publishLimit != nil && !n.publishLimit.Allow() {
+		return nil, iccerror.ErrTooManyRequests
+	}
+
+	buf := new(bytes.Buffer)
+	if n.pooledBufferSize > 0 {
+		buf = bufferPool.Get().(*bytes.Buffer)
+		defer func() {
+			if buf.Cap() <= n.pooledBufferSize {
+				buf.Reset()
+				bufferPool.Put(buf)
+			}
+		}()
+	}
+
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, fmt.Errorf("reading message: %w", err)
 	}
 
-	if err := validateMessage(message, uid); err != nil {
-		return fmt.Errorf("validate message: %w", err)
+	data := bytes.TrimSpace(buf.Bytes())
+	if len(data) == 0 {
+		return nil, iccerror.NewMessageError(iccerror.ErrInvalid, "the request body is empty")
 	}
 
-	bs, err := json.Marshal(message)
+	if data[0] == '[' {
+		return n.publishList(ctx, data, uid)
+	}
+
+	message, problems := n.parseMessage(buf.Bytes(), uid)
+	if len(problems) > 0 {
+		return nil, iccerror.NewMessageError(iccerror.ErrInvalid, "%s", strings.Join(problems, "; "))
+	}
+
+	message.Meta = metaFromContext(ctx)
+
+	if err := n.canPublish(ctx, uid, message); err != nil {
+		return nil, fmt.Errorf("checking permission: %w", err)
+	}
+
+	if err := n.allowMeetings(message); err != nil {
+		return nil, err
+	}
+
+	id, err := n.publishOnce(ctx, uid, message)
 	if err != nil {
-		return fmt.Errorf("can not marshal notify message: %v", err)
+		return nil, err
+	}
+	return []string{id}, nil
+}
+
+// publishList validates and saves a json list of messages.
+func (n *Notify) publishList(ctx context.Context, data []byte, uid int) ([]string, error) {
+	var rawMessages []json.RawMessage
+	if err := json.Unmarshal(data, &rawMessages); err != nil {
+		return nil, iccerror.NewMessageError(iccerror.ErrInvalid, "invalid json: %v", err)
+	}
+
+	if len(rawMessages) == 0 {
+		return nil, iccerror.NewMessageError(iccerror.ErrInvalid, "list of messages is empty")
+	}
+
+	if n.maxListItems > 0 && len(rawMessages) > n.maxListItems {
+		return nil, iccerror.NewMessageError(iccerror.ErrInvalid, "list has %d messages, only %d are allowed", len(rawMessages), n.maxListItems)
+	}
+
+	// Publish took one token for the request. Each other message needs its
+	// own token.
+	if n.publishLimit != nil && len(rawMessages) > 1 && !n.publishLimit.AllowN(len(rawMessages)-1) {
+		n.publishLimit.Refund()
+		return nil, iccerror.ErrTooManyRequests
+	}
+
+	messages := make([]Message, len(rawMessages))
+	var validationErr iccerror.ValidationError
+	for i, raw := range rawMessages {
+		message, problems := n.parseMessage(raw, uid)
+		for _, problem := range problems {
+			validationErr.Problems = append(validationErr.Problems, iccerror.Problem{Index: i, Msg: problem})
+		}
+		message.Meta = metaFromContext(ctx)
+		messages[i] = message
+	}
+
+	if len(validationErr.Problems) > 0 {
+		return nil, validationErr
+	}
+
+	for i, message := range messages {
+		if err := n.canPublish(ctx, uid, message); err != nil {
+			return nil, fmt.Errorf("checking permission of message %d: %w", i, err)
+		}
+	}
+
+	if err := n.allowMeetings(messages...); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(messages))
+	for i, message := range messages {
+		id, err := n.publishOnce(ctx, uid, message)
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", i, err)
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+// save saves the encoded message with the publish pool or directly.
+func (n *Notify) save(ctx context.Context, bs []byte, message Message) error {
+	if n.pool != nil {
+		return n.pool.publish(ctx, bs, message)
+	}
+
+	return n.store(bs, message)
+}
+
+// AsyncPublish returns true, if Publish returns before the message is saved.
+func (n *Notify) AsyncPublish() bool {
+	return n.publishAsync
+}
+
+// store saves the encoded message in the backend.
+//
+// The inbox is written first. So a client, that is woken up by the published
+// message, finds it in the inbox.
+//
+// Ephemeral messages are only sent to the open connections. They are not
+// written to the stream, the inbox or the persist stream.
+func (n *Notify) store(bs []byte, message Message) error {
+	if message.Ephemeral {
+		icclog.Debug("Sending ephemeral notify message: `%s`", bs)
+		if err := n.backend.NotifyPublishEphemeral(bs); err != nil {
+			return fmt.Errorf("sending ephemeral message: %w", err)
+		}
+		return nil
+	}
+
+	if err := n.addToInbox(bs, message); err != nil {
+		return fmt.Errorf("saving message in inbox: %w", err)
 	}
 
 	icclog.Debug("Saving notify message: `%s`", bs)
@@ -110,29 +488,149 @@ func (n *Notify) Publish(r io.Reader, uid int) error {
 		return fmt.Errorf("saving message in backend: %w", err)
 	}
 
+	if err := n.retain(bs, message); err != nil {
+		return fmt.Errorf("saving retained message in backend: %w", err)
+	}
+
+	if err := n.addToPersist(bs, message); err != nil {
+		return fmt.Errorf("saving message in persist stream: %w", err)
+	}
+
 	return nil
 }
 
-func validateMessage(message Message, userID int) error {
+// retain saves a message with the field `retain` as the current value of its
+// name in its meeting. A message without a value removes the retained message.
+func (n *Notify) retain(bs []byte, message Message) error {
+	if !message.Retain {
+		return nil
+	}
+
+	if isEmptyJSON(message.Message) {
+		return n.backend.NotifyUnretain(message.ToMeeting, message.Name)
+	}
+	return n.backend.NotifyRetain(message.ToMeeting, message.Name, bs, n.retainTTL)
+}
+
+// PublishSystem publishes a message from the service itself to all connections
+// of a meeting.
+//
+// The message is not saved in the backend but only delivered to the
+// connections of this instance. It is expected, that each instance of the
+// service creates the same system messages.
+func (n *Notify) PublishSystem(meetingID int, name string, message interface{}) error {
+	encodedMessage, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("encoding system message: %w", err)
+	}
+
+	bs, err := json.Marshal(Message{
+		ChannelID: systemChannelID,
+		ToMeeting: meetingID,
+		Name:      name,
+		Message:   encodedMessage,
+	})
+	if err != nil {
+		return fmt.Errorf("can not marshal notify message: %v", err)
+	}
+
+	icclog.Debug("Publish system message: `%s`", bs)
+	n.topic.Publish(string(bs))
+	return nil
+}
+
+// parseMessage decodes and validates one message. It returns all problems of
+// the message.
+func (n *Notify) parseMessage(data []byte, userID int) (Message, []string) {
+	var message Message
+	if err := json.Unmarshal(data, &message); err != nil {
+		return Message{}, []string{fmt.Sprintf("invalid json: %v", err)}
+	}
+
+	problems := validateMessage(message, userID)
+	problems = append(problems, n.checkUTF8(&message)...)
+	// A retained message without a value removes the retained message.
+	if !n.allowEmptyMessage && !message.Retain && isEmptyJSON(message.Message) {
+		problems = append(problems, "notify message does not have required field `message`")
+	}
+
+	if limits := n.validateLimits(message); len(limits) > 0 {
+		// Do not decode a message, that is too big.
+		return message, append(problems, limits...)
+	}
+
+	problems = append(problems, n.canonicalize(&message)...)
+	return message, append(problems, n.schemas.validate(message)...)
+}
+
+// isEmptyJSON returns true, if the json value is missing or null.
+func isEmptyJSON(value json.RawMessage) bool {
+	value = bytes.TrimSpace(value)
+	return len(value) == 0 || bytes.Equal(value, []byte("null"))
+}
+
+// validateMessage returns all problems of the message.
+func validateMessage(message Message, userID int) []string {
+	var problems []string
 	if message.ChannelID.uid() != userID {
-		return iccerror.NewMessageError(iccerror.ErrInvalid, "invalid channel id `%s`", message.ChannelID)
+		problems = append(problems, fmt.Sprintf("invalid channel id `%s`", message.ChannelID))
 	}
 
 	if message.Name == "" {
-		return iccerror.NewMessageError(iccerror.ErrInvalid, "notify message does not have required field `name`")
+		problems = append(problems, "notify message does not have required field `name`")
 	}
 
-	return nil
+	if message.Ephemeral && message.Retain {
+		problems = append(problems, "ephemeral message can not be retained")
+	}
+
+	if message.Retain && message.ToMeeting == 0 {
+		problems = append(problems, "retained message needs the field `to_meeting`")
+	}
+
+	return problems
 }
 
 // Message is a message from the one client to all/some others.
 type Message struct {
+	// ID is set by the service, when the message is published. A value from
+	// the client is overwritten.
+	ID string `json:"id,omitempty"`
+
+	// PublishedAt is the time in unix milliseconds, when the message was
+	// published. It is set by the service. A value from the client is
+	// overwritten.
+	PublishedAt int64 `json:"published_at,omitempty"`
+
 	ChannelID  channelID       `json:"channel_id"`
 	ToMeeting  int             `json:"to_meeting,omitempty"`
 	ToUsers    []int           `json:"to_users,omitempty"`
 	ToChannels []string        `json:"to_channels,omitempty"`
 	Name       string          `json:"name"`
 	Message    json.RawMessage `json:"message"`
+
+	// Priority of the message. If a connection has many messages waiting,
+	// messages with a higher priority are delivered first.
+	Priority int `json:"priority,omitempty"`
+
+	// Retain marks the message as the current value for its name in the
+	// meeting ToMeeting. It is delivered to each new connection to the meeting
+	// until a newer message with the same name is published. A retained
+	// message without a value removes the current value.
+	Retain bool `json:"retain,omitempty"`
+
+	// Ephemeral marks a message, that is only delivered to the connections
+	// that are open when it is published, like a typing indicator. It is not
+	// saved in the inbox and can not be retained.
+	Ephemeral bool `json:"ephemeral,omitempty"`
+
+	// IdempotencyKey is used with WithIdempotency to find a message, that is
+	// published again. It is not saved with the message.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// Meta contains the metadata from the X-ICC-Meta-* headers of the publish
+	// request. A value from the client is overwritten.
+	Meta map[string]string `json:"meta,omitempty"`
 }
 
 func (m Message) forMe(meetingID, uid int, cID channelID) bool {
@@ -156,10 +654,13 @@ func (m Message) forMe(meetingID, uid int, cID channelID) bool {
 
 // OutMessage is a message that is going out of the service.
 type OutMessage struct {
-	SenderUserID    int             `json:"sender_user_id"`
-	SenderChannelID string          `json:"sender_channel_id"`
-	Name            string          `json:"name"`
-	Message         json.RawMessage `json:"message"`
+	SenderUserID    int               `json:"sender_user_id"`
+	SenderChannelID string            `json:"sender_channel_id"`
+	Name            string            `json:"name"`
+	Message         json.RawMessage   `json:"message"`
+	MessageID       string            `json:"message_id,omitempty"`
+	PublishedAt     int64             `json:"published_at,omitempty"`
+	Meta            map[string]string `json:"meta,omitempty"`
 }
 
 // messageProvider returns messages by calling Next().
@@ -170,42 +671,192 @@ type messageProvider struct {
 	channelID channelID
 
 	topic      *topic.Topic
-	messageBuf []string
+	messageBuf []Message
+
+	// retained returns the retained messages of the meeting. It is called
+	// with the first call of Next() and then set to nil. It is nil for
+	// connections without a meeting.
+	retained func() ([][]byte, error)
+
+	// retainedIDs are the ids of the delivered retained messages. A message
+	// published after the connection started can be in the retained messages
+	// and in the topic. It is only delivered once.
+	retainedIDs map[string]bool
+
+	// expires is the time, when the connection expires. The zero value means,
+	// that it does not expire.
+	expires time.Time
+
+	// lastMessage holds the last message of the recent sender channels. If it
+	// is nil, duplicate messages are not dropped.
+	lastMessage *lastMessages
+
+	// pause is the pause state of the connection. It is nil, if pausing is
+	// disabled.
+	pause       *pauseState
+	pauseBuffer int
+
+	// memory counts the bytes of messageBuf. It is nil, if the memory is not
+	// limited. It is closed, when the context of the connection is done.
+	memory *connMemory
+
+	// evicted is closed, when the connection was removed from the memory
+	// budget. It is nil, if the memory is not limited.
+	evicted <-chan struct{}
 }
 
 // Next returns the next message. Can be called many times.
+//
+// If there are many messages waiting for the connection, the messages with a
+// higher priority are returned first.
 func (mp *messageProvider) Next(ctx context.Context) (OutMessage, error) {
-	var message Message
+	if err := mp.checkEvicted(); err != nil {
+		return OutMessage{}, err
+	}
 
-	for {
-		if len(mp.messageBuf) == 0 {
-			tid, messages, err := mp.topic.Receive(ctx, mp.tid)
-			if err != nil {
-				return OutMessage{}, fmt.Errorf("fetching message from topic: %w", err)
-			}
+	if mp.retained != nil {
+		retained, err := mp.retained()
+		if err != nil {
+			return OutMessage{}, fmt.Errorf("fetching retained messages: %w", err)
+		}
+		mp.retained = nil
 
-			mp.tid = tid
-			mp.messageBuf = messages
+		for _, m := range retained {
+			if err := mp.addToBuffer(string(m)); err != nil {
+				return OutMessage{}, fmt.Errorf("adding retained message: %w", err)
+			}
 		}
 
-		m := mp.messageBuf[0]
-		mp.messageBuf = mp.messageBuf[1:]
+		mp.retainedIDs = make(map[string]bool, len(mp.messageBuf))
+		for _, message := range mp.messageBuf {
+			if message.ID != "" {
+				mp.retainedIDs[message.ID] = true
+			}
+		}
+	}
 
-		if err := json.Unmarshal([]byte(m), &message); err != nil {
-			return OutMessage{}, fmt.Errorf("decoding message: %w", err)
+	for {
+		// The connection can be paused while it waits for messages. So the
+		// pause is checked again after each receive.
+		if mp.pause != nil {
+			if err := mp.waitResume(ctx); err != nil {
+				return OutMessage{}, err
+			}
 		}
 
-		if message.forMe(mp.meetingID, mp.uid, mp.channelID) {
+		if len(mp.messageBuf) > 0 {
+			// New messages are added to the waiting ones, so a message with a
+			// higher priority does not wait until the buffer is empty. The
+			// topic has new messages, so fetch does not block.
+			if mp.topic.LastID() > mp.tid {
+				if err := mp.fetch(ctx); err != nil {
+					return OutMessage{}, err
+				}
+			}
 			break
 		}
+
+		if err := mp.fetch(ctx); err != nil {
+			return OutMessage{}, err
+		}
 	}
 
+	if err := mp.checkEvicted(); err != nil {
+		return OutMessage{}, err
+	}
+
+	message := mp.messageBuf[0]
+	mp.messageBuf = mp.messageBuf[1:]
+	mp.memory.release(messageSize(message))
+
 	out := OutMessage{
 		message.ChannelID.uid(),
 		message.ChannelID.String(),
 		message.Name,
 		message.Message,
+		message.ID,
+		message.PublishedAt,
+		message.Meta,
 	}
 
 	return out, nil
 }
+
+// fetch receives the next messages from the topic and adds them to the message
+// buffer. The buffer is sorted by priority. Messages with the same priority
+// keep their order.
+func (mp *messageProvider) fetch(ctx context.Context) error {
+	tid, messages, err := mp.receive(ctx)
+	if err != nil {
+		return fmt.Errorf("fetching message from topic: %w", err)
+	}
+	mp.tid = tid
+
+	for _, m := range messages {
+		if err := mp.addToBuffer(m); err != nil {
+			return fmt.Errorf("adding message: %w", err)
+		}
+	}
+
+	sort.SliceStable(mp.messageBuf, func(i, j int) bool {
+		return mp.messageBuf[i].Priority > mp.messageBuf[j].Priority
+	})
+	return nil
+}
+
+// addToBuffer decodes a message and adds it to the message buffer, if it is for
+// the connection.
+func (mp *messageProvider) addToBuffer(m string) error {
+	var message Message
+	if err := json.Unmarshal([]byte(m), &message); err != nil {
+		return fmt.Errorf("decoding message: %w", err)
+	}
+
+	if !message.forMe(mp.meetingID, mp.uid, mp.channelID) {
+		return nil
+	}
+
+	if mp.retainedIDs[message.ID] {
+		delete(mp.retainedIDs, message.ID)
+		return nil
+	}
+
+	if mp.lastMessage != nil {
+		// Each message has its own id and publish time. So duplicates are
+		// compared without them.
+		withoutID := message
+		withoutID.ID = ""
+		withoutID.PublishedAt = 0
+		bs, err := json.Marshal(withoutID)
+		if err != nil {
+			return fmt.Errorf("encoding message without id: %w", err)
+		}
+
+		if mp.lastMessage.repeated(message.ChannelID, string(bs)) {
+			return nil
+		}
+	}
+
+	mp.messageBuf = append(mp.messageBuf, message)
+	mp.memory.add(messageSize(message))
+	mp.shedBuffer()
+	return nil
+}
+
+// receive fetches the next messages from the topic. It returns
+// errConnectionExpired, if the connection expires before there are new
+// messages.
+func (mp *messageProvider) receive(ctx context.Context) (uint64, []string, error) {
+	if mp.expires.IsZero() {
+		return mp.topic.Receive(ctx, mp.tid)
+	}
+
+	expiresCtx, cancel := context.WithDeadline(ctx, mp.expires)
+	defer cancel()
+
+	tid, messages, err := mp.topic.Receive(expiresCtx, mp.tid)
+	if err != nil && ctx.Err() == nil && expiresCtx.Err() != nil {
+		return 0, nil, errConnectionExpired
+	}
+	return tid, messages, err
+}
@@ -2,12 +2,17 @@ package notify_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/dsmock"
 	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+	"github.com/OpenSlides/openslides-icc-service/internal/icctest"
 	"github.com/OpenSlides/openslides-icc-service/internal/notify"
 )
 
@@ -21,7 +26,7 @@ func TestSend(t *testing.T) {
 	t.Run("invalid json", func(t *testing.T) {
 		defer backend.reset()
 
-		err := n.Publish(strings.NewReader(`{123`), 1)
+		_, err := n.Publish(ctx, strings.NewReader(`{123`), 1)
 
 		if !errors.Is(err, iccerror.ErrInvalid) {
 			t.Errorf("send() returned err `%s`, expected `%s`", err, iccerror.ErrInvalid.Error())
@@ -31,7 +36,7 @@ func TestSend(t *testing.T) {
 	t.Run("invalid format", func(t *testing.T) {
 		defer backend.reset()
 
-		err := n.Publish(strings.NewReader(`{"to_users":1,"message":"hans"}`), 1)
+		_, err := n.Publish(ctx, strings.NewReader(`{"to_users":1,"message":"hans"}`), 1)
 
 		if !errors.Is(err, iccerror.ErrInvalid) {
 			t.Errorf("send() returned err `%s`, expected `%s`", err, iccerror.ErrInvalid.Error())
@@ -41,7 +46,7 @@ func TestSend(t *testing.T) {
 	t.Run("no channel_id", func(t *testing.T) {
 		defer backend.reset()
 
-		err := n.Publish(strings.NewReader(`
+		_, err := n.Publish(ctx, strings.NewReader(`
 		{
 			"to_users": [2], 
 			"message": "hans"
@@ -56,7 +61,7 @@ func TestSend(t *testing.T) {
 	t.Run("invalid channel_id", func(t *testing.T) {
 		defer backend.reset()
 
-		err := n.Publish(strings.NewReader(`
+		_, err := n.Publish(ctx, strings.NewReader(`
 		{
 			"channel_id": "abc",
 			"to_users": [2], 
@@ -71,7 +76,7 @@ func TestSend(t *testing.T) {
 	t.Run("no Name", func(t *testing.T) {
 		defer backend.reset()
 
-		err := n.Publish(strings.NewReader(`
+		_, err := n.Publish(ctx, strings.NewReader(`
 		{
 			"channel_id": "server:1:2",
 			"to_users": [2], 
@@ -86,7 +91,7 @@ func TestSend(t *testing.T) {
 	t.Run("valid", func(t *testing.T) {
 		defer backend.reset()
 
-		err := n.Publish(strings.NewReader(`
+		ids, err := n.Publish(ctx, strings.NewReader(`
 		{
 			"channel_id": "server:1:2",
 			"name": "message-name",
@@ -102,13 +107,86 @@ func TestSend(t *testing.T) {
 			t.Fatalf("backend received %d messages, expected 1", len(backend.receivedMessages))
 		}
 
-		expected := `{"channel_id":"server:1:2","to_users":[2],"name":"message-name","message":"hans"}`
+		if len(ids) != 1 || ids[0] == "" {
+			t.Fatalf("got ids %v, expected one id", ids)
+		}
+
+		at := publishedAt(t, string(backend.receivedMessages[0]))
+		expected := fmt.Sprintf(`{"id":"%s","published_at":%d,"channel_id":"server:1:2","to_users":[2],"name":"message-name","message":"hans"}`, ids[0], at)
 		if string(backend.receivedMessages[0]) != expected {
 			t.Errorf("received message:\n%s\n\nexpected:\n%s", backend.receivedMessages[0], expected)
 		}
 	})
 }
 
+func TestSendList(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := newBackendStrub()
+	n := notify.New(ctx, backend)
+
+	t.Run("valid", func(t *testing.T) {
+		defer backend.reset()
+
+		_, err := n.Publish(ctx, strings.NewReader(`[
+			{"channel_id":"server:1:2","name":"first","to_users":[2],"message":"hans"},
+			{"channel_id":"server:1:2","name":"second","to_users":[2],"message":"hans"}
+		]`), 1)
+
+		if err != nil {
+			t.Fatalf("send returned unexpected error: %v", err)
+		}
+
+		if len(backend.receivedMessages) != 2 {
+			t.Errorf("backend received %d messages, expected 2", len(backend.receivedMessages))
+		}
+	})
+
+	t.Run("all problems", func(t *testing.T) {
+		defer backend.reset()
+
+		_, err := n.Publish(ctx, strings.NewReader(`[
+			{"channel_id":"server:1:2","name":"valid","to_users":[2],"message":"hans"},
+			{"channel_id":"server:1:2","to_users":[2],"message":"hans"},
+			{"channel_id":"server:3:2","to_users":[2],"message":"hans"},
+			{"channel_id":123}
+		]`), 1)
+
+		var validationErr iccerror.ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Fatalf("send returned err `%v`, expected a validation error", err)
+		}
+
+		if !errors.Is(err, iccerror.ErrInvalid) {
+			t.Errorf("send returned err `%v`, expected `%s`", err, iccerror.ErrInvalid.Error())
+		}
+
+		var indexes []int
+		for _, problem := range validationErr.Problems {
+			indexes = append(indexes, problem.Index)
+		}
+
+		if fmt.Sprint(indexes) != "[1 2 2 3]" {
+			t.Errorf("got problems for indexes %v, expected [1 2 2 3]", indexes)
+		}
+
+		if len(backend.receivedMessages) != 0 {
+			t.Errorf("backend received %d messages, expected none", len(backend.receivedMessages))
+		}
+	})
+
+	t.Run("empty list", func(t *testing.T) {
+		defer backend.reset()
+
+		_, err := n.Publish(ctx, strings.NewReader(`[]`), 1)
+
+		if !errors.Is(err, iccerror.ErrInvalid) {
+			t.Errorf("send returned err `%v`, expected `%s`", err, iccerror.ErrInvalid.Error())
+		}
+	})
+}
+
 func TestReceive(t *testing.T) {
 	testCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -116,10 +194,10 @@ func TestReceive(t *testing.T) {
 	backend := newBackendStrub()
 	n := notify.New(testCtx, backend)
 
-	_, next := n.Receive(1, 2)
+	_, next := n.Receive(testCtx, 1, 2)
 
 	t.Run("Get first message", func(t *testing.T) {
-		if err := n.Publish(strings.NewReader(`{"channel_id":"server:1:2","name":"message-name","to_users":[2],"message":"hans"}`), 1); err != nil {
+		if _, err := n.Publish(testCtx, strings.NewReader(`{"channel_id":"server:1:2","name":"message-name","to_users":[2],"message":"hans"}`), 1); err != nil {
 			t.Fatalf("sending message: %v", err)
 		}
 
@@ -146,7 +224,7 @@ func TestReceive(t *testing.T) {
 	})
 
 	t.Run("Message for meeting", func(t *testing.T) {
-		if err := n.Publish(strings.NewReader(`{"channel_id":"server:1:2","name":"to-meeting-name","to_meeting":1,"message":"klaus"}`), 1); err != nil {
+		if _, err := n.Publish(testCtx, strings.NewReader(`{"channel_id":"server:1:2","name":"to-meeting-name","to_meeting":1,"message":"klaus"}`), 1); err != nil {
 			t.Fatalf("sending message: %v", err)
 		}
 
@@ -165,7 +243,7 @@ func TestReceive(t *testing.T) {
 	})
 
 	t.Run("Message not for me", func(t *testing.T) {
-		if err := n.Publish(strings.NewReader(`{"channel_id":"server:1:2","name":"message-name","to_users":[3],"message":"hans"}`), 1); err != nil {
+		if _, err := n.Publish(testCtx, strings.NewReader(`{"channel_id":"server:1:2","name":"message-name","to_users":[3],"message":"hans"}`), 1); err != nil {
 			t.Fatalf("sending message: %v", err)
 		}
 
@@ -187,3 +265,1445 @@ func TestReceive(t *testing.T) {
 		}
 	})
 }
+
+func BenchmarkPublish(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	message := `{"channel_id":"server:1:2","name":"message-name","to_users":[2],"message":"hans"}`
+
+	for _, bm := range []struct {
+		name    string
+		options []notify.Option
+	}{
+		{"pooled buffer", nil},
+		// Reads each request into a new buffer like before the buffer pool.
+		{"without pool", []notify.Option{notify.WithPooledBufferSize(0)}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			n := notify.New(ctx, nopBackend{}, bm.options...)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := n.Publish(ctx, strings.NewReader(message), 1); err != nil {
+					b.Fatalf("publish: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPublishWorkers(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := notify.New(ctx, nopBackend{}, notify.WithPublishWorkers(4))
+	message := `{"channel_id":"server:1:2","name":"message-name","to_users":[2],"message":"hans"}`
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := n.Publish(ctx, strings.NewReader(message), 1); err != nil {
+				b.Errorf("publish: %v", err)
+				return
+			}
+		}
+	})
+}
+
+func TestPublishWorkersContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := newBlockingBackend()
+	defer close(backend.release)
+
+	n := notify.New(ctx, backend, notify.WithPublishWorkers(1))
+	message := `{"channel_id":"server:1:2","name":"message-name","to_users":[2],"message":"hans"}`
+
+	publishCtx, publishCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer publishCancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := n.Publish(publishCtx, strings.NewReader(message), 1)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Publish returned `%v`, expected context.DeadlineExceeded", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Publish did not return after the context was done")
+	}
+}
+
+func TestPublishQueueSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := newBlockingBackend()
+	defer close(backend.release)
+
+	n := notify.New(ctx, backend, notify.WithPublishWorkers(1), notify.WithAsyncPublish(), notify.WithPublishQueueSize(1))
+	message := `{"channel_id":"server:1:2","name":"message-name","to_users":[2],"message":"hans"}`
+
+	// The first message blocks the worker, the second one waits in the
+	// queue.
+	for i := 0; i < 2; i++ {
+		if _, err := n.Publish(ctx, strings.NewReader(message), 1); err != nil {
+			t.Fatalf("publish message %d: %v", i, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := n.Publish(ctx, strings.NewReader(message), 1); !errors.Is(err, iccerror.ErrUnavailable) {
+		t.Errorf("Publish with a full queue returned `%v`, expected `%v`", err, iccerror.ErrUnavailable)
+	}
+}
+
+func TestMessageID(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := newBackendStrub()
+	n := notify.New(ctx, backend)
+
+	_, next := n.Receive(ctx, 1, 2)
+
+	ids, err := n.Publish(ctx, strings.NewReader(`[
+		{"channel_id":"server:1:2","name":"first","to_users":[2],"message":"hans"},
+		{"channel_id":"server:1:2","name":"second","to_users":[2],"message":"hans"}
+	]`), 1)
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	if len(ids) != 2 || ids[0] == "" || ids[0] == ids[1] {
+		t.Fatalf("got ids %v, expected two different ids", ids)
+	}
+
+	for i, id := range ids {
+		message, err := next(ctx)
+		if err != nil {
+			t.Fatalf("receiving message %d: %v", i, err)
+		}
+
+		if message.MessageID != id {
+			t.Errorf("message %d has id `%s`, expected `%s`", i, message.MessageID, id)
+		}
+	}
+}
+
+func TestULIDMessageID(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := newBackendStrub()
+	n := notify.New(ctx, backend, notify.WithULIDMessageIDs())
+
+	_, next := n.Receive(ctx, 1, 2)
+
+	for i := 0; i < 3; i++ {
+		if _, err := n.Publish(ctx, strings.NewReader(`[
+			{"channel_id":"server:1:2","name":"first","to_users":[2],"message":"hans"},
+			{"channel_id":"server:1:2","name":"second","to_users":[2],"message":"hans"}
+		]`), 1); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	var last string
+	for i := 0; i < 6; i++ {
+		message, err := next(ctx)
+		if err != nil {
+			t.Fatalf("receiving message %d: %v", i, err)
+		}
+
+		if len(message.MessageID) != 26 {
+			t.Fatalf("message %d has id `%s`, expected a ULID", i, message.MessageID)
+		}
+
+		if message.MessageID <= last {
+			t.Errorf("message %d has id `%s`, expected it to be greater then `%s`", i, message.MessageID, last)
+		}
+		last = message.MessageID
+	}
+}
+
+func TestPublishedAt(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := newBackendStrub()
+	n := notify.New(ctx, backend)
+
+	_, next := n.Receive(ctx, 1, 2)
+
+	before := time.Now().UnixMilli()
+	for i := 0; i < 3; i++ {
+		if _, err := n.Publish(ctx, strings.NewReader(`[
+			{"channel_id":"server:1:2","name":"first","to_users":[2],"message":"hans","published_at":1},
+			{"channel_id":"server:1:2","name":"second","to_users":[2],"message":"hans"}
+		]`), 1); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	var last int64
+	for i := 0; i < 6; i++ {
+		message, err := next(ctx)
+		if err != nil {
+			t.Fatalf("receiving message %d: %v", i, err)
+		}
+
+		if message.PublishedAt < before {
+			t.Fatalf("message %d has published_at %d, expected at least %d", i, message.PublishedAt, before)
+		}
+
+		if message.PublishedAt < last {
+			t.Errorf("message %d has published_at %d, expected it to be at least %d", i, message.PublishedAt, last)
+		}
+		last = message.PublishedAt
+	}
+}
+
+func TestRetained(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := newBackendStrub()
+	n := notify.New(ctx, backend)
+
+	if _, err := n.Publish(ctx, strings.NewReader(`{"channel_id":"server:1:2","name":"current-slide","to_meeting":1,"message":"slide 1","retain":true}`), 1); err != nil {
+		t.Fatalf("publish first message: %v", err)
+	}
+
+	if _, err := n.Publish(ctx, strings.NewReader(`{"channel_id":"server:1:2","name":"current-slide","to_meeting":1,"message":"slide 2","retain":true}`), 1); err != nil {
+		t.Fatalf("publish second message: %v", err)
+	}
+
+	// Wait for the messages to be processed before a new client connects.
+	time.Sleep(10 * time.Millisecond)
+
+	_, next := n.Receive(ctx, 1, 3)
+
+	nextCtx, nextCancel := context.WithTimeout(ctx, time.Second)
+	defer nextCancel()
+
+	message, err := next(nextCtx)
+	if err != nil {
+		t.Fatalf("receiving retained message: %v", err)
+	}
+
+	if string(message.Message) != `"slide 2"` {
+		t.Errorf("got message %s, expected \"slide 2\"", message.Message)
+	}
+
+	t.Run("Other meeting", func(t *testing.T) {
+		_, next := n.Receive(ctx, 2, 3)
+
+		nextCtx, nextCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer nextCancel()
+
+		if message, err := next(nextCtx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got message %v (err: %v), expected no message", message, err)
+		}
+	})
+
+	t.Run("Delivered once", func(t *testing.T) {
+		_, next := n.Receive(ctx, 1, 3)
+
+		// The message is published after the connection started, so it is
+		// in the topic and in the retained messages.
+		if _, err := n.Publish(ctx, strings.NewReader(`{"channel_id":"server:1:2","name":"current-slide","to_meeting":1,"message":"slide 3","retain":true}`), 1); err != nil {
+			t.Fatalf("publish third message: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		nextCtx, nextCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer nextCancel()
+
+		message, err := next(nextCtx)
+		if err != nil {
+			t.Fatalf("receiving retained message: %v", err)
+		}
+
+		if string(message.Message) != `"slide 3"` {
+			t.Errorf("got message %s, expected \"slide 3\"", message.Message)
+		}
+
+		if message, err := next(nextCtx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got message %v (err: %v), expected no second message", message, err)
+		}
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		if _, err := n.Publish(ctx, strings.NewReader(`{"channel_id":"server:1:2","name":"current-slide","to_meeting":1,"message":null,"retain":true}`), 1); err != nil {
+			t.Fatalf("publish empty message: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		_, next := n.Receive(ctx, 1, 3)
+
+		nextCtx, nextCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer nextCancel()
+
+		if message, err := next(nextCtx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got message %v (err: %v), expected no message", message, err)
+		}
+	})
+
+	t.Run("Without meeting", func(t *testing.T) {
+		_, err := n.Publish(ctx, strings.NewReader(`{"channel_id":"server:1:2","name":"current-slide","to_users":[3],"message":"slide","retain":true}`), 1)
+
+		if !errors.Is(err, iccerror.ErrInvalid) {
+			t.Errorf("got error `%v`, expected `%v`", err, iccerror.ErrInvalid)
+		}
+	})
+}
+
+func TestPriority(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := newBackendStrub()
+	n := notify.New(ctx, backend)
+
+	_, next := n.Receive(ctx, 1, 2)
+
+	for _, m := range []string{
+		`{"channel_id":"server:1:2","name":"low-1","to_users":[2],"message":"low"}`,
+		`{"channel_id":"server:1:2","name":"low-2","to_users":[2],"message":"low"}`,
+		`{"channel_id":"server:1:2","name":"high","to_users":[2],"message":"high","priority":10}`,
+	} {
+		if _, err := n.Publish(ctx, strings.NewReader(m), 1); err != nil {
+			t.Fatalf("publish message: %v", err)
+		}
+	}
+
+	// Wait for the messages to be processed by the service.
+	time.Sleep(10 * time.Millisecond)
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		message, err := next(ctx)
+		if err != nil {
+			t.Fatalf("Next() returned: %v", err)
+		}
+		got = append(got, message.Name)
+	}
+
+	expect := []string{"high", "low-1", "low-2"}
+	for i := range expect {
+		if got[i] != expect[i] {
+			t.Errorf("got messages %v, expected %v", got, expect)
+			break
+		}
+	}
+
+	t.Run("while messages are waiting", func(t *testing.T) {
+		_, next := n.Receive(ctx, 1, 3)
+
+		publish := func(m string) {
+			if _, err := n.Publish(ctx, strings.NewReader(m), 1); err != nil {
+				t.Fatalf("publish message: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		publish(`{"channel_id":"server:1:2","name":"low-1","to_users":[3],"message":"low"}`)
+		publish(`{"channel_id":"server:1:2","name":"low-2","to_users":[3],"message":"low"}`)
+
+		var got []string
+		message, err := next(ctx)
+		if err != nil {
+			t.Fatalf("Next() returned: %v", err)
+		}
+		got = append(got, message.Name)
+
+		// low-2 is still waiting, when this message arrives.
+		publish(`{"channel_id":"server:1:2","name":"high","to_users":[3],"message":"high","priority":10}`)
+
+		for i := 0; i < 2; i++ {
+			message, err := next(ctx)
+			if err != nil {
+				t.Fatalf("Next() returned: %v", err)
+			}
+			got = append(got, message.Name)
+		}
+
+		expect := []string{"low-1", "high", "low-2"}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("got messages %v, expected %v", got, expect)
+		}
+	})
+}
+
+func TestMaxBufferedBytes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := newBackendStrub()
+	n := notify.New(ctx, backend, notify.WithMaxBufferedBytes(3500))
+
+	_, next := n.Receive(ctx, 1, 2)
+
+	// Each message has about 1000 bytes. Only three fit in the limit.
+	payload := `"` + strings.Repeat("x", 1000) + `"`
+	for i := 0; i < 6; i++ {
+		m := fmt.Sprintf(`{"channel_id":"server:1:2","name":"m-%d","to_users":[2],"message":%s}`, i, payload)
+		if _, err := n.Publish(ctx, strings.NewReader(m), 1); err != nil {
+			t.Fatalf("publish message: %v", err)
+		}
+	}
+
+	// Wait for the messages to be processed by the service.
+	time.Sleep(10 * time.Millisecond)
+
+	message, err := next(ctx)
+	if err != nil {
+		t.Fatalf("Next() returned: %v", err)
+	}
+	got := []string{message.Name}
+
+	if buffered := n.BufferedBytes(); buffered > 3500 {
+		t.Errorf("%d bytes are buffered, expected at most 3500", buffered)
+	}
+
+	for i := 0; i < 2; i++ {
+		message, err := next(ctx)
+		if err != nil {
+			t.Fatalf("Next() returned: %v", err)
+		}
+		got = append(got, message.Name)
+	}
+
+	expect := []string{"m-3", "m-4", "m-5"}
+	for i := range expect {
+		if got[i] != expect[i] {
+			t.Errorf("got messages %v, expected the newest %v", got, expect)
+			break
+		}
+	}
+
+	if buffered := n.BufferedBytes(); buffered != 0 {
+		t.Errorf("%d bytes are buffered after all messages were received, expected 0", buffered)
+	}
+}
+
+func TestMaxBufferedBytesSlowConnection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := notify.New(ctx, newBackendStrub(), notify.WithMaxBufferedBytes(3500), notify.WithPause(100))
+
+	// The paused connection buffers all messages, until it holds the most
+	// memory.
+	stalledCID, stalledNext := n.Receive(ctx, 1, 3)
+	if err := n.Pause(3, stalledCID); err != nil {
+		t.Fatalf("pause: %v", err)
+	}
+
+	stalledErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := stalledNext(ctx); err != nil {
+				stalledErr <- err
+				return
+			}
+		}
+	}()
+
+	// The context of the first call to Next is the context of the
+	// connection. So the healthy connection reads in the background.
+	_, healthyNext := n.Receive(ctx, 1, 2)
+	healthy := make(chan string, 10)
+	go func() {
+		for {
+			message, err := healthyNext(ctx)
+			if err != nil {
+				close(healthy)
+				return
+			}
+			healthy <- message.Name
+		}
+	}()
+
+	// Fill the memory with messages for the stalled connection.
+	payload := `"` + strings.Repeat("x", 1000) + `"`
+	for i := 0; i < 3; i++ {
+		m := fmt.Sprintf(`{"channel_id":"server:1:2","name":"stalled-%d","to_users":[3],"message":%s}`, i, payload)
+		if _, err := n.Publish(ctx, strings.NewReader(m), 1); err != nil {
+			t.Fatalf("publish message: %v", err)
+		}
+	}
+
+	for start := time.Now(); n.BufferedBytes() < 3000; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("stalled connection buffered only %d bytes", n.BufferedBytes())
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		m := fmt.Sprintf(`{"channel_id":"server:1:2","name":"m-%d","to_users":[2,3],"message":%s}`, i, payload)
+		if _, err := n.Publish(ctx, strings.NewReader(m), 1); err != nil {
+			t.Fatalf("publish message: %v", err)
+		}
+
+		select {
+		case name, ok := <-healthy:
+			if !ok {
+				t.Fatalf("healthy connection was closed")
+			}
+
+			if expect := fmt.Sprintf("m-%d", i); name != expect {
+				t.Fatalf("healthy connection got message %s, expected %s", name, expect)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("healthy connection did not get message %d", i)
+		}
+	}
+
+	select {
+	case err := <-stalledErr:
+		if !errors.Is(err, iccerror.ErrTooSlow) {
+			t.Errorf("stalled connection returned `%v`, expected `%v`", err, iccerror.ErrTooSlow)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("stalled connection was not closed")
+	}
+}
+
+func TestWithRecordingBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := icctest.NewRecordingBackend()
+	n := notify.New(ctx, backend)
+
+	t.Run("Publish is recorded", func(t *testing.T) {
+		ids, err := n.Publish(ctx, strings.NewReader(`{"channel_id":"server:1:2","name":"message-name","to_users":[2],"message":"hans"}`), 1)
+		if err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+
+		ops := backend.Operations()
+		if len(ops) != 1 {
+			t.Fatalf("got %d operations, expected 1", len(ops))
+		}
+
+		at := publishedAt(t, ops[0].Args[0].(string))
+		expect := fmt.Sprintf(`{"id":"%s","published_at":%d,"channel_id":"server:1:2","to_users":[2],"name":"message-name","message":"hans"}`, ids[0], at)
+		if ops[0].Method != "NotifyPublish" || ops[0].Args[0] != expect {
+			t.Errorf("got operation %v, expected NotifyPublish with %s", ops[0], expect)
+		}
+	})
+
+	t.Run("Receive scripted message", func(t *testing.T) {
+		_, next := n.Receive(ctx, 0, 2)
+
+		backend.ScriptNotify([]byte(`{"channel_id":"server:3:1","name":"scripted","to_users":[2],"message":"klaus"}`))
+
+		nextCtx, nextCancel := context.WithTimeout(ctx, time.Second)
+		defer nextCancel()
+
+		message, err := next(nextCtx)
+		if err != nil {
+			t.Fatalf("Next() returned: %v", err)
+		}
+
+		if message.Name != "scripted" || message.SenderUserID != 3 {
+			t.Errorf("got message %v, expected the scripted message", message)
+		}
+	})
+}
+
+func TestDedup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The clock moves forward for each message, so each message has another
+	// published_at.
+	now := time.Unix(1_000, 0)
+	clock := func() time.Time {
+		now = now.Add(time.Millisecond)
+		return now
+	}
+
+	backend := newBackendStrub()
+	n := notify.New(ctx, backend, notify.WithDedup(), notify.WithPublishClock(clock))
+
+	_, next := n.Receive(ctx, 1, 2)
+
+	for i, tt := range []struct {
+		message string
+		expect  string
+	}{
+		{`{"channel_id":"server:1:2","name":"heartbeat","to_users":[2],"message":1}`, "server:1:2/1"},
+		{`{"channel_id":"server:1:2","name":"heartbeat","to_users":[2],"message":1}`, ""},
+		{`{"channel_id":"server:1:2","name":"heartbeat","to_users":[2],"message":2}`, "server:1:2/2"},
+		{`{"channel_id":"server:1:2","name":"heartbeat","to_users":[2],"message":1}`, "server:1:2/1"},
+		{`{"channel_id":"server:1:3","name":"heartbeat","to_users":[2],"message":1}`, "server:1:3/1"},
+	} {
+		if _, err := n.Publish(ctx, strings.NewReader(tt.message), 1); err != nil {
+			t.Fatalf("publish message %d: %v", i, err)
+		}
+
+		nextCtx, nextCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		message, err := next(nextCtx)
+		nextCancel()
+
+		if tt.expect == "" {
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("message %d: got message %v (err: %v), expected it to be dropped", i, message, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("message %d: Next() returned: %v", i, err)
+		}
+
+		if got := message.SenderChannelID + "/" + string(message.Message); got != tt.expect {
+			t.Errorf("message %d: got %s, expected %s", i, got, tt.expect)
+		}
+	}
+}
+
+func TestInbox(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := icctest.NewRecordingBackend()
+	n := notify.New(ctx, backend, notify.WithInbox(backend, nil, 2, time.Hour))
+
+	publish := func(t *testing.T, message string) {
+		t.Helper()
+		if _, err := n.Publish(ctx, strings.NewReader(message), 1); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	publish(t, `{"channel_id":"server:1:2","name":"first","to_users":[2],"message":"hans"}`)
+	publish(t, `{"channel_id":"server:1:2","name":"other-user","to_users":[3],"message":"hans"}`)
+	publish(t, `{"channel_id":"server:1:2","name":"meeting","to_meeting":5,"message":"hans"}`)
+
+	t.Run("Missed messages", func(t *testing.T) {
+		messages, err := n.Inbox(5, 2, notify.InboxCursor{})
+		if err != nil {
+			t.Fatalf("Inbox: %v", err)
+		}
+
+		if len(messages) != 2 || messages[0].Name != "first" || messages[1].Name != "meeting" {
+			t.Fatalf("got messages %v, expected `first` and `meeting`", messages)
+		}
+
+		if messages[0].SenderUserID != 1 || messages[0].SenderChannelID != "server:1:2" {
+			t.Errorf("got sender %d %s, expected 1 server:1:2", messages[0].SenderUserID, messages[0].SenderChannelID)
+		}
+
+		newer, err := n.Inbox(5, 2, notify.InboxCursor{User: messages[0].ID})
+		if err != nil {
+			t.Fatalf("Inbox with last id: %v", err)
+		}
+
+		if len(newer) != 1 || newer[0].Name != "meeting" {
+			t.Errorf("got messages %v since %s, expected only `meeting`", newer, messages[0].ID)
+		}
+	})
+
+	t.Run("Cursor per inbox", func(t *testing.T) {
+		messages, err := n.Inbox(5, 2, notify.InboxCursor{})
+		if err != nil {
+			t.Fatalf("Inbox: %v", err)
+		}
+
+		// The id of the meeting message is newer then the id of the user
+		// message. The user message is still returned, since it is in another
+		// inbox.
+		older, err := n.Inbox(5, 2, notify.InboxCursor{Meeting: messages[1].ID})
+		if err != nil {
+			t.Fatalf("Inbox with meeting id: %v", err)
+		}
+
+		if len(older) != 1 || older[0].Name != "first" {
+			t.Errorf("got messages %v since meeting id %s, expected only `first`", older, messages[1].ID)
+		}
+	})
+
+	t.Run("Inbox before publish", func(t *testing.T) {
+		// A client, that is woken up by the published message, has to find
+		// it in the inbox.
+		var methods []string
+		for _, op := range backend.Operations() {
+			if op.Method == "InboxAdd" || op.Method == "NotifyPublish" {
+				methods = append(methods, op.Method)
+			}
+		}
+
+		if len(methods) < 2 || methods[0] != "InboxAdd" || methods[1] != "NotifyPublish" {
+			t.Errorf("got operations %v, expected InboxAdd before NotifyPublish", methods)
+		}
+	})
+
+	t.Run("Cap", func(t *testing.T) {
+		publish(t, `{"channel_id":"server:1:2","name":"second","to_users":[2],"message":"hans"}`)
+		publish(t, `{"channel_id":"server:1:2","name":"third","to_users":[2],"message":"hans"}`)
+
+		messages, err := n.Inbox(0, 2, notify.InboxCursor{})
+		if err != nil {
+			t.Fatalf("Inbox: %v", err)
+		}
+
+		if len(messages) != 2 || messages[0].Name != "second" || messages[1].Name != "third" {
+			t.Errorf("got messages %v, expected the newest two messages", messages)
+		}
+	})
+
+	t.Run("Invalid last id", func(t *testing.T) {
+		_, err := n.Inbox(0, 2, notify.InboxCursor{User: "not-an-id"})
+
+		if !errors.Is(err, iccerror.ErrInvalid) {
+			t.Errorf("Inbox() returned err `%v`, expected `%s`", err, iccerror.ErrInvalid.Error())
+		}
+	})
+}
+
+func TestEphemeral(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	inbox := icctest.NewRecordingBackend()
+	n := notify.New(ctx, newBackendStrub(), notify.WithInbox(inbox, nil, 10, time.Hour))
+
+	_, next := n.Receive(ctx, 0, 2)
+
+	if _, err := n.Publish(ctx, strings.NewReader(`{"channel_id":"server:1:2","name":"typing","to_users":[2],"message":true,"ephemeral":true}`), 1); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	t.Run("Open connection", func(t *testing.T) {
+		message, err := next(ctx)
+		if err != nil {
+			t.Fatalf("Next() returned: %v", err)
+		}
+
+		if message.Name != "typing" {
+			t.Errorf("got message %s, expected typing", message.Name)
+		}
+	})
+
+	t.Run("Late joiner", func(t *testing.T) {
+		_, lateNext := n.Receive(ctx, 0, 2)
+
+		nextCtx, nextCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer nextCancel()
+
+		if message, err := lateNext(nextCtx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got message %v (err: %v), expected no message", message, err)
+		}
+	})
+
+	t.Run("Not in inbox", func(t *testing.T) {
+		messages, err := n.Inbox(0, 2, notify.InboxCursor{})
+		if err != nil {
+			t.Fatalf("Inbox: %v", err)
+		}
+
+		if len(messages) != 0 {
+			t.Errorf("got messages %v, expected none", messages)
+		}
+	})
+
+	t.Run("Retained", func(t *testing.T) {
+		_, err := n.Publish(ctx, strings.NewReader(`{"channel_id":"server:1:2","name":"typing","to_meeting":1,"message":true,"ephemeral":true,"retain":true}`), 1)
+
+		if !errors.Is(err, iccerror.ErrInvalid) {
+			t.Errorf("got error `%v`, expected `%v`", err, iccerror.ErrInvalid)
+		}
+	})
+}
+
+func TestEphemeralNotSaved(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := icctest.NewRecordingBackend()
+	n := notify.New(ctx, backend, notify.WithPersist(backend, 100))
+
+	_, next := n.Receive(ctx, 0, 2)
+
+	if _, err := n.Publish(ctx, strings.NewReader(`{"channel_id":"server:1:2","name":"typing","to_users":[2],"message":true,"ephemeral":true}`), 1); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	message, err := next(ctx)
+	if err != nil {
+		t.Fatalf("Next() returned: %v", err)
+	}
+
+	if message.Name != "typing" {
+		t.Errorf("got message %s, expected typing", message.Name)
+	}
+
+	var methods []string
+	for _, op := range backend.Operations() {
+		methods = append(methods, op.Method)
+	}
+
+	if !reflect.DeepEqual(methods, []string{"NotifyPublishEphemeral"}) {
+		t.Errorf("got operations %v, expected only NotifyPublishEphemeral", methods)
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := icctest.NewRecordingBackend()
+	n := notify.New(ctx, backend, notify.WithIdempotency(backend, time.Minute))
+
+	publish := func(t *testing.T, message string, uid int) []string {
+		t.Helper()
+
+		ids, err := n.Publish(ctx, strings.NewReader(message), uid)
+		if err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+		return ids
+	}
+
+	countPublished := func() int {
+		var count int
+		for _, op := range backend.Operations() {
+			if op.Method == "NotifyPublish" {
+				count++
+			}
+		}
+		return count
+	}
+
+	message := `{"channel_id":"server:1:2","name":"vote","to_users":[2],"message":true,"idempotency_key":"abc"}`
+
+	first := publish(t, message, 1)
+
+	t.Run("Retry", func(t *testing.T) {
+		retry := publish(t, message, 1)
+
+		if retry[0] != first[0] {
+			t.Errorf("retry returned id %s, expected %s", retry[0], first[0])
+		}
+
+		if got := countPublished(); got != 1 {
+			t.Errorf("got %d published messages, expected 1", got)
+		}
+	})
+
+	t.Run("Key is not published", func(t *testing.T) {
+		for _, op := range backend.Operations() {
+			if op.Method == "NotifyPublish" && strings.Contains(op.Args[0].(string), "idempotency_key") {
+				t.Errorf("published message %s contains the idempotency key", op.Args[0])
+			}
+		}
+	})
+
+	t.Run("Other user", func(t *testing.T) {
+		other := publish(t, `{"channel_id":"server:3:2","name":"vote","to_users":[2],"message":true,"idempotency_key":"abc"}`, 3)
+
+		if other[0] == first[0] {
+			t.Errorf("message of other user got the id %s of the first message", other[0])
+		}
+	})
+
+	t.Run("Other key", func(t *testing.T) {
+		other := publish(t, `{"channel_id":"server:1:2","name":"vote","to_users":[2],"message":true,"idempotency_key":"xyz"}`, 1)
+
+		if other[0] == first[0] {
+			t.Errorf("message with other key got the id %s of the first message", other[0])
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		before := countPublished()
+
+		list := `[` + message + `,{"channel_id":"server:1:2","name":"vote","to_users":[2],"message":false,"idempotency_key":"list"}]`
+		ids := publish(t, list, 1)
+
+		if len(ids) != 2 || ids[0] != first[0] || ids[1] == first[0] {
+			t.Errorf("list returned ids %v, expected [%s, <new id>]", ids, first[0])
+		}
+
+		if got := countPublished() - before; got != 1 {
+			t.Errorf("list published %d messages, expected 1", got)
+		}
+	})
+}
+
+func TestSchemas(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	schemas, err := notify.ParseSchemas([]byte(`{
+		"vote": {
+			"type": "object",
+			"properties": {"option": {"type": "integer"}},
+			"required": ["option"]
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("parsing schemas: %v", err)
+	}
+
+	n := notify.New(ctx, newBackendStrub(), notify.WithSchemas(schemas))
+
+	for _, tt := range []struct {
+		name    string
+		message string
+		valid   bool
+	}{
+		{"conforming", `{"option":3}`, true},
+		{"missing field", `{}`, false},
+		{"wrong type", `{"option":"three"}`, false},
+		{"no message", `null`, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := n.Publish(ctx, strings.NewReader(`{"channel_id":"server:1:2","name":"vote","to_meeting":1,"message":`+tt.message+`}`), 1)
+
+			if tt.valid && err != nil {
+				t.Errorf("publish: %v", err)
+			}
+
+			if !tt.valid && !errors.Is(err, iccerror.ErrInvalid) {
+				t.Errorf("got error `%v`, expected `%v`", err, iccerror.ErrInvalid)
+			}
+		})
+	}
+
+	t.Run("error body", func(t *testing.T) {
+		schemas, err := notify.ParseSchemas([]byte(`{"choice": {"enum": ["a", "b"]}}`))
+		if err != nil {
+			t.Fatalf("parsing schemas: %v", err)
+		}
+		n := notify.New(ctx, newBackendStrub(), notify.WithSchemas(schemas))
+
+		_, publishErr := n.Publish(ctx, strings.NewReader(`{"channel_id":"server:1:2","name":"choice","to_meeting":1,"message":"c"}`), 1)
+		if publishErr == nil {
+			t.Fatalf("publish did not return an error")
+		}
+
+		var body struct {
+			Error string `json:"error"`
+			Msg   string `json:"msg"`
+		}
+		if err := json.Unmarshal([]byte(publishErr.Error()), &body); err != nil {
+			t.Fatalf("decoding error body `%s`: %v", publishErr.Error(), err)
+		}
+
+		if body.Error != "invalid" || !strings.Contains(body.Msg, `"a", "b"`) {
+			t.Errorf("got error body %v, expected the enum values in the message", body)
+		}
+	})
+
+	t.Run("name without schema", func(t *testing.T) {
+		_, err := n.Publish(ctx, strings.NewReader(`{"channel_id":"server:1:2","name":"other","to_meeting":1,"message":"anything"}`), 1)
+		if err != nil {
+			t.Errorf("publish: %v", err)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		list := `[{"channel_id":"server:1:2","name":"vote","to_meeting":1,"message":{"option":1}},{"channel_id":"server:1:2","name":"vote","to_meeting":1,"message":{}}]`
+		_, err := n.Publish(ctx, strings.NewReader(list), 1)
+
+		var validationErr iccerror.ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Fatalf("got error `%v`, expected a validation error", err)
+		}
+
+		if len(validationErr.Problems) != 1 || validationErr.Problems[0].Index != 1 {
+			t.Errorf("got problems %v, expected one problem for message 1", validationErr.Problems)
+		}
+	})
+}
+
+func TestMessageLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := notify.New(ctx, newBackendStrub(), notify.WithMaxMessageBytes(20), notify.WithMaxMessageDepth(2))
+
+	for _, tt := range []struct {
+		name    string
+		message string
+		valid   bool
+	}{
+		{"small", `"hello"`, true},
+		{"at size limit", `"123456789012345678"`, true},
+		{"above size limit", `"1234567890123456789"`, false},
+		{"at depth limit", `{"a":[1]}`, true},
+		{"above depth limit", `{"a":[[1]]}`, false},
+		{"brackets in string", `{"a":"[[{"}`, true},
+		{"escaped quote", `{"a":"\"[["}`, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := n.Publish(ctx, strings.NewReader(`{"channel_id":"server:1:2","name":"test","to_meeting":1,"message":`+tt.message+`}`), 1)
+
+			if tt.valid && err != nil {
+				t.Errorf("publish: %v", err)
+			}
+
+			if !tt.valid && !errors.Is(err, iccerror.ErrInvalid) {
+				t.Errorf("got error `%v`, expected `%v`", err, iccerror.ErrInvalid)
+			}
+		})
+	}
+}
+
+func TestEmptyMessage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, tt := range []struct {
+		name    string
+		body    string
+		options []notify.Option
+		valid   bool
+	}{
+		{"empty body", ``, nil, false},
+		{"only whitespace", " \n", nil, false},
+		{"without message", `{"channel_id":"server:1:2","name":"test","to_users":[1]}`, nil, false},
+		{"null message", `{"channel_id":"server:1:2","name":"test","to_users":[1],"message":null}`, nil, false},
+		{"empty string", `{"channel_id":"server:1:2","name":"test","to_users":[1],"message":""}`, nil, true},
+		{"allowed without message", `{"channel_id":"server:1:2","name":"test","to_users":[1]}`, []notify.Option{notify.WithAllowEmptyMessage()}, true},
+		{"allowed null message", `{"channel_id":"server:1:2","name":"test","to_users":[1],"message":null}`, []notify.Option{notify.WithAllowEmptyMessage()}, true},
+		{"allowed empty body", ``, []notify.Option{notify.WithAllowEmptyMessage()}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackendStrub()
+			n := notify.New(ctx, backend, tt.options...)
+
+			_, err := n.Publish(ctx, strings.NewReader(tt.body), 1)
+
+			if tt.valid {
+				if err != nil {
+					t.Errorf("publish: %v", err)
+				}
+				return
+			}
+
+			if !errors.Is(err, iccerror.ErrInvalid) {
+				t.Errorf("got error `%v`, expected `%v`", err, iccerror.ErrInvalid)
+			}
+
+			if len(backend.receivedMessages) != 0 {
+				t.Errorf("backend received %d messages, expected none", len(backend.receivedMessages))
+			}
+		})
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	invalid := "{\"channel_id\":\"server:1:2\",\"name\":\"test\",\"to_users\":[1],\"message\":\"a\xffb\"}"
+	valid := `{"channel_id":"server:1:2","name":"test","to_users":[1],"message":"äöü"}`
+
+	for _, tt := range []struct {
+		name    string
+		options []notify.Option
+		body    string
+		valid   bool
+		expect  string
+	}{
+		{"keep invalid", nil, invalid, true, "\"a\xffb\""},
+		{"reject invalid", []notify.Option{notify.WithRejectInvalidUTF8()}, invalid, false, ""},
+		{"reject valid", []notify.Option{notify.WithRejectInvalidUTF8()}, valid, true, `"äöü"`},
+		{"sanitize invalid", []notify.Option{notify.WithSanitizeUTF8()}, invalid, true, "\"a\uFFFDb\""},
+		{"sanitize valid", []notify.Option{notify.WithSanitizeUTF8()}, valid, true, `"äöü"`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackendStrub()
+			n := notify.New(ctx, backend, tt.options...)
+
+			_, err := n.Publish(ctx, strings.NewReader(tt.body), 1)
+
+			if !tt.valid {
+				if !errors.Is(err, iccerror.ErrInvalid) {
+					t.Errorf("got error `%v`, expected `%v`", err, iccerror.ErrInvalid)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("publish: %v", err)
+			}
+
+			var saved struct {
+				Message json.RawMessage `json:"message"`
+			}
+			if err := json.Unmarshal(backend.receivedMessages[0], &saved); err != nil {
+				t.Fatalf("decoding saved message: %v", err)
+			}
+
+			if string(saved.Message) != tt.expect {
+				t.Errorf("saved message %q, expected %q", saved.Message, tt.expect)
+			}
+		})
+	}
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pretty := `{
+		"channel_id": "server:1:2",
+		"name": "test",
+		"to_users": [1],
+		"message": {
+			"b": [1, 2.50, 9007199254740993],
+			"a": {"y": "<&>", "x": null}
+		}
+	}`
+
+	for _, tt := range []struct {
+		name    string
+		options []notify.Option
+		expect  string
+	}{
+		{"compact", nil, `{"b":[1,2.50,9007199254740993],"a":{"y":"<&>","x":null}}`},
+		{"canonical", []notify.Option{notify.WithCanonicalJSON()}, `{"a":{"x":null,"y":"<&>"},"b":[1,2.50,9007199254740993]}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackendStrub()
+			n := notify.New(ctx, backend, tt.options...)
+
+			if _, err := n.Publish(ctx, strings.NewReader(pretty), 1); err != nil {
+				t.Fatalf("publish: %v", err)
+			}
+
+			var saved struct {
+				Message json.RawMessage `json:"message"`
+			}
+			if err := json.Unmarshal(backend.receivedMessages[0], &saved); err != nil {
+				t.Fatalf("decoding saved message: %v", err)
+			}
+
+			if string(saved.Message) != tt.expect {
+				t.Errorf("saved message %s, expected %s", saved.Message, tt.expect)
+			}
+
+			var got, expect interface{}
+			if err := json.Unmarshal(saved.Message, &got); err != nil {
+				t.Fatalf("decoding saved field message: %v", err)
+			}
+			if err := json.Unmarshal([]byte(`{"a":{"x":null,"y":"<&>"},"b":[1,2.5,9007199254740993]}`), &expect); err != nil {
+				t.Fatalf("decoding expected message: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, expect) {
+				t.Errorf("saved message is %v, expected %v", got, expect)
+			}
+		})
+	}
+
+	t.Run("keep invalid utf8", func(t *testing.T) {
+		backend := newBackendStrub()
+		n := notify.New(ctx, backend, notify.WithCanonicalJSON())
+
+		if _, err := n.Publish(ctx, strings.NewReader("{\"channel_id\":\"server:1:2\",\"name\":\"test\",\"to_users\":[1],\"message\":{\"b\":\"\xff\",\"a\":1}}"), 1); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+
+		var saved struct {
+			Message json.RawMessage `json:"message"`
+		}
+		if err := json.Unmarshal(backend.receivedMessages[0], &saved); err != nil {
+			t.Fatalf("decoding saved message: %v", err)
+		}
+
+		if expect := "{\"b\":\"\xff\",\"a\":1}"; string(saved.Message) != expect {
+			t.Errorf("saved message %q, expected %q", saved.Message, expect)
+		}
+	})
+}
+
+func TestPause(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := notify.New(ctx, newBackendStrub(), notify.WithPause(2))
+
+	cid, next := n.Receive(ctx, 0, 2)
+
+	if err := n.Pause(2, cid); err != nil {
+		t.Fatalf("pause: %v", err)
+	}
+
+	received := make(chan string, 10)
+	go func() {
+		for {
+			message, err := next(ctx)
+			if err != nil {
+				return
+			}
+			received <- string(message.Message)
+		}
+	}()
+
+	for i := 1; i <= 3; i++ {
+		message := fmt.Sprintf(`{"channel_id":"server:1:2","name":"counter","to_users":[2],"message":%d}`, i)
+		if _, err := n.Publish(ctx, strings.NewReader(message), 1); err != nil {
+			t.Fatalf("publish %d: %v", i, err)
+		}
+	}
+
+	t.Run("Buffered while paused", func(t *testing.T) {
+		select {
+		case m := <-received:
+			t.Fatalf("got message %s while paused", m)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	t.Run("Flushed on resume", func(t *testing.T) {
+		if err := n.Resume(2, cid); err != nil {
+			t.Fatalf("resume: %v", err)
+		}
+
+		var got []string
+		for len(got) < 2 {
+			select {
+			case m := <-received:
+				got = append(got, m)
+			case <-time.After(time.Second):
+				t.Fatalf("got messages %v after resume, expected [2 3]", got)
+			}
+		}
+
+		if got[0] != "2" || got[1] != "3" {
+			t.Errorf("got messages %v after resume, expected [2 3]", got)
+		}
+	})
+
+	t.Run("Paused while waiting", func(t *testing.T) {
+		// The connection waits for new messages, when it is paused.
+		if err := n.Pause(2, cid); err != nil {
+			t.Fatalf("pause: %v", err)
+		}
+
+		message := `{"channel_id":"server:1:2","name":"counter","to_users":[2],"message":4}`
+		if _, err := n.Publish(ctx, strings.NewReader(message), 1); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+
+		select {
+		case m := <-received:
+			t.Fatalf("got message %s while paused", m)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		if err := n.Resume(2, cid); err != nil {
+			t.Fatalf("resume: %v", err)
+		}
+
+		select {
+		case m := <-received:
+			if m != "4" {
+				t.Errorf("got message %s after resume, expected 4", m)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("got no message after resume")
+		}
+	})
+
+	t.Run("Connection of other user", func(t *testing.T) {
+		if err := n.Pause(3, cid); !errors.Is(err, iccerror.ErrNotAllowed) {
+			t.Errorf("got error `%v`, expected `%v`", err, iccerror.ErrNotAllowed)
+		}
+	})
+
+	t.Run("Unknown connection", func(t *testing.T) {
+		if err := n.Pause(2, "server:2:404"); !errors.Is(err, iccerror.ErrNotFound) {
+			t.Errorf("got error `%v`, expected `%v`", err, iccerror.ErrNotFound)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		disabled := notify.New(ctx, newBackendStrub())
+		cid, _ := disabled.Receive(ctx, 0, 2)
+
+		if err := disabled.Pause(2, cid); !errors.Is(err, iccerror.ErrInvalid) {
+			t.Errorf("got error `%v`, expected `%v`", err, iccerror.ErrInvalid)
+		}
+	})
+}
+
+func TestLargeNumber(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := notify.New(ctx, newBackendStrub())
+
+	_, next := n.Receive(ctx, 0, 2)
+
+	payload := `{"user_id":9007199254740993}`
+	if _, err := n.Publish(ctx, strings.NewReader(`{"channel_id":"server:1:2","name":"big","to_users":[2],"message":`+payload+`}`), 1); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	message, err := next(ctx)
+	if err != nil {
+		t.Fatalf("Next() returned: %v", err)
+	}
+
+	if got := string(message.Message); got != payload {
+		t.Errorf("got message %s, expected %s", got, payload)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := icctest.NewRecordingBackend()
+	n := notify.New(ctx, backend, notify.WithPersist(backend, 100))
+
+	for _, message := range []string{
+		`{"channel_id":"server:1:2","name":"vote","to_meeting":1,"message":true}`,
+		`{"channel_id":"server:1:2","name":"direct","to_channels":["server:2:1"],"message":true}`,
+		`{"channel_id":"server:1:2","name":"typing","to_channels":["server:2:1"],"message":true,"ephemeral":true}`,
+	} {
+		if _, err := n.Publish(ctx, strings.NewReader(message), 1); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	// The ephemeral message is not persisted.
+	var persisted []icctest.Operation
+	var published []string
+	for _, op := range backend.Operations() {
+		switch op.Method {
+		case "NotifyPersist":
+			persisted = append(persisted, op)
+		case "NotifyPublish":
+			published = append(published, op.Args[0].(string))
+		}
+	}
+
+	if len(persisted) != 2 {
+		t.Fatalf("got %d persisted messages, expected 2", len(persisted))
+	}
+
+	for i, op := range persisted {
+		if op.Args[0] != published[i] || op.Args[1] != 1 || op.Args[3] != 100 {
+			t.Errorf("persisted %v, expected message %s from user 1 with max length 100", op.Args, published[i])
+		}
+	}
+
+	if persisted[0].Args[2] != "vote" || persisted[1].Args[2] != "direct" {
+		t.Errorf("persisted names %v and %v, expected vote and direct", persisted[0].Args[2], persisted[1].Args[2])
+	}
+}
+
+func TestPublishPermissionsBeforeMeetingLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.Stub(dsmock.YAMLData(`
+	meeting/1/admin_group_id: 11
+	group/10/permissions: [meeting.can_manage_settings]
+	group/12/permissions: [meeting.can_see_frontpage]
+	user/2/group_$1_ids: [10]
+	user/3/group_$1_ids: [12]
+	`))
+
+	n := notify.New(
+		ctx,
+		newBackendStrub(),
+		notify.WithPublishPermissions(ds, map[string]string{"system": "meeting.can_manage_settings"}),
+		notify.WithMaxMeetingPublishRate(0.001),
+	)
+
+	message := func(uid int) *strings.Reader {
+		return strings.NewReader(fmt.Sprintf(`{"channel_id":"server:%d:1","name":"system","to_meeting":1,"message":"hans"}`, uid))
+	}
+
+	if _, err := n.Publish(ctx, message(3), 3); !errors.Is(err, iccerror.ErrNotAllowed) {
+		t.Fatalf("Publish without permission returned `%v`, expected `%s`", err, iccerror.ErrNotAllowed.Error())
+	}
+
+	if _, err := n.Publish(ctx, message(2), 2); err != nil {
+		t.Errorf("Publish after a rejected message returned: %v", err)
+	}
+}
+
+func TestPublishPermissions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.Stub(dsmock.YAMLData(`
+	meeting/1/admin_group_id: 11
+	group/10/permissions: [meeting.can_manage_settings]
+	group/12/permissions: [meeting.can_see_frontpage]
+	user/1/group_$1_ids: [11]
+	user/2/group_$1_ids: [10]
+	user/3/group_$1_ids: [12]
+	user/4/organization_management_level: superadmin
+	user/3/meeting_ids: [1]
+	user/6/meeting_ids: [2]
+	`))
+
+	backend := newBackendStrub()
+	n := notify.New(ctx, backend, notify.WithPublishPermissions(ds, map[string]string{
+		"system": "meeting.can_manage_settings",
+	}))
+
+	for _, tt := range []struct {
+		name    string
+		uid     int
+		message string
+		allowed bool
+	}{
+		{"admin group", 1, `"name":"system","to_meeting":1`, true},
+		{"with permission", 2, `"name":"system","to_meeting":1`, true},
+		{"without permission", 3, `"name":"system","to_meeting":1`, false},
+		{"not in meeting", 5, `"name":"system","to_meeting":1`, false},
+		{"superadmin", 4, `"name":"system","to_meeting":1`, true},
+		{"without meeting", 2, `"name":"system","to_users":[1]`, false},
+		{"to user in meeting", 2, `"name":"system","to_meeting":1,"to_users":[3]`, true},
+		{"to user in other meeting", 2, `"name":"system","to_meeting":1,"to_users":[6]`, false},
+		{"to unknown user", 2, `"name":"system","to_meeting":1,"to_users":[404]`, false},
+		{"to channel", 2, `"name":"system","to_meeting":1,"to_channels":["server:6:1"]`, false},
+		{"superadmin to other meeting", 4, `"name":"system","to_meeting":1,"to_users":[6]`, true},
+		{"other name", 3, `"name":"chat","to_meeting":1`, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer backend.reset()
+
+			message := fmt.Sprintf(`{"channel_id":"server:%d:1",%s,"message":"hans"}`, tt.uid, tt.message)
+			_, err := n.Publish(ctx, strings.NewReader(message), tt.uid)
+
+			if tt.allowed {
+				if err != nil {
+					t.Fatalf("Publish returned unexpected error: %v", err)
+				}
+				return
+			}
+
+			if !errors.Is(err, iccerror.ErrNotAllowed) {
+				t.Errorf("Publish returned err `%v`, expected `%s`", err, iccerror.ErrNotAllowed.Error())
+			}
+
+			if len(backend.receivedMessages) != 0 {
+				t.Errorf("backend received %d messages, expected none", len(backend.receivedMessages))
+			}
+		})
+	}
+}
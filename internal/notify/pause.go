@@ -0,0 +1,183 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+)
+
+// WithPause lets a client pause the delivery of messages to one of its
+// connections, for example when the client is in the background. While the
+// connection is paused, up to bufferSize messages are buffered and delivered
+// after resume. If there are more messages, the oldest ones are dropped.
+//
+// The pause state is only saved in the instance, that holds the connection.
+// Other instances do not know the connection and return ErrNotFound.
+func WithPause(bufferSize int) Option {
+	return func(n *Notify) {
+		n.pauseBuffer = bufferSize
+		n.pauses = make(map[string]*pauseState)
+	}
+}
+
+// pauseState is the pause state of one connection.
+type pauseState struct {
+	mu      sync.Mutex
+	resumed chan struct{}
+}
+
+// pause pauses the connection. Does nothing, if it is already paused.
+func (p *pauseState) pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.resumed == nil {
+		p.resumed = make(chan struct{})
+	}
+}
+
+// resume resumes the connection. Does nothing, if it is not paused.
+func (p *pauseState) resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.resumed != nil {
+		close(p.resumed)
+		p.resumed = nil
+	}
+}
+
+// waiting returns a channel that is closed on resume. Returns nil, if the
+// connection is not paused.
+func (p *pauseState) waiting() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.resumed
+}
+
+// registerPause adds the pause state of a new connection. The returned
+// function removes it.
+func (n *Notify) registerPause(cid string) (*pauseState, func()) {
+	p := new(pauseState)
+
+	n.pausesMu.Lock()
+	n.pauses[cid] = p
+	n.pausesMu.Unlock()
+
+	return p, func() {
+		n.pausesMu.Lock()
+		delete(n.pauses, cid)
+		n.pausesMu.Unlock()
+	}
+}
+
+// pauseOf returns the pause state of a connection of the user.
+func (n *Notify) pauseOf(uid int, cid string) (*pauseState, error) {
+	if n.pauses == nil {
+		return nil, iccerror.NewMessageError(iccerror.ErrInvalid, "pausing connections is disabled")
+	}
+
+	if channelID(cid).uid() != uid {
+		return nil, iccerror.NewMessageError(iccerror.ErrNotAllowed, "channel `%s` is not a connection of the user", cid)
+	}
+
+	n.pausesMu.Lock()
+	defer n.pausesMu.Unlock()
+
+	p, ok := n.pauses[cid]
+	if !ok {
+		return nil, iccerror.NewMessageError(iccerror.ErrNotFound, "there is no connection with channel `%s` on this instance", cid)
+	}
+	return p, nil
+}
+
+// Pause pauses the delivery of messages to the connection with the channel id.
+// The connection has to belong to the user.
+func (n *Notify) Pause(uid int, cid string) error {
+	p, err := n.pauseOf(uid, cid)
+	if err != nil {
+		return err
+	}
+
+	p.pause()
+	return nil
+}
+
+// Resume delivers the buffered messages of a paused connection and all
+// following messages.
+func (n *Notify) Resume(uid int, cid string) error {
+	p, err := n.pauseOf(uid, cid)
+	if err != nil {
+		return err
+	}
+
+	p.resume()
+	return nil
+}
+
+// waitResume blocks while the connection is paused. In this time, messages for
+// the connection are buffered.
+//
+// The buffered messages are sorted by priority after resume. Until then, they
+// are in the order they were published, so the oldest can be dropped.
+func (mp *messageProvider) waitResume(ctx context.Context) error {
+	var paused bool
+	for {
+		if err := mp.checkEvicted(); err != nil {
+			return err
+		}
+
+		resumed := mp.pause.waiting()
+		if resumed == nil {
+			break
+		}
+		paused = true
+
+		resumeCtx, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-resumed:
+				cancel()
+			case <-mp.evicted:
+				cancel()
+			case <-resumeCtx.Done():
+			}
+		}()
+
+		tid, messages, err := mp.receive(resumeCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil && errors.Is(err, context.Canceled) {
+				// Resumed or evicted from the memory budget.
+				continue
+			}
+			return fmt.Errorf("fetching message while paused: %w", err)
+		}
+		mp.tid = tid
+
+		for _, m := range messages {
+			if err := mp.addToBuffer(m); err != nil {
+				return fmt.Errorf("adding message: %w", err)
+			}
+		}
+
+		if len(mp.messageBuf) > mp.pauseBuffer {
+			for _, message := range mp.messageBuf[:len(mp.messageBuf)-mp.pauseBuffer] {
+				mp.memory.release(messageSize(message))
+			}
+			mp.messageBuf = mp.messageBuf[len(mp.messageBuf)-mp.pauseBuffer:]
+		}
+	}
+
+	if paused {
+		sort.SliceStable(mp.messageBuf, func(i, j int) bool {
+			return mp.messageBuf[i].Priority > mp.messageBuf[j].Priority
+		})
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+)
+
+// superadminLevel is the organization management level that is allowed to
+// publish all messages.
+const superadminLevel = "superadmin"
+
+// WithPublishPermissions only allows users to publish a message with one of the
+// names in perms, if they have the mapped permission in the meeting of the
+// message.
+//
+// Members of the admin group of the meeting and superadmins are allowed to
+// publish all messages. Messages with other names can be published by
+// everyone.
+//
+// The permission has to be set for a group of the user. Permissions that are
+// only implied by other permissions are not considered.
+//
+// The permission only covers the meeting of the message. So a message with one
+// of the names can only be sent to users of this meeting and not to channels,
+// except by superadmins.
+func WithPublishPermissions(ds datastore.Getter, perms map[string]string) Option {
+	return func(n *Notify) {
+		n.datastore = ds
+		n.publishPerms = perms
+	}
+}
+
+// canPublish returns an ErrNotAllowed error, if the user is not allowed to
+// publish the message.
+func (n *Notify) canPublish(ctx context.Context, uid int, message Message) error {
+	perm, ok := n.publishPerms[message.Name]
+	if !ok {
+		return nil
+	}
+
+	fetch := datastore.NewRequest(n.datastore)
+
+	level, err := fetch.User_OrganizationManagementLevel(uid).Value(ctx)
+	if err != nil {
+		var errDoesNotExist datastore.DoesNotExistError
+		if errors.As(err, &errDoesNotExist) {
+			return iccerror.NewMessageError(iccerror.ErrNotAllowed, "User %d does not exist.", uid)
+		}
+		return fmt.Errorf("fetching organization management level: %w", err)
+	}
+
+	if level == superadminLevel {
+		return nil
+	}
+
+	if message.ToMeeting == 0 {
+		return iccerror.NewMessageError(iccerror.ErrNotAllowed, "Message `%s` has to be sent to a meeting.", message.Name)
+	}
+
+	groupIDs, err := fetch.User_GroupIDs(uid, message.ToMeeting).Value(ctx)
+	if err != nil {
+		return fmt.Errorf("fetching groups of user %d: %w", uid, err)
+	}
+
+	adminGroupID, hasAdminGroup, err := fetch.Meeting_AdminGroupID(message.ToMeeting).Value(ctx)
+	if err != nil {
+		return fmt.Errorf("fetching admin group of meeting %d: %w", message.ToMeeting, err)
+	}
+
+	allowed, err := hasMeetingPerm(ctx, fetch, groupIDs, adminGroupID, hasAdminGroup, perm)
+	if err != nil {
+		return err
+	}
+
+	if !allowed {
+		return iccerror.NewMessageError(iccerror.ErrNotAllowed, "You are not allowed to publish message `%s` in meeting %d.", message.Name, message.ToMeeting)
+	}
+
+	return checkMeetingTargets(ctx, fetch, message)
+}
+
+// hasMeetingPerm returns true, if one of the groups is the admin group or has
+// the permission.
+func hasMeetingPerm(ctx context.Context, fetch *datastore.Request, groupIDs []int, adminGroupID int, hasAdminGroup bool, perm string) (bool, error) {
+	for _, groupID := range groupIDs {
+		if hasAdminGroup && groupID == adminGroupID {
+			return true, nil
+		}
+
+		groupPerms, err := fetch.Group_Permissions(groupID).Value(ctx)
+		if err != nil {
+			return false, fmt.Errorf("fetching permissions of group %d: %w", groupID, err)
+		}
+
+		for _, p := range groupPerms {
+			if p == perm {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// checkMeetingTargets returns an ErrNotAllowed error, if the message is sent to
+// channels or to users, that are not in the meeting of the message.
+func checkMeetingTargets(ctx context.Context, fetch *datastore.Request, message Message) error {
+	if len(message.ToChannels) > 0 {
+		return iccerror.NewMessageError(iccerror.ErrNotAllowed, "Message `%s` can not be sent to channels.", message.Name)
+	}
+
+	for _, userID := range message.ToUsers {
+		meetingIDs, err := fetch.User_MeetingIDs(userID).Value(ctx)
+		if err != nil {
+			var errDoesNotExist datastore.DoesNotExistError
+			if !errors.As(err, &errDoesNotExist) {
+				return fmt.Errorf("fetching meetings of user %d: %w", userID, err)
+			}
+		}
+
+		inMeeting := false
+		for _, meetingID := range meetingIDs {
+			if meetingID == message.ToMeeting {
+				inMeeting = true
+				break
+			}
+		}
+
+		if !inMeeting {
+			return iccerror.NewMessageError(iccerror.ErrNotAllowed, "Message `%s` can only be sent to users of meeting %d.", message.Name, message.ToMeeting)
+		}
+	}
+	return nil
+}
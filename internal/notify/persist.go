@@ -0,0 +1,35 @@
+package notify
+
+import (
+	"fmt"
+)
+
+// PersistBackend saves a record of all published notify messages.
+type PersistBackend interface {
+	// NotifyPersist adds the message with the sender and the name to the
+	// record. The record keeps about the newest `maxLen` messages. 0 means no
+	// limit.
+	NotifyPersist(message []byte, senderUserID int, name string, maxLen int) error
+}
+
+// WithPersist saves each published message in a record, so the notify traffic
+// can be audited. Unlike the inbox, it also contains messages to channels.
+// Ephemeral messages are never saved.
+func WithPersist(backend PersistBackend, maxLen int) Option {
+	return func(n *Notify) {
+		n.persist = backend
+		n.persistMaxLen = maxLen
+	}
+}
+
+// addToPersist saves the encoded message in the record.
+func (n *Notify) addToPersist(bs []byte, message Message) error {
+	if n.persist == nil || message.Ephemeral {
+		return nil
+	}
+
+	if err := n.persist.NotifyPersist(bs, message.ChannelID.uid(), message.Name, n.persistMaxLen); err != nil {
+		return fmt.Errorf("persisting message: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+)
+
+// InboxWait is like Inbox, but only returns the messages, that match. It
+// blocks until there is at least one matching message or the context is done.
+// When the context is done, no messages and no error are returned. A nil match
+// matches all messages.
+//
+// The returned cursor is after all messages, that were read, also the ones
+// that did not match.
+//
+// Returns an error, if the inbox is not enabled.
+func (n *Notify) InboxWait(ctx context.Context, meetingID, uid int, cursor InboxCursor, match func(OutMessage) bool) ([]InboxMessage, InboxCursor, error) {
+	if n.inbox == nil {
+		return nil, cursor, iccerror.NewMessageError(iccerror.ErrInvalid, "the notify inbox is not enabled")
+	}
+
+	// The topic id is fetched before the inbox is read. So a message, that
+	// is published in between, wakes up the loop.
+	tid := n.topic.LastID()
+
+	for {
+		messages, err := n.Inbox(meetingID, uid, cursor)
+		if err != nil {
+			return nil, cursor, err
+		}
+		cursor = cursor.next(messages)
+
+		var matching []InboxMessage
+		for _, m := range messages {
+			if match == nil || match(m.OutMessage) {
+				matching = append(matching, m)
+			}
+		}
+
+		if len(matching) > 0 {
+			return matching, cursor, nil
+		}
+
+		tid, err = n.waitInbox(ctx, tid, meetingID, uid)
+		if err != nil {
+			if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+				return nil, cursor, nil
+			}
+			return nil, cursor, err
+		}
+	}
+}
+
+// waitInbox blocks until there is a message in the topic after tid, that is
+// saved in the inbox of the user or the meeting.
+func (n *Notify) waitInbox(ctx context.Context, tid uint64, meetingID, uid int) (uint64, error) {
+	for {
+		newTID, messages, err := n.topic.Receive(ctx, tid)
+		if err != nil {
+			return 0, fmt.Errorf("fetching message from topic: %w", err)
+		}
+		tid = newTID
+
+		for _, m := range messages {
+			var message Message
+			if err := json.Unmarshal([]byte(m), &message); err != nil {
+				return 0, fmt.Errorf("decoding message: %w", err)
+			}
+
+			if !message.Ephemeral && message.forMe(meetingID, uid, "") {
+				return tid, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
+)
+
+// defaultPublishQueueSize is the number of messages that can wait for a
+// worker without WithPublishQueueSize.
+const defaultPublishQueueSize = 1000
+
+// WithPublishQueueSize sets the number of messages that can wait for a worker
+// of WithPublishWorkers. If the queue is full, async publish requests are
+// rejected with ErrUnavailable and other publish requests wait. A negative
+// size is ignored.
+func WithPublishQueueSize(size int) Option {
+	return func(n *Notify) {
+		if size >= 0 {
+			n.publishQueueSize = size
+		}
+	}
+}
+
+// publishJob is a message that waits to be saved in the backend.
+type publishJob struct {
+	encoded []byte
+	message Message
+
+	// result gets the error from the backend. It is nil in async mode.
+	result chan error
+}
+
+// publishPool saves messages in the backend with a fixed number of workers.
+//
+// Has to be created with newPublishPool().
+type publishPool struct {
+	notify *Notify
+	jobs   chan publishJob
+	closed <-chan struct{}
+	async  bool
+}
+
+func newPublishPool(n *Notify, workers, queueSize int, async bool, closed <-chan struct{}) *publishPool {
+	p := publishPool{
+		notify: n,
+		jobs:   make(chan publishJob, queueSize),
+		closed: closed,
+		async:  async,
+	}
+
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return &p
+}
+
+// work saves the messages from the queue until the service is closed.
+func (p *publishPool) work() {
+	for {
+		select {
+		case <-p.closed:
+			return
+
+		case job := <-p.jobs:
+			err := p.notify.store(job.encoded, job.message)
+			if job.result != nil {
+				job.result <- err
+				continue
+			}
+
+			if err != nil {
+				icclog.Info("Error: saving notify message: %v", err)
+			}
+		}
+	}
+}
+
+// publish queues a message.
+//
+// In async mode, it returns directly. In other case, it waits until the
+// message is saved and returns the error from the backend. If the context is
+// done before, it returns the error of the context. A queued message is still
+// saved.
+func (p *publishPool) publish(ctx context.Context, encoded []byte, message Message) error {
+	job := publishJob{encoded: encoded, message: message}
+
+	if p.async {
+		select {
+		case p.jobs <- job:
+			return nil
+		default:
+			return iccerror.NewMessageError(iccerror.ErrUnavailable, "Too many notify messages are waiting to be saved.")
+		}
+	}
+
+	job.result = make(chan error, 1)
+	select {
+	case p.jobs <- job:
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for a publish worker: %w", ctx.Err())
+	case <-p.closed:
+		return fmt.Errorf("notify service is closed")
+	}
+
+	select {
+	case err := <-job.result:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for the message to be saved: %w", ctx.Err())
+	case <-p.closed:
+		return fmt.Errorf("notify service is closed")
+	}
+}
@@ -0,0 +1,76 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Schemas holds a json schema for the field `message` of notify messages with
+// a specific name.
+//
+// Has to be created with ParseSchemas() or LoadSchemas().
+type Schemas map[string]*gojsonschema.Schema
+
+// ParseSchemas parses a json object from message names to json schemas.
+func ParseSchemas(data []byte) (Schemas, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("decoding schemas: %w", err)
+	}
+
+	schemas := make(Schemas, len(raw))
+	for name, rawSchema := range raw {
+		schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(rawSchema))
+		if err != nil {
+			return nil, fmt.Errorf("parsing schema for `%s`: %w", name, err)
+		}
+		schemas[name] = schema
+	}
+	return schemas, nil
+}
+
+// LoadSchemas reads the schemas from a file. See ParseSchemas.
+func LoadSchemas(path string) (Schemas, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading schema file: %w", err)
+	}
+
+	return ParseSchemas(data)
+}
+
+// WithSchemas validates the field `message` of each published message against
+// the schema for its name. Messages with a name without a schema are not
+// validated.
+func WithSchemas(schemas Schemas) Option {
+	return func(n *Notify) {
+		n.schemas = schemas
+	}
+}
+
+// validate returns all problems of the message with the schema of its name.
+func (s Schemas) validate(message Message) []string {
+	schema, ok := s[message.Name]
+	if !ok {
+		return nil
+	}
+
+	payload := []byte(message.Message)
+	if len(payload) == 0 {
+		payload = []byte("null")
+	}
+
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(payload))
+	if err != nil {
+		return []string{fmt.Sprintf("validating message `%s`: %v", message.Name, err)}
+	}
+
+	var problems []string
+	for _, e := range result.Errors() {
+		problems = append(problems, fmt.Sprintf("message `%s` does not match its schema: %s", message.Name, e))
+	}
+	return problems
+}
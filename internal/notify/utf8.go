@@ -0,0 +1,52 @@
+package notify
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// WithRejectInvalidUTF8 rejects published messages with ErrInvalid, if the
+// field `message` is not valid UTF-8.
+//
+// The other fields of a message are always decoded as strings. Invalid bytes
+// in them are replaced by the json decoder.
+func WithRejectInvalidUTF8() Option {
+	return func(n *Notify) {
+		n.invalidUTF8 = utf8Reject
+	}
+}
+
+// WithSanitizeUTF8 replaces the invalid UTF-8 bytes in the field `message` of
+// published messages with the replacement character U+FFFD.
+func WithSanitizeUTF8() Option {
+	return func(n *Notify) {
+		n.invalidUTF8 = utf8Sanitize
+	}
+}
+
+// utf8Policy decides, what happens with a message, that is not valid UTF-8.
+type utf8Policy int
+
+const (
+	utf8Keep utf8Policy = iota
+	utf8Reject
+	utf8Sanitize
+)
+
+// checkUTF8 applies the utf8 policy to the message. It returns the problems
+// of a rejected message.
+//
+// Invalid bytes can only be in json strings, so the sanitized message is still
+// valid json.
+func (n *Notify) checkUTF8(message *Message) []string {
+	if n.invalidUTF8 == utf8Keep || utf8.Valid(message.Message) {
+		return nil
+	}
+
+	if n.invalidUTF8 == utf8Reject {
+		return []string{"field `message` is not valid UTF-8"}
+	}
+
+	message.Message = bytes.ToValidUTF8(message.Message, []byte("\uFFFD"))
+	return nil
+}
@@ -0,0 +1,74 @@
+// Package ratelimit implements a token bucket rate limiter.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket. It is filled with `rate` tokens per second up to
+// `burst` tokens. Each allowed event takes one token.
+//
+// Has to be created with ratelimit.New(). It is save for concurrent use.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// New creates a full bucket.
+func New(rate float64, burst int) *Bucket {
+	return newWithClock(rate, burst, time.Now)
+}
+
+func newWithClock(rate float64, burst int, now func() time.Time) *Bucket {
+	return &Bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now(),
+		now:    now,
+	}
+}
+
+// Allow takes a token from the bucket. It returns false, if the bucket is
+// empty.
+func (b *Bucket) Allow() bool {
+	return b.AllowN(1)
+}
+
+// AllowN takes n tokens from the bucket. It returns false and takes no token,
+// if the bucket has less then n tokens. So n has to be at most burst.
+func (b *Bucket) AllowN(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < float64(n) {
+		return false
+	}
+
+	b.tokens -= float64(n)
+	return true
+}
+
+// Refund gives back a token from Allow, that was not used. It does nothing
+// for a full bucket.
+func (b *Bucket) Refund() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens++
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
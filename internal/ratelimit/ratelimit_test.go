@@ -0,0 +1,96 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) add(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func TestBucket(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	b := newWithClock(2, 2, clock.now)
+
+	t.Run("under the limit", func(t *testing.T) {
+		if !b.Allow() || !b.Allow() {
+			t.Errorf("Allow() returned false for a full bucket")
+		}
+	})
+
+	t.Run("over the limit", func(t *testing.T) {
+		if b.Allow() {
+			t.Errorf("Allow() returned true for an empty bucket")
+		}
+	})
+
+	t.Run("refill", func(t *testing.T) {
+		clock.add(500 * time.Millisecond)
+
+		if !b.Allow() {
+			t.Errorf("Allow() returned false after refill")
+		}
+
+		if b.Allow() {
+			t.Errorf("Allow() returned true, expected only one new token")
+		}
+	})
+
+	t.Run("refill is capped by burst", func(t *testing.T) {
+		clock.add(time.Hour)
+
+		for i := 0; i < 2; i++ {
+			if !b.Allow() {
+				t.Errorf("Allow() %d returned false", i)
+			}
+		}
+
+		if b.Allow() {
+			t.Errorf("Allow() returned true, expected only burst tokens")
+		}
+	})
+
+	t.Run("refund", func(t *testing.T) {
+		b.Refund()
+
+		if !b.Allow() {
+			t.Errorf("Allow() returned false after refund")
+		}
+
+		clock.add(time.Hour)
+		b.Refund()
+		for i := 0; i < 2; i++ {
+			b.Allow()
+		}
+
+		if b.Allow() {
+			t.Errorf("Allow() returned true, refund of a full bucket added a token")
+		}
+	})
+
+	t.Run("allow many", func(t *testing.T) {
+		clock.add(500 * time.Millisecond)
+
+		if b.AllowN(2) {
+			t.Errorf("AllowN(2) returned true with one token")
+		}
+
+		if !b.Allow() {
+			t.Errorf("Allow() returned false, AllowN(2) took the token")
+		}
+
+		clock.add(time.Hour)
+		if !b.AllowN(2) {
+			t.Errorf("AllowN(2) returned false for a full bucket")
+		}
+	})
+}
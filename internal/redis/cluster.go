@@ -0,0 +1,242 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// clusterHashTag is the prefix of all keys in cluster mode. Redis only uses the
+// part in braces to calculate the slot of a key. So all keys are in the same
+// slot and commands with many keys work.
+const clusterHashTag = "{icc}"
+
+// clusterSlots is the number of slots in a redis cluster.
+const clusterSlots = 16384
+
+// keySlot returns the cluster slot of a key.
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start != -1 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % clusterSlots
+}
+
+// crc16 implements CRC16-CCITT (XModem) like redis does.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// dialCluster connects to the cluster node that owns the slot of the icc keys.
+// The connection follows the redirections of the cluster, see clusterConn.
+//
+// addr can be any node of the cluster.
+func dialCluster(addr string, dialOptions ...redis.DialOption) (redis.Conn, error) {
+	conn, err := dialRedis(addr, dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.Do("CLUSTER", "SLOTS")
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cluster slots: %w", err)
+	}
+
+	host, port, err := slotOwner(reply, keySlot(clusterHashTag))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("finding cluster node: %w", err)
+	}
+
+	if host == "" {
+		// An empty host means the node that answered.
+		host, _, err = net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("invalid address %s: %w", addr, err)
+		}
+	}
+
+	dial := func(addr string) (redis.Conn, error) { return dialRedis(addr, dialOptions...) }
+
+	owner := net.JoinHostPort(host, strconv.Itoa(port))
+	if owner != addr {
+		conn.Close()
+		conn, err = dial(owner)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &clusterConn{Conn: conn, addr: owner, dial: dial}, nil
+}
+
+// clusterConn is a connection to a cluster node, that follows the redirections
+// of the cluster.
+//
+// If the slot of the icc keys was moved to another node, for example after a
+// failover, a command gets a MOVED error. Then the connection is opened to the
+// new node and the command is sent again. An ASK error, while the slot is
+// migrated, sends the command once to the other node.
+//
+// Commands, that were pipelined with Send, are not sent again, since some of
+// their replies could already be read. The error is returned and the
+// connection is marked as broken, so the pool does not reuse it. The next
+// connection is opened to the new owner of the slot.
+type clusterConn struct {
+	redis.Conn
+	addr string
+	dial func(addr string) (redis.Conn, error)
+
+	pending int
+	err     error
+}
+
+func (c *clusterConn) Send(cmd string, args ...interface{}) error {
+	c.pending++
+	return c.Conn.Send(cmd, args...)
+}
+
+func (c *clusterConn) Receive() (interface{}, error) {
+	if c.pending > 0 {
+		c.pending--
+	}
+
+	reply, err := c.Conn.Receive()
+	if _, _, ok := redirection(err); ok {
+		c.err = err
+	}
+	return reply, err
+}
+
+func (c *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	// Do reads the replies of all pending commands.
+	pipelined := c.pending > 0
+	c.pending = 0
+
+	reply, err := c.Conn.Do(cmd, args...)
+	kind, addr, ok := redirection(err)
+	if !ok {
+		return reply, err
+	}
+
+	if pipelined || cmd == "" {
+		c.err = err
+		return reply, err
+	}
+
+	if strings.HasPrefix(addr, ":") {
+		// An empty host means the node that answered.
+		host, _, _ := net.SplitHostPort(c.addr)
+		addr = host + addr
+	}
+
+	conn, dialErr := c.dial(addr)
+	if dialErr != nil {
+		c.err = err
+		return nil, fmt.Errorf("following %s redirection to %s: %w", kind, addr, dialErr)
+	}
+
+	if kind == "ASK" {
+		defer conn.Close()
+		if _, err := conn.Do("ASKING"); err != nil {
+			return nil, fmt.Errorf("asking %s: %w", addr, err)
+		}
+		return conn.Do(cmd, args...)
+	}
+
+	c.Conn.Close()
+	c.Conn = conn
+	c.addr = addr
+	return c.Conn.Do(cmd, args...)
+}
+
+func (c *clusterConn) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.Conn.Err()
+}
+
+// redirection returns the kind and the address of a MOVED or ASK error of the
+// cluster.
+func redirection(err error) (string, string, bool) {
+	var redisErr redis.Error
+	if !errors.As(err, &redisErr) {
+		return "", "", false
+	}
+
+	// The error looks like `MOVED 1862 127.0.0.1:7002`.
+	fields := strings.Fields(string(redisErr))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", "", false
+	}
+	return fields[0], fields[2], true
+}
+
+// slotOwner parses the reply of CLUSTER SLOTS and returns the host and port of
+// the master of a slot.
+func slotOwner(reply interface{}, slot int) (string, int, error) {
+	ranges, err := redis.Values(reply, nil)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid reply: %w", err)
+	}
+
+	for _, r := range ranges {
+		values, err := redis.Values(r, nil)
+		if err != nil || len(values) < 3 {
+			return "", 0, fmt.Errorf("invalid slot range %v", r)
+		}
+
+		start, err := redis.Int(values[0], nil)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid slot range start: %w", err)
+		}
+
+		end, err := redis.Int(values[1], nil)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid slot range end: %w", err)
+		}
+
+		if slot < start || slot > end {
+			continue
+		}
+
+		master, err := redis.Values(values[2], nil)
+		if err != nil || len(master) < 2 {
+			return "", 0, fmt.Errorf("invalid master node %v", values[2])
+		}
+
+		host, err := redis.String(master[0], nil)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid master host: %w", err)
+		}
+
+		port, err := redis.Int(master[1], nil)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid master port: %w", err)
+		}
+
+		return host, port, nil
+	}
+
+	return "", 0, fmt.Errorf("no node for slot %d", slot)
+}
@@ -0,0 +1,171 @@
+package redis
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestKeySlot(t *testing.T) {
+	for _, tt := range []struct {
+		key    string
+		expect int
+	}{
+		{"123456789", 12739},
+		{"{icc}", 1862},
+		{"{icc}icc-notify", 1862},
+		{"other{icc}", 1862},
+		{"{}icc", 3532},
+	} {
+		if got := keySlot(tt.key); got != tt.expect {
+			t.Errorf("keySlot(%s) = %d, expected %d", tt.key, got, tt.expect)
+		}
+	}
+}
+
+func TestClusterKeysInOneSlot(t *testing.T) {
+	k := newKeys(clusterHashTag)
+	slot := keySlot(clusterHashTag)
+
+	ms := k.milliseconds(clusterHashTag)
+
+	for _, key := range []string{k.notify, k.notifyRetain(1), k.applause(1), k.applause(42), k.applauseMeetingSet, ms.applause(1), ms.applauseMeetingSet} {
+		if got := keySlot(key); got != slot {
+			t.Errorf("key %s is in slot %d, expected %d", key, got, slot)
+		}
+	}
+}
+
+// clusterSlotsReply builds a reply of CLUSTER SLOTS with three masters.
+func clusterSlotsReply() interface{} {
+	node := func(start, end int64, host string, port int64) interface{} {
+		return []interface{}{
+			start,
+			end,
+			[]interface{}{[]byte(host), port, []byte("node-id")},
+			[]interface{}{[]byte("replica"), int64(7000), []byte("replica-id")},
+		}
+	}
+
+	return []interface{}{
+		node(0, 5460, "node-a", 7001),
+		node(5461, 10922, "node-b", 7002),
+		node(10923, 16383, "", 7003),
+	}
+}
+
+func TestSlotOwner(t *testing.T) {
+	for _, tt := range []struct {
+		slot int
+		host string
+		port int
+	}{
+		{keySlot(clusterHashTag), "node-a", 7001},
+		{keySlot("123456789"), "", 7003},
+		{5461, "node-b", 7002},
+	} {
+		host, port, err := slotOwner(clusterSlotsReply(), tt.slot)
+		if err != nil {
+			t.Fatalf("slotOwner(%d): %v", tt.slot, err)
+		}
+
+		if host != tt.host || port != tt.port {
+			t.Errorf("slotOwner(%d) = %s:%d, expected %s:%d", tt.slot, host, port, tt.host, tt.port)
+		}
+	}
+
+	if _, _, err := slotOwner([]interface{}{}, 1); err == nil {
+		t.Errorf("slotOwner without ranges did not return an error")
+	}
+}
+
+// nodeConn is a connection to a fake cluster node. It returns the error for
+// each command in errs and records all commands.
+type nodeConn struct {
+	redis.Conn
+	addr     string
+	errs     map[string]error
+	commands *[]string
+}
+
+func (c *nodeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	*c.commands = append(*c.commands, c.addr+" "+cmd)
+	if err := c.errs[cmd]; err != nil {
+		return nil, err
+	}
+	return "OK", nil
+}
+
+func (c *nodeConn) Send(cmd string, args ...interface{}) error {
+	*c.commands = append(*c.commands, c.addr+" "+cmd)
+	return nil
+}
+
+func (c *nodeConn) Close() error { return nil }
+func (c *nodeConn) Err() error   { return nil }
+
+func TestClusterConnRedirection(t *testing.T) {
+	newConn := func(errs map[string]error) (*clusterConn, *[]string) {
+		var commands []string
+		conn := &clusterConn{
+			Conn: &nodeConn{addr: "node-a:7001", errs: errs, commands: &commands},
+			addr: "node-a:7001",
+			dial: func(addr string) (redis.Conn, error) {
+				return &nodeConn{addr: addr, commands: &commands}, nil
+			},
+		}
+		return conn, &commands
+	}
+
+	t.Run("moved", func(t *testing.T) {
+		conn, commands := newConn(map[string]error{"GET": redis.Error("MOVED 1862 node-b:7002")})
+
+		if _, err := conn.Do("GET", "{icc}key"); err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+		if _, err := conn.Do("SET", "{icc}key", 1); err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+
+		expect := []string{"node-a:7001 GET", "node-b:7002 GET", "node-b:7002 SET"}
+		if !reflect.DeepEqual(*commands, expect) {
+			t.Errorf("got commands %v, expected %v", *commands, expect)
+		}
+	})
+
+	t.Run("ask", func(t *testing.T) {
+		conn, commands := newConn(map[string]error{"GET": redis.Error("ASK 1862 :7003")})
+
+		if _, err := conn.Do("GET", "{icc}key"); err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+		if _, err := conn.Do("SET", "{icc}key", 1); err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+
+		expect := []string{"node-a:7001 GET", "node-a:7003 ASKING", "node-a:7003 GET", "node-a:7001 SET"}
+		if !reflect.DeepEqual(*commands, expect) {
+			t.Errorf("got commands %v, expected %v", *commands, expect)
+		}
+	})
+
+	t.Run("pipelined", func(t *testing.T) {
+		conn, commands := newConn(map[string]error{"EXEC": redis.Error("MOVED 1862 node-b:7002")})
+
+		conn.Send("MULTI")
+		conn.Send("SET", "{icc}key", 1)
+		if _, err := conn.Do("EXEC"); err == nil {
+			t.Errorf("Do did not return the error of the pipeline")
+		}
+
+		if conn.Err() == nil {
+			t.Errorf("connection is not marked as broken")
+		}
+
+		expect := []string{"node-a:7001 MULTI", "node-a:7001 SET", "node-a:7001 EXEC"}
+		if !reflect.DeepEqual(*commands, expect) {
+			t.Errorf("got commands %v, expected %v", *commands, expect)
+		}
+	})
+}
@@ -2,9 +2,17 @@ package redis
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
 	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
 	"github.com/gomodule/redigo/redis"
 )
@@ -13,31 +21,387 @@ const (
 	// notifyKey is the name of the icc stream name.
 	notifyKey = "icc-notify"
 
-	// applauseKey is the name of the redis key for applause.
-	applauseKey = "applause"
+	// notifyEphemeralChannel is the name of the redis pub/sub channel for
+	// ephemeral notify messages.
+	notifyEphemeralChannel = "icc-notify-ephemeral"
+
+	// notifyRetainPrefix is the prefix of the redis hashes for retained
+	// notify messages. Each meeting has its own hash.
+	notifyRetainPrefix = "icc-notify-retained:"
+
+	// applausePrefix is the prefix of the redis keys for applause. Each meeting
+	// has its own key.
+	applausePrefix = "applause:"
+
+	// applauseMeetingsKey is the name of the redis set with the ids of the
+	// meetings, that have an applause key.
+	applauseMeetingsKey = "applause-meetings"
+
+	// legacyApplauseKey is the name of the redis sorted set, that an older
+	// version used for the applause of all meetings. Its members are
+	// `meetingID-userID` and its scores are unix times in seconds.
+	legacyApplauseKey = "applause"
+
+	// applauseCounterPrefix is the prefix of the redis keys for the number of
+	// users with applause of a meeting in each time window. It is only used
+	// with WithApplauseCounter.
+	applauseCounterPrefix = "applause-counter:"
+
+	// applauseMillisecondsPrefix, applauseMillisecondsMeetingsKey and
+	// applauseMillisecondsCounterPrefix replace the applause keys with
+	// WithApplauseMilliseconds.
+	applauseMillisecondsPrefix        = "applause-ms:"
+	applauseMillisecondsMeetingsKey   = "applause-ms-meetings"
+	applauseMillisecondsCounterPrefix = "applause-ms-counter:"
+
+	// applauseLeaderboardPrefix is the prefix of the redis hashes, that count
+	// the applause of each user of a meeting in one minute.
+	applauseLeaderboardPrefix = "applause-leaderboard:"
+
+	// notifyPersistKey is the name of the redis stream with a record of all
+	// notify messages.
+	notifyPersistKey = "icc-notify-persist"
+
+	// inboxPrefix is the prefix of the redis streams for the notify inboxes.
+	inboxPrefix = "icc-inbox:"
+
+	// idempotencyPrefix is the prefix of the redis keys for the idempotency
+	// keys of notify messages.
+	idempotencyPrefix = "icc-idempotency:"
+
+	// encodingGzip is the value of the field `encoding` of a notify message,
+	// that is compressed with gzip.
+	encodingGzip = "gzip"
 )
 
 // Redis implements the icc backend by saving the data to redis.
 //
 // Has to be created with redis.New().
 type Redis struct {
-	pool         *redis.Pool
-	lastNotifyID string
+	keys keys
+	pool *redis.Pool
+
+	// lastNotifyID is the id of the last received notify message. It is only
+	// written by notifyReceive, but can be read with Cursor from other
+	// goroutines.
+	lastNotifyIDMu sync.Mutex
+	lastNotifyID   string
+
+	// ephemeralConn is the connection, that is subscribed to the channel of
+	// ephemeral messages. It is only used by NotifyReceiveEphemeral.
+	ephemeralConn *redis.PubSubConn
+
+	// blockingPool is used for blocking commands. Its connections have no
+	// read timeout.
+	blockingPool *redis.Pool
+
+	// readPool and readBlockingPool are used to receive notify messages and
+	// to count applause. They connect to the replica or, without a replica,
+	// are the same as pool and blockingPool.
+	readPool         *redis.Pool
+	readBlockingPool *redis.Pool
+
+	// noZAddGT is set to 1, if redis does not support the GT option of ZADD.
+	noZAddGT int32
+
+	// meetingsMigrated is set to 1, after the applause keys of an older
+	// version were added to the set of applause meetings.
+	meetingsMigrated int32
+
+	// legacyApplauseScale converts the seconds of the legacy applause key to
+	// the unit of the applause time.
+	legacyApplauseScale int64
+
+	compress bool
+
+	// compressMinBytes is the size, from that messages are compressed.
+	compressMinBytes int
+
+	// pruneBatchSize is the maximum number of applause, that is removed with
+	// one command. 0 means no limit.
+	pruneBatchSize int
+
+	// recreateWrongType removes applause keys with the wrong type, so they can
+	// be recreated.
+	recreateWrongType bool
+
+	// applauseCounter is the width of the applause counters in the unit of the
+	// applause time. 0 means, that there are no counters.
+	applauseCounter int64
+
+	// poolWaitTimeout is the maximum time NotifyPublish and ApplausePublish
+	// wait for a free connection. 0 means no limit.
+	poolWaitTimeout time.Duration
+
+	// streamMaxAge is the age after that messages are removed from the
+	// notify stream and the persist stream. 0 means no limit.
+	streamMaxAge time.Duration
+}
+
+// Option is an optional argument for redis.New().
+type Option func(*config)
+
+type config struct {
+	connectTimeout time.Duration
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	compress       bool
+	cluster        bool
+	pruneBatchSize int
+	replicaAddr    string
+
+	recreateWrongType bool
+	applauseCounter   int64
+	poolWaitTimeout   time.Duration
+	streamMaxAge      time.Duration
+	compressMinBytes  int
+
+	applauseMilliseconds bool
+}
+
+// WithTimeouts sets the timeouts for connecting to redis, reading from redis
+// and writing to redis. A value of 0 means no timeout.
+//
+// The connect timeout includes the DNS lookup of the redis host.
+//
+// The read timeout is not used for blocking commands.
+func WithTimeouts(connect, read, write time.Duration) Option {
+	return func(c *config) {
+		c.connectTimeout = connect
+		c.readTimeout = read
+		c.writeTimeout = write
+	}
+}
+
+// WithCompression compresses notify messages with gzip before they are saved.
+//
+// Messages are always decompressed when they are read. So compressed and
+// uncompressed messages can be mixed.
+func WithCompression() Option {
+	return func(c *config) {
+		c.compress = true
+	}
+}
+
+// WithCompressMinBytes only compresses notify messages with at least size
+// bytes, if WithCompression is used. Smaller messages are saved uncompressed,
+// since compressing them costs more then it saves.
+func WithCompressMinBytes(size int) Option {
+	return func(c *config) {
+		c.compressMinBytes = size
+	}
+}
+
+// WithCluster connects to a redis cluster. addr can be any node of the
+// cluster.
+//
+// All keys get the hash tag {icc}, so they are saved in the same slot. Each
+// connection is opened to the node that owns this slot.
+//
+// If the slot is moved to another node, a command is redirected to the new
+// node. Commands, that were pipelined, fail once, see clusterConn.
+func WithCluster() Option {
+	return func(c *config) {
+		c.cluster = true
+	}
+}
+
+// WithPruneBatchSize lets ApplauseCleanOld remove at most size applause of a
+// meeting with one redis command. It is repeated until all old applause is
+// removed. So other commands are not blocked for long, if a meeting has a lot
+// of old applause.
+//
+// A size of 0 removes all old applause of a meeting with one command.
+func WithPruneBatchSize(size int) Option {
+	return func(c *config) {
+		c.pruneBatchSize = size
+	}
+}
+
+// WithReplica receives notify messages and counts applause from a read-only
+// replica of redis. All other commands use the primary.
+//
+// Messages that are not replicated yet are received later. No message is
+// missed, since the stream ids are the same on the replica.
+//
+// The replica can not be used together with WithCluster.
+func WithReplica(addr string) Option {
+	return func(c *config) {
+		c.replicaAddr = addr
+	}
+}
+
+// WithRecreateWrongType removes an applause key, that holds a value of a
+// different type, when redis returns a WRONGTYPE error for it. The key is
+// recreated with the next applause.
+//
+// Without this option, the error is returned. This is the default, since the
+// key probably belongs to another service that uses the same redis database.
+func WithRecreateWrongType() Option {
+	return func(c *config) {
+		c.recreateWrongType = true
+	}
+}
+
+// WithApplauseCounter keeps counters of the applause of each meeting. Each
+// counter is the number of users, whose last applause is in a time window of
+// the given width. The width uses the unit of the applause time, for example 1
+// for seconds or 1000 for milliseconds.
+//
+// ApplauseCounters sums the counters since a time without counting the
+// applause. Applause that was saved without this option is not counted.
+func WithApplauseCounter(width int64) Option {
+	return func(c *config) {
+		c.applauseCounter = width
+	}
+}
+
+// WithApplauseMilliseconds saves the applause in other keys, that are only used
+// for applause times in milliseconds. So applause in seconds and in
+// milliseconds is never mixed, when the resolution is changed. The applause of
+// the other resolution is not counted and expires like old applause.
+func WithApplauseMilliseconds() Option {
+	return func(c *config) {
+		c.applauseMilliseconds = true
+	}
+}
+
+// WithPoolWaitTimeout limits the time NotifyPublish and ApplausePublish wait
+// for a free connection, when all connections of the pool are in use. After
+// the timeout, they return ErrUnavailable.
+//
+// Without this option, they wait until a connection is free.
+func WithPoolWaitTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.poolWaitTimeout = d
+	}
+}
+
+// WithStreamMaxAge removes the messages from the notify stream and the persist
+// stream, that are older then d. The streams are trimmed with each new message
+// by MINID, so redis 6.2 or newer is needed. It can be combined with the
+// maxLen of NotifyPersist.
+//
+// Other then maxLen, the age is trimmed exactly. Each new message only removes
+// the few messages, that got too old since the last one.
+func WithStreamMaxAge(d time.Duration) Option {
+	return func(c *config) {
+		c.streamMaxAge = d
+	}
 }
 
 // New creates a new initializes redis instance.
-func New(addr string) *Redis {
-	pool := redis.Pool{
-		MaxActive:   100,
-		Wait:        true,
-		MaxIdle:     10,
-		IdleTimeout: 240 * time.Second,
-		Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", addr) },
+func New(addr string, options ...Option) *Redis {
+	var cfg config
+	for _, o := range options {
+		o(&cfg)
+	}
+
+	dialOptions := []redis.DialOption{
+		redis.DialConnectTimeout(cfg.connectTimeout),
+		redis.DialWriteTimeout(cfg.writeTimeout),
+	}
+
+	var hashTag string
+	if cfg.cluster {
+		hashTag = clusterHashTag
+	}
+
+	k := newKeys(hashTag)
+	if cfg.applauseMilliseconds {
+		k = k.milliseconds(hashTag)
+	}
+
+	r := Redis{
+		keys:         k,
+		pool:         newPool(addr, cfg.cluster, append(dialOptions, redis.DialReadTimeout(cfg.readTimeout))...),
+		blockingPool: newPool(addr, cfg.cluster, dialOptions...),
+		compress:     cfg.compress,
+
+		pruneBatchSize:    cfg.pruneBatchSize,
+		recreateWrongType: cfg.recreateWrongType,
+		applauseCounter:   cfg.applauseCounter,
+		poolWaitTimeout:   cfg.poolWaitTimeout,
+		streamMaxAge:      cfg.streamMaxAge,
+		compressMinBytes:  cfg.compressMinBytes,
+
+		legacyApplauseScale: 1,
+	}
+
+	if cfg.applauseMilliseconds {
+		r.legacyApplauseScale = 1000
+	}
+
+	r.readPool = r.pool
+	r.readBlockingPool = r.blockingPool
+	if cfg.replicaAddr != "" {
+		r.readPool = newPool(cfg.replicaAddr, false, append(dialOptions, redis.DialReadTimeout(cfg.readTimeout))...)
+		r.readBlockingPool = newPool(cfg.replicaAddr, false, dialOptions...)
+	}
+
+	return &r
+}
+
+func newPool(addr string, cluster bool, dialOptions ...redis.DialOption) *redis.Pool {
+	dial := func() (redis.Conn, error) { return dialRedis(addr, dialOptions...) }
+
+	var maxLifetime time.Duration
+	if cluster {
+		dial = func() (redis.Conn, error) { return dialCluster(addr, dialOptions...) }
+
+		// Reconnect from time to time, so the new owner of the slot is used
+		// after a failover.
+		maxLifetime = time.Minute
+	}
+
+	return &redis.Pool{
+		MaxActive:       100,
+		Wait:            true,
+		MaxIdle:         10,
+		IdleTimeout:     240 * time.Second,
+		MaxConnLifetime: maxLifetime,
+		Dial:            dial,
+	}
+}
+
+// dialRedis connects to redis. The connect timeout also stops the DNS lookup of
+// the host.
+//
+// The dial does not use the context of the command. It could be the short
+// context of poolWaitTimeout.
+//
+// If the host can not be resolved, a message is logged.
+func dialRedis(addr string, dialOptions ...redis.DialOption) (redis.Conn, error) {
+	conn, err := redis.Dial("tcp", addr, dialOptions...)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			icclog.Info("Can not resolve redis host `%s`: %v", dnsErr.Name, dnsErr)
+			return nil, fmt.Errorf("resolving redis host `%s`: %w", dnsErr.Name, err)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// getConn returns a connection from the primary pool. It waits for a free
+// connection until the context is done or poolWaitTimeout is over.
+func (r *Redis) getConn(ctx context.Context) (redis.Conn, error) {
+	waitCtx := ctx
+	if r.poolWaitTimeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, r.poolWaitTimeout)
+		defer cancel()
 	}
 
-	return &Redis{
-		pool: &pool,
+	conn, err := r.pool.GetContext(waitCtx)
+	if err != nil {
+		if ctx.Err() == nil && waitCtx.Err() != nil {
+			return nil, iccerror.NewMessageError(iccerror.ErrUnavailable, "All connections to redis are in use. Please try again later.")
+		}
+		return nil, fmt.Errorf("getting redis connection: %w", err)
 	}
+	return conn, nil
 }
 
 // Wait blocks until a connection to redis can be established.
@@ -56,13 +420,166 @@ func (r *Redis) Wait(ctx context.Context) {
 
 // NotifyPublish saves a valid notify message.
 func (r *Redis) NotifyPublish(message []byte) error {
+	conn, err := r.getConn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	args := []interface{}{r.keys.notify}
+	if r.streamMaxAge > 0 {
+		args = append(args, "MINID", r.streamMinID())
+	}
+
+	fields, err := r.notifyFields(message)
+	if err != nil {
+		return err
+	}
+	args = append(args, "*")
+	args = append(args, fields...)
+
+	if _, err := conn.Do("XADD", args...); err != nil {
+		return fmt.Errorf("xadd: %w", err)
+	}
+	return nil
+}
+
+// notifyFields returns the fields of the stream entry for a notify message.
+// With WithCompression, messages with at least compressMinBytes are
+// compressed. The field `encoding` is only set for a compressed message.
+func (r *Redis) notifyFields(message []byte) ([]interface{}, error) {
+	if !r.compress || len(message) < r.compressMinBytes {
+		return []interface{}{"content", message}, nil
+	}
+
+	compressed, err := compress(message)
+	if err != nil {
+		return nil, fmt.Errorf("compressing message: %w", err)
+	}
+	return []interface{}{"content", compressed, "encoding", encodingGzip}, nil
+}
+
+// streamMinID returns the stream id of the oldest messages, that are kept with
+// WithStreamMaxAge.
+func (r *Redis) streamMinID() string {
+	return fmt.Sprintf("%d-0", time.Now().Add(-r.streamMaxAge).UnixMilli())
+}
+
+// StreamLen returns the number of notify messages in the stream.
+func (r *Redis) StreamLen() (int, error) {
+	conn := r.readPool.Get()
+	defer conn.Close()
+
+	length, err := redis.Int(conn.Do("XLEN", r.keys.notify))
+	if err != nil {
+		return 0, fmt.Errorf("xlen: %w", err)
+	}
+	return length, nil
+}
+
+// LastID returns the id of the newest notify message in the stream. It
+// returns an empty string, if the stream is empty.
+func (r *Redis) LastID() (string, error) {
+	conn := r.readPool.Get()
+	defer conn.Close()
+
+	ids, _, err := streamEntries(conn.Do("XREVRANGE", r.keys.notify, "+", "-", "COUNT", 1))
+	if err != nil {
+		return "", fmt.Errorf("xrevrange: %w", err)
+	}
+
+	if len(ids) == 0 {
+		return "", nil
+	}
+	return ids[0], nil
+}
+
+// Cursor returns the id of the last notify message, that was received with
+// NotifyReceive. It returns an empty string, if no message was received yet.
+func (r *Redis) Cursor() string {
+	r.lastNotifyIDMu.Lock()
+	defer r.lastNotifyIDMu.Unlock()
+
+	return r.lastNotifyID
+}
+
+// maxStreamLag is the highest lag, that StreamLag counts. The script has to
+// read each message of the lag, so it would block redis for long with a big
+// lag.
+const maxStreamLag = 10000
+
+// streamLagScript counts the entries of the stream KEYS[1] after the id
+// ARGV[1], but at most ARGV[2]. XRANGE with an exclusive start needs redis
+// 6.2, so the entry with the start id is skipped in the script.
+var streamLagScript = redis.NewScript(1, `
+local lag = 0
+local start = ARGV[1]
+local limit = tonumber(ARGV[2])
+while lag < limit do
+	local entries = redis.call('XRANGE', KEYS[1], start, '+', 'COUNT', 1000)
+	local n = #entries
+	if n > 0 and entries[1][1] == start then
+		n = n - 1
+	end
+	if n == 0 then
+		return lag
+	end
+	lag = lag + n
+	start = entries[#entries][1]
+end
+return limit
+`)
+
+// StreamLag returns the number of notify messages in the stream, that were
+// not received yet. A lag over maxStreamLag is returned as maxStreamLag.
+//
+// Before the first message is received, the lag is 0.
+func (r *Redis) StreamLag() (int, error) {
+	cursor := r.Cursor()
+	if cursor == "" {
+		return 0, nil
+	}
+
 	conn := r.pool.Get()
 	defer conn.Close()
 
-	_, err := conn.Do("XADD", notifyKey, "*", "content", message)
+	lag, err := redis.Int(streamLagScript.Do(conn, r.keys.notify, cursor, maxStreamLag))
 	if err != nil {
+		return 0, fmt.Errorf("counting messages after %s: %w", cursor, err)
+	}
+	return lag, nil
+}
+
+// NotifyPersist adds a message to the persist stream together with the sender
+// and the name of the message.
+//
+// The stream is trimmed to about maxLen entries. A maxLen of 0 means no
+// trimming. With WithStreamMaxAge, older messages are also removed.
+func (r *Redis) NotifyPersist(message []byte, senderUserID int, name string, maxLen int) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	// XADD can only trim with one strategy. If both are used, the stream is
+	// trimmed by age with XTRIM.
+	trimAge := r.streamMaxAge > 0
+	args := []interface{}{r.keys.notifyPersist}
+	if maxLen > 0 {
+		args = append(args, "MAXLEN", "~", maxLen)
+	} else if trimAge {
+		args = append(args, "MINID", r.streamMinID())
+		trimAge = false
+	}
+	args = append(args, "*", "content", message, "sender_user_id", senderUserID, "name", name)
+
+	if _, err := conn.Do("XADD", args...); err != nil {
 		return fmt.Errorf("xadd: %w", err)
 	}
+
+	if trimAge {
+		if _, err := conn.Do("XTRIM", r.keys.notifyPersist, "MINID", r.streamMinID()); err != nil {
+			return fmt.Errorf("xtrim: %w", err)
+		}
+	}
 	return nil
 }
 
@@ -74,9 +591,24 @@ func (r *Redis) NotifyPublish(message []byte) error {
 //
 // It is expected, that only one goroutine is calling this function.
 func (r *Redis) NotifyReceive(ctx context.Context) ([]byte, error) {
-	id := r.lastNotifyID
+	return r.notifyReceive(ctx, "$")
+}
+
+// NotifyReceiveFromBeginning is like NotifyReceive, but the first call returns
+// the oldest message that is saved in redis.
+//
+// After all saved messages are returned, the function continues with new
+// messages. No message is missed between them.
+func (r *Redis) NotifyReceiveFromBeginning(ctx context.Context) ([]byte, error) {
+	return r.notifyReceive(ctx, "0-0")
+}
+
+// notifyReceive reads the next message after the last read message. If no
+// message was read yet, it reads the next message after firstID.
+func (r *Redis) notifyReceive(ctx context.Context, firstID string) ([]byte, error) {
+	id := r.Cursor()
 	if id == "" {
-		id = "$"
+		id = firstID
 	}
 
 	type streamReturn struct {
@@ -88,10 +620,10 @@ func (r *Redis) NotifyReceive(ctx context.Context) ([]byte, error) {
 	streamFinished := make(chan streamReturn)
 
 	go func() {
-		conn := r.pool.Get()
+		conn := r.readBlockingPool.Get()
 		defer conn.Close()
 
-		id, data, err := stream(conn.Do("XREAD", "COUNT", 1, "BLOCK", "0", "STREAMS", notifyKey, id))
+		id, data, err := stream(conn.Do("XREAD", "COUNT", 1, "BLOCK", "0", "STREAMS", r.keys.notify, id))
 		streamFinished <- streamReturn{id, data, err}
 	}()
 
@@ -103,7 +635,9 @@ func (r *Redis) NotifyReceive(ctx context.Context) ([]byte, error) {
 	}
 
 	if received.id != "" {
-		r.lastNotifyID = id
+		r.lastNotifyIDMu.Lock()
+		r.lastNotifyID = received.id
+		r.lastNotifyIDMu.Unlock()
 	}
 
 	if err := received.err; err != nil {
@@ -113,49 +647,988 @@ func (r *Redis) NotifyReceive(ctx context.Context) ([]byte, error) {
 	return received.data, nil
 }
 
-// ApplausePublish saves an applause for the user at a given time as unix time
-// stamp.
-func (r *Redis) ApplausePublish(meetingID, userID int, time int64) error {
+// NotifyPublishEphemeral sends an ephemeral message to all instances with redis
+// pub/sub. The message is not saved, so it is only received by the instances,
+// that are subscribed at this moment.
+func (r *Redis) NotifyPublishEphemeral(message []byte) error {
 	conn := r.pool.Get()
 	defer conn.Close()
 
-	meetingUser := fmt.Sprintf("%d-%d", meetingID, userID)
-	if _, err := conn.Do("ZADD", applauseKey, time, meetingUser); err != nil {
-		return fmt.Errorf("adding applause in redis: %w", err)
+	if _, err := conn.Do("PUBLISH", r.keys.notifyEphemeral, message); err != nil {
+		return fmt.Errorf("publish: %w", err)
 	}
-
 	return nil
 }
 
-// ApplauseSince returned all applause since a given time as unix time stamp.
-func (r *Redis) ApplauseSince(time int64) (map[int]int, error) {
+// NotifyReceiveEphemeral is a blocking function that receives the ephemeral
+// messages. The first call subscribes to the channel. Messages, that are
+// published before or while the connection is lost, are not received.
+//
+// It is expected, that only one goroutine is calling this function.
+func (r *Redis) NotifyReceiveEphemeral(ctx context.Context) ([]byte, error) {
+	if r.ephemeralConn == nil {
+		psc := redis.PubSubConn{Conn: r.blockingPool.Get()}
+		if err := psc.Subscribe(r.keys.notifyEphemeral); err != nil {
+			psc.Close()
+			return nil, fmt.Errorf("subscribe: %w", err)
+		}
+		r.ephemeralConn = &psc
+	}
+	psc := r.ephemeralConn
+
+	type receiveReturn struct {
+		data []byte
+		err  error
+	}
+
+	received := make(chan receiveReturn, 1)
+	go func() {
+		for {
+			switch v := psc.Receive().(type) {
+			case redis.Message:
+				received <- receiveReturn{data: v.Data}
+				return
+			case error:
+				received <- receiveReturn{err: v}
+				return
+			}
+		}
+	}()
+
+	select {
+	case got := <-received:
+		if got.err != nil {
+			// The next call subscribes again.
+			psc.Close()
+			r.ephemeralConn = nil
+			return nil, fmt.Errorf("receive ephemeral message from redis: %w", got.err)
+		}
+		return got.data, nil
+
+	case <-ctx.Done():
+		// Closing the connection stops the goroutine.
+		psc.Close()
+		r.ephemeralConn = nil
+		return nil, ctx.Err()
+	}
+}
+
+// NotifyRetain saves a message as the last value for the name in the meeting.
+//
+// The hash of the meeting expires after ttl without a new retained message.
+func (r *Redis) NotifyRetain(meetingID int, name string, message []byte, ttl time.Duration) error {
 	conn := r.pool.Get()
 	defer conn.Close()
 
-	meetingUsers, err := redis.Strings(conn.Do("ZRANGE", applauseKey, time, "+inf", "BYSCORE"))
+	key := r.keys.notifyRetain(meetingID)
+
+	if err := conn.Send("MULTI"); err != nil {
+		return fmt.Errorf("sending multi: %w", err)
+	}
+
+	if err := conn.Send("HSET", key, name, message); err != nil {
+		return fmt.Errorf("sending hset: %w", err)
+	}
+
+	if ttl > 0 {
+		if err := conn.Send("PEXPIRE", key, ttl.Milliseconds()); err != nil {
+			return fmt.Errorf("sending pexpire: %w", err)
+		}
+	}
+
+	replies, err := redis.Values(conn.Do("EXEC"))
 	if err != nil {
-		return nil, fmt.Errorf("getting applause from redis: %w", err)
+		return fmt.Errorf("saving retained message: %w", err)
 	}
 
-	out := make(map[int]int)
-	for _, meetingUser := range meetingUsers {
-		var meetingID int
-		if _, err := fmt.Sscanf(meetingUser, "%d-", &meetingID); err != nil {
-			return nil, fmt.Errorf("invalid value in redis %s: %w", meetingUser, err)
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return fmt.Errorf("saving retained message: %w", err)
 		}
-		out[meetingID]++
 	}
+	return nil
+}
 
-	return out, nil
+// NotifyUnretain removes the retained message for the name in the meeting.
+func (r *Redis) NotifyUnretain(meetingID int, name string) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("HDEL", r.keys.notifyRetain(meetingID), name); err != nil {
+		return fmt.Errorf("hdel: %w", err)
+	}
+	return nil
 }
 
-// ApplauseCleanOld removes applause that is older then a given time.
-func (r *Redis) ApplauseCleanOld(olderThen int64) error {
+// NotifyRetained returns the retained messages of a meeting.
+func (r *Redis) NotifyRetained(meetingID int) ([][]byte, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	messages, err := redis.ByteSlices(conn.Do("HVALS", r.keys.notifyRetain(meetingID)))
+	if err != nil {
+		return nil, fmt.Errorf("hvals: %w", err)
+	}
+	return messages, nil
+}
+
+// InboxAdd adds a message to the inboxes with the given keys.
+//
+// Each inbox is a redis stream that is capped to `size` messages. It expires
+// after ttl without new messages. All inboxes are written in one transaction,
+// so the message is saved in all of them or in none.
+func (r *Redis) InboxAdd(keys []string, message []byte, size int, ttl time.Duration) error {
 	conn := r.pool.Get()
 	defer conn.Close()
 
-	if _, err := conn.Do("ZREMRANGEBYSCORE", applauseKey, 0, olderThen-1); err != nil {
-		return fmt.Errorf("removing old applause from redis: %w", err)
+	if err := conn.Send("MULTI"); err != nil {
+		return fmt.Errorf("sending multi: %w", err)
+	}
+
+	for _, key := range keys {
+		key = r.keys.inboxPrefix + key
+
+		if err := conn.Send("XADD", key, "MAXLEN", size, "*", "content", message); err != nil {
+			return fmt.Errorf("sending xadd: %w", err)
+		}
+
+		if ttl > 0 {
+			if err := conn.Send("PEXPIRE", key, ttl.Milliseconds()); err != nil {
+				return fmt.Errorf("sending pexpire: %w", err)
+			}
+		}
+	}
+
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return fmt.Errorf("adding message to inboxes: %w", err)
+	}
+
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return fmt.Errorf("adding message to inboxes: %w", err)
+		}
 	}
 	return nil
 }
+
+// InboxSince returns the messages of the inbox with the given key that are
+// newer then lastID.
+//
+// This needs redis 6.2 or newer.
+func (r *Redis) InboxSince(key string, lastID string) ([]string, [][]byte, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	start := "-"
+	if lastID != "" {
+		start = "(" + lastID
+	}
+
+	ids, messages, err := streamEntries(conn.Do("XRANGE", r.keys.inboxPrefix+key, start, "+"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("xrange: %w", err)
+	}
+	return ids, messages, nil
+}
+
+// IdempotencyMark saves the message id for the key with SET NX. If the key
+// already exists, its message id is returned.
+//
+// The key is always saved with the expiry ttl. So the ttl has to be greater
+// then 0.
+func (r *Redis) IdempotencyMark(key string, messageID string, ttl time.Duration) (string, error) {
+	// A key without expiry would be kept forever.
+	if ttl <= 0 {
+		return "", fmt.Errorf("idempotency key %s needs a ttl, got %s", key, ttl)
+	}
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	key = r.keys.idempotencyPrefix + key
+
+	reply, err := conn.Do("SET", key, messageID, "NX", "PX", ttl.Milliseconds())
+	if err != nil {
+		return "", fmt.Errorf("set: %w", err)
+	}
+
+	if reply != nil {
+		return messageID, nil
+	}
+
+	firstID, err := redis.String(conn.Do("GET", key))
+	if err != nil {
+		if err == redis.ErrNil {
+			// The key expired between SET and GET.
+			return messageID, nil
+		}
+		return "", fmt.Errorf("get: %w", err)
+	}
+	return firstID, nil
+}
+
+// IdempotencyUnmark removes the key.
+func (r *Redis) IdempotencyUnmark(key string) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("DEL", r.keys.idempotencyPrefix+key); err != nil {
+		return fmt.Errorf("del: %w", err)
+	}
+	return nil
+}
+
+// ApplausePublish saves an applause for the user at a given time as unix time
+// stamp.
+//
+// An older time than the saved time of the user is ignored. This needs redis
+// 6.2 or newer. On older versions, the time is always overwritten.
+func (r *Redis) ApplausePublish(meetingID, userID int, time int64) error {
+	conn, err := r.getConn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return r.applausePublishKey(conn, meetingID, userID, time)
+}
+
+// applausePublishKey saves the applause with the connection. The key is
+// recreated, if it has the wrong type and WithRecreateWrongType is used.
+func (r *Redis) applausePublishKey(conn redis.Conn, meetingID, userID int, time int64) error {
+	key := r.keys.applause(meetingID)
+
+	err := r.applausePublish(conn, key, userID, time)
+	recreated, err := r.handleWrongType(conn, key, err)
+	if recreated {
+		err = r.applausePublish(conn, key, userID, time)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Do("SADD", r.keys.applauseMeetingSet, meetingID); err != nil {
+		return fmt.Errorf("adding meeting to applause meetings: %w", err)
+	}
+	return err
+}
+
+// ApplausePublishContext is like ApplausePublish, but returns when the context
+// is done. This includes the wait for a free connection. A command, that was
+// already sent, is not taken back from redis. It runs until redis answers or
+// the read timeout is over.
+func (r *Redis) ApplausePublishContext(ctx context.Context, meetingID, userID int, time int64) error {
+	conn, err := r.getConn(ctx)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer conn.Close()
+		done <- r.applausePublishKey(conn, meetingID, userID, time)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// applausePublishCounterScript adds the applause of the user ARGV[2] with the
+// time ARGV[1] to the sorted set KEYS[1]. An older time is not saved, like
+// ZADD GT.
+//
+// The hash KEYS[2] has a counter for each window of the width ARGV[3]. The user
+// is moved from the counter of the old time to the counter of the new time. A
+// counter, that was already removed by pruneCounterScript, is not decreased.
+var applausePublishCounterScript = redis.NewScript(2, `
+local time = tonumber(ARGV[1])
+local width = tonumber(ARGV[3])
+local old = redis.call('ZSCORE', KEYS[1], ARGV[2])
+if old and time <= tonumber(old) then
+	return 0
+end
+
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+if old then
+	local oldWindow = string.format('%d', math.floor(tonumber(old) / width))
+	if redis.call('HEXISTS', KEYS[2], oldWindow) == 1 then
+		if redis.call('HINCRBY', KEYS[2], oldWindow, -1) <= 0 then
+			redis.call('HDEL', KEYS[2], oldWindow)
+		end
+	end
+end
+redis.call('HINCRBY', KEYS[2], string.format('%d', math.floor(time / width)), 1)
+return 0
+`)
+
+// applausePublish adds the applause of the user to the key.
+func (r *Redis) applausePublish(conn redis.Conn, key string, userID int, time int64) error {
+	if r.applauseCounter > 0 {
+		counterKey := r.keys.applauseCounter(key)
+		if _, err := applausePublishCounterScript.Do(conn, key, counterKey, time, userID, r.applauseCounter); err != nil {
+			return fmt.Errorf("adding applause in redis: %w", err)
+		}
+		return nil
+	}
+
+	if atomic.LoadInt32(&r.noZAddGT) == 0 {
+		_, err := conn.Do("ZADD", key, "GT", time, userID)
+		if err == nil {
+			return nil
+		}
+
+		var redisErr redis.Error
+		if !errors.As(err, &redisErr) || !strings.Contains(err.Error(), "syntax error") {
+			return fmt.Errorf("adding applause in redis: %w", err)
+		}
+
+		icclog.Info("Redis does not support ZADD GT. Using ZADD without GT: %v", err)
+		atomic.StoreInt32(&r.noZAddGT, 1)
+	}
+
+	if _, err := conn.Do("ZADD", key, time, userID); err != nil {
+		return fmt.Errorf("adding applause in redis: %w", err)
+	}
+
+	return nil
+}
+
+// ApplauseSince returned all applause since a given time as unix time stamp.
+func (r *Redis) ApplauseSince(time int64) (map[int]int, error) {
+	conn := r.readPool.Get()
+	defer conn.Close()
+
+	meetingIDs, err := r.keys.applauseMeetings(conn)
+	if err != nil {
+		return nil, fmt.Errorf("getting applause meetings: %w", err)
+	}
+
+	// All ZCOUNT commands are sent in one pipeline.
+	for _, meetingID := range meetingIDs {
+		if err := conn.Send("ZCOUNT", r.keys.applause(meetingID), time, "+inf"); err != nil {
+			return nil, fmt.Errorf("sending zcount: %w", err)
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("flushing zcount: %w", err)
+	}
+
+	// All replies have to be read, before the connection can be used again.
+	counts := make([]int, len(meetingIDs))
+	errs := make([]error, len(meetingIDs))
+	for i := range meetingIDs {
+		counts[i], errs[i] = redis.Int(conn.Receive())
+	}
+
+	out := make(map[int]int)
+	for i, meetingID := range meetingIDs {
+		if errs[i] != nil {
+			recreated, err := r.handleWrongType(nil, r.keys.applause(meetingID), errs[i])
+			if recreated {
+				continue
+			}
+			return nil, fmt.Errorf("getting applause for meeting %d from redis: %w", meetingID, err)
+		}
+
+		if counts[i] > 0 {
+			out[meetingID] = counts[i]
+		}
+	}
+
+	return out, nil
+}
+
+// ActiveApplauseMeetings returns the ids of the meetings with applause since
+// the given time, ordered by id. Meetings with only older applause are left
+// out.
+func (r *Redis) ActiveApplauseMeetings(since int64) ([]int, error) {
+	applause, err := r.ApplauseSince(since)
+	if err != nil {
+		return nil, fmt.Errorf("counting applause: %w", err)
+	}
+
+	meetingIDs := make([]int, 0, len(applause))
+	for meetingID := range applause {
+		meetingIDs = append(meetingIDs, meetingID)
+	}
+	sort.Ints(meetingIDs)
+	return meetingIDs, nil
+}
+
+// ApplauseCounters returns the number of users with applause since the given
+// time for each meeting. It sums the counters of WithApplauseCounter. The
+// window of since is counted completely, so the result can contain applause
+// up to one window width before since.
+//
+// Returns an error, if WithApplauseCounter is not used.
+func (r *Redis) ApplauseCounters(since int64) (map[int]int, error) {
+	if r.applauseCounter <= 0 {
+		return nil, errors.New("applause counter is not enabled")
+	}
+
+	conn := r.readPool.Get()
+	defer conn.Close()
+
+	meetingIDs, err := r.keys.applauseMeetings(conn)
+	if err != nil {
+		return nil, fmt.Errorf("getting applause meetings: %w", err)
+	}
+
+	// All HGETALL commands are sent in one pipeline.
+	for _, meetingID := range meetingIDs {
+		if err := conn.Send("HGETALL", r.keys.applauseCounter(r.keys.applause(meetingID))); err != nil {
+			return nil, fmt.Errorf("sending hgetall: %w", err)
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("flushing hgetall: %w", err)
+	}
+
+	// All replies have to be read, before the connection can be used again.
+	counters := make([]map[string]int, len(meetingIDs))
+	errs := make([]error, len(meetingIDs))
+	for i := range meetingIDs {
+		counters[i], errs[i] = redis.IntMap(conn.Receive())
+	}
+
+	first := since / r.applauseCounter
+	out := make(map[int]int)
+	for i, meetingID := range meetingIDs {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("getting applause counters for meeting %d from redis: %w", meetingID, errs[i])
+		}
+
+		for window, count := range counters[i] {
+			w, err := strconv.ParseInt(window, 10, 64)
+			if err != nil || w < first {
+				continue
+			}
+			out[meetingID] += count
+		}
+
+		if out[meetingID] <= 0 {
+			delete(out, meetingID)
+		}
+	}
+	return out, nil
+}
+
+// ApplauseSize returns the number of users in the applause set of a meeting.
+func (r *Redis) ApplauseSize(meetingID int) (int, error) {
+	conn := r.readPool.Get()
+	defer conn.Close()
+
+	key := r.keys.applause(meetingID)
+	size, err := redis.Int(conn.Do("ZCARD", key))
+	if err != nil {
+		if recreated, err := r.handleWrongType(nil, key, err); !recreated {
+			return 0, fmt.Errorf("zcard: %w", err)
+		}
+	}
+	return size, nil
+}
+
+// ApplauseUsers returns the ids of the users with applause in a meeting since
+// the given time.
+func (r *Redis) ApplauseUsers(meetingID int, since int64) ([]int, error) {
+	conn := r.readPool.Get()
+	defer conn.Close()
+
+	key := r.keys.applause(meetingID)
+	userIDs, err := redis.Ints(conn.Do("ZRANGEBYSCORE", key, since, "+inf"))
+	if err != nil {
+		if recreated, err := r.handleWrongType(nil, key, err); !recreated {
+			return nil, fmt.Errorf("zrangebyscore: %w", err)
+		}
+	}
+	return userIDs, nil
+}
+
+// ApplauseLeaderboardAdd counts one applause of the user in the meeting. at is
+// a unix time in seconds.
+//
+// The applause is counted in a hash for each minute. It expires after ttl and
+// one more minute.
+func (r *Redis) ApplauseLeaderboardAdd(meetingID, userID int, at int64, ttl time.Duration) error {
+	conn, err := r.getConn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	key := r.keys.applauseLeaderboard(meetingID, at/60)
+	if err := conn.Send("HINCRBY", key, userID, 1); err != nil {
+		return fmt.Errorf("sending hincrby: %w", err)
+	}
+
+	if err := conn.Send("PEXPIRE", key, (ttl + time.Minute).Milliseconds()); err != nil {
+		return fmt.Errorf("sending pexpire: %w", err)
+	}
+
+	if _, err := conn.Do(""); err != nil {
+		return fmt.Errorf("counting applause of user: %w", err)
+	}
+	return nil
+}
+
+// ApplauseLeaderboard returns the number of applause of each user in the
+// meeting since the given unix time in seconds. The applause is counted from
+// the start of the minute of since.
+func (r *Redis) ApplauseLeaderboard(meetingID int, since int64) (map[int]int, error) {
+	conn := r.readPool.Get()
+	defer conn.Close()
+
+	first := since / 60
+	last := time.Now().Unix() / 60
+	for minute := first; minute <= last; minute++ {
+		if err := conn.Send("HGETALL", r.keys.applauseLeaderboard(meetingID, minute)); err != nil {
+			return nil, fmt.Errorf("sending hgetall: %w", err)
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("flushing hgetall: %w", err)
+	}
+
+	// All replies have to be read, before the connection can be used again.
+	counts := make(map[int]int)
+	var firstErr error
+	for minute := first; minute <= last; minute++ {
+		values, err := redis.IntMap(conn.Receive())
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("reading applause of minute %d: %w", minute, err)
+			}
+			continue
+		}
+
+		for user, count := range values {
+			userID, err := strconv.Atoi(user)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("invalid user id in leaderboard: %s", user)
+				}
+				continue
+			}
+			counts[userID] += count
+		}
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return counts, nil
+}
+
+// ApplauseCleanOld removes applause that is older then a given time.
+//
+// If the applause of one meeting can not be removed, the other meetings are
+// still cleaned. In this case, an PruneError is returned.
+//
+// Redis removes the key of a meeting together with its last applause. So
+// meetings without activity do not leave keys behind. The meeting is also
+// removed from the set of applause meetings.
+//
+// The first call also adds the applause keys, that were saved by an older
+// version without the set of applause meetings, and converts the applause of
+// the legacy key, that was used for all meetings.
+func (r *Redis) ApplauseCleanOld(olderThen int64) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	if atomic.LoadInt32(&r.meetingsMigrated) == 0 {
+		if err := r.migrateApplauseMeetings(conn); err != nil {
+			return fmt.Errorf("adding existing applause meetings: %w", err)
+		}
+		atomic.StoreInt32(&r.meetingsMigrated, 1)
+	}
+
+	meetingIDs, err := r.keys.applauseMeetings(conn)
+	if err != nil {
+		return fmt.Errorf("getting applause meetings: %w", err)
+	}
+
+	pruneErr := PruneError{Errors: make(map[int]error)}
+	for _, meetingID := range meetingIDs {
+		key := r.keys.applause(meetingID)
+		if err := r.pruneApplause(conn, key, olderThen); err != nil {
+			if recreated, err := r.handleWrongType(conn, key, err); !recreated {
+				pruneErr.Errors[meetingID] = err
+				continue
+			}
+		}
+
+		if _, err := removeMeetingScript.Do(conn, key, r.keys.applauseMeetingSet, meetingID); err != nil {
+			pruneErr.Errors[meetingID] = fmt.Errorf("removing meeting from applause meetings: %w", err)
+		}
+	}
+
+	if len(pruneErr.Errors) > 0 {
+		return pruneErr
+	}
+	return nil
+}
+
+// removeMeetingScript removes the meeting ARGV[1] from the set KEYS[2], if
+// its applause key KEYS[1] does not exist. It is a script, so a meeting with
+// new applause is not removed.
+var removeMeetingScript = redis.NewScript(2, `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	redis.call('SREM', KEYS[2], ARGV[1])
+end
+return 0
+`)
+
+// migrateApplauseMeetings adds the meetings of all applause keys to the set of
+// applause meetings. Keys with an invalid meeting id are skipped.
+func (r *Redis) migrateApplauseMeetings(conn redis.Conn) error {
+	if err := r.migrateLegacyApplause(conn); err != nil {
+		return fmt.Errorf("converting legacy applause: %w", err)
+	}
+
+	keys, err := scanKeys(conn, r.keys.applausePrefix+"*")
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{r.keys.applauseMeetingSet}
+	for _, key := range keys {
+		meetingID, err := strconv.Atoi(strings.TrimPrefix(key, r.keys.applausePrefix))
+		if err != nil {
+			icclog.Info("Ignoring redis key `%s`, since it is not an applause key of a meeting", key)
+			continue
+		}
+		args = append(args, meetingID)
+	}
+
+	if len(args) == 1 {
+		return nil
+	}
+
+	if _, err := conn.Do("SADD", args...); err != nil {
+		return fmt.Errorf("sadd: %w", err)
+	}
+	return nil
+}
+
+// migrateLegacyApplause moves the applause from the legacy key to the key of
+// each meeting and removes the legacy key. Members with an invalid format are
+// dropped.
+func (r *Redis) migrateLegacyApplause(conn redis.Conn) error {
+	keyType, err := redis.String(conn.Do("TYPE", legacyApplauseKey))
+	if err != nil {
+		return fmt.Errorf("getting type of legacy key: %w", err)
+	}
+
+	switch keyType {
+	case "none":
+		return nil
+	case "zset":
+	default:
+		icclog.Info("Ignoring redis key `%s` of type %s, since it is not the legacy applause key", legacyApplauseKey, keyType)
+		return nil
+	}
+
+	applause, err := redis.Int64Map(conn.Do("ZRANGE", legacyApplauseKey, 0, -1, "WITHSCORES"))
+	if err != nil {
+		return fmt.Errorf("reading legacy key: %w", err)
+	}
+
+	for meetingUser, time := range applause {
+		var meetingID, userID int
+		if _, err := fmt.Sscanf(meetingUser, "%d-%d", &meetingID, &userID); err != nil {
+			icclog.Info("Dropping legacy applause `%s`, since it is not in the format meeting-user", meetingUser)
+			continue
+		}
+
+		if err := r.applausePublishKey(conn, meetingID, userID, time*r.legacyApplauseScale); err != nil {
+			return fmt.Errorf("adding legacy applause of meeting %d: %w", meetingID, err)
+		}
+	}
+
+	if _, err := conn.Do("DEL", legacyApplauseKey); err != nil {
+		return fmt.Errorf("removing legacy key: %w", err)
+	}
+
+	icclog.Info("Converted %d applause from the legacy redis key `%s`", len(applause), legacyApplauseKey)
+	return nil
+}
+
+// pruneBatchScript removes at most ARGV[2] members of the sorted set KEYS[1]
+// with a score up to ARGV[1]. It returns the number of removed members.
+//
+// It is a script, so applause that is renewed between finding and removing the
+// members is not removed.
+var pruneBatchScript = redis.NewScript(1, `
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+if #members > 0 then
+	redis.call('ZREM', KEYS[1], unpack(members))
+end
+return #members
+`)
+
+// pruneCounterScript removes the counters of the hash KEYS[2] for the windows
+// before ARGV[1]. The hash is removed, if the sorted set KEYS[1] does not
+// exist anymore.
+var pruneCounterScript = redis.NewScript(2, `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	redis.call('DEL', KEYS[2])
+	return 0
+end
+
+local first = tonumber(ARGV[1])
+for _, window in ipairs(redis.call('HKEYS', KEYS[2])) do
+	if tonumber(window) < first then
+		redis.call('HDEL', KEYS[2], window)
+	end
+end
+return 0
+`)
+
+// pruneApplause removes the applause in the given key that is older then
+// olderThen.
+//
+// With a pruneBatchSize, the applause is removed in batches. Other clients can
+// run their commands between the batches.
+func (r *Redis) pruneApplause(conn redis.Conn, key string, olderThen int64) error {
+	if err := r.pruneApplauseSet(conn, key, olderThen); err != nil {
+		return err
+	}
+
+	if r.applauseCounter > 0 {
+		counterKey := r.keys.applauseCounter(key)
+		if _, err := pruneCounterScript.Do(conn, key, counterKey, olderThen/r.applauseCounter); err != nil {
+			return fmt.Errorf("removing old applause counters: %w", err)
+		}
+	}
+	return nil
+}
+
+// pruneApplauseSet removes the members of the sorted set, that are older then
+// olderThen.
+func (r *Redis) pruneApplauseSet(conn redis.Conn, key string, olderThen int64) error {
+	if r.pruneBatchSize <= 0 {
+		if _, err := conn.Do("ZREMRANGEBYSCORE", key, "-inf", olderThen-1); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	for {
+		removed, err := redis.Int(pruneBatchScript.Do(conn, key, olderThen-1, r.pruneBatchSize))
+		if err != nil {
+			return err
+		}
+
+		if removed < r.pruneBatchSize {
+			return nil
+		}
+	}
+}
+
+// handleWrongType checks, if err is a WRONGTYPE error for the key. This means,
+// that the key exists, but is not a sorted set. Probably another service uses
+// the same key in the same redis database.
+//
+// With WithRecreateWrongType, the key is removed with conn and recreated is
+// true. If conn is nil, a connection to the primary is used. Otherwise, a
+// descriptive error is returned. All other errors are returned unchanged.
+func (r *Redis) handleWrongType(conn redis.Conn, key string, err error) (recreated bool, _ error) {
+	if !isWrongTypeError(err) {
+		return false, err
+	}
+
+	if !r.recreateWrongType {
+		return false, iccerror.NewMessageError(
+			iccerror.ErrInternal,
+			"redis key `%s` does not hold applause, probably another service uses the same key. Remove the key or use ICC_REDIS_RECREATE_WRONGTYPE.",
+			key,
+		)
+	}
+
+	if conn == nil {
+		conn = r.pool.Get()
+		defer conn.Close()
+	}
+
+	// The counters belong to the removed applause.
+	delKeys := []interface{}{key}
+	if r.applauseCounter > 0 && strings.HasPrefix(key, r.keys.applausePrefix) {
+		delKeys = append(delKeys, r.keys.applauseCounter(key))
+	}
+
+	if _, delErr := conn.Do("DEL", delKeys...); delErr != nil {
+		return false, fmt.Errorf("removing key `%s` with the wrong type: %w", key, delErr)
+	}
+
+	icclog.Info("Removed redis key `%s`, since it had the wrong type: %v", key, err)
+	return true, nil
+}
+
+// isWrongTypeError returns true, if the error was returned by redis, because a
+// command was used on a key with a value of a different type.
+func isWrongTypeError(err error) bool {
+	var redisErr redis.Error
+	if !errors.As(err, &redisErr) {
+		return false
+	}
+
+	return strings.HasPrefix(redisErr.Error(), "WRONGTYPE")
+}
+
+// IsAuthError returns true, if the error was returned by redis, because the
+// connection is not authenticated or the password is wrong.
+func IsAuthError(err error) bool {
+	var redisErr redis.Error
+	if !errors.As(err, &redisErr) {
+		return false
+	}
+
+	msg := redisErr.Error()
+	return strings.HasPrefix(msg, "NOAUTH") || strings.HasPrefix(msg, "WRONGPASS")
+}
+
+// PruneError is returned by ApplauseCleanOld, if the applause of some meetings
+// could not be removed.
+type PruneError struct {
+	// Errors contains the error for each failed meeting id.
+	Errors map[int]error
+}
+
+func (e PruneError) Error() string {
+	meetingIDs := make([]int, 0, len(e.Errors))
+	for id := range e.Errors {
+		meetingIDs = append(meetingIDs, id)
+	}
+	sort.Ints(meetingIDs)
+
+	msgs := make([]string, len(meetingIDs))
+	for i, id := range meetingIDs {
+		msgs[i] = fmt.Sprintf("meeting %d: %v", id, e.Errors[id])
+	}
+
+	return fmt.Sprintf("removing old applause failed for %d meetings: %s", len(meetingIDs), strings.Join(msgs, "; "))
+}
+
+// keys holds the names of the redis keys.
+type keys struct {
+	notify             string
+	notifyEphemeral    string
+	notifyRetainPrefix string
+	notifyPersist      string
+	applausePrefix     string
+	inboxPrefix        string
+	idempotencyPrefix  string
+
+	applauseMeetingSet string
+
+	applauseCounterPrefix     string
+	applauseLeaderboardPrefix string
+}
+
+// newKeys returns the key names with the given hash tag as prefix.
+func newKeys(hashTag string) keys {
+	return keys{
+		notify:             hashTag + notifyKey,
+		notifyEphemeral:    hashTag + notifyEphemeralChannel,
+		notifyRetainPrefix: hashTag + notifyRetainPrefix,
+		notifyPersist:      hashTag + notifyPersistKey,
+		applausePrefix:     hashTag + applausePrefix,
+		inboxPrefix:        hashTag + inboxPrefix,
+
+		idempotencyPrefix: hashTag + idempotencyPrefix,
+
+		applauseMeetingSet: hashTag + applauseMeetingsKey,
+
+		applauseCounterPrefix:     hashTag + applauseCounterPrefix,
+		applauseLeaderboardPrefix: hashTag + applauseLeaderboardPrefix,
+	}
+}
+
+// milliseconds returns the keys with the applause keys for applause times in
+// milliseconds.
+func (k keys) milliseconds(hashTag string) keys {
+	k.applausePrefix = hashTag + applauseMillisecondsPrefix
+	k.applauseMeetingSet = hashTag + applauseMillisecondsMeetingsKey
+	k.applauseCounterPrefix = hashTag + applauseMillisecondsCounterPrefix
+	return k
+}
+
+// applauseLeaderboard returns the redis key for the applause of the users of a
+// meeting in the minute.
+func (k keys) applauseLeaderboard(meetingID int, minute int64) string {
+	return fmt.Sprintf("%s%d:%d", k.applauseLeaderboardPrefix, meetingID, minute)
+}
+
+// notifyRetain returns the redis key for the retained messages of a meeting.
+func (k keys) notifyRetain(meetingID int) string {
+	return fmt.Sprintf("%s%d", k.notifyRetainPrefix, meetingID)
+}
+
+// applause returns the redis key for the applause of a meeting.
+func (k keys) applause(meetingID int) string {
+	return fmt.Sprintf("%s%d", k.applausePrefix, meetingID)
+}
+
+// applauseCounter returns the redis key for the applause counter that belongs
+// to the applause key of a meeting.
+func (k keys) applauseCounter(applauseKey string) string {
+	return k.applauseCounterPrefix + strings.TrimPrefix(applauseKey, k.applausePrefix)
+}
+
+// applauseMeetings returns the ids of all meetings in the set of applause
+// meetings. Members, that are not a meeting id, are skipped.
+func (k keys) applauseMeetings(conn redis.Conn) ([]int, error) {
+	members, err := redis.Strings(conn.Do("SMEMBERS", k.applauseMeetingSet))
+	if err != nil {
+		return nil, fmt.Errorf("smembers: %w", err)
+	}
+
+	meetingIDs := make([]int, 0, len(members))
+	for _, member := range members {
+		meetingID, err := strconv.Atoi(member)
+		if err != nil {
+			continue
+		}
+		meetingIDs = append(meetingIDs, meetingID)
+	}
+	return meetingIDs, nil
+}
+
+// scanKeys returns all keys that match the pattern.
+func scanKeys(conn redis.Conn, pattern string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 100))
+		if err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+
+		if len(values) != 2 {
+			return nil, fmt.Errorf("invalid scan response with %d values", len(values))
+		}
+
+		cursor, err = redis.String(values[0], nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scan cursor: %w", err)
+		}
+
+		found, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scan keys: %w", err)
+		}
+		keys = append(keys, found...)
+
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
@@ -1,12 +1,24 @@
 package redis_test
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/OpenSlides/openslides-icc-service/internal/iccerror"
+	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
 	"github.com/OpenSlides/openslides-icc-service/internal/redis"
+	redigo "github.com/gomodule/redigo/redis"
 	"github.com/ory/dockertest/v3"
 )
 
@@ -37,6 +49,87 @@ func TestICC(t *testing.T) {
 	redisConn := redis.New("localhost:" + port)
 	redisConn.Wait(context.Background())
 
+	t.Run("Receive from beginning", func(t *testing.T) {
+		for _, m := range []string{"first", "second"} {
+			if err := redisConn.NotifyPublish([]byte(m)); err != nil {
+				t.Fatalf("NotifyPublish returned unexpected error: %v", err)
+			}
+		}
+
+		consumer := redis.New("localhost:" + port)
+
+		receive := func(expect string) {
+			t.Helper()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			message, err := consumer.NotifyReceiveFromBeginning(ctx)
+			if err != nil {
+				t.Fatalf("NotifyReceiveFromBeginning returned unexpected error: %v", err)
+			}
+
+			if string(message) != expect {
+				t.Errorf("NotifyReceiveFromBeginning returned `%s`, expected `%s`", message, expect)
+			}
+		}
+
+		receive("first")
+		receive("second")
+
+		if err := redisConn.NotifyPublish([]byte("live")); err != nil {
+			t.Fatalf("NotifyPublish returned unexpected error: %v", err)
+		}
+		receive("live")
+	})
+
+	t.Run("Ephemeral not replayed", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		subscriber := redis.New("localhost:" + port)
+		received := make(chan []byte, 1)
+		go func() {
+			message, _ := subscriber.NotifyReceiveEphemeral(ctx)
+			received <- message
+		}()
+
+		// Publish until the subscriber has subscribed.
+		var got []byte
+		for got == nil && ctx.Err() == nil {
+			if err := redisConn.NotifyPublishEphemeral([]byte("typing")); err != nil {
+				t.Fatalf("NotifyPublishEphemeral returned unexpected error: %v", err)
+			}
+
+			select {
+			case got = <-received:
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+
+		if string(got) != "typing" {
+			t.Errorf("NotifyReceiveEphemeral returned `%s`, expected `typing`", got)
+		}
+
+		consumer := redis.New("localhost:" + port)
+		for _, expect := range []string{"first", "second", "live"} {
+			message, err := consumer.NotifyReceiveFromBeginning(ctx)
+			if err != nil {
+				t.Fatalf("NotifyReceiveFromBeginning returned unexpected error: %v", err)
+			}
+
+			if string(message) != expect {
+				t.Errorf("NotifyReceiveFromBeginning returned `%s`, expected `%s`", message, expect)
+			}
+		}
+
+		shortCtx, shortCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer shortCancel()
+		if message, err := consumer.NotifyReceiveFromBeginning(shortCtx); err == nil {
+			t.Errorf("NotifyReceiveFromBeginning returned `%s`, expected no more messages", message)
+		}
+	})
+
 	t.Run("Receive blocks", func(t *testing.T) {
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
@@ -118,6 +211,285 @@ func TestICC(t *testing.T) {
 		}
 	})
 
+	t.Run("Compressed messages", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		compressConn := redis.New("localhost:"+port, redis.WithCompression())
+
+		done := make(chan []byte, 2)
+		go func() {
+			for {
+				message, err := compressConn.NotifyReceive(ctx)
+				if err != nil {
+					return
+				}
+				done <- message
+			}
+		}()
+
+		// Wait for NotifyReceive to be called.
+		time.Sleep(10 * time.Millisecond)
+
+		// The first message is not compressed, the second is.
+		redisConn.NotifyPublish([]byte("old message"))
+		time.Sleep(10 * time.Millisecond)
+		compressConn.NotifyPublish([]byte("new message"))
+
+		for _, expect := range []string{"old message", "new message"} {
+			timer := time.NewTimer(time.Second)
+			select {
+			case got := <-done:
+				if string(got) != expect {
+					t.Errorf("NotifyReceive returned `%s`, expected `%s`", got, expect)
+				}
+			case <-timer.C:
+				t.Fatalf("NotifyReceive did not return `%s`", expect)
+			}
+			timer.Stop()
+		}
+	})
+
+	t.Run("Retained messages", func(t *testing.T) {
+		if err := redisConn.NotifyRetain(1, "name", []byte("first"), time.Minute); err != nil {
+			t.Fatalf("NotifyRetain returned unexpected error: %v", err)
+		}
+
+		if err := redisConn.NotifyRetain(1, "name", []byte("second"), time.Minute); err != nil {
+			t.Fatalf("NotifyRetain returned unexpected error: %v", err)
+		}
+
+		if err := redisConn.NotifyRetain(2, "name", []byte("other meeting"), time.Minute); err != nil {
+			t.Fatalf("NotifyRetain returned unexpected error: %v", err)
+		}
+
+		retained, err := redisConn.NotifyRetained(1)
+		if err != nil {
+			t.Fatalf("NotifyRetained returned unexpected error: %v", err)
+		}
+
+		if len(retained) != 1 || string(retained[0]) != "second" {
+			t.Errorf("NotifyRetained returned %q, expected [second]", retained)
+		}
+
+		conn, err := redigo.Dial("tcp", "localhost:"+port)
+		if err != nil {
+			t.Fatalf("connecting to redis: %v", err)
+		}
+		defer conn.Close()
+
+		ttl, err := redigo.Int(conn.Do("PTTL", "icc-notify-retained:1"))
+		if err != nil {
+			t.Fatalf("pttl: %v", err)
+		}
+
+		if ttl <= 0 || ttl > 60_000 {
+			t.Errorf("retained hash has ttl %dms, expected at most one minute", ttl)
+		}
+
+		if err := redisConn.NotifyUnretain(1, "name"); err != nil {
+			t.Fatalf("NotifyUnretain returned unexpected error: %v", err)
+		}
+
+		retained, err = redisConn.NotifyRetained(1)
+		if err != nil {
+			t.Fatalf("NotifyRetained returned unexpected error: %v", err)
+		}
+
+		if len(retained) != 0 {
+			t.Errorf("NotifyRetained after unretain returned %q, expected nothing", retained)
+		}
+	})
+
+	t.Run("Inbox", func(t *testing.T) {
+		for _, m := range []string{"first", "second", "third"} {
+			if err := redisConn.InboxAdd([]string{"user:1", "meeting:1"}, []byte(m), 2, time.Minute); err != nil {
+				t.Fatalf("InboxAdd returned unexpected error: %v", err)
+			}
+		}
+
+		ids, messages, err := redisConn.InboxSince("user:1", "")
+		if err != nil {
+			t.Fatalf("InboxSince returned unexpected error: %v", err)
+		}
+
+		if len(messages) != 2 || string(messages[0]) != "second" || string(messages[1]) != "third" {
+			t.Fatalf("InboxSince returned %q, expected [second third]", messages)
+		}
+
+		_, messages, err = redisConn.InboxSince("user:1", ids[0])
+		if err != nil {
+			t.Fatalf("InboxSince with last id returned unexpected error: %v", err)
+		}
+
+		if len(messages) != 1 || string(messages[0]) != "third" {
+			t.Errorf("InboxSince since %s returned %q, expected [third]", ids[0], messages)
+		}
+
+		_, messages, err = redisConn.InboxSince("meeting:1", "")
+		if err != nil {
+			t.Fatalf("InboxSince for meeting returned unexpected error: %v", err)
+		}
+
+		if len(messages) != 2 {
+			t.Errorf("InboxSince for meeting returned %q, expected two messages", messages)
+		}
+	})
+
+	t.Run("Idempotency key", func(t *testing.T) {
+		firstID, err := redisConn.IdempotencyMark("1:abc", "first", time.Minute)
+		if err != nil {
+			t.Fatalf("IdempotencyMark returned unexpected error: %v", err)
+		}
+
+		if firstID != "first" {
+			t.Errorf("IdempotencyMark returned %s, expected first", firstID)
+		}
+
+		retryID, err := redisConn.IdempotencyMark("1:abc", "retry", time.Minute)
+		if err != nil {
+			t.Fatalf("IdempotencyMark on retry returned unexpected error: %v", err)
+		}
+
+		if retryID != "first" {
+			t.Errorf("IdempotencyMark on retry returned %s, expected first", retryID)
+		}
+
+		if err := redisConn.IdempotencyUnmark("1:abc"); err != nil {
+			t.Fatalf("IdempotencyUnmark returned unexpected error: %v", err)
+		}
+
+		afterID, err := redisConn.IdempotencyMark("1:abc", "after", time.Minute)
+		if err != nil {
+			t.Fatalf("IdempotencyMark after unmark returned unexpected error: %v", err)
+		}
+
+		if afterID != "after" {
+			t.Errorf("IdempotencyMark after unmark returned %s, expected after", afterID)
+		}
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		before, err := redisConn.StreamLen()
+		if err != nil {
+			t.Fatalf("StreamLen returned unexpected error: %v", err)
+		}
+
+		if err := redisConn.NotifyPublish([]byte("stats")); err != nil {
+			t.Fatalf("NotifyPublish returned unexpected error: %v", err)
+		}
+
+		after, err := redisConn.StreamLen()
+		if err != nil {
+			t.Fatalf("StreamLen returned unexpected error: %v", err)
+		}
+
+		if after != before+1 {
+			t.Errorf("StreamLen returned %d after publish, expected %d", after, before+1)
+		}
+
+		for _, uid := range []int{1, 2} {
+			if err := redisConn.ApplausePublish(99, uid, 1000); err != nil {
+				t.Fatalf("ApplausePublish returned unexpected error: %v", err)
+			}
+		}
+
+		size, err := redisConn.ApplauseSize(99)
+		if err != nil {
+			t.Fatalf("ApplauseSize returned unexpected error: %v", err)
+		}
+
+		if size != 2 {
+			t.Errorf("ApplauseSize returned %d, expected 2", size)
+		}
+
+		if err := redisConn.ApplauseCleanOld(2000); err != nil {
+			t.Fatalf("ApplauseCleanOld returned unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Stream lag", func(t *testing.T) {
+		consumer := redis.New("localhost:" + port)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		received := make(chan error, 1)
+		go func() {
+			_, err := consumer.NotifyReceive(ctx)
+			received <- err
+		}()
+
+		// Give the consumer time to block on XREAD.
+		time.Sleep(10 * time.Millisecond)
+
+		if err := redisConn.NotifyPublish([]byte("cursor")); err != nil {
+			t.Fatalf("NotifyPublish returned unexpected error: %v", err)
+		}
+
+		if err := <-received; err != nil {
+			t.Fatalf("NotifyReceive returned unexpected error: %v", err)
+		}
+
+		for _, m := range []string{"behind1", "behind2"} {
+			if err := redisConn.NotifyPublish([]byte(m)); err != nil {
+				t.Fatalf("NotifyPublish returned unexpected error: %v", err)
+			}
+		}
+
+		lastID, err := consumer.LastID()
+		if err != nil {
+			t.Fatalf("LastID returned unexpected error: %v", err)
+		}
+
+		if cursor := consumer.Cursor(); cursor == "" || cursor == lastID {
+			t.Errorf("Cursor returned `%s`, expected an id older then `%s`", cursor, lastID)
+		}
+
+		lag, err := consumer.StreamLag()
+		if err != nil {
+			t.Fatalf("StreamLag returned unexpected error: %v", err)
+		}
+
+		if lag != 2 {
+			t.Errorf("StreamLag returned %d, expected 2", lag)
+		}
+	})
+
+	t.Run("Persist notify messages", func(t *testing.T) {
+		for _, m := range []string{"first", "second", "third"} {
+			if err := redisConn.NotifyPersist([]byte(m), 5, "audit", 0); err != nil {
+				t.Fatalf("NotifyPersist returned unexpected error: %v", err)
+			}
+		}
+
+		conn, err := redigo.Dial("tcp", "localhost:"+port)
+		if err != nil {
+			t.Fatalf("connecting to redis: %v", err)
+		}
+		defer conn.Close()
+
+		entries, err := redigo.Values(conn.Do("XRANGE", "icc-notify-persist", "-", "+"))
+		if err != nil {
+			t.Fatalf("reading persist stream: %v", err)
+		}
+
+		if len(entries) != 3 {
+			t.Fatalf("got %d persisted messages, expected 3", len(entries))
+		}
+
+		entry, _ := redigo.Values(entries[0], nil)
+		fields, err := redigo.StringMap(entry[1], nil)
+		if err != nil {
+			t.Fatalf("decoding fields: %v", err)
+		}
+
+		expect := map[string]string{"content": "first", "sender_user_id": "5", "name": "audit"}
+		if !reflect.DeepEqual(fields, expect) {
+			t.Errorf("got fields %v, expected %v", fields, expect)
+		}
+	})
+
 	t.Run("Receive empty applause", func(t *testing.T) {
 		applause, err := redisConn.ApplauseSince(1000)
 
@@ -212,6 +584,28 @@ func TestICC(t *testing.T) {
 		}
 	})
 
+	t.Run("Older applause does not overwrite newer", func(t *testing.T) {
+		defer redisConn.ApplauseCleanOld(1000)
+
+		if err := redisConn.ApplausePublish(1, 1, 20); err != nil {
+			t.Fatalf("sending applause: %v", err)
+		}
+
+		if err := redisConn.ApplausePublish(1, 1, 10); err != nil {
+			t.Fatalf("sending applause: %v", err)
+		}
+
+		applause, err := redisConn.ApplauseSince(15)
+
+		if err != nil {
+			t.Fatalf("receiveApplause returned unexpected error: %v", err)
+		}
+
+		if applause[1] != 1 {
+			t.Errorf("receiveApplause returned %d, expected 1", applause)
+		}
+	})
+
 	t.Run("Receive applause for one user to old", func(t *testing.T) {
 		defer redisConn.ApplauseCleanOld(1000)
 
@@ -252,29 +646,1067 @@ func TestICC(t *testing.T) {
 		}
 	})
 
-	t.Run("Receive applause for one user in two meetings", func(t *testing.T) {
+	t.Run("Delete keys of inactive meetings", func(t *testing.T) {
+		conn, err := redigo.Dial("tcp", "localhost:"+port)
+		if err != nil {
+			t.Fatalf("connecting to redis: %v", err)
+		}
+		defer conn.Close()
+
+		if err := redisConn.ApplausePublish(7, 1, 10); err != nil {
+			t.Fatalf("sending applause: %v", err)
+		}
+
+		if err := redisConn.ApplausePublish(8, 1, 200); err != nil {
+			t.Fatalf("sending applause: %v", err)
+		}
 		defer redisConn.ApplauseCleanOld(1000)
 
+		if err := redisConn.ApplauseCleanOld(100); err != nil {
+			t.Fatalf("deleting old applause: %v", err)
+		}
+
+		for _, tt := range []struct {
+			key    string
+			exists bool
+		}{
+			{"applause:7", false},
+			{"applause:8", true},
+		} {
+			exists, err := redigo.Bool(conn.Do("EXISTS", tt.key))
+			if err != nil {
+				t.Fatalf("checking key %s: %v", tt.key, err)
+			}
+
+			if exists != tt.exists {
+				t.Errorf("key %s exists: %t, expected %t", tt.key, exists, tt.exists)
+			}
+		}
+
+		meetingIDs, err := redigo.Ints(conn.Do("SMEMBERS", "applause-meetings"))
+		if err != nil {
+			t.Fatalf("reading applause meetings: %v", err)
+		}
+
+		if !reflect.DeepEqual(meetingIDs, []int{8}) {
+			t.Errorf("got applause meetings %v, expected [8]", meetingIDs)
+		}
+	})
+
+	t.Run("Ignore foreign applause keys", func(t *testing.T) {
+		conn, err := redigo.Dial("tcp", "localhost:"+port)
+		if err != nil {
+			t.Fatalf("connecting to redis: %v", err)
+		}
+		defer conn.Close()
+
+		if _, err := conn.Do("SET", "applause:foo", "bar"); err != nil {
+			t.Fatalf("setting foreign key: %v", err)
+		}
+		defer conn.Do("DEL", "applause:foo")
+
 		if err := redisConn.ApplausePublish(1, 1, 10); err != nil {
 			t.Fatalf("sending applause: %v", err)
 		}
+		defer redisConn.ApplauseCleanOld(1000)
 
-		if err := redisConn.ApplausePublish(2, 2, 10); err != nil {
-			t.Fatalf("sending applause: %v", err)
+		applause, err := redisConn.ApplauseSince(0)
+		if err != nil {
+			t.Fatalf("ApplauseSince: %v", err)
 		}
 
-		applause, err := redisConn.ApplauseSince(10)
+		if !reflect.DeepEqual(applause, map[int]int{1: 1}) {
+			t.Errorf("got applause %v, expected map[1:1]", applause)
+		}
 
+		if err := redisConn.ApplauseCleanOld(5); err != nil {
+			t.Errorf("ApplauseCleanOld: %v", err)
+		}
+	})
+
+	t.Run("Delete applause with one broken meeting", func(t *testing.T) {
+		conn, err := redigo.Dial("tcp", "localhost:"+port)
 		if err != nil {
-			t.Fatalf("receiveApplause returned unexpected error: %v", err)
+			t.Fatalf("connecting to redis: %v", err)
 		}
+		defer conn.Close()
 
-		if applause[1] != 1 {
-			t.Errorf("receiveApplause returned %d, expected 2", applause)
+		if _, err := conn.Do("SET", "applause:3", "not a sorted set"); err != nil {
+			t.Fatalf("creating broken key: %v", err)
 		}
+		defer conn.Do("DEL", "applause:3")
 
-		if applause[2] != 1 {
-			t.Errorf("receiveApplause returned %d, expected 2", applause)
+		for _, meetingID := range []int{1, 2} {
+			if err := redisConn.ApplausePublish(meetingID, 1, 10); err != nil {
+				t.Fatalf("sending applause: %v", err)
+			}
+		}
+
+		err = redisConn.ApplauseCleanOld(100)
+
+		var pruneErr redis.PruneError
+		if !errors.As(err, &pruneErr) {
+			t.Fatalf("ApplauseCleanOld returned error `%v`, expected a PruneError", err)
+		}
+
+		if len(pruneErr.Errors) != 1 || pruneErr.Errors[3] == nil {
+			t.Errorf("got errors for meetings %v, expected only meeting 3", pruneErr.Errors)
+		}
+
+		if _, err := conn.Do("DEL", "applause:3"); err != nil {
+			t.Fatalf("deleting broken key: %v", err)
+		}
+
+		applause, err := redisConn.ApplauseSince(10)
+		if err != nil {
+			t.Fatalf("receiveApplause returned unexpected error: %v", err)
+		}
+
+		if len(applause) != 0 {
+			t.Errorf("receiveApplause returned %v, expected no applause", applause)
 		}
 	})
+
+	t.Run("Delete applause in batches", func(t *testing.T) {
+		batchConn := redis.New("localhost:"+port, redis.WithPruneBatchSize(2))
+		defer batchConn.ApplauseCleanOld(1000)
+
+		// Five old applause need three batches.
+		for userID := 1; userID <= 5; userID++ {
+			if err := batchConn.ApplausePublish(1, userID, 10); err != nil {
+				t.Fatalf("sending applause: %v", err)
+			}
+		}
+
+		if err := batchConn.ApplausePublish(1, 6, 200); err != nil {
+			t.Fatalf("sending applause: %v", err)
+		}
+
+		if err := batchConn.ApplauseCleanOld(100); err != nil {
+			t.Fatalf("deleting old applause: %v", err)
+		}
+
+		applause, err := batchConn.ApplauseSince(0)
+		if err != nil {
+			t.Fatalf("receiveApplause returned unexpected error: %v", err)
+		}
+
+		if applause[1] != 1 {
+			t.Errorf("got %d applause, expected 1", applause[1])
+		}
+	})
+
+	t.Run("Applause counter", func(t *testing.T) {
+		for _, batchSize := range []int{0, 2} {
+			counterConn := redis.New("localhost:"+port, redis.WithApplauseCounter(1), redis.WithPruneBatchSize(batchSize))
+
+			// User 1 applauses three times, the older time is not saved.
+			for _, a := range []struct {
+				meetingID int
+				userID    int
+				time      int64
+			}{
+				{1, 1, 10}, {1, 1, 300}, {1, 1, 20},
+				{1, 2, 10}, {1, 3, 50}, {1, 4, 200},
+				{2, 1, 10}, {2, 2, 400},
+			} {
+				if err := counterConn.ApplausePublish(a.meetingID, a.userID, a.time); err != nil {
+					t.Fatalf("sending applause: %v", err)
+				}
+			}
+
+			compare := func(t *testing.T, since int64, expect map[int]int) {
+				t.Helper()
+
+				counters, err := counterConn.ApplauseCounters(since)
+				if err != nil {
+					t.Fatalf("ApplauseCounters: %v", err)
+				}
+
+				counted, err := counterConn.ApplauseSince(since)
+				if err != nil {
+					t.Fatalf("ApplauseSince: %v", err)
+				}
+
+				if !reflect.DeepEqual(counters, counted) {
+					t.Errorf("batch size %d: counters %v and counted applause %v are different", batchSize, counters, counted)
+				}
+
+				if !reflect.DeepEqual(counters, expect) {
+					t.Errorf("batch size %d: got counters %v, expected %v", batchSize, counters, expect)
+				}
+			}
+
+			compare(t, 0, map[int]int{1: 4, 2: 2})
+			compare(t, 50, map[int]int{1: 3, 2: 1})
+
+			// Without new applause, the level goes back to 0.
+			compare(t, 401, map[int]int{})
+
+			if err := counterConn.ApplauseCleanOld(100); err != nil {
+				t.Fatalf("deleting old applause: %v", err)
+			}
+			compare(t, 100, map[int]int{1: 2, 2: 1})
+
+			if err := counterConn.ApplauseCleanOld(1000); err != nil {
+				t.Fatalf("deleting old applause: %v", err)
+			}
+			compare(t, 1000, map[int]int{})
+		}
+	})
+
+	t.Run("Receive applause for one user in two meetings", func(t *testing.T) {
+		defer redisConn.ApplauseCleanOld(1000)
+
+		if err := redisConn.ApplausePublish(1, 1, 10); err != nil {
+			t.Fatalf("sending applause: %v", err)
+		}
+
+		if err := redisConn.ApplausePublish(2, 2, 10); err != nil {
+			t.Fatalf("sending applause: %v", err)
+		}
+
+		applause, err := redisConn.ApplauseSince(10)
+
+		if err != nil {
+			t.Fatalf("receiveApplause returned unexpected error: %v", err)
+		}
+
+		if applause[1] != 1 {
+			t.Errorf("receiveApplause returned %d, expected 2", applause)
+		}
+
+		if applause[2] != 1 {
+			t.Errorf("receiveApplause returned %d, expected 2", applause)
+		}
+	})
+}
+
+// blackHole starts a tcp server that accepts connections but never answers.
+func blackHole(t *testing.T) (string, func()) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	var conns []net.Conn
+	var mu sync.Mutex
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+
+	return l.Addr().String(), func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	addr, closeBlackHole := blackHole(t)
+	defer closeBlackHole()
+
+	r := redis.New(addr, redis.WithTimeouts(time.Second, 20*time.Millisecond, time.Second))
+
+	t.Run("read timeout on normal command", func(t *testing.T) {
+		done := make(chan error)
+		go func() {
+			done <- r.NotifyPublish([]byte("message"))
+		}()
+
+		timer := time.NewTimer(time.Second)
+		defer timer.Stop()
+
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("NotifyPublish returned no error")
+			}
+		case <-timer.C:
+			t.Errorf("NotifyPublish did not return after the read timeout")
+		}
+	})
+
+	t.Run("no read timeout on blocking command", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		_, err := r.NotifyReceive(ctx)
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("NotifyReceive returned error `%v`, expected the context to stop it", err)
+		}
+	})
+}
+
+func TestUnresolvableHost(t *testing.T) {
+	var logs bytes.Buffer
+	icclog.SetInfoLogger(log.New(&logs, "", 0))
+	defer icclog.SetInfoLogger(log.Default())
+
+	// The top level domain .invalid can never be resolved.
+	r := redis.New("redis.invalid:6379", redis.WithTimeouts(500*time.Millisecond, time.Second, time.Second))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.NotifyPublish([]byte("message"))
+	}()
+
+	timer := time.NewTimer(5 * time.Second)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("NotifyPublish returned no error")
+		}
+
+		if !strings.Contains(err.Error(), "redis.invalid") {
+			t.Errorf("NotifyPublish returned error `%v`, expected it to name the host", err)
+		}
+
+	case <-timer.C:
+		t.Fatalf("NotifyPublish did not return after the connect timeout")
+	}
+
+	if !strings.Contains(logs.String(), "Can not resolve redis host `redis.invalid`") {
+		t.Errorf("got logs `%s`, expected a message about the host", logs.String())
+	}
+}
+
+// fakeRedis starts a tcp server that understands enough of the redis protocol
+// to answer the commands of redis.Redis. It returns the address and a function
+// that returns the names of the received commands.
+//
+// queued contains replies for a command, that are returned once each before
+// the default reply.
+func fakeRedis(t *testing.T, queued map[string][]string) (string, func() []string) {
+	t.Helper()
+
+	addr, commands := fakeRedisArgs(t, queued)
+	return addr, func() []string {
+		var names []string
+		for _, command := range commands() {
+			names = append(names, command[0])
+		}
+		return names
+	}
+}
+
+// fakeRedisArgs is like fakeRedis, but returns each command with its
+// arguments.
+func fakeRedisArgs(t *testing.T, queued map[string][]string) (string, func() [][]string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var mu sync.Mutex
+	var commands [][]string
+
+	replies := map[string]string{
+		"XADD":     "$3\r\n1-0\r\n",
+		"SCAN":     "*2\r\n$1\r\n0\r\n*1\r\n$10\r\napplause:1\r\n",
+		"SMEMBERS": "*1\r\n$1\r\n1\r\n",
+		"ZCOUNT":   ":3\r\n",
+		"TYPE":     "+none\r\n",
+		"XREAD":    "*1\r\n*2\r\n$10\r\nicc-notify\r\n*1\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$7\r\ncontent\r\n$5\r\nhello\r\n",
+	}
+
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		for {
+			// Each command is an array of bulk strings.
+			var args int
+			if _, err := fmt.Fscanf(r, "*%d\r\n", &args); err != nil {
+				return
+			}
+
+			var command []string
+			for i := 0; i < args; i++ {
+				var size int
+				if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+					return
+				}
+
+				arg := make([]byte, size+2)
+				if _, err := io.ReadFull(r, arg); err != nil {
+					return
+				}
+				command = append(command, string(arg[:size]))
+			}
+
+			mu.Lock()
+			commands = append(commands, command)
+			reply, ok := replies[command[0]]
+			if !ok {
+				reply = "+OK\r\n"
+			}
+			if q := queued[command[0]]; len(q) > 0 {
+				reply = q[0]
+				queued[command[0]] = q[1:]
+			}
+			mu.Unlock()
+
+			if _, err := conn.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	return listener.Addr().String(), func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([][]string(nil), commands...)
+	}
+}
+
+func TestReplica(t *testing.T) {
+	primaryAddr, primaryCommands := fakeRedis(t, nil)
+	replicaAddr, replicaCommands := fakeRedis(t, nil)
+
+	r := redis.New(primaryAddr, redis.WithReplica(replicaAddr))
+
+	if err := r.NotifyPublish([]byte("hello")); err != nil {
+		t.Fatalf("NotifyPublish: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	message, err := r.NotifyReceive(ctx)
+	if err != nil {
+		t.Fatalf("NotifyReceive: %v", err)
+	}
+
+	if string(message) != "hello" {
+		t.Errorf("received `%s`, expected `hello`", message)
+	}
+
+	applause, err := r.ApplauseSince(0)
+	if err != nil {
+		t.Fatalf("ApplauseSince: %v", err)
+	}
+
+	if applause[1] != 3 {
+		t.Errorf("got %d applause, expected 3", applause[1])
+	}
+
+	if got := primaryCommands(); !reflect.DeepEqual(got, []string{"XADD"}) {
+		t.Errorf("primary received commands %v, expected [XADD]", got)
+	}
+
+	if got := replicaCommands(); !reflect.DeepEqual(got, []string{"XREAD", "SMEMBERS", "ZCOUNT"}) {
+		t.Errorf("replica received commands %v, expected [XREAD SMEMBERS ZCOUNT]", got)
+	}
+}
+
+func TestWrongType(t *testing.T) {
+	wrongType := "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+
+	t.Run("Error", func(t *testing.T) {
+		addr, commands := fakeRedis(t, map[string][]string{"ZADD": {wrongType}})
+		r := redis.New(addr)
+
+		err := r.ApplausePublish(1, 1, 1)
+		if !errors.Is(err, iccerror.ErrInternal) {
+			t.Fatalf("ApplausePublish returned `%v`, expected an internal error", err)
+		}
+
+		if !strings.Contains(err.Error(), "applause:1") {
+			t.Errorf("error `%v` does not name the key", err)
+		}
+
+		if got := commands(); !reflect.DeepEqual(got, []string{"ZADD"}) {
+			t.Errorf("received commands %v, expected [ZADD]", got)
+		}
+	})
+
+	t.Run("Recreate on publish", func(t *testing.T) {
+		addr, commands := fakeRedis(t, map[string][]string{"ZADD": {wrongType}})
+		r := redis.New(addr, redis.WithRecreateWrongType())
+
+		if err := r.ApplausePublish(1, 1, 1); err != nil {
+			t.Fatalf("ApplausePublish: %v", err)
+		}
+
+		if got := commands(); !reflect.DeepEqual(got, []string{"ZADD", "DEL", "ZADD", "SADD"}) {
+			t.Errorf("received commands %v, expected [ZADD DEL ZADD SADD]", got)
+		}
+	})
+
+	t.Run("Recreate on count", func(t *testing.T) {
+		addr, commands := fakeRedis(t, map[string][]string{"ZCOUNT": {wrongType}})
+		r := redis.New(addr, redis.WithRecreateWrongType())
+
+		applause, err := r.ApplauseSince(0)
+		if err != nil {
+			t.Fatalf("ApplauseSince: %v", err)
+		}
+
+		if len(applause) != 0 {
+			t.Errorf("got applause %v, expected none", applause)
+		}
+
+		if got := commands(); !reflect.DeepEqual(got, []string{"SMEMBERS", "ZCOUNT", "DEL"}) {
+			t.Errorf("received commands %v, expected [SMEMBERS ZCOUNT DEL]", got)
+		}
+	})
+}
+
+func TestInboxAddTransaction(t *testing.T) {
+	addr, commands := fakeRedis(t, map[string][]string{
+		"EXEC": {"*4\r\n$3\r\n1-0\r\n:1\r\n$3\r\n2-0\r\n:1\r\n"},
+	})
+	r := redis.New(addr)
+
+	if err := r.InboxAdd([]string{"user:1", "meeting:1"}, []byte("hello"), 10, time.Minute); err != nil {
+		t.Fatalf("InboxAdd: %v", err)
+	}
+
+	expect := []string{"MULTI", "XADD", "PEXPIRE", "XADD", "PEXPIRE", "EXEC"}
+	if got := commands(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("received commands %v, expected %v", got, expect)
+	}
+}
+
+func TestNotifyRetainTTL(t *testing.T) {
+	addr, commands := fakeRedisArgs(t, map[string][]string{
+		"EXEC": {"*2\r\n:1\r\n:1\r\n"},
+	})
+	r := redis.New(addr)
+
+	if err := r.NotifyRetain(5, "slide", []byte("hello"), 90*time.Second); err != nil {
+		t.Fatalf("NotifyRetain: %v", err)
+	}
+
+	expect := [][]string{
+		{"MULTI"},
+		{"HSET", "icc-notify-retained:5", "slide", "hello"},
+		{"PEXPIRE", "icc-notify-retained:5", "90000"},
+		{"EXEC"},
+	}
+	if got := commands(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("received commands %v, expected %v", got, expect)
+	}
+}
+
+func TestStreamLag(t *testing.T) {
+	addr, commands := fakeRedis(t, map[string][]string{
+		"XREVRANGE": {"*1\r\n*2\r\n$3\r\n3-0\r\n*2\r\n$7\r\ncontent\r\n$5\r\nthird\r\n"},
+		"EVALSHA":   {":2\r\n"},
+	})
+	r := redis.New(addr)
+
+	lag, err := r.StreamLag()
+	if err != nil {
+		t.Fatalf("StreamLag before receive: %v", err)
+	}
+
+	if lag != 0 {
+		t.Errorf("StreamLag before receive returned %d, expected 0", lag)
+	}
+
+	if _, err := r.NotifyReceive(context.Background()); err != nil {
+		t.Fatalf("NotifyReceive: %v", err)
+	}
+
+	if cursor := r.Cursor(); cursor != "1-0" {
+		t.Errorf("Cursor returned `%s`, expected `1-0`", cursor)
+	}
+
+	lastID, err := r.LastID()
+	if err != nil {
+		t.Fatalf("LastID: %v", err)
+	}
+
+	if lastID != "3-0" {
+		t.Errorf("LastID returned `%s`, expected `3-0`", lastID)
+	}
+
+	lag, err = r.StreamLag()
+	if err != nil {
+		t.Fatalf("StreamLag: %v", err)
+	}
+
+	if lag != 2 {
+		t.Errorf("StreamLag returned %d, expected 2", lag)
+	}
+
+	if got := commands(); !reflect.DeepEqual(got, []string{"XREAD", "XREVRANGE", "EVALSHA"}) {
+		t.Errorf("received commands %v, expected [XREAD XREVRANGE EVALSHA]", got)
+	}
+}
+
+func TestNotifyPublishEphemeral(t *testing.T) {
+	addr, commands := fakeRedisArgs(t, map[string][]string{
+		"PUBLISH": {":1\r\n"},
+	})
+	r := redis.New(addr)
+
+	if err := r.NotifyPublishEphemeral([]byte("typing")); err != nil {
+		t.Fatalf("NotifyPublishEphemeral: %v", err)
+	}
+
+	expect := [][]string{{"PUBLISH", "icc-notify-ephemeral", "typing"}}
+	if got := commands(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("received commands %v, expected %v", got, expect)
+	}
+}
+
+func TestStreamLagLimit(t *testing.T) {
+	addr, commands := fakeRedisArgs(t, map[string][]string{
+		"EVALSHA": {":10000\r\n"},
+	})
+	r := redis.New(addr)
+
+	if _, err := r.NotifyReceive(context.Background()); err != nil {
+		t.Fatalf("NotifyReceive: %v", err)
+	}
+
+	if _, err := r.StreamLag(); err != nil {
+		t.Fatalf("StreamLag: %v", err)
+	}
+
+	for _, command := range commands() {
+		if command[0] == "EVALSHA" && command[len(command)-1] != "10000" {
+			t.Errorf("got command %v, expected the limit 10000", command)
+		}
+	}
+}
+
+func TestPoolWaitTimeout(t *testing.T) {
+	// The server accepts connections, but never answers. So each command
+	// keeps its connection.
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	accepted := make(chan net.Conn, 200)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	r := redis.New(listener.Addr().String(), redis.WithPoolWaitTimeout(20*time.Millisecond))
+
+	// Use all 100 connections of the pool.
+	for i := 0; i < 100; i++ {
+		go r.NotifyPublish([]byte("blocking"))
+	}
+
+	var conns []net.Conn
+	t.Cleanup(func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+
+	for len(conns) < 100 {
+		select {
+		case conn := <-accepted:
+			conns = append(conns, conn)
+		case <-time.After(time.Second):
+			t.Fatalf("only %d connections were opened", len(conns))
+		}
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		start := time.Now()
+		err := r.NotifyPublish([]byte("waiting"))
+
+		if !errors.Is(err, iccerror.ErrUnavailable) {
+			t.Errorf("NotifyPublish returned `%v`, expected ErrUnavailable", err)
+		}
+
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("NotifyPublish returned after %s", d)
+		}
+	})
+
+	t.Run("canceled request", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := r.ApplausePublishContext(ctx, 1, 1, 1)
+
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("ApplausePublishContext returned `%v`, expected context.Canceled", err)
+		}
+	})
+}
+
+func TestIdempotencyTTL(t *testing.T) {
+	addr, commands := fakeRedisArgs(t, nil)
+	r := redis.New(addr)
+
+	if _, err := r.IdempotencyMark("1:key", "msg-1", 90*time.Second); err != nil {
+		t.Fatalf("IdempotencyMark: %v", err)
+	}
+
+	got := commands()
+	expect := [][]string{{"SET", "icc-idempotency:1:key", "msg-1", "NX", "PX", "90000"}}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("received commands %v, expected %v", got, expect)
+	}
+
+	t.Run("without ttl", func(t *testing.T) {
+		if _, err := r.IdempotencyMark("1:other", "msg-2", 0); err == nil {
+			t.Errorf("IdempotencyMark without ttl did not return an error")
+		}
+
+		if got := commands(); len(got) != 1 {
+			t.Errorf("received commands %v, expected no new command", got[1:])
+		}
+	})
+}
+
+func TestApplauseMilliseconds(t *testing.T) {
+	addr, commands := fakeRedisArgs(t, nil)
+	r := redis.New(addr, redis.WithApplauseMilliseconds(), redis.WithApplauseCounter(1000))
+
+	if err := r.ApplausePublish(1, 1, 1_000_000); err != nil {
+		t.Fatalf("ApplausePublish: %v", err)
+	}
+
+	var msKeys int
+	for _, command := range commands() {
+		for _, arg := range command[1:] {
+			if strings.HasPrefix(arg, "applause:") || strings.HasPrefix(arg, "applause-counter:") || arg == "applause-meetings" {
+				t.Errorf("got command %v, expected only keys for milliseconds", command)
+			}
+			if strings.HasPrefix(arg, "applause-ms") {
+				msKeys++
+			}
+		}
+	}
+
+	if msKeys == 0 {
+		t.Errorf("got commands %v, expected keys for milliseconds", commands())
+	}
+}
+
+func TestActiveApplauseMeetings(t *testing.T) {
+	addr, commands := fakeRedisArgs(t, map[string][]string{
+		"SMEMBERS": {"*3\r\n$1\r\n3\r\n$1\r\n2\r\n$1\r\n1\r\n"},
+		"ZCOUNT":   {":1\r\n", ":0\r\n", ":4\r\n"},
+	})
+	r := redis.New(addr)
+
+	meetingIDs, err := r.ActiveApplauseMeetings(100)
+	if err != nil {
+		t.Fatalf("ActiveApplauseMeetings: %v", err)
+	}
+
+	if !reflect.DeepEqual(meetingIDs, []int{1, 3}) {
+		t.Errorf("got meetings %v, expected [1 3]", meetingIDs)
+	}
+
+	for _, command := range commands() {
+		if command[0] == "ZCOUNT" && command[2] != "100" {
+			t.Errorf("got command %v, expected to count since 100", command)
+		}
+	}
+}
+
+func TestApplauseMeetingSet(t *testing.T) {
+	t.Run("Skip invalid members", func(t *testing.T) {
+		addr, commands := fakeRedisArgs(t, map[string][]string{
+			"SMEMBERS": {"*2\r\n$3\r\nfoo\r\n$1\r\n2\r\n"},
+		})
+		r := redis.New(addr)
+
+		applause, err := r.ApplauseSince(0)
+		if err != nil {
+			t.Fatalf("ApplauseSince: %v", err)
+		}
+
+		if !reflect.DeepEqual(applause, map[int]int{2: 3}) {
+			t.Errorf("got applause %v, expected map[2:3]", applause)
+		}
+
+		for _, command := range commands() {
+			if command[0] == "ZCOUNT" && command[1] != "applause:2" {
+				t.Errorf("got command %v, expected to count only applause:2", command)
+			}
+		}
+	})
+
+	t.Run("Add meeting on publish", func(t *testing.T) {
+		addr, commands := fakeRedisArgs(t, nil)
+		r := redis.New(addr)
+
+		if err := r.ApplausePublish(7, 1, 100); err != nil {
+			t.Fatalf("ApplausePublish: %v", err)
+		}
+
+		got := commands()
+		if last := got[len(got)-1]; !reflect.DeepEqual(last, []string{"SADD", "applause-meetings", "7"}) {
+			t.Errorf("last command is %v, expected [SADD applause-meetings 7]", last)
+		}
+	})
+
+	t.Run("Add old keys on first clean", func(t *testing.T) {
+		addr, commands := fakeRedisArgs(t, map[string][]string{
+			"SCAN": {"*2\r\n$1\r\n0\r\n*2\r\n$12\r\napplause:foo\r\n$10\r\napplause:2\r\n"},
+		})
+		r := redis.New(addr)
+
+		for i := 0; i < 2; i++ {
+			if err := r.ApplauseCleanOld(100); err != nil {
+				t.Fatalf("ApplauseCleanOld: %v", err)
+			}
+		}
+
+		var scans int
+		var added [][]string
+		for _, command := range commands() {
+			switch command[0] {
+			case "SCAN":
+				scans++
+			case "SADD":
+				added = append(added, command)
+			}
+		}
+
+		if scans != 1 {
+			t.Errorf("got %d SCAN commands, expected 1", scans)
+		}
+
+		if !reflect.DeepEqual(added, [][]string{{"SADD", "applause-meetings", "2"}}) {
+			t.Errorf("got SADD commands %v, expected only meeting 2", added)
+		}
+	})
+
+	t.Run("Convert legacy key on first clean", func(t *testing.T) {
+		addr, commands := fakeRedisArgs(t, map[string][]string{
+			"TYPE":   {"+zset\r\n"},
+			"ZRANGE": {"*4\r\n$3\r\n3-5\r\n$2\r\n90\r\n$3\r\nbad\r\n$2\r\n95\r\n"},
+			"SCAN":   {"*2\r\n$1\r\n0\r\n*0\r\n"},
+		})
+		r := redis.New(addr)
+
+		if err := r.ApplauseCleanOld(100); err != nil {
+			t.Fatalf("ApplauseCleanOld: %v", err)
+		}
+
+		var converted [][]string
+		for _, command := range commands() {
+			switch command[0] {
+			case "ZADD", "SADD", "DEL":
+				converted = append(converted, command)
+			}
+		}
+
+		expect := [][]string{
+			{"ZADD", "applause:3", "GT", "90", "5"},
+			{"SADD", "applause-meetings", "3"},
+			{"DEL", "applause"},
+		}
+		if !reflect.DeepEqual(converted, expect) {
+			t.Errorf("got commands %v, expected %v", converted, expect)
+		}
+	})
+}
+
+func TestApplauseUsers(t *testing.T) {
+	addr, commands := fakeRedisArgs(t, map[string][]string{
+		"ZRANGEBYSCORE": {"*2\r\n$1\r\n5\r\n$1\r\n7\r\n"},
+	})
+	r := redis.New(addr)
+
+	userIDs, err := r.ApplauseUsers(1, 100)
+	if err != nil {
+		t.Fatalf("ApplauseUsers: %v", err)
+	}
+
+	if !reflect.DeepEqual(userIDs, []int{5, 7}) {
+		t.Errorf("got users %v, expected [5 7]", userIDs)
+	}
+
+	expect := []string{"ZRANGEBYSCORE", "applause:1", "100", "+inf"}
+	got := commands()
+	if len(got) == 0 || !reflect.DeepEqual(got[len(got)-1], expect) {
+		t.Errorf("got commands %v, expected %v", got, expect)
+	}
+}
+
+func TestStreamMaxAge(t *testing.T) {
+	port, stopRedis := startRedis(t)
+	defer stopRedis()
+
+	redisConn := redis.New("localhost:"+port, redis.WithStreamMaxAge(time.Hour))
+	redisConn.Wait(context.Background())
+
+	conn, err := redigo.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("connecting to redis: %v", err)
+	}
+	defer conn.Close()
+
+	for _, key := range []string{"icc-notify", "icc-notify-persist"} {
+		// Messages from 1970 are older then the max age.
+		for _, id := range []string{"1-0", "2-0"} {
+			if _, err := conn.Do("XADD", key, id, "content", "old"); err != nil {
+				t.Fatalf("adding old message to %s: %v", key, err)
+			}
+		}
+	}
+
+	if err := redisConn.NotifyPublish([]byte("new")); err != nil {
+		t.Fatalf("NotifyPublish returned unexpected error: %v", err)
+	}
+
+	if err := redisConn.NotifyPersist([]byte("new"), 5, "audit", 10); err != nil {
+		t.Fatalf("NotifyPersist returned unexpected error: %v", err)
+	}
+
+	for _, key := range []string{"icc-notify", "icc-notify-persist"} {
+		entries, err := redigo.Values(conn.Do("XRANGE", key, "-", "+"))
+		if err != nil {
+			t.Fatalf("reading stream %s: %v", key, err)
+		}
+
+		if len(entries) != 1 {
+			t.Errorf("stream %s has %d messages, expected only the new one", key, len(entries))
+		}
+	}
+}
+
+func TestStreamMaxAgeCommands(t *testing.T) {
+	addr, commands := fakeRedisArgs(t, nil)
+	r := redis.New(addr, redis.WithStreamMaxAge(time.Minute))
+
+	before := time.Now().Add(-time.Minute).UnixMilli()
+	if err := r.NotifyPublish([]byte("message")); err != nil {
+		t.Fatalf("NotifyPublish: %v", err)
+	}
+
+	if err := r.NotifyPersist([]byte("message"), 1, "name", 0); err != nil {
+		t.Fatalf("NotifyPersist without maxLen: %v", err)
+	}
+
+	if err := r.NotifyPersist([]byte("message"), 1, "name", 10); err != nil {
+		t.Fatalf("NotifyPersist with maxLen: %v", err)
+	}
+	after := time.Now().Add(-time.Minute).UnixMilli()
+
+	var trims [][]string
+	for _, command := range commands() {
+		if command[0] == "XADD" || command[0] == "XTRIM" {
+			trims = append(trims, command[:4])
+		}
+	}
+
+	expect := [][]string{
+		{"XADD", "icc-notify", "MINID", ""},
+		{"XADD", "icc-notify-persist", "MINID", ""},
+		{"XADD", "icc-notify-persist", "MAXLEN", "~"},
+		{"XTRIM", "icc-notify-persist", "MINID", ""},
+	}
+
+	if len(trims) != len(expect) {
+		t.Fatalf("got commands %v, expected %d commands", trims, len(expect))
+	}
+
+	for i, command := range trims {
+		if command[2] == "MINID" {
+			var ms int64
+			if _, err := fmt.Sscanf(command[3], "%d-0", &ms); err != nil || ms < before || ms > after {
+				t.Errorf("command %v has min id %s, expected a time one minute ago", command, command[3])
+			}
+			command[3] = ""
+		}
+
+		if !reflect.DeepEqual(command, expect[i]) {
+			t.Errorf("got command %v, expected %v", command, expect[i])
+		}
+	}
+}
+
+func TestApplauseLeaderboard(t *testing.T) {
+	addr, commands := fakeRedisArgs(t, map[string][]string{
+		"HGETALL": {
+			"*4\r\n$1\r\n5\r\n$1\r\n2\r\n$1\r\n7\r\n$1\r\n1\r\n",
+			"*2\r\n$1\r\n5\r\n$1\r\n3\r\n",
+		},
+	})
+	r := redis.New(addr)
+
+	// The test reads the minutes until now. Do not start at the end of a
+	// minute.
+	if time.Now().Unix()%60 == 59 {
+		time.Sleep(time.Second)
+	}
+
+	now := time.Now().Unix()
+	if err := r.ApplauseLeaderboardAdd(1, 5, now, time.Minute); err != nil {
+		t.Fatalf("ApplauseLeaderboardAdd: %v", err)
+	}
+
+	// Since the last minute, so two minutes are read.
+	counts, err := r.ApplauseLeaderboard(1, now-60)
+	if err != nil {
+		t.Fatalf("ApplauseLeaderboard: %v", err)
+	}
+
+	if expect := map[int]int{5: 5, 7: 1}; !reflect.DeepEqual(counts, expect) {
+		t.Errorf("got counts %v, expected %v", counts, expect)
+	}
+
+	key := fmt.Sprintf("applause-leaderboard:1:%d", now/60)
+	var hgetall int
+	for _, command := range commands() {
+		switch command[0] {
+		case "HINCRBY":
+			if !reflect.DeepEqual(command, []string{"HINCRBY", key, "5", "1"}) {
+				t.Errorf("got command %v, expected to count user 5 in %s", command, key)
+			}
+		case "PEXPIRE":
+			if !reflect.DeepEqual(command, []string{"PEXPIRE", key, "120000"}) {
+				t.Errorf("got command %v, expected the ttl and one minute", command)
+			}
+		case "HGETALL":
+			hgetall++
+		}
+	}
+
+	if hgetall != 2 {
+		t.Errorf("got %d HGETALL commands, expected 2", hgetall)
+	}
 }
@@ -1,7 +1,10 @@
 package redis
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
 )
 
 // stream parses a redis stream object.
@@ -35,7 +38,32 @@ func stream(reply interface{}, err error) (string, []byte, error) {
 		return "", nil, fmt.Errorf("invalid input. Expected got %d stream data, expected 1", len(data))
 	}
 
-	v := data[0]
+	return streamElement(data[0])
+}
+
+// streamEntries parses the reply of XRANGE.
+func streamEntries(reply interface{}, err error) ([]string, [][]byte, error) {
+	if err != nil {
+		return nil, nil, err
+	}
+	entries, ok := reply.([]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid input. Data has to be a list, not %T", reply)
+	}
+
+	ids := make([]string, len(entries))
+	contents := make([][]byte, len(entries))
+	for i, entry := range entries {
+		ids[i], contents[i], err = streamElement(entry)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return ids, contents, nil
+}
+
+// streamElement parses one element of a redis stream.
+func streamElement(v interface{}) (string, []byte, error) {
 	element, ok := v.([]interface{})
 	if !ok {
 		return "", nil, fmt.Errorf("invalid input. Stream element has to be a two-tuple, got %T", v)
@@ -55,6 +83,8 @@ func stream(reply interface{}, err error) (string, []byte, error) {
 		return "", nil, fmt.Errorf("invalid input. Odd number of key value pairs")
 	}
 
+	var content []byte
+	var encoding string
 	for i := 0; i < len(kv)-1; i += 2 {
 		key, ok := kv[i].([]byte)
 		if !ok {
@@ -66,10 +96,60 @@ func stream(reply interface{}, err error) (string, []byte, error) {
 		}
 		switch string(key) {
 		case "content":
-			return string(id), value, nil
+			content = value
+		case "encoding":
+			encoding = string(value)
 		default:
 			return "", nil, fmt.Errorf("invalid input. Unknown key \"%s\"", key)
 		}
 	}
-	return "", nil, fmt.Errorf("invalid input. `content` not in response")
+
+	if content == nil {
+		return "", nil, fmt.Errorf("invalid input. `content` not in response")
+	}
+
+	decoded, err := decompress(encoding, content)
+	if err != nil {
+		return "", nil, fmt.Errorf("decoding content of %s: %w", id, err)
+	}
+	return string(id), decoded, nil
+}
+
+// compress compresses data with gzip.
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("writing data: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("closing gzip writer: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress decodes data with the given encoding. An empty encoding means,
+// that the data is not compressed.
+func decompress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case "":
+		return data, nil
+
+	case encodingGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("reading gzip header: %w", err)
+		}
+		defer r.Close()
+
+		decoded, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("reading gzip data: %w", err)
+		}
+		return decoded, nil
+
+	default:
+		return nil, fmt.Errorf("unknown encoding `%s`", encoding)
+	}
 }
@@ -0,0 +1,129 @@
+package redis
+
+import (
+	"strings"
+	"testing"
+)
+
+// xreadReply builds the reply of XREAD for one stream element.
+func xreadReply(id string, kv ...[]byte) interface{} {
+	fields := make([]interface{}, len(kv))
+	for i, v := range kv {
+		fields[i] = v
+	}
+
+	element := []interface{}{[]byte(id), fields}
+	return []interface{}{
+		[]interface{}{[]byte(notifyKey), []interface{}{element}},
+	}
+}
+
+func TestStreamCompression(t *testing.T) {
+	message := []byte(strings.Repeat(`{"name":"message","message":"some data"}`, 10))
+
+	t.Run("round trip", func(t *testing.T) {
+		compressed, err := compress(message)
+		if err != nil {
+			t.Fatalf("compress: %v", err)
+		}
+
+		if len(compressed) >= len(message) {
+			t.Errorf("compressed message has %d bytes, expected less then %d", len(compressed), len(message))
+		}
+
+		id, got, err := stream(xreadReply("1-0", []byte("content"), compressed, []byte("encoding"), []byte(encodingGzip)), nil)
+		if err != nil {
+			t.Fatalf("stream: %v", err)
+		}
+
+		if id != "1-0" {
+			t.Errorf("got id %s, expected 1-0", id)
+		}
+
+		if string(got) != string(message) {
+			t.Errorf("got message %s, expected %s", got, message)
+		}
+	})
+
+	t.Run("uncompressed entry", func(t *testing.T) {
+		_, got, err := stream(xreadReply("1-0", []byte("content"), message), nil)
+		if err != nil {
+			t.Fatalf("stream: %v", err)
+		}
+
+		if string(got) != string(message) {
+			t.Errorf("got message %s, expected %s", got, message)
+		}
+	})
+
+	t.Run("unknown encoding", func(t *testing.T) {
+		_, _, err := stream(xreadReply("1-0", []byte("content"), message, []byte("encoding"), []byte("snappy")), nil)
+		if err == nil {
+			t.Errorf("stream did not return an error")
+		}
+	})
+}
+
+func TestCompressMinBytes(t *testing.T) {
+	r := New("localhost:6379", WithCompression(), WithCompressMinBytes(100))
+
+	for _, tt := range []struct {
+		name       string
+		message    []byte
+		compressed bool
+	}{
+		{"below threshold", []byte(`{"name":"small"}`), false},
+		{"at threshold", []byte(strings.Repeat("a", 100)), true},
+		{"above threshold", []byte(strings.Repeat(`{"name":"message","message":"some data"}`, 10)), true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, err := r.notifyFields(tt.message)
+			if err != nil {
+				t.Fatalf("notifyFields: %v", err)
+			}
+
+			kv := make([][]byte, len(fields))
+			for i, f := range fields {
+				switch v := f.(type) {
+				case string:
+					kv[i] = []byte(v)
+				case []byte:
+					kv[i] = v
+				}
+			}
+
+			if compressed := len(kv) == 4 && string(kv[3]) == encodingGzip; compressed != tt.compressed {
+				t.Errorf("got fields %q, expected compressed: %t", kv, tt.compressed)
+			}
+
+			_, got, err := stream(xreadReply("1-0", kv...), nil)
+			if err != nil {
+				t.Fatalf("stream: %v", err)
+			}
+
+			if string(got) != string(tt.message) {
+				t.Errorf("got message %s, expected %s", got, tt.message)
+			}
+		})
+	}
+}
+
+func TestStreamEntries(t *testing.T) {
+	reply := []interface{}{
+		[]interface{}{[]byte("1-0"), []interface{}{[]byte("content"), []byte("first")}},
+		[]interface{}{[]byte("2-0"), []interface{}{[]byte("content"), []byte("second")}},
+	}
+
+	ids, messages, err := streamEntries(reply, nil)
+	if err != nil {
+		t.Fatalf("streamEntries: %v", err)
+	}
+
+	if len(ids) != 2 || ids[0] != "1-0" || ids[1] != "2-0" {
+		t.Errorf("got ids %v, expected [1-0 2-0]", ids)
+	}
+
+	if len(messages) != 2 || string(messages[0]) != "first" || string(messages[1]) != "second" {
+		t.Errorf("got messages %q, expected [first second]", messages)
+	}
+}
@@ -0,0 +1,167 @@
+package run
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envPrefixes are the prefixes of environment variables, that are expected to
+// be used by the service. Unknown variables with this prefixes are probably
+// typos.
+var envPrefixes = []string{"ICC_", "DATASTORE_", "AUTH_"}
+
+// envSecrets are the environment variables for secrets. They have no default
+// and are read in buildAuth.
+var envSecrets = []string{"AUTH_TOKEN_KEY", "AUTH_COOKIE_KEY"}
+
+var (
+	portEnv = []string{
+		"ICC_PORT",
+		"ICC_REDIS_PORT",
+		"ICC_REDIS_REPLICA_PORT",
+		"DATASTORE_READER_PORT",
+		"MESSAGE_BUS_PORT",
+		"AUTH_PORT",
+	}
+
+	durationEnv = []string{
+		"ICC_LISTEN_RETRY",
+		"ICC_REDIS_CONNECT_TIMEOUT",
+		"ICC_REDIS_READ_TIMEOUT",
+		"ICC_REDIS_WRITE_TIMEOUT",
+		"ICC_REDIS_POOL_WAIT_TIMEOUT",
+		"ICC_STREAM_MAX_AGE",
+		"ICC_APPLAUSE_DECAY",
+		"ICC_APPLAUSE_PRUNE_INTERVAL",
+		"ICC_APPLAUSE_LEADERBOARD_WINDOW",
+		"ICC_APPLAUSE_COOLDOWN",
+		"ICC_NOTIFY_MAX_CONNECTION_AGE",
+		"ICC_NOTIFY_INBOX_TTL",
+		"ICC_NOTIFY_RETAIN_TTL",
+		"ICC_NOTIFY_IDEMPOTENCY_WINDOW",
+		"ICC_AUTH_QUEUE_TIMEOUT",
+		"ICC_SHUTDOWN_TIMEOUT_SIGINT",
+		"ICC_SHUTDOWN_TIMEOUT_SIGTERM",
+	}
+
+	intEnv = []string{
+		"ICC_MAX_HEADER_BYTES",
+		"ICC_COMPRESS_MIN_BYTES",
+		"ICC_APPLAUSE_MAX_MEETINGS",
+		"ICC_APPLAUSE_PRUNE_BATCH_SIZE",
+		"ICC_NOTIFY_PUBLISH_WORKERS",
+		"ICC_NOTIFY_PUBLISH_QUEUE_SIZE",
+		"ICC_NOTIFY_POOLED_BUFFER_SIZE",
+		"ICC_NOTIFY_INBOX_SIZE",
+		"ICC_NOTIFY_PAUSE_BUFFER",
+		"ICC_NOTIFY_BUFFER_SIZE",
+		"ICC_NOTIFY_PERSIST_MAXLEN",
+		"ICC_NOTIFY_MAX_MESSAGE_BYTES",
+		"ICC_NOTIFY_MAX_MESSAGE_DEPTH",
+		"ICC_NOTIFY_MAX_LIST_ITEMS",
+		"ICC_NOTIFY_MAX_BUFFERED_BYTES",
+		"ICC_AUTH_MAX_CONCURRENT",
+		"ICC_METRICS_MAX_MEETINGS",
+	}
+
+	floatEnv = []string{
+		"ICC_MAX_SEND_RPS",
+		"ICC_MAX_MEETING_SEND_RPS",
+	}
+
+	// boolEnv are compared with `true` or `false`, so other values like `1`
+	// are rejected instead of being read as the other value.
+	boolEnv = []string{
+		"ICC_DATASTORE_WAIT",
+		"ICC_COMPRESS_MESSAGES",
+		"ICC_REDIS_CLUSTER",
+		"ICC_REDIS_RECREATE_WRONGTYPE",
+		"ICC_APPLAUSE_VIA_NOTIFY",
+		"ICC_APPLAUSE_MILLISECONDS",
+		"ICC_APPLAUSE_BEST_EFFORT",
+		"ICC_APPLAUSE_COUNTER",
+		"ICC_APPLAUSE_PRESENT_LEVEL",
+		"ICC_NOTIFY_DEDUP",
+		"ICC_NOTIFY_PUBLISH_ASYNC",
+		"ICC_NOTIFY_PERSIST",
+		"ICC_ALLOW_EMPTY_MESSAGE",
+		"ICC_CANONICALIZE_JSON",
+		"ICC_AUTH_REQUIRED",
+		"REDIS_TEST_CONN",
+	}
+)
+
+// validateEnv checks the environment before the service is started.
+//
+// It returns a warning for each variable in environment with one of the
+// envPrefixes, that is not used by the service. The values in env, that are
+// not a valid port, duration, number or boolean, are returned as error.
+func validateEnv(environment []string, env map[string]string) (warnings []string, err error) {
+	known := make(map[string]bool)
+	for name := range defaultEnv(nil) {
+		known[name] = true
+	}
+	for _, name := range append(append([]string{}, secretFileEnv...), envSecrets...) {
+		known[name] = true
+		known[name+"_FILE"] = true
+	}
+
+	for _, value := range environment {
+		name := strings.SplitN(value, "=", 2)[0]
+		if known[name] || !hasEnvPrefix(name) {
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf("unknown environment variable %s", name))
+	}
+	sort.Strings(warnings)
+
+	var problems []string
+	for _, name := range portEnv {
+		port, err := strconv.Atoi(env[name])
+		if err != nil || port < 0 || port > 65535 {
+			problems = append(problems, fmt.Sprintf("%s has to be a port number, not `%s`", name, env[name]))
+		}
+	}
+
+	for _, name := range durationEnv {
+		if _, err := time.ParseDuration(env[name]); err != nil {
+			problems = append(problems, fmt.Sprintf("%s has to be a duration like `5s`, not `%s`", name, env[name]))
+		}
+	}
+
+	for _, name := range intEnv {
+		if _, err := strconv.Atoi(env[name]); err != nil {
+			problems = append(problems, fmt.Sprintf("%s has to be an integer, not `%s`", name, env[name]))
+		}
+	}
+
+	for _, name := range floatEnv {
+		if _, err := strconv.ParseFloat(env[name], 64); err != nil {
+			problems = append(problems, fmt.Sprintf("%s has to be a number, not `%s`", name, env[name]))
+		}
+	}
+
+	for _, name := range boolEnv {
+		if env[name] != "true" && env[name] != "false" {
+			problems = append(problems, fmt.Sprintf("%s has to be `true` or `false`, not `%s`", name, env[name]))
+		}
+	}
+
+	if len(problems) > 0 {
+		return warnings, errors.New(strings.Join(problems, "; "))
+	}
+	return warnings, nil
+}
+
+func hasEnvPrefix(name string) bool {
+	for _, prefix := range envPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/auth"
+	"github.com/ostcar/topic"
+)
+
+// logoutPruneTime is the duration, a logout event is kept. It should be higher
+// then the max livetime of a token.
+const logoutPruneTime = 15 * time.Minute
+
+// logoutBroadcast reads the logout events from one LogoutEventer and delivers
+// them to many receivers.
+//
+// The LogoutEventer from the message bus can only be used by one goroutine.
+// After an auth reload, the old and the new auth service have to receive the
+// logout events.
+type logoutBroadcast struct {
+	topic *topic.Topic
+	done  <-chan struct{}
+}
+
+// newLogoutBroadcast starts to read logout events until the context is done.
+func newLogoutBroadcast(ctx context.Context, receiver auth.LogoutEventer, errHandler func(error)) *logoutBroadcast {
+	b := logoutBroadcast{
+		topic: topic.New(topic.WithClosed(ctx.Done())),
+		done:  ctx.Done(),
+	}
+
+	go b.listen(ctx, receiver, errHandler)
+	go b.prune(ctx)
+	return &b
+}
+
+func (b *logoutBroadcast) listen(ctx context.Context, receiver auth.LogoutEventer, errHandler func(error)) {
+	for {
+		sessionIDs, err := receiver.LogoutEvent(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			errHandler(fmt.Errorf("receiving logout event: %w", err))
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if len(sessionIDs) > 0 {
+			b.topic.Publish(sessionIDs...)
+		}
+	}
+}
+
+func (b *logoutBroadcast) prune(ctx context.Context) {
+	tick := time.NewTicker(5 * time.Minute)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			b.topic.Prune(time.Now().Add(-logoutPruneTime))
+		}
+	}
+}
+
+// eventer returns a LogoutEventer that returns all logout events from now on.
+func (b *logoutBroadcast) eventer() auth.LogoutEventer {
+	return &topicEventer{topic: b.topic, tid: b.topic.LastID()}
+}
+
+// feed delivers the logout events to the auth service until ctx is done.
+//
+// auth.ListenOnLogouts does not return, when its context is done, but calls
+// the error handler and retries. So after ctx is done, which happens when the
+// auth service is replaced by a reload, the goroutine waits in the error
+// handler until the broadcast stops and does not report the errors.
+func (b *logoutBroadcast) feed(ctx context.Context, a *auth.Auth, errHandler func(error)) {
+	a.ListenOnLogouts(ctx, b.eventer(), func(err error) {
+		if ctx.Err() != nil {
+			<-b.done
+			return
+		}
+		errHandler(err)
+	})
+}
+
+// topicEventer implements auth.LogoutEventer by reading from a topic.
+type topicEventer struct {
+	topic *topic.Topic
+	tid   uint64
+}
+
+func (e *topicEventer) LogoutEvent(ctx context.Context) ([]string, error) {
+	tid, sessionIDs, err := e.topic.Receive(ctx, e.tid)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	e.tid = tid
+	return sessionIDs, nil
+}
@@ -0,0 +1,90 @@
+package run
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/auth"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
+	messageBusRedis "github.com/OpenSlides/openslides-autoupdate-service/pkg/redis"
+	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
+)
+
+// MessageBus receives the logout events and the datastore updates from the
+// other OpenSlides services.
+type MessageBus interface {
+	auth.LogoutEventer
+	datastore.Updater
+}
+
+// MessageBusFactory builds a MessageBus from the environment.
+type MessageBusFactory func(env map[string]string) (MessageBus, error)
+
+var (
+	messageBusesMu sync.Mutex
+	messageBuses   = map[string]MessageBusFactory{
+		"redis": buildRedisMessageBus,
+		"fake":  buildFakeMessageBus,
+	}
+)
+
+// RegisterMessageBus makes a message bus available with the environment
+// variable MESSAGING=name.
+//
+// It panics, if a message bus with the name is already registered. It should
+// be called before Run.
+func RegisterMessageBus(name string, factory MessageBusFactory) {
+	messageBusesMu.Lock()
+	defer messageBusesMu.Unlock()
+
+	if _, ok := messageBuses[name]; ok {
+		panic(fmt.Sprintf("message bus %s is already registered", name))
+	}
+	messageBuses[name] = factory
+}
+
+func buildMessageBus(env map[string]string) (MessageBus, error) {
+	serviceName := env["MESSAGING"]
+	icclog.Info("Messaging Service: %s", serviceName)
+
+	messageBusesMu.Lock()
+	factory, ok := messageBuses[serviceName]
+	names := make([]string, 0, len(messageBuses))
+	for name := range messageBuses {
+		names = append(names, name)
+	}
+	messageBusesMu.Unlock()
+
+	if !ok {
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown messagin service `%s`, expected one of %s", serviceName, strings.Join(names, ", "))
+	}
+
+	return factory(env)
+}
+
+func buildRedisMessageBus(env map[string]string) (MessageBus, error) {
+	redisAddress := env["MESSAGE_BUS_HOST"] + ":" + env["MESSAGE_BUS_PORT"]
+	conn := messageBusRedis.NewConnection(redisAddress)
+	if env["REDIS_TEST_CONN"] == "true" {
+		if err := conn.TestConn(); err != nil {
+			return nil, fmt.Errorf("connect to redis: %w", err)
+		}
+	}
+
+	return &messageBusRedis.Redis{Conn: conn}, nil
+}
+
+// buildFakeMessageBus returns a message bus, that never receives anything. So
+// logouts do not close connections and tokens of logged out users are
+// accepted until they expire. Outside of development, this is logged as a
+// warning.
+func buildFakeMessageBus(env map[string]string) (MessageBus, error) {
+	if env["OPENSLIDES_DEVELOPMENT"] == "false" {
+		icclog.Info("Warning: MESSAGING=fake without OPENSLIDES_DEVELOPMENT. The service does not receive logout events and datastore updates. Use MESSAGING=redis in production.")
+	}
+
+	return &messageBusRedis.Redis{Conn: messageBusRedis.BlockingConn{}}, nil
+}
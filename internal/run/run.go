@@ -2,69 +2,208 @@ package run
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/auth"
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
-	messageBusRedis "github.com/OpenSlides/openslides-autoupdate-service/pkg/redis"
 	"github.com/OpenSlides/openslides-icc-service/internal/applause"
 	"github.com/OpenSlides/openslides-icc-service/internal/icchttp"
 	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
 	"github.com/OpenSlides/openslides-icc-service/internal/notify"
 	"github.com/OpenSlides/openslides-icc-service/internal/redis"
+	"github.com/OpenSlides/openslides-icc-service/internal/webhook"
 )
 
 // Run starts the http server.
 //
-// The server is automaticly closed when ctx is done.
+// The server is automaticly closed when ctx is done or an error of a class in
+// ICC_FATAL_ERRORS happens. In the last case, the error is returned.
+//
+// The active connections are drained for the timeout from
+// WithShutdownTimeout. Without it, the timeout of SIGTERM is used.
 //
 // The service is configured by the argument `environment`. It expect strings in
 // the format `KEY=VALUE`, like the output from `os.Environmen()`.
 func Run(ctx context.Context, environment []string, secret func(name string) (string, error)) error {
 	env := defaultEnv(environment)
+	if err := readSecretFiles(env); err != nil {
+		return fmt.Errorf("reading secret files: %w", err)
+	}
 
-	errHandler := buildErrHandler()
+	warnings, err := validateEnv(environment, env)
+	for _, warning := range warnings {
+		icclog.Info("Warning: %s", warning)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid environment: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	fatalClasses, err := parseFatalErrors(env["ICC_FATAL_ERRORS"])
+	if err != nil {
+		return fmt.Errorf("parsing ICC_FATAL_ERRORS: %w", err)
+	}
+
+	timeouts, err := parseShutdownTimeouts(env)
+	if err != nil {
+		return fmt.Errorf("parsing shutdown timeouts: %w", err)
+	}
+
+	// Without a timeout from the caller, the connections are drained like
+	// after SIGTERM.
+	shutdownTimeout, ok := ctx.Value(shutdownTimeoutKey{}).(func() time.Duration)
+	if !ok {
+		shutdownTimeout = func() time.Duration { return timeouts[syscall.SIGTERM] }
+	}
+
+	var fatalErr error
+	var fatalOnce sync.Once
+	errHandler := buildErrHandler(fatalClasses, func(err error) {
+		fatalOnce.Do(func() {
+			fatalErr = err
+			cancel()
+		})
+	})
 
 	messageBus, err := buildMessageBus(env)
 	if err != nil {
 		return fmt.Errorf("building message bus: %w", err)
 	}
 
-	auth, err := buildAuth(
-		ctx,
-		env,
-		secret,
-		messageBus,
-		errHandler,
-	)
+	logouts := newLogoutBroadcast(ctx, messageBus, errHandler)
+	auth, err := startAuth(ctx, env, func(authCtx context.Context) (icchttp.Authenticater, error) {
+		return buildAuth(
+			authCtx,
+			env,
+			secret,
+			logouts,
+			errHandler,
+		)
+	}, errHandler)
 	if err != nil {
 		return fmt.Errorf("building auth: %w", err)
 	}
+	go reloadOnHangup(ctx, auth, errHandler)
 
 	ds, err := buildDatastore(env, messageBus)
 	if err != nil {
 		return fmt.Errorf("build datastore service: %w", err)
 	}
 
-	backend := redis.New(env["ICC_REDIS_HOST"] + ":" + env["ICC_REDIS_PORT"])
+	if env["ICC_DATASTORE_WAIT"] == "true" {
+		if err := waitForDatastore(ctx, datastoreURL(env), 500*time.Millisecond, 10*time.Second); err != nil {
+			return err
+		}
+	}
 
-	notifyService := notify.New(ctx, backend)
-	applauseService := applause.New(backend, ds, ctx.Done())
-	go applauseService.Loop(ctx, errHandler)
-	go applauseService.PruneOldData(ctx)
+	redisTimeouts := make(map[string]time.Duration)
+	for _, name := range []string{"ICC_REDIS_CONNECT_TIMEOUT", "ICC_REDIS_READ_TIMEOUT", "ICC_REDIS_WRITE_TIMEOUT"} {
+		d, err := time.ParseDuration(env[name])
+		if err != nil {
+			return fmt.Errorf("parsing %s: %w", name, err)
+		}
+		redisTimeouts[name] = d
+	}
 
-	mux := http.NewServeMux()
-	icchttp.HandleHealth(mux)
-	notify.HandleReceive(mux, notifyService, auth)
-	notify.HandlePublish(mux, notifyService, auth)
-	applause.HandleReceive(mux, applauseService, auth)
-	applause.HandleSend(mux, applauseService, auth)
+	redisOptions := []redis.Option{
+		redis.WithTimeouts(
+			redisTimeouts["ICC_REDIS_CONNECT_TIMEOUT"],
+			redisTimeouts["ICC_REDIS_READ_TIMEOUT"],
+			redisTimeouts["ICC_REDIS_WRITE_TIMEOUT"],
+		),
+	}
+	if env["ICC_COMPRESS_MESSAGES"] == "true" {
+		redisOptions = append(redisOptions, redis.WithCompression())
+	}
+
+	compressMinBytes, err := strconv.Atoi(env["ICC_COMPRESS_MIN_BYTES"])
+	if err != nil {
+		return fmt.Errorf("parsing ICC_COMPRESS_MIN_BYTES: %w", err)
+	}
+	redisOptions = append(redisOptions, redis.WithCompressMinBytes(compressMinBytes))
+	if env["ICC_REDIS_CLUSTER"] == "true" {
+		redisOptions = append(redisOptions, redis.WithCluster())
+	}
+	if env["ICC_REDIS_RECREATE_WRONGTYPE"] == "true" {
+		redisOptions = append(redisOptions, redis.WithRecreateWrongType())
+	}
+	if env["ICC_APPLAUSE_MILLISECONDS"] == "true" {
+		redisOptions = append(redisOptions, redis.WithApplauseMilliseconds())
+	}
+	if env["ICC_APPLAUSE_COUNTER"] == "true" {
+		// Each counter holds the applause of one second.
+		var width int64 = 1
+		if env["ICC_APPLAUSE_MILLISECONDS"] == "true" {
+			width = 1000
+		}
+		redisOptions = append(redisOptions, redis.WithApplauseCounter(width))
+	}
+
+	poolWaitTimeout, err := time.ParseDuration(env["ICC_REDIS_POOL_WAIT_TIMEOUT"])
+	if err != nil {
+		return fmt.Errorf("parsing ICC_REDIS_POOL_WAIT_TIMEOUT: %w", err)
+	}
+	if poolWaitTimeout > 0 {
+		redisOptions = append(redisOptions, redis.WithPoolWaitTimeout(poolWaitTimeout))
+	}
+
+	streamMaxAge, err := time.ParseDuration(env["ICC_STREAM_MAX_AGE"])
+	if err != nil {
+		return fmt.Errorf("parsing ICC_STREAM_MAX_AGE: %w", err)
+	}
+	if streamMaxAge > 0 {
+		redisOptions = append(redisOptions, redis.WithStreamMaxAge(streamMaxAge))
+	}
+
+	if env["ICC_REDIS_REPLICA_HOST"] != "" {
+		if env["ICC_REDIS_CLUSTER"] == "true" {
+			return fmt.Errorf("ICC_REDIS_REPLICA_HOST can not be used with ICC_REDIS_CLUSTER")
+		}
+		redisOptions = append(redisOptions, redis.WithReplica(env["ICC_REDIS_REPLICA_HOST"]+":"+env["ICC_REDIS_REPLICA_PORT"]))
+	}
+
+	pruneBatchSize, err := strconv.Atoi(env["ICC_APPLAUSE_PRUNE_BATCH_SIZE"])
+	if err != nil {
+		return fmt.Errorf("parsing ICC_APPLAUSE_PRUNE_BATCH_SIZE: %w", err)
+	}
+	if pruneBatchSize > 0 {
+		redisOptions = append(redisOptions, redis.WithPruneBatchSize(pruneBatchSize))
+	}
 
-	listenAddr := ":" + env["ICC_PORT"]
-	srv := &http.Server{Addr: listenAddr, Handler: mux}
+	backend := redis.New(env["ICC_REDIS_HOST"]+":"+env["ICC_REDIS_PORT"], redisOptions...)
+
+	handler, connections, err := buildHandler(ctx, env, backend, ds, auth, errHandler)
+	if err != nil {
+		return fmt.Errorf("building http handler: %w", err)
+	}
+
+	srv, err := buildServer(env, handler)
+	if err != nil {
+		return fmt.Errorf("building http server: %w", err)
+	}
+
+	listenRetry, err := time.ParseDuration(env["ICC_LISTEN_RETRY"])
+	if err != nil {
+		return fmt.Errorf("parsing ICC_LISTEN_RETRY: %w", err)
+	}
+
+	listener, err := listen(ctx, srv.Addr, listenRetry, 500*time.Millisecond)
+	if err != nil {
+		return err
+	}
 
 	// Shutdown logic in separate goroutine.
 	wait := make(chan error)
@@ -72,43 +211,610 @@ func Run(ctx context.Context, environment []string, secret func(name string) (st
 		// Wait for the context to be closed.
 		<-ctx.Done()
 
-		if err := srv.Shutdown(context.Background()); err != nil {
+		timeout := shutdownTimeout()
+
+		shutdownCtx := context.Background()
+		if timeout > 0 {
+			var cancelShutdown context.CancelFunc
+			shutdownCtx, cancelShutdown = context.WithTimeout(shutdownCtx, timeout)
+			defer cancelShutdown()
+		}
+
+		shutdown := func() error {
+			return srv.Shutdown(shutdownCtx)
+		}
+
+		report := func(active int) {
+			icclog.Info("Shutdown: %d active connections", active)
+		}
+
+		drainTime, err := connections.Drain(shutdown, time.Second, report)
+		if errors.Is(err, context.DeadlineExceeded) {
+			icclog.Info("Shutdown: timeout after %s, closing %d connections", drainTime, connections.Active())
+			err = srv.Close()
+		}
+
+		if err != nil {
 			wait <- fmt.Errorf("HTTP server shutdown: %w", err)
 			return
 		}
+		icclog.Info("Shutdown: all connections drained in %s", drainTime)
 		wait <- nil
 	}()
 
-	icclog.Info("Listen on %s", listenAddr)
-	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+	if err := serve(srv, listener); err != http.ErrServerClosed {
 		return fmt.Errorf("HTTP Server failed: %v", err)
 	}
 
-	return <-wait
+	if err := <-wait; err != nil {
+		return err
+	}
+
+	if fatalErr != nil {
+		return fmt.Errorf("fatal error: %w", fatalErr)
+	}
+	return nil
+}
+
+// Backend is the backend of the notify and the applause service.
+type Backend interface {
+	notify.Backend
+	notify.InboxBackend
+	notify.IdempotencyBackend
+	notify.PersistBackend
+	applause.Backend
+	applause.CounterBackend
+	icchttp.StatsBackend
+}
+
+// Handler returns the http handler with all routes of the service, like Run
+// builds it. It is meant for tests, that need the full service with other
+// backends.
+//
+// The environment is used like in Run. The background goroutines stop, when
+// ctx is done.
+func Handler(ctx context.Context, environment []string, backend Backend, ds datastore.Getter, auth icchttp.Authenticater) (http.Handler, error) {
+	reloadAuth, err := icchttp.NewReloadAuth(ctx, func(context.Context) (icchttp.Authenticater, error) {
+		return auth, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("building auth: %w", err)
+	}
+
+	env := defaultEnv(environment)
+	if err := readSecretFiles(env); err != nil {
+		return nil, fmt.Errorf("reading secret files: %w", err)
+	}
+
+	if _, err := validateEnv(environment, env); err != nil {
+		return nil, fmt.Errorf("invalid environment: %w", err)
+	}
+
+	handler, _, err := buildHandler(ctx, env, backend, ds, reloadAuth, buildErrHandler(nil, nil))
+	if err != nil {
+		return nil, fmt.Errorf("building http handler: %w", err)
+	}
+	return handler, nil
+}
+
+// buildHandler builds the notify and applause services and returns the http
+// handler with all routes.
+//
+// The returned ConnectionCounter counts the open connections of the handler.
+func buildHandler(
+	ctx context.Context,
+	env map[string]string,
+	backend Backend,
+	ds datastore.Getter,
+	reloadAuth *icchttp.ReloadAuth,
+	errHandler func(error),
+) (http.Handler, *icchttp.ConnectionCounter, error) {
+	auth, err := limitAuth(env, reloadAuth)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	maxConnectionAge, err := time.ParseDuration(env["ICC_NOTIFY_MAX_CONNECTION_AGE"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_NOTIFY_MAX_CONNECTION_AGE: %w", err)
+	}
+
+	var notifyBackend notify.Backend = backend
+	if url := env["ICC_WEBHOOK_URL"]; url != "" {
+		icclog.Info("Webhook: %s", url)
+		wh := webhook.New(url, []byte(env["ICC_WEBHOOK_SECRET"]))
+		go wh.Loop(ctx, nonFatal(errHandler))
+		notifyBackend = wh.Wrap(backend)
+	}
+
+	notifyOptions := []notify.Option{notify.WithMaxConnectionAge(maxConnectionAge)}
+	if env["ICC_NOTIFY_DEDUP"] == "true" {
+		notifyOptions = append(notifyOptions, notify.WithDedup())
+	}
+
+	if env["ICC_ALLOW_EMPTY_MESSAGE"] == "true" {
+		notifyOptions = append(notifyOptions, notify.WithAllowEmptyMessage())
+	}
+
+	publishWorkers, err := strconv.Atoi(env["ICC_NOTIFY_PUBLISH_WORKERS"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_NOTIFY_PUBLISH_WORKERS: %w", err)
+	}
+	notifyOptions = append(notifyOptions, notify.WithPublishWorkers(publishWorkers))
+
+	publishQueueSize, err := strconv.Atoi(env["ICC_NOTIFY_PUBLISH_QUEUE_SIZE"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_NOTIFY_PUBLISH_QUEUE_SIZE: %w", err)
+	}
+	notifyOptions = append(notifyOptions, notify.WithPublishQueueSize(publishQueueSize))
+
+	pooledBufferSize, err := strconv.Atoi(env["ICC_NOTIFY_POOLED_BUFFER_SIZE"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_NOTIFY_POOLED_BUFFER_SIZE: %w", err)
+	}
+	notifyOptions = append(notifyOptions, notify.WithPooledBufferSize(pooledBufferSize))
+
+	if env["ICC_NOTIFY_PUBLISH_ASYNC"] == "true" {
+		notifyOptions = append(notifyOptions, notify.WithAsyncPublish())
+	}
+
+	maxSendRPS, err := strconv.ParseFloat(env["ICC_MAX_SEND_RPS"], 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_MAX_SEND_RPS: %w", err)
+	}
+	if maxSendRPS > 0 {
+		notifyOptions = append(notifyOptions, notify.WithMaxPublishRate(maxSendRPS))
+	}
+
+	maxMeetingSendRPS, err := strconv.ParseFloat(env["ICC_MAX_MEETING_SEND_RPS"], 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_MAX_MEETING_SEND_RPS: %w", err)
+	}
+	if maxMeetingSendRPS > 0 {
+		notifyOptions = append(notifyOptions, notify.WithMaxMeetingPublishRate(maxMeetingSendRPS))
+	}
+
+	switch env["ICC_NOTIFY_MESSAGE_ID_FORMAT"] {
+	case "ulid":
+		notifyOptions = append(notifyOptions, notify.WithULIDMessageIDs())
+	case "counter":
+	default:
+		return nil, nil, fmt.Errorf("invalid ICC_NOTIFY_MESSAGE_ID_FORMAT `%s`, expected `counter` or `ulid`", env["ICC_NOTIFY_MESSAGE_ID_FORMAT"])
+	}
+
+	switch env["ICC_UTF8_POLICY"] {
+	case "reject":
+		notifyOptions = append(notifyOptions, notify.WithRejectInvalidUTF8())
+	case "sanitize":
+		notifyOptions = append(notifyOptions, notify.WithSanitizeUTF8())
+	case "keep":
+	default:
+		return nil, nil, fmt.Errorf("invalid ICC_UTF8_POLICY `%s`, expected `keep`, `reject` or `sanitize`", env["ICC_UTF8_POLICY"])
+	}
+
+	if env["ICC_CANONICALIZE_JSON"] == "true" {
+		notifyOptions = append(notifyOptions, notify.WithCanonicalJSON())
+	}
+
+	publishPerms, err := parsePublishPermissions(env["ICC_NOTIFY_PUBLISH_PERMISSIONS"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_NOTIFY_PUBLISH_PERMISSIONS: %w", err)
+	}
+	if len(publishPerms) > 0 {
+		notifyOptions = append(notifyOptions, notify.WithPublishPermissions(ds, publishPerms))
+	}
+
+	inboxSize, err := strconv.Atoi(env["ICC_NOTIFY_INBOX_SIZE"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_NOTIFY_INBOX_SIZE: %w", err)
+	}
+	if inboxSize > 0 {
+		inboxTTL, err := time.ParseDuration(env["ICC_NOTIFY_INBOX_TTL"])
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing ICC_NOTIFY_INBOX_TTL: %w", err)
+		}
+		notifyOptions = append(notifyOptions, notify.WithInbox(backend, ds, inboxSize, inboxTTL))
+	}
+
+	retainTTL, err := time.ParseDuration(env["ICC_NOTIFY_RETAIN_TTL"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_NOTIFY_RETAIN_TTL: %w", err)
+	}
+	notifyOptions = append(notifyOptions, notify.WithRetainTTL(retainTTL))
+
+	idempotencyWindow, err := time.ParseDuration(env["ICC_NOTIFY_IDEMPOTENCY_WINDOW"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_NOTIFY_IDEMPOTENCY_WINDOW: %w", err)
+	}
+	if idempotencyWindow > 0 {
+		notifyOptions = append(notifyOptions, notify.WithIdempotency(backend, idempotencyWindow))
+	}
+
+	if env["ICC_NOTIFY_PERSIST"] == "true" {
+		persistMaxLen, err := strconv.Atoi(env["ICC_NOTIFY_PERSIST_MAXLEN"])
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing ICC_NOTIFY_PERSIST_MAXLEN: %w", err)
+		}
+		notifyOptions = append(notifyOptions, notify.WithPersist(backend, persistMaxLen))
+	}
+
+	bufferSize, err := strconv.Atoi(env["ICC_NOTIFY_BUFFER_SIZE"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_NOTIFY_BUFFER_SIZE: %w", err)
+	}
+	notifyOptions = append(notifyOptions, notify.WithBufferSize(bufferSize))
+
+	maxBufferedBytes, err := strconv.Atoi(env["ICC_NOTIFY_MAX_BUFFERED_BYTES"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_NOTIFY_MAX_BUFFERED_BYTES: %w", err)
+	}
+	notifyOptions = append(notifyOptions, notify.WithMaxBufferedBytes(maxBufferedBytes))
+
+	pauseBuffer, err := strconv.Atoi(env["ICC_NOTIFY_PAUSE_BUFFER"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_NOTIFY_PAUSE_BUFFER: %w", err)
+	}
+	if pauseBuffer > 0 {
+		notifyOptions = append(notifyOptions, notify.WithPause(pauseBuffer))
+	}
+
+	if path := env["ICC_NOTIFY_SCHEMA_FILE"]; path != "" {
+		schemas, err := notify.LoadSchemas(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("loading ICC_NOTIFY_SCHEMA_FILE: %w", err)
+		}
+		notifyOptions = append(notifyOptions, notify.WithSchemas(schemas))
+	}
+
+	maxMessageBytes, err := strconv.Atoi(env["ICC_NOTIFY_MAX_MESSAGE_BYTES"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_NOTIFY_MAX_MESSAGE_BYTES: %w", err)
+	}
+	if maxMessageBytes > 0 {
+		notifyOptions = append(notifyOptions, notify.WithMaxMessageBytes(maxMessageBytes))
+	}
+
+	maxMessageDepth, err := strconv.Atoi(env["ICC_NOTIFY_MAX_MESSAGE_DEPTH"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_NOTIFY_MAX_MESSAGE_DEPTH: %w", err)
+	}
+	if maxMessageDepth > 0 {
+		notifyOptions = append(notifyOptions, notify.WithMaxMessageDepth(maxMessageDepth))
+	}
+
+	maxListItems, err := strconv.Atoi(env["ICC_NOTIFY_MAX_LIST_ITEMS"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_NOTIFY_MAX_LIST_ITEMS: %w", err)
+	}
+	if maxListItems > 0 {
+		notifyOptions = append(notifyOptions, notify.WithMaxListItems(maxListItems))
+	}
+
+	notifyService := notify.New(ctx, notifyBackend, notifyOptions...)
+	var applauseOptions []applause.Option
+	if env["ICC_APPLAUSE_VIA_NOTIFY"] == "true" {
+		applauseOptions = append(applauseOptions, applause.WithNotify(notifyService))
+	}
+
+	maxApplauseMeetings, err := strconv.Atoi(env["ICC_APPLAUSE_MAX_MEETINGS"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_APPLAUSE_MAX_MEETINGS: %w", err)
+	}
+	applauseOptions = append(applauseOptions, applause.WithMaxMeetings(maxApplauseMeetings))
+
+	if env["ICC_APPLAUSE_MILLISECONDS"] == "true" {
+		applauseOptions = append(applauseOptions, applause.WithMilliseconds())
+	}
+
+	if env["ICC_APPLAUSE_BEST_EFFORT"] == "true" {
+		applauseOptions = append(applauseOptions, applause.WithBestEffort())
+	}
+
+	if env["ICC_APPLAUSE_COUNTER"] == "true" {
+		applauseOptions = append(applauseOptions, applause.WithCounter(backend))
+	}
+
+	leaderboardWindow, err := time.ParseDuration(env["ICC_APPLAUSE_LEADERBOARD_WINDOW"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_APPLAUSE_LEADERBOARD_WINDOW: %w", err)
+	}
+	if leaderboardWindow > 0 {
+		leaderboard, ok := backend.(applause.LeaderboardBackend)
+		if !ok {
+			return nil, nil, fmt.Errorf("ICC_APPLAUSE_LEADERBOARD_WINDOW needs a backend, that can count the applause of users")
+		}
+		applauseOptions = append(applauseOptions, applause.WithLeaderboard(leaderboard, leaderboardWindow))
+	}
+
+	if env["ICC_APPLAUSE_PRESENT_LEVEL"] == "true" {
+		users, ok := backend.(applause.UserBackend)
+		if !ok {
+			return nil, nil, fmt.Errorf("ICC_APPLAUSE_PRESENT_LEVEL needs a backend, that can list the users with applause")
+		}
+		applauseOptions = append(applauseOptions, applause.WithPresentLevel(users))
+	}
+
+	applauseDecay, err := time.ParseDuration(env["ICC_APPLAUSE_DECAY"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_APPLAUSE_DECAY: %w", err)
+	}
+	if applauseDecay > 0 {
+		applauseOptions = append(applauseOptions, applause.WithDecay(applauseDecay))
+	}
+
+	applauseCooldown, err := time.ParseDuration(env["ICC_APPLAUSE_COOLDOWN"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_APPLAUSE_COOLDOWN: %w", err)
+	}
+	if applauseCooldown > 0 {
+		applauseOptions = append(applauseOptions, applause.WithCooldown(applauseCooldown))
+	}
+
+	pruneInterval, err := time.ParseDuration(env["ICC_APPLAUSE_PRUNE_INTERVAL"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_APPLAUSE_PRUNE_INTERVAL: %w", err)
+	}
+	applauseOptions = append(applauseOptions, applause.WithPruneInterval(pruneInterval))
+
+	applauseService := applause.New(backend, ds, ctx.Done(), applauseOptions...)
+	go applauseService.Loop(ctx, errHandler)
+	go applauseService.PruneOldData(ctx, errHandler)
+
+	drainer := new(icchttp.Drainer)
+	registry := new(icchttp.Registry)
+
+	mux := http.NewServeMux()
+	icchttp.HandleHealth(mux)
+	icchttp.HandleReady(mux, drainer)
+	icchttp.HandleDrain(mux, drainer, env["ICC_ADMIN_TOKEN"])
+	icchttp.HandleReloadAuth(mux, reloadAuth, env["ICC_ADMIN_TOKEN"])
+	icchttp.HandleConnections(mux, registry, env["ICC_ADMIN_TOKEN"])
+	icchttp.HandleStats(mux, backend, env["ICC_ADMIN_TOKEN"])
+
+	metricsMaxMeetings, err := strconv.Atoi(env["ICC_METRICS_MAX_MEETINGS"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_METRICS_MAX_MEETINGS: %w", err)
+	}
+	icchttp.HandleMetrics(mux, registry, env["ICC_ADMIN_TOKEN"], metricsMaxMeetings)
+	notify.HandleReceive(mux, notifyService, auth)
+	notify.HandlePublish(mux, notifyService, auth)
+	notify.HandleInbox(mux, notifyService, auth)
+	notify.HandlePoll(mux, notifyService, auth)
+	notify.HandlePause(mux, notifyService, auth)
+	applause.HandleReceive(mux, applauseService, auth)
+	applause.HandleSend(mux, applauseService, auth)
+	applause.HandleCount(mux, applauseService, auth)
+	applause.HandleWS(mux, applauseService, auth, parseOrigins(env["ICC_APPLAUSE_WS_ORIGINS"]))
+	applause.HandleTotal(mux, applauseService, env["ICC_ADMIN_TOKEN"])
+	applause.HandleActive(mux, applauseService, env["ICC_ADMIN_TOKEN"])
+	applause.HandleLeaderboard(mux, applauseService, env["ICC_ADMIN_TOKEN"])
+
+	endpoints := []string{
+		icchttp.Path + "/health",
+		icchttp.Path + "/ready",
+		icchttp.Path + "/metrics",
+		icchttp.Path + "/notify",
+		icchttp.Path + "/notify/publish",
+		icchttp.Path + "/notify/inbox",
+		icchttp.Path + "/notify/poll",
+		icchttp.Path + "/notify/pause",
+		icchttp.Path + "/notify/resume",
+		icchttp.Path + "/applause",
+		icchttp.Path + "/applause/send",
+		icchttp.Path + "/applause/count",
+		icchttp.Path + "/applause/ws",
+		icchttp.Path + "/applause/total",
+		icchttp.Path + "/applause/active",
+		icchttp.Path + "/applause/leaderboard",
+	}
+	if err := icchttp.HandleRoot(mux, env["ICC_ROOT_BEHAVIOR"], endpoints); err != nil {
+		return nil, nil, fmt.Errorf("register root path: %w", err)
+	}
+
+	trustedProxies, err := icchttp.ParseTrustedProxies(env["ICC_TRUSTED_PROXIES"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ICC_TRUSTED_PROXIES: %w", err)
+	}
+
+	connections := new(icchttp.ConnectionCounter)
+
+	streamingPaths := []string{
+		icchttp.Path + "/notify",
+		icchttp.Path + "/notify/poll",
+		icchttp.Path + "/applause",
+		icchttp.Path + "/applause/ws",
+	}
+
+	var handler http.Handler = mux
+	handler = icchttp.APIKeyMiddleware(handler, icchttp.ParseAPIKeys(env["ICC_SEND_API_KEYS"]), icchttp.Path+"/notify/publish")
+	handler = registry.Middleware(handler, streamingPaths...)
+	handler = drainer.Middleware(handler, streamingPaths...)
+	handler = icchttp.ClientIPMiddleware(handler, trustedProxies)
+	handler = connections.Middleware(handler)
+
+	return handler, connections, nil
+}
+
+// buildServer returns the http server. It is not started.
+//
+// If ICC_TLS_CERT and ICC_TLS_KEY are set, the certificate is loaded and the
+// server has a TLSConfig.
+func buildServer(env map[string]string, handler http.Handler) (*http.Server, error) {
+	maxHeaderBytes, err := strconv.Atoi(env["ICC_MAX_HEADER_BYTES"])
+	if err != nil {
+		return nil, fmt.Errorf("parsing ICC_MAX_HEADER_BYTES: %w", err)
+	}
+
+	srv := &http.Server{
+		Addr:           net.JoinHostPort(env["ICC_LISTEN_HOST"], env["ICC_PORT"]),
+		Handler:        handler,
+		MaxHeaderBytes: maxHeaderBytes,
+		ConnContext:    icchttp.ConnContext,
+	}
+
+	certFile, keyFile := env["ICC_TLS_CERT"], env["ICC_TLS_KEY"]
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("ICC_TLS_CERT and ICC_TLS_KEY have to be set together")
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading tls certificate: %w", err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	return srv, nil
+}
+
+// serve starts the server on the listener. With a TLSConfig, it serves HTTPS.
+//
+// Like http.Server.Serve, it always returns an error. After Shutdown or Close,
+// it is http.ErrServerClosed.
+func serve(srv *http.Server, listener net.Listener) error {
+	if srv.TLSConfig != nil {
+		icclog.Info("Listen on %s with TLS", srv.Addr)
+		return srv.ServeTLS(listener, "", "")
+	}
+
+	icclog.Info("Listen on %s", srv.Addr)
+	return srv.Serve(listener)
+}
+
+// listen opens the tcp listener for the server.
+//
+// If the address is already in use, it is retried every interval until retry
+// is over. This helps on a rolling restart, when the old process did not close
+// the port yet. The returned error tells the operator what to do.
+func listen(ctx context.Context, addr string, retry, interval time.Duration) (net.Listener, error) {
+	deadline := time.Now().Add(retry)
+	for {
+		listener, err := net.Listen("tcp", addr)
+		if err == nil {
+			return listener, nil
+		}
+
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, fmt.Errorf("listen on %s: %w", addr, err)
+		}
+
+		if !time.Now().Before(deadline) {
+			icclog.Info("Address %s is already in use", addr)
+			return nil, fmt.Errorf("address %s is already in use. Stop the other process on this port, set ICC_PORT to a free port or set ICC_LISTEN_RETRY to wait for the port: %w", addr, err)
+		}
+
+		icclog.Info("Address %s is already in use. Retry in %s", addr, interval)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for address %s: %w", addr, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
 }
 
 // defaultEnv parses the environment (output from os.Environ()) and sets specific
 // defaut values.
 func defaultEnv(environment []string) map[string]string {
 	env := map[string]string{
-		"ICC_PORT": "9007",
+		"ICC_LISTEN_HOST":      "",
+		"ICC_PORT":             "9007",
+		"ICC_MAX_HEADER_BYTES": "65536",
+		"ICC_LISTEN_RETRY":     "0",
+		"ICC_TLS_CERT":         "",
+		"ICC_TLS_KEY":          "",
 
 		"ICC_REDIS_HOST": "localhost",
 		"ICC_REDIS_PORT": "6379",
 
+		"ICC_REDIS_REPLICA_HOST": "",
+		"ICC_REDIS_REPLICA_PORT": "6379",
+
+		"ICC_REDIS_CONNECT_TIMEOUT": "5s",
+		"ICC_REDIS_READ_TIMEOUT":    "5s",
+		"ICC_REDIS_WRITE_TIMEOUT":   "5s",
+		"ICC_REDIS_CLUSTER":         "false",
+		"ICC_COMPRESS_MESSAGES":     "false",
+		"ICC_COMPRESS_MIN_BYTES":    "0",
+
+		"ICC_REDIS_RECREATE_WRONGTYPE": "false",
+		"ICC_REDIS_POOL_WAIT_TIMEOUT":  "0",
+		"ICC_STREAM_MAX_AGE":           "0",
+
+		"ICC_APPLAUSE_VIA_NOTIFY":       "false",
+		"ICC_APPLAUSE_MAX_MEETINGS":     "0",
+		"ICC_APPLAUSE_MILLISECONDS":     "false",
+		"ICC_APPLAUSE_BEST_EFFORT":      "false",
+		"ICC_APPLAUSE_COUNTER":          "false",
+		"ICC_APPLAUSE_PRESENT_LEVEL":    "false",
+		"ICC_APPLAUSE_DECAY":            "0",
+		"ICC_APPLAUSE_PRUNE_BATCH_SIZE": "0",
+		"ICC_APPLAUSE_PRUNE_INTERVAL":   "5m",
+		"ICC_APPLAUSE_WS_ORIGINS":       "",
+		"ICC_NOTIFY_MAX_CONNECTION_AGE": "0",
+		"ICC_NOTIFY_DEDUP":              "false",
+		"ICC_MAX_SEND_RPS":              "0",
+		"ICC_NOTIFY_PUBLISH_WORKERS":    "0",
+		"ICC_NOTIFY_PUBLISH_QUEUE_SIZE": "1000",
+		"ICC_NOTIFY_POOLED_BUFFER_SIZE": "65536",
+		"ICC_NOTIFY_PUBLISH_ASYNC":      "false",
+		"ICC_NOTIFY_INBOX_SIZE":         "0",
+		"ICC_NOTIFY_INBOX_TTL":          "24h",
+		"ICC_NOTIFY_RETAIN_TTL":         "24h",
+		"ICC_NOTIFY_IDEMPOTENCY_WINDOW": "1m",
+		"ICC_NOTIFY_SCHEMA_FILE":        "",
+		"ICC_NOTIFY_PAUSE_BUFFER":       "0",
+		"ICC_NOTIFY_BUFFER_SIZE":        "0",
+		"ICC_NOTIFY_PERSIST":            "false",
+		"ICC_NOTIFY_PERSIST_MAXLEN":     "100000",
+
+		"ICC_APPLAUSE_LEADERBOARD_WINDOW": "0",
+		"ICC_APPLAUSE_COOLDOWN":           "0",
+
+		"ICC_NOTIFY_PUBLISH_PERMISSIONS": "",
+		"ICC_MAX_MEETING_SEND_RPS":       "0",
+		"ICC_NOTIFY_MESSAGE_ID_FORMAT":   "ulid",
+		"ICC_NOTIFY_MAX_MESSAGE_BYTES":   "0",
+		"ICC_NOTIFY_MAX_MESSAGE_DEPTH":   "0",
+		"ICC_NOTIFY_MAX_LIST_ITEMS":      "100",
+		"ICC_ALLOW_EMPTY_MESSAGE":        "false",
+		"ICC_UTF8_POLICY":                "keep",
+		"ICC_CANONICALIZE_JSON":          "false",
+		"ICC_NOTIFY_MAX_BUFFERED_BYTES":  "0",
+
+		"ICC_TRUSTED_PROXIES": "",
+		"ICC_ADMIN_TOKEN":     "",
+		"ICC_SEND_API_KEYS":   "",
+		"ICC_ROOT_BEHAVIOR":   "info",
+
+		"ICC_WEBHOOK_URL":    "",
+		"ICC_WEBHOOK_SECRET": "",
+
+		"ICC_METRICS_MAX_MEETINGS": "100",
+
 		"DATASTORE_READER_HOST":     "localhost",
 		"DATASTORE_READER_PORT":     "9010",
 		"DATASTORE_READER_PROTOCOL": "http",
+		"ICC_DATASTORE_WAIT":        "false",
 
 		"MESSAGING":        "fake",
 		"MESSAGE_BUS_HOST": "localhost",
 		"MESSAGE_BUS_PORT": "6379",
 		"REDIS_TEST_CONN":  "true",
 
-		"AUTH":          "fake",
-		"AUTH_PROTOCOL": "http",
-		"AUTH_HOST":     "localhost",
-		"AUTH_PORT":     "9004",
+		"AUTH":              "fake",
+		"AUTH_PROTOCOL":     "http",
+		"AUTH_HOST":         "localhost",
+		"AUTH_PORT":         "9004",
+		"ICC_AUTH_REQUIRED": "true",
+
+		"ICC_AUTH_MAX_CONCURRENT": "0",
+		"ICC_AUTH_QUEUE_TIMEOUT":  "1s",
+
+		"ICC_SHUTDOWN_TIMEOUT_SIGINT":  "2s",
+		"ICC_SHUTDOWN_TIMEOUT_SIGTERM": "30s",
+
+		"ICC_FATAL_ERRORS": "",
 
 		"OPENSLIDES_DEVELOPMENT": "false",
 	}
@@ -124,7 +830,12 @@ func defaultEnv(environment []string) map[string]string {
 	return env
 }
 
-func secret(name string, getSecret func(name string) (string, error), dev bool) (string, error) {
+// secret returns the secret with the given name.
+//
+// The secret is read from the environment variable with the upper case name,
+// like `AUTH_TOKEN_KEY`, or from the file in the variable with the suffix
+// `_FILE`. If none of them is set, getSecret is used.
+func secret(name string, env map[string]string, getSecret func(name string) (string, error), dev bool) (string, error) {
 	defaultSecrets := map[string]string{
 		"auth_token_key":  auth.DebugTokenKey,
 		"auth_cookie_key": auth.DebugCookieKey,
@@ -135,24 +846,153 @@ func secret(name string, getSecret func(name string) (string, error), dev bool)
 		return "", fmt.Errorf("unknown secret %s", name)
 	}
 
-	s, err := getSecret(name)
+	s, ok, err := envOrFile(env, strings.ToUpper(name))
+	if err != nil {
+		return "", fmt.Errorf("reading secret %s: %w", name, err)
+	}
+	if ok {
+		return s, nil
+	}
+
+	s, err = getSecret(name)
 	if err != nil {
 		if !dev {
-			return "", fmt.Errorf("can not read secret %s: %w", s, err)
+			return "", fmt.Errorf("can not read secret %s: %w", name, err)
 		}
 		s = d
 	}
 	return s, nil
 }
 
-func buildErrHandler() func(err error) {
+// secretFileEnv are the environment variables, that can also be read from a
+// file. See envOrFile.
+var secretFileEnv = []string{
+	"ICC_ADMIN_TOKEN",
+	"ICC_SEND_API_KEYS",
+	"ICC_WEBHOOK_SECRET",
+}
+
+// readSecretFiles sets the variables of secretFileEnv, that are read from a
+// file.
+func readSecretFiles(env map[string]string) error {
+	for _, name := range secretFileEnv {
+		value, _, err := envOrFile(env, name)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", name, err)
+		}
+		env[name] = value
+	}
+	return nil
+}
+
+// envOrFile returns the value of the environment variable with the given name.
+// If it is empty, the content of the file in the variable with the suffix
+// `_FILE` is returned without a trailing newline.
+//
+// The second return value is false, if none of them is set.
+func envOrFile(env map[string]string, name string) (string, bool, error) {
+	if value := env[name]; value != "" {
+		return value, true, nil
+	}
+
+	path := env[name+"_FILE"]
+	if path == "" {
+		return "", false, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("reading %s_FILE: %w", name, err)
+	}
+	return strings.TrimSuffix(string(content), "\n"), true, nil
+}
+
+// Classes of errors that can be used in ICC_FATAL_ERRORS.
+const (
+	// errorClassRedisAuth is an error from redis, because the service could not
+	// authenticate.
+	errorClassRedisAuth = "redis-auth"
+
+	// errorClassConnection is a network error.
+	errorClassConnection = "connection"
+)
+
+// parseFatalErrors parses a comma separated list of error classes.
+func parseFatalErrors(value string) (map[string]bool, error) {
+	classes := make(map[string]bool)
+	for _, class := range strings.Split(value, ",") {
+		class = strings.TrimSpace(class)
+		switch class {
+		case "":
+			continue
+		case errorClassRedisAuth, errorClassConnection:
+			classes[class] = true
+		default:
+			return nil, fmt.Errorf("unknown error class `%s`", class)
+		}
+	}
+	return classes, nil
+}
+
+// errorClass returns the class of an error or an empty string, if the error
+// does not belong to a class.
+func errorClass(err error) string {
+	if redis.IsAuthError(err) {
+		return errorClassRedisAuth
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return errorClassConnection
+	}
+	return ""
+}
+
+// nonFatalError is an error, that never stops the service, also if its class
+// is in ICC_FATAL_ERRORS.
+type nonFatalError struct {
+	err error
+}
+
+func (e nonFatalError) Error() string {
+	return e.err.Error()
+}
+
+func (e nonFatalError) Unwrap() error {
+	return e.err
+}
+
+// nonFatal returns an error handler, that marks all errors as nonFatalError
+// and passes them to errHandler. It is used for the webhook, since a failing
+// webhook must not affect the service.
+func nonFatal(errHandler func(error)) func(error) {
+	return func(err error) {
+		errHandler(nonFatalError{err})
+	}
+}
+
+// buildErrHandler returns the handler for errors that happen in the
+// background.
+//
+// The errors are logged. If the class of an error is in fatalClasses, fatal is
+// called with the error. A nonFatalError is only logged.
+func buildErrHandler(fatalClasses map[string]bool, fatal func(error)) func(err error) {
 	return func(err error) {
 		var closing interface {
 			Closing()
 		}
-		if !errors.As(err, &closing) {
-			icclog.Info("Error: %v", err)
+		if errors.As(err, &closing) {
+			return
+		}
+
+		var nonFatalErr nonFatalError
+		if class := errorClass(err); class != "" && fatalClasses[class] && !errors.As(err, &nonFatalErr) {
+			icclog.Info("Fatal error (%s): %v", class, err)
+			fatal(err)
+			return
 		}
+
+		icclog.Info("Error: %v", err)
 	}
 }
 
@@ -161,19 +1001,19 @@ func buildAuth(
 	ctx context.Context,
 	env map[string]string,
 	getSecret func(name string) (string, error),
-	receiver auth.LogoutEventer,
+	logouts *logoutBroadcast,
 	errHandler func(error),
 ) (icchttp.Authenticater, error) {
 	method := env["AUTH"]
 	switch method {
 	case "ticket":
 		icclog.Info("Auth Method: ticket")
-		tokenKey, err := secret("auth_token_key", getSecret, env["OPENSLIDES_DEVELOPMENT"] != "false")
+		tokenKey, err := secret("auth_token_key", env, getSecret, env["OPENSLIDES_DEVELOPMENT"] != "false")
 		if err != nil {
 			return nil, fmt.Errorf("getting token secret: %w", err)
 		}
 
-		cookieKey, err := secret("auth_cookie_key", getSecret, env["OPENSLIDES_DEVELOPMENT"] != "false")
+		cookieKey, err := secret("auth_cookie_key", env, getSecret, env["OPENSLIDES_DEVELOPMENT"] != "false")
 		if err != nil {
 			return nil, fmt.Errorf("getting cookie secret: %w", err)
 		}
@@ -194,7 +1034,7 @@ func buildAuth(
 			return nil, fmt.Errorf("creating auth connection: %w", err)
 		}
 
-		go a.ListenOnLogouts(ctx, receiver, errHandler)
+		go logouts.feed(ctx, a, errHandler)
 		go a.PruneOldData(ctx)
 		return a, nil
 
@@ -207,6 +1047,134 @@ func buildAuth(
 	}
 }
 
+// parsePublishPermissions parses a comma separated list of `name=permission`
+// pairs.
+func parsePublishPermissions(value string) (map[string]string, error) {
+	perms := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid pair `%s`, expected `name=permission`", pair)
+		}
+		perms[parts[0]] = parts[1]
+	}
+	return perms, nil
+}
+
+// parseOrigins parses a comma separated list of origins.
+func parseOrigins(value string) []string {
+	var origins []string
+	for _, origin := range strings.Split(value, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		origins = append(origins, origin)
+	}
+	return origins
+}
+
+// authRetryInterval is the duration between two tries to build the auth
+// service, if it was not available at startup.
+const authRetryInterval = 5 * time.Second
+
+// startAuth builds the auth service.
+//
+// If ICC_AUTH_REQUIRED is false, the service also starts, when the auth service
+// can not be build. In this case, authenticated requests get the status 503 and
+// the auth service is build again in the background.
+func startAuth(
+	ctx context.Context,
+	env map[string]string,
+	build func(ctx context.Context) (icchttp.Authenticater, error),
+	errHandler func(error),
+) (*icchttp.ReloadAuth, error) {
+	if env["ICC_AUTH_REQUIRED"] == "false" {
+		return icchttp.StartReloadAuth(ctx, build, authRetryInterval, errHandler), nil
+	}
+
+	return icchttp.NewReloadAuth(ctx, build)
+}
+
+// limitAuth limits the concurrent calls to the auth service with
+// ICC_AUTH_MAX_CONCURRENT. The limit wraps the ReloadAuth, so it is kept on a
+// reload.
+func limitAuth(env map[string]string, auth *icchttp.ReloadAuth) (icchttp.Authenticater, error) {
+	authLimit, err := strconv.Atoi(env["ICC_AUTH_MAX_CONCURRENT"])
+	if err != nil {
+		return nil, fmt.Errorf("parsing ICC_AUTH_MAX_CONCURRENT: %w", err)
+	}
+
+	if authLimit <= 0 {
+		return auth, nil
+	}
+
+	authQueueTimeout, err := time.ParseDuration(env["ICC_AUTH_QUEUE_TIMEOUT"])
+	if err != nil {
+		return nil, fmt.Errorf("parsing ICC_AUTH_QUEUE_TIMEOUT: %w", err)
+	}
+
+	return icchttp.NewLimitAuth(auth, authLimit, authQueueTimeout), nil
+}
+
+type shutdownTimeoutKey struct{}
+
+// WithShutdownTimeout returns a context for Run, that carries the time to drain
+// the active connections after the context is done. The function is called,
+// when the shutdown starts, so the caller can choose the timeout, when it
+// cancels the context.
+func WithShutdownTimeout(ctx context.Context, timeout func() time.Duration) context.Context {
+	return context.WithValue(ctx, shutdownTimeoutKey{}, timeout)
+}
+
+// ShutdownTimeouts returns the shutdown timeout for SIGINT and SIGTERM from
+// the environment.
+func ShutdownTimeouts(environment []string) (map[os.Signal]time.Duration, error) {
+	return parseShutdownTimeouts(defaultEnv(environment))
+}
+
+// parseShutdownTimeouts returns the shutdown timeout for SIGINT and SIGTERM.
+func parseShutdownTimeouts(env map[string]string) (map[os.Signal]time.Duration, error) {
+	timeouts := make(map[os.Signal]time.Duration, 2)
+	for sig, name := range map[os.Signal]string{
+		syscall.SIGINT:  "ICC_SHUTDOWN_TIMEOUT_SIGINT",
+		syscall.SIGTERM: "ICC_SHUTDOWN_TIMEOUT_SIGTERM",
+	} {
+		d, err := time.ParseDuration(env[name])
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", name, err)
+		}
+		timeouts[sig] = d
+	}
+	return timeouts, nil
+}
+
+// reloadOnHangup reloads the auth service each time the process receives
+// SIGHUP.
+func reloadOnHangup(ctx context.Context, auth *icchttp.ReloadAuth, errHandler func(error)) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			if err := auth.Reload(); err != nil {
+				errHandler(fmt.Errorf("reloading auth: %w", err))
+				continue
+			}
+			icclog.Info("Auth reloaded")
+		}
+	}
+}
+
 // authStub implements the authenticater interface. It allways returs the given
 // user id.
 type authStub int
@@ -221,43 +1189,50 @@ func (a authStub) FromContext(ctx context.Context) int {
 	return int(a)
 }
 
-type messageBus interface {
-	auth.LogoutEventer
-	datastore.Updater
+// buildDatastore configures the datastore service.
+func buildDatastore(env map[string]string, updater datastore.Updater) (*datastore.Datastore, error) {
+	source := datastore.NewSourceDatastore(datastoreURL(env), updater)
+	return datastore.New(source, nil), nil
 }
 
-func buildMessageBus(env map[string]string) (messageBus, error) {
-	serviceName := env["MESSAGING"]
-	icclog.Info("Messaging Service: %s", serviceName)
+// datastoreURL returns the url of the datastore reader.
+func datastoreURL(env map[string]string) string {
+	protocol := env["DATASTORE_READER_PROTOCOL"]
+	host := env["DATASTORE_READER_HOST"]
+	port := env["DATASTORE_READER_PORT"]
+	return protocol + "://" + host + ":" + port
+}
 
-	var conn messageBusRedis.Connection
-	switch serviceName {
-	case "redis":
-		redisAddress := env["MESSAGE_BUS_HOST"] + ":" + env["MESSAGE_BUS_PORT"]
-		c := messageBusRedis.NewConnection(redisAddress)
-		if env["REDIS_TEST_CONN"] == "true" {
-			if err := c.TestConn(); err != nil {
-				return nil, fmt.Errorf("connect to redis: %w", err)
-			}
+// waitForDatastore blocks until the datastore reader at url answers a http
+// request. Each status code counts as an answer, only the connection has to
+// work.
+//
+// The first retry is after interval. The interval is doubled after each try up
+// to maxInterval.
+func waitForDatastore(ctx context.Context, url string, interval, maxInterval time.Duration) error {
+	client := http.Client{Timeout: maxInterval}
+	for {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return fmt.Errorf("creating request to datastore: %w", err)
 		}
 
-		conn = c
-
-	case "fake":
-		conn = messageBusRedis.BlockingConn{}
-	default:
-		return nil, fmt.Errorf("unknown messagin service `%s`", serviceName)
-	}
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			return nil
+		}
 
-	return &messageBusRedis.Redis{Conn: conn}, nil
-}
+		icclog.Info("Datastore at %s is not reachable: %v. Retry in %s", url, err, interval)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for datastore at %s: %w", url, ctx.Err())
+		case <-time.After(interval):
+		}
 
-// buildDatastore configures the datastore service.
-func buildDatastore(env map[string]string, updater datastore.Updater) (*datastore.Datastore, error) {
-	protocol := env["DATASTORE_READER_PROTOCOL"]
-	host := env["DATASTORE_READER_HOST"]
-	port := env["DATASTORE_READER_PORT"]
-	url := protocol + "://" + host + ":" + port
-	source := datastore.NewSourceDatastore(url, updater)
-	return datastore.New(source, nil), nil
+		interval *= 2
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+	}
 }
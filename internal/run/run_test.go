@@ -0,0 +1,643 @@
+package run
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/auth"
+	"github.com/OpenSlides/openslides-icc-service/internal/icchttp"
+	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+func TestBuildServerMaxHeaderBytes(t *testing.T) {
+	env := defaultEnv([]string{"ICC_MAX_HEADER_BYTES=1024"})
+	srv, err := buildServer(env, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if err != nil {
+		t.Fatalf("buildServer: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	url := "http://" + listener.Addr().String()
+
+	for _, tt := range []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"small header", "small", 200},
+		{"oversized header", strings.Repeat("x", 16<<10), 431},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", url, nil)
+			if err != nil {
+				t.Fatalf("creating request: %v", err)
+			}
+			req.Header.Set("X-Big", tt.header)
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("sending request: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %s, expected %d", resp.Status, tt.status)
+			}
+		})
+	}
+}
+
+func TestBuildServerListenHost(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	t.Run("all interfaces", func(t *testing.T) {
+		srv, err := buildServer(defaultEnv(nil), handler)
+		if err != nil {
+			t.Fatalf("buildServer: %v", err)
+		}
+
+		if srv.Addr != ":9007" {
+			t.Errorf("got address %s, expected :9007", srv.Addr)
+		}
+	})
+
+	t.Run("configured host", func(t *testing.T) {
+		env := defaultEnv([]string{"ICC_LISTEN_HOST=127.0.0.1", "ICC_PORT=0"})
+		srv, err := buildServer(env, handler)
+		if err != nil {
+			t.Fatalf("buildServer: %v", err)
+		}
+
+		listener, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			t.Fatalf("listen on %s: %v", srv.Addr, err)
+		}
+		defer listener.Close()
+
+		addr := listener.Addr().(*net.TCPAddr)
+		if !addr.IP.Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("server listens on %s, expected 127.0.0.1", addr.IP)
+		}
+	})
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile, certPEM := selfSignedCert(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	t.Run("only cert", func(t *testing.T) {
+		env := defaultEnv([]string{"ICC_TLS_CERT=" + certFile})
+		if _, err := buildServer(env, handler); err == nil {
+			t.Errorf("buildServer did not return an error")
+		}
+	})
+
+	env := defaultEnv([]string{"ICC_TLS_CERT=" + certFile, "ICC_TLS_KEY=" + keyFile})
+	srv, err := buildServer(env, handler)
+	if err != nil {
+		t.Fatalf("buildServer: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(srv, listener)
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	resp, err := client.Get("https://" + listener.Addr().String())
+	if err != nil {
+		t.Fatalf("sending request: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 || resp.TLS == nil {
+		t.Errorf("got status %s with tls %v, expected 200 over tls", resp.Status, resp.TLS != nil)
+	}
+
+	client.CloseIdleConnections()
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("serve returned `%v`, expected http.ErrServerClosed", err)
+	}
+}
+
+// selfSignedCert writes a certificate for 127.0.0.1 and its key to files.
+func selfSignedCert(t *testing.T) (certFile, keyFile string, certPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "icc test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("encoding key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("writing cert: %v", err)
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("writing key: %v", err)
+	}
+	return certFile, keyFile, certPEM
+}
+
+func TestListenAddressInUse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first, err := listen(ctx, "127.0.0.1:0", 0, time.Millisecond)
+	if err != nil {
+		t.Fatalf("first listen: %v", err)
+	}
+	addr := first.Addr().String()
+
+	t.Run("in use", func(t *testing.T) {
+		_, err := listen(ctx, addr, 0, time.Millisecond)
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			t.Fatalf("got error `%v`, expected EADDRINUSE", err)
+		}
+
+		if !strings.Contains(err.Error(), "already in use") {
+			t.Errorf("got error `%v`, expected a message that the address is in use", err)
+		}
+	})
+
+	t.Run("retry until free", func(t *testing.T) {
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			first.Close()
+		}()
+
+		second, err := listen(ctx, addr, time.Second, 5*time.Millisecond)
+		if err != nil {
+			t.Fatalf("listen with retry: %v", err)
+		}
+		second.Close()
+	})
+}
+
+func TestWaitForDatastore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Reserve a free port for the datastore, that is started later.
+	reserved, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := reserved.Addr().String()
+	reserved.Close()
+
+	t.Run("not reachable", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+
+		err := waitForDatastore(ctx, "http://"+addr, time.Millisecond, 5*time.Millisecond)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got error `%v`, expected a deadline error", err)
+		}
+	})
+
+	t.Run("available after delay", func(t *testing.T) {
+		srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+		defer srv.Close()
+
+		go func() {
+			time.Sleep(30 * time.Millisecond)
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				t.Errorf("listen for datastore: %v", err)
+				return
+			}
+			srv.Listener = listener
+			srv.Start()
+		}()
+
+		start := time.Now()
+		if err := waitForDatastore(ctx, "http://"+addr, 5*time.Millisecond, 10*time.Millisecond); err != nil {
+			t.Fatalf("wait for datastore: %v", err)
+		}
+
+		if time.Since(start) < 30*time.Millisecond {
+			t.Errorf("returned after %s, before the datastore was started", time.Since(start))
+		}
+	})
+}
+
+func TestStartAuthWithoutSecrets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	noSecret := func(name string) (string, error) {
+		return "", errors.New("secret not mounted")
+	}
+
+	for _, tt := range []struct {
+		name      string
+		required  string
+		expectErr bool
+	}{
+		{"required", "true", true},
+		{"not required", "false", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			env := defaultEnv([]string{"AUTH=ticket", "ICC_AUTH_REQUIRED=" + tt.required})
+			a, err := startAuth(ctx, env, func(authCtx context.Context) (icchttp.Authenticater, error) {
+				return buildAuth(authCtx, env, noSecret, nil, func(error) {})
+			}, func(error) {})
+
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("startAuth did not return an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("startAuth: %v", err)
+			}
+
+			resp := httptest.NewRecorder()
+			icchttp.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), a).
+				ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+
+			if resp.Code != 503 {
+				t.Errorf("got status %d, expected 503", resp.Code)
+			}
+		})
+	}
+}
+
+func TestSecretFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/token_key"
+	if err := os.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("writing secret file: %v", err)
+	}
+
+	mounted := func(name string) (string, error) {
+		return "from-secret", nil
+	}
+
+	for _, tt := range []struct {
+		name   string
+		env    []string
+		expect string
+	}{
+		{"mounted secret", nil, "from-secret"},
+		{"file", []string{"AUTH_TOKEN_KEY_FILE=" + path}, "from-file"},
+		{"inline value", []string{"AUTH_TOKEN_KEY=inline"}, "inline"},
+		{"inline value before file", []string{"AUTH_TOKEN_KEY=inline", "AUTH_TOKEN_KEY_FILE=" + path}, "inline"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := secret("auth_token_key", defaultEnv(tt.env), mounted, false)
+			if err != nil {
+				t.Fatalf("secret: %v", err)
+			}
+
+			if got != tt.expect {
+				t.Errorf("got secret %q, expected %q", got, tt.expect)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		env := defaultEnv([]string{"AUTH_TOKEN_KEY_FILE=" + dir + "/missing"})
+		if _, err := secret("auth_token_key", env, mounted, true); err == nil {
+			t.Errorf("secret with missing file did not return an error")
+		}
+	})
+
+	t.Run("env variables", func(t *testing.T) {
+		env := defaultEnv([]string{"ICC_ADMIN_TOKEN_FILE=" + path, "ICC_WEBHOOK_SECRET=inline"})
+		if err := readSecretFiles(env); err != nil {
+			t.Fatalf("readSecretFiles: %v", err)
+		}
+
+		if env["ICC_ADMIN_TOKEN"] != "from-file" || env["ICC_WEBHOOK_SECRET"] != "inline" {
+			t.Errorf("got admin token %q and webhook secret %q, expected from-file and inline", env["ICC_ADMIN_TOKEN"], env["ICC_WEBHOOK_SECRET"])
+		}
+	})
+}
+
+func TestValidateEnv(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		environment := []string{"ICC_PORT=0", "AUTH_TOKEN_KEY_FILE=/run/secrets/key", "HOME=/root"}
+		warnings, err := validateEnv(environment, defaultEnv(environment))
+		if err != nil {
+			t.Errorf("validateEnv returned error: %v", err)
+		}
+
+		if len(warnings) != 0 {
+			t.Errorf("got warnings %v, expected none", warnings)
+		}
+	})
+
+	t.Run("unknown keys", func(t *testing.T) {
+		environment := []string{"ICC_PROT=9007", "DATASTORE_READER_HOTS=x", "AUTH_PORTT=1", "OTHER_VAR=1"}
+		warnings, err := validateEnv(environment, defaultEnv(environment))
+		if err != nil {
+			t.Errorf("validateEnv returned error: %v", err)
+		}
+
+		expect := []string{
+			"unknown environment variable AUTH_PORTT",
+			"unknown environment variable DATASTORE_READER_HOTS",
+			"unknown environment variable ICC_PROT",
+		}
+		if !reflect.DeepEqual(warnings, expect) {
+			t.Errorf("got warnings %v, expected %v", warnings, expect)
+		}
+	})
+
+	for _, tt := range []struct {
+		name   string
+		env    string
+		expect string
+	}{
+		{"port", "ICC_PORT=nine", "ICC_PORT has to be a port number, not `nine`"},
+		{"port out of range", "AUTH_PORT=70000", "AUTH_PORT has to be a port number, not `70000`"},
+		{"duration", "ICC_NOTIFY_INBOX_TTL=24", "ICC_NOTIFY_INBOX_TTL has to be a duration like `5s`, not `24`"},
+		{"integer", "ICC_NOTIFY_INBOX_SIZE=ten", "ICC_NOTIFY_INBOX_SIZE has to be an integer, not `ten`"},
+		{"number", "ICC_MAX_SEND_RPS=fast", "ICC_MAX_SEND_RPS has to be a number, not `fast`"},
+		{"boolean", "ICC_NOTIFY_PERSIST=1", "ICC_NOTIFY_PERSIST has to be `true` or `false`, not `1`"},
+	} {
+		t.Run("invalid "+tt.name, func(t *testing.T) {
+			environment := []string{tt.env}
+			_, err := validateEnv(environment, defaultEnv(environment))
+			if err == nil {
+				t.Fatalf("validateEnv did not return an error")
+			}
+
+			if err.Error() != tt.expect {
+				t.Errorf("got error `%v`, expected `%s`", err, tt.expect)
+			}
+		})
+	}
+}
+
+func TestParsePublishPermissions(t *testing.T) {
+	perms, err := parsePublishPermissions("system=meeting.can_manage_settings, chat=chat.can_manage")
+	if err != nil {
+		t.Fatalf("parsePublishPermissions: %v", err)
+	}
+
+	if len(perms) != 2 || perms["system"] != "meeting.can_manage_settings" || perms["chat"] != "chat.can_manage" {
+		t.Errorf("got %v, expected two permissions", perms)
+	}
+
+	if _, err := parsePublishPermissions("system"); err == nil {
+		t.Errorf("parsePublishPermissions without permission did not return an error")
+	}
+}
+
+func TestErrHandler(t *testing.T) {
+	authErr := fmt.Errorf("fetching applause: %w", redigo.Error("NOAUTH Authentication required."))
+	connErr := fmt.Errorf("fetching applause: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")})
+
+	for _, tt := range []struct {
+		name        string
+		fatalErrors string
+		err         error
+		expectFatal bool
+	}{
+		{"redis auth fatal", "redis-auth", authErr, true},
+		{"redis auth not fatal", "", authErr, false},
+		{"connection fatal", "redis-auth, connection", connErr, true},
+		{"connection not fatal", "redis-auth", connErr, false},
+		{"unclassified", "redis-auth,connection", errors.New("some error"), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			classes, err := parseFatalErrors(tt.fatalErrors)
+			if err != nil {
+				t.Fatalf("parseFatalErrors: %v", err)
+			}
+
+			var fatalErr error
+			buildErrHandler(classes, func(err error) { fatalErr = err })(tt.err)
+
+			if got := fatalErr != nil; got != tt.expectFatal {
+				t.Errorf("fatal was called: %t, expected %t", got, tt.expectFatal)
+			}
+		})
+	}
+
+	t.Run("webhook connection", func(t *testing.T) {
+		classes, err := parseFatalErrors("connection")
+		if err != nil {
+			t.Fatalf("parseFatalErrors: %v", err)
+		}
+
+		// The http client returns a *url.Error, that implements net.Error.
+		webhookErr := fmt.Errorf("sending message to webhook: %w", &url.Error{Op: "Post", URL: "http://webhook", Err: connErr})
+
+		var fatalErr error
+		nonFatal(buildErrHandler(classes, func(err error) { fatalErr = err }))(webhookErr)
+
+		if fatalErr != nil {
+			t.Errorf("fatal was called with the webhook error `%v`", fatalErr)
+		}
+	})
+
+	if _, err := parseFatalErrors("unknown"); err == nil {
+		t.Errorf("parseFatalErrors with unknown class did not return an error")
+	}
+}
+
+// blockingEventer is a LogoutEventer without logout events.
+type blockingEventer struct{}
+
+func (blockingEventer) LogoutEvent(ctx context.Context) ([]string, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestLogoutFeedStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logouts := newLogoutBroadcast(ctx, blockingEventer{}, func(error) {})
+
+	eventerCtx, eventerCancel := context.WithCancel(ctx)
+	eventerCancel()
+	if _, err := logouts.eventer().LogoutEvent(eventerCtx); !errors.Is(err, context.Canceled) {
+		t.Errorf("LogoutEvent with a done context returned `%v`, expected context.Canceled", err)
+	}
+
+	a, err := auth.New("http://localhost:0", ctx.Done(), []byte(auth.DebugTokenKey), []byte(auth.DebugCookieKey))
+	if err != nil {
+		t.Fatalf("auth.New: %v", err)
+	}
+
+	authCtx, authCancel := context.WithCancel(ctx)
+	reported := make(chan error, 1)
+	go logouts.feed(authCtx, a, func(err error) {
+		select {
+		case reported <- err:
+		default:
+		}
+	})
+	authCancel()
+
+	select {
+	case err := <-reported:
+		t.Errorf("feed reported `%v` after the auth context was done", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestShutdownTimeouts(t *testing.T) {
+	timeouts, err := ShutdownTimeouts([]string{"ICC_SHUTDOWN_TIMEOUT_SIGINT=1s"})
+	if err != nil {
+		t.Fatalf("ShutdownTimeouts: %v", err)
+	}
+
+	if got := timeouts[syscall.SIGINT]; got != time.Second {
+		t.Errorf("got SIGINT timeout %s, expected 1s", got)
+	}
+
+	if got := timeouts[syscall.SIGTERM]; got != 30*time.Second {
+		t.Errorf("got default SIGTERM timeout %s, expected 30s", got)
+	}
+
+	if _, err := parseShutdownTimeouts(defaultEnv([]string{"ICC_SHUTDOWN_TIMEOUT_SIGINT=soon"})); err == nil {
+		t.Errorf("parseShutdownTimeouts with invalid duration did not return an error")
+	}
+}
+
+type customMessageBus struct {
+	MessageBus
+}
+
+func TestRegisterMessageBus(t *testing.T) {
+	var gotEnv map[string]string
+	RegisterMessageBus("test-custom", func(env map[string]string) (MessageBus, error) {
+		gotEnv = env
+		return customMessageBus{}, nil
+	})
+
+	env := defaultEnv([]string{"MESSAGING=test-custom"})
+	bus, err := buildMessageBus(env)
+	if err != nil {
+		t.Fatalf("buildMessageBus: %v", err)
+	}
+
+	if _, ok := bus.(customMessageBus); !ok {
+		t.Errorf("got message bus %T, expected the registered one", bus)
+	}
+
+	if gotEnv["MESSAGING"] != "test-custom" {
+		t.Errorf("factory got MESSAGING=%s, expected test-custom", gotEnv["MESSAGING"])
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := buildMessageBus(defaultEnv([]string{"MESSAGING=unknown"}))
+		if err == nil || !strings.Contains(err.Error(), "test-custom") {
+			t.Errorf("got error `%v`, expected it to list the registered buses", err)
+		}
+	})
+
+	t.Run("register twice", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("second registration did not panic")
+			}
+		}()
+
+		RegisterMessageBus("test-custom", func(env map[string]string) (MessageBus, error) {
+			return nil, nil
+		})
+	})
+}
+
+func TestFakeMessageBusWarning(t *testing.T) {
+	var logs bytes.Buffer
+	icclog.SetInfoLogger(log.New(&logs, "", 0))
+	defer icclog.SetInfoLogger(log.Default())
+
+	for _, tt := range []struct {
+		name        string
+		development string
+		expectWarn  bool
+	}{
+		{"production", "false", true},
+		{"development", "true", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+
+			env := defaultEnv([]string{"MESSAGING=fake", "OPENSLIDES_DEVELOPMENT=" + tt.development})
+			if _, err := buildMessageBus(env); err != nil {
+				t.Fatalf("buildMessageBus: %v", err)
+			}
+
+			if got := strings.Contains(logs.String(), "Warning: MESSAGING=fake"); got != tt.expectWarn {
+				t.Errorf("got log `%s`, expected a warning: %t", logs.String(), tt.expectWarn)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+// Package webhook forwards notify messages to an external http server.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/icclog"
+	"github.com/OpenSlides/openslides-icc-service/internal/notify"
+)
+
+const (
+	// SignatureHeader is the name of the http header that contains the
+	// signature of the message.
+	SignatureHeader = "X-ICC-Signature"
+
+	queueSize = 1000
+)
+
+// Webhook sends messages to an url.
+//
+// Has to be created with webhook.New().
+type Webhook struct {
+	url    string
+	secret []byte
+	client *http.Client
+	queue  chan []byte
+
+	maxAttempts int
+	backoff     time.Duration
+}
+
+// Option is an optional argument for webhook.New().
+type Option func(*Webhook)
+
+// WithRetry sets how often a message is sent and how long to wait before the
+// first retry. The wait time is doubled on each retry.
+func WithRetry(maxAttempts int, backoff time.Duration) Option {
+	return func(w *Webhook) {
+		w.maxAttempts = maxAttempts
+		w.backoff = backoff
+	}
+}
+
+// New initializes a webhook.
+//
+// Each message is signed with the secret. The signature is sent in the header
+// X-ICC-Signature as `sha256=HEX_HMAC`.
+func New(url string, secret []byte, options ...Option) *Webhook {
+	w := Webhook{
+		url:         url,
+		secret:      secret,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan []byte, queueSize),
+		maxAttempts: 5,
+		backoff:     500 * time.Millisecond,
+	}
+
+	for _, o := range options {
+		o(&w)
+	}
+
+	return &w
+}
+
+// Send queues a message to be sent to the webhook.
+//
+// It does not block. If the queue is full, the message is dropped.
+func (w *Webhook) Send(message []byte) {
+	select {
+	case w.queue <- message:
+	default:
+		icclog.Info("Webhook: queue is full. Dropping message")
+	}
+}
+
+// Loop sends the queued messages to the webhook until the context is done.
+func (w *Webhook) Loop(ctx context.Context, errHandler func(error)) {
+	if errHandler == nil {
+		errHandler = func(error) {}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case message := <-w.queue:
+			if err := w.deliver(ctx, message); err != nil && ctx.Err() == nil {
+				errHandler(fmt.Errorf("sending message to webhook: %w", err))
+			}
+		}
+	}
+}
+
+// deliver sends one message. It retries on network errors and on 5xx
+// responses.
+func (w *Webhook) deliver(ctx context.Context, message []byte) error {
+	backoff := w.backoff
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		retry, err = w.post(ctx, message)
+		if err == nil || !retry || attempt >= w.maxAttempts {
+			return err
+		}
+
+		icclog.Debug("Webhook: attempt %d failed: %v", attempt, err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// post sends the message one time. It returns true, if the request should be
+// retried.
+func (w *Webhook) post(ctx context.Context, message []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", w.url, bytes.NewReader(message))
+	if err != nil {
+		return false, fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(w.secret, message))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("sending request: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return true, fmt.Errorf("webhook returned status %s", resp.Status)
+	}
+
+	if resp.StatusCode >= 400 {
+		return false, fmt.Errorf("webhook returned status %s", resp.Status)
+	}
+
+	return false, nil
+}
+
+// Sign returns the signature of a message in the format of the
+// X-ICC-Signature header.
+func Sign(secret, message []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(message)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Wrap returns a notify backend that sends each published message to the
+// webhook after it was saved in b. Ephemeral messages are not sent, since
+// NotifyPublishEphemeral is not wrapped.
+func (w *Webhook) Wrap(b notify.Backend) notify.Backend {
+	return backend{Backend: b, webhook: w}
+}
+
+type backend struct {
+	notify.Backend
+	webhook *Webhook
+}
+
+func (b backend) NotifyPublish(message []byte) error {
+	if err := b.Backend.NotifyPublish(message); err != nil {
+		return err
+	}
+
+	b.webhook.Send(message)
+	return nil
+}
@@ -0,0 +1,159 @@
+package webhook_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-icc-service/internal/webhook"
+)
+
+type notifyBackendStub struct {
+	published [][]byte
+}
+
+func (b *notifyBackendStub) NotifyPublish(message []byte) error {
+	b.published = append(b.published, message)
+	return nil
+}
+
+func (b *notifyBackendStub) NotifyReceive(ctx context.Context) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (b *notifyBackendStub) NotifyPublishEphemeral([]byte) error {
+	return nil
+}
+
+func (b *notifyBackendStub) NotifyReceiveEphemeral(ctx context.Context) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (b *notifyBackendStub) NotifyRetain(int, string, []byte, time.Duration) error {
+	return nil
+}
+
+func (b *notifyBackendStub) NotifyUnretain(int, string) error {
+	return nil
+}
+
+func (b *notifyBackendStub) NotifyRetained(int) ([][]byte, error) {
+	return nil, nil
+}
+
+type webhookRequest struct {
+	body      string
+	signature string
+}
+
+// webhookServer starts a http server that returns the given status codes. After
+// the last status, it returns 200.
+func webhookServer(statusCodes ...int) (*httptest.Server, <-chan webhookRequest) {
+	received := make(chan webhookRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- webhookRequest{string(body), r.Header.Get(webhook.SignatureHeader)}
+
+		if len(statusCodes) > 0 {
+			w.WriteHeader(statusCodes[0])
+			statusCodes = statusCodes[1:]
+		}
+	}))
+	return srv, received
+}
+
+func receive(t *testing.T, received <-chan webhookRequest) webhookRequest {
+	t.Helper()
+
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+
+	select {
+	case r := <-received:
+		return r
+	case <-timer.C:
+		t.Fatalf("webhook did not receive a message")
+		return webhookRequest{}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv, received := webhookServer()
+	defer srv.Close()
+
+	wh := webhook.New(srv.URL, []byte("secret"))
+	go wh.Loop(ctx, func(err error) { t.Errorf("Loop error: %v", err) })
+
+	notifyBackend := new(notifyBackendStub)
+	if err := wh.Wrap(notifyBackend).NotifyPublish([]byte(`{"name":"message"}`)); err != nil {
+		t.Fatalf("NotifyPublish: %v", err)
+	}
+
+	if len(notifyBackend.published) != 1 {
+		t.Errorf("wrapped backend got %d messages, expected 1", len(notifyBackend.published))
+	}
+
+	got := receive(t, received)
+
+	if got.body != `{"name":"message"}` {
+		t.Errorf("webhook got body %s", got.body)
+	}
+
+	if expect := webhook.Sign([]byte("secret"), []byte(`{"name":"message"}`)); got.signature != expect {
+		t.Errorf("webhook got signature %s, expected %s", got.signature, expect)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv, received := webhookServer(503, 500)
+	defer srv.Close()
+
+	wh := webhook.New(srv.URL, []byte("secret"), webhook.WithRetry(3, time.Millisecond))
+	go wh.Loop(ctx, func(err error) { t.Errorf("Loop error: %v", err) })
+
+	wh.Send([]byte("message"))
+
+	for i := 0; i < 3; i++ {
+		if got := receive(t, received); got.body != "message" {
+			t.Errorf("attempt %d: webhook got body %s", i+1, got.body)
+		}
+	}
+}
+
+func TestWebhookNoRetryOn4xx(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv, received := webhookServer(400)
+	defer srv.Close()
+
+	errs := make(chan error, 1)
+	wh := webhook.New(srv.URL, []byte("secret"), webhook.WithRetry(3, time.Millisecond))
+	go wh.Loop(ctx, func(err error) { errs <- err })
+
+	wh.Send([]byte("message"))
+	receive(t, received)
+
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatalf("Loop did not report an error")
+	}
+
+	select {
+	case <-received:
+		t.Errorf("webhook was called again after 400")
+	case <-time.After(20 * time.Millisecond):
+	}
+}